@@ -9,11 +9,13 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
 	"gometric/internal/agent"
+	"gometric/internal/agentconfig"
+	"gometric/internal/config"
 	"gometric/internal/logger"
 
-	"github.com/caarlos0/env/v7"
 	"github.com/jessevdk/go-flags"
 )
 
@@ -26,33 +28,38 @@ var (
 func main() {
 	var cfg agent.Config
 
-	parser := flags.NewParser(&cfg, flags.HelpFlag)
-	if _, err := parser.Parse(); err != nil {
-		var e *flags.Error
+	err := config.Load(&cfg, os.Args[1:])
 
-		if errors.As(err, &e) {
-			if e.Type == flags.ErrHelp {
-				log.Printf("%s", e.Message)
-				exit(0)
-			}
+	var e *flags.Error
+	if errors.As(err, &e) {
+		if e.Type == flags.ErrHelp {
+			log.Printf("%s", e.Message)
+			exit(0)
 		}
 		log.Fatalf("error parse arguments:%+v\n", err)
 	}
 
-	// The values of the config is overridden
-	// from the environment variables
-	if err := env.Parse(&cfg); err != nil {
-		log.Fatalf("error parse env variables:%+v\n", err)
-	}
-
 	// Print version
 	if cfg.Version {
 		printVersion()
 		exit(0)
 	}
 
-	if err := agent.ParseConfigFile(&cfg); err != nil {
-		fmt.Printf("parse config error: %+v\n", err)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+
+	// Print or check the resulting config
+	if cfg.PrintConfig != "" {
+		if err := config.Print(os.Stdout, &cfg, cfg.PrintConfig); err != nil {
+			log.Fatalf("error print config:%+v\n", err)
+		}
+		exit(0)
+	}
+
+	if cfg.CheckConfig {
+		fmt.Println("config is valid")
 		exit(0)
 	}
 
@@ -67,9 +74,20 @@ func main() {
 	ctx, stop := context.WithCancel(context.Background())
 
 	// Run metric collector with pollInterval 2 sec
-	m := agent.MemStatCollector(ctx, cfg.PollInterval)
-	v := agent.VirtualMemoryCollector(ctx, cfg.PollInterval)
-	c := agent.CPUCollector(ctx, cfg.PollInterval)
+	poll := agent.NewInterval(time.Duration(cfg.PollInterval) * time.Second)
+	m := agent.MemStatCollector(ctx, poll)
+	v := agent.VirtualMemoryCollector(ctx, poll)
+	c := agent.CPUCollector(ctx, poll)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		logger.Error("could not get hostname", err)
+	}
+
+	agentID := cfg.AgentID
+	if agentID == "" {
+		agentID = hostname
+	}
 
 	collector := agent.Collector{
 		Endpoint:          "http://" + cfg.EndpointAddr + "/update/",
@@ -77,52 +95,85 @@ func main() {
 		KeySign:           cfg.KeySign,
 		RateLimit:         cfg.RateLimit,
 		RSAPublicKey:      cfg.RSAPublicKey,
+		AgentID:           agentID,
+		Hostname:          hostname,
+		Version:           buildVersion,
+		Collectors:        []string{agentconfig.CollectorRuntime, agentconfig.CollectorMemory, agentconfig.CollectorCPU},
+		Poll:              poll,
 	}
 
 	// runtime metrics
-	collector.RegisterMetric("Alloc", &(m.Alloc))
-	collector.RegisterMetric("BuckHashSys", &(m.BuckHashSys))
-	collector.RegisterMetric("Frees", &(m.Frees))
-	collector.RegisterMetric("GCCPUFraction", &(m.GCCPUFraction))
-	collector.RegisterMetric("GCSys", &(m.GCSys))
-	collector.RegisterMetric("HeapAlloc", &(m.HeapAlloc))
-	collector.RegisterMetric("HeapIdle", &(m.HeapIdle))
-	collector.RegisterMetric("HeapInuse", &(m.HeapInuse))
-	collector.RegisterMetric("HeapObjects", &(m.HeapObjects))
-	collector.RegisterMetric("HeapReleased", &(m.HeapReleased))
-	collector.RegisterMetric("HeapSys", &(m.HeapSys))
-	collector.RegisterMetric("LastGC", &(m.LastGC))
-	collector.RegisterMetric("Lookups", &(m.Lookups))
-	collector.RegisterMetric("MCacheInuse", &(m.MCacheInuse))
-	collector.RegisterMetric("MCacheSys", &(m.MCacheSys))
-	collector.RegisterMetric("MSpanInuse", &(m.MSpanInuse))
-	collector.RegisterMetric("MSpanSys", &(m.MSpanSys))
-	collector.RegisterMetric("Mallocs", &(m.Mallocs))
-	collector.RegisterMetric("NextGC", &(m.NextGC))
-	collector.RegisterMetric("NumForcedGC", &(m.NumForcedGC))
-	collector.RegisterMetric("NumGC", &(m.NumGC))
-	collector.RegisterMetric("OtherSys", &(m.OtherSys))
-	collector.RegisterMetric("PauseTotalNs", &(m.PauseTotalNs))
-	collector.RegisterMetric("StackInuse", &(m.StackInuse))
-	collector.RegisterMetric("StackSys", &(m.StackSys))
-	collector.RegisterMetric("Sys", &(m.Sys))
-	collector.RegisterMetric("TotalAlloc", &(m.TotalAlloc))
-	collector.RegisterMetric("PollCount", &(m.PollCount))
-	collector.RegisterMetric("RandomValue", &(m.RandomValue))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "Alloc", &(m.Alloc))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "BuckHashSys", &(m.BuckHashSys))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "Frees", &(m.Frees))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "GCCPUFraction", &(m.GCCPUFraction))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "GCSys", &(m.GCSys))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "HeapAlloc", &(m.HeapAlloc))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "HeapIdle", &(m.HeapIdle))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "HeapInuse", &(m.HeapInuse))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "HeapObjects", &(m.HeapObjects))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "HeapReleased", &(m.HeapReleased))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "HeapSys", &(m.HeapSys))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "LastGC", &(m.LastGC))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "Lookups", &(m.Lookups))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "MCacheInuse", &(m.MCacheInuse))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "MCacheSys", &(m.MCacheSys))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "MSpanInuse", &(m.MSpanInuse))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "MSpanSys", &(m.MSpanSys))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "Mallocs", &(m.Mallocs))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "NextGC", &(m.NextGC))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "NumForcedGC", &(m.NumForcedGC))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "NumGC", &(m.NumGC))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "OtherSys", &(m.OtherSys))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "PauseTotalNs", &(m.PauseTotalNs))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "StackInuse", &(m.StackInuse))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "StackSys", &(m.StackSys))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "Sys", &(m.Sys))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "TotalAlloc", &(m.TotalAlloc))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "PollCount", &(m.PollCount))
+	collector.RegisterCollectorMetric(agentconfig.CollectorRuntime, "RandomValue", &(m.RandomValue))
 
 	// virtual memory metrics
-	collector.RegisterMetric("TotalMemory", &(v.Total))
-	collector.RegisterMetric("FreeMemory", &(v.Free))
+	collector.RegisterCollectorMetric(agentconfig.CollectorMemory, "TotalMemory", &(v.Total))
+	collector.RegisterCollectorMetric(agentconfig.CollectorMemory, "FreeMemory", &(v.Free))
 
 	// cpu utilization metrics
 	for i := 0; i < c.Counts; i++ {
-		collector.RegisterMetric(fmt.Sprintf("CPUutilization%d", i+1), &(c.Percent[i]))
+		collector.RegisterCollectorMetric(agentconfig.CollectorCPU, fmt.Sprintf("CPUutilization%d", i+1), &(c.Percent[i]))
+	}
+
+	// statsd metrics from applications
+	if cfg.StatsDAddr != "" || cfg.StatsDSocket != "" {
+		statsd := agent.NewStatsDServer(cfg.StatsDAddr, cfg.StatsDSocket)
+		if err := statsd.Listen(ctx, &wg); err != nil {
+			logger.Fatal("statsd listen failed", err)
+		}
+		collector.RegisterSource(statsd)
+		collector.Collectors = append(collector.Collectors, "statsd")
+		logger.Info("StatsD listener started")
+	}
+
+	// metrics pushed by local applications
+	if cfg.PushAddr != "" || cfg.PushSocket != "" {
+		push := agent.NewPushServer(cfg.PushAddr, cfg.PushSocket)
+		if err := push.Listen(ctx, &wg); err != nil {
+			logger.Fatal("push api listen failed", err)
+		}
+		collector.RegisterSource(push)
+		collector.Collectors = append(collector.Collectors, "push")
+		logger.Info("Push API started")
 	}
 
 	// send metrics
 	go collector.SendMetric(ctx, &wg)
 	logger.Debug("SendMetric() started")
 
+	// apply config changes from the server
+	if cfg.ConfigPoll > 0 {
+		go collector.PollConfig(ctx, "http://"+cfg.EndpointAddr+"/agent/config", time.Duration(cfg.ConfigPoll)*time.Second)
+		logger.Debug("PollConfig() started")
+	}
+
 	sigint := make(chan os.Signal, 1)
 	signal.Notify(sigint, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gometric/pkg/client"
+)
+
+type getCommand struct {
+	Type string `long:"type" short:"t" choice:"gauge" choice:"counter" description:"set metric type (detected automatically if empty)"`
+	Args struct {
+		ID string `positional-arg-name:"id" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+func (c *getCommand) Execute(args []string) error {
+	cl, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+
+	m, err := getMetric(ctx, cl, c.Args.ID, c.Type)
+	if err != nil {
+		return err
+	}
+
+	return writeMetrics(os.Stdout, opts.Output, []client.Metric{m})
+}
+
+// getMetric запрашивает метрику, перебирая типы, если тип не указан.
+func getMetric(ctx context.Context, cl *client.Client, id, mtype string) (client.Metric, error) {
+	if mtype != "" {
+		return cl.Get(ctx, id, mtype)
+	}
+
+	for _, t := range []string{"gauge", "counter"} {
+		m, err := cl.Get(ctx, id, t)
+		if errors.Is(err, client.ErrNotFound) {
+			continue
+		}
+		return m, err
+	}
+
+	return client.Metric{}, fmt.Errorf("metric %s: %w", id, client.ErrNotFound)
+}
+
+type setCommand struct {
+	Args struct {
+		ID    string `positional-arg-name:"id" required:"yes"`
+		Value string `positional-arg-name:"value" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+func (c *setCommand) Execute(args []string) error {
+	v, err := strconv.ParseFloat(c.Args.Value, 64)
+	if err != nil {
+		return fmt.Errorf("invalid gauge value %q", c.Args.Value)
+	}
+
+	cl, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+
+	return cl.Update(ctx, client.Metric{ID: c.Args.ID, MType: "gauge", Value: &v})
+}
+
+type incCommand struct {
+	Args struct {
+		ID    string `positional-arg-name:"id" required:"yes"`
+		Delta string `positional-arg-name:"delta" description:"counter delta (default 1)"`
+	} `positional-args:"yes"`
+}
+
+func (c *incCommand) Execute(args []string) error {
+	delta := int64(1)
+	if c.Args.Delta != "" {
+		var err error
+		delta, err = strconv.ParseInt(c.Args.Delta, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid counter delta %q", c.Args.Delta)
+		}
+	}
+
+	cl, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+
+	return cl.Update(ctx, client.Metric{ID: c.Args.ID, MType: "counter", Delta: &delta})
+}
+
+type deleteCommand struct {
+	Args struct {
+		IDs []string `positional-arg-name:"id" required:"1"`
+	} `positional-args:"yes"`
+}
+
+func (c *deleteCommand) Execute(args []string) error {
+	cl, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+
+	for _, id := range c.Args.IDs {
+		if err := cl.Delete(ctx, id); err != nil {
+			return fmt.Errorf("delete %s: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+type renameCommand struct {
+	Args struct {
+		ID    string `positional-arg-name:"id" required:"yes"`
+		NewID string `positional-arg-name:"new-id" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+func (c *renameCommand) Execute(args []string) error {
+	cl, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+
+	return cl.Rename(ctx, c.Args.ID, c.Args.NewID)
+}
+
+type listCommand struct {
+	Type  string `long:"type" short:"t" choice:"gauge" choice:"counter" description:"show only metrics of the type"`
+	Match string `long:"match" short:"m" description:"show only metrics with id matching the glob pattern"`
+}
+
+func (c *listCommand) Execute(args []string) error {
+	cl, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+
+	list, err := cl.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	list, err = filterMetrics(list, c.Type, c.Match)
+	if err != nil {
+		return err
+	}
+
+	return writeMetrics(os.Stdout, opts.Output, list)
+}
+
+// filterMetrics оставляет метрики указанного типа с идентификатором, подходящим под glob шаблон.
+func filterMetrics(list []client.Metric, mtype, pattern string) ([]client.Metric, error) {
+	result := make([]client.Metric, 0, len(list))
+
+	for _, m := range list {
+		if mtype != "" && m.MType != mtype {
+			continue
+		}
+
+		if pattern != "" {
+			ok, err := path.Match(pattern, m.ID)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		result = append(result, m)
+	}
+
+	return result, nil
+}
+
+type watchCommand struct {
+	Interval time.Duration `long:"interval" short:"i" default:"2s" description:"set poll interval"`
+	Type     string        `long:"type" short:"t" choice:"gauge" choice:"counter" description:"watch only metrics of the type"`
+	Match    string        `long:"match" short:"m" description:"watch only metrics with id matching the glob pattern"`
+	Poll     bool          `long:"poll" description:"poll all metrics instead of receiving the update stream"`
+}
+
+func (c *watchCommand) Execute(args []string) error {
+	cl, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if !c.Poll {
+		out := &streamWriter{w: os.Stdout, format: opts.Output}
+
+		var writeErr error
+		err := cl.Watch(ctx, client.WatchFilter{Match: c.Match, Type: c.Type}, func(m client.Metric) {
+			if err := out.write(m); err != nil && writeErr == nil {
+				writeErr = err
+				stop()
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return writeErr
+	}
+
+	last := make(map[string]string)
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		reqCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+		list, err := cl.List(reqCtx)
+		cancel()
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			fmt.Fprintf(os.Stderr, "%s error: %s\n", time.Now().Format(time.RFC3339), err)
+		} else {
+			list, err = filterMetrics(list, c.Type, c.Match)
+			if err != nil {
+				return err
+			}
+
+			var changed []client.Metric
+			for _, m := range list {
+				if v := formatValue(m); last[m.ID] != v {
+					last[m.ID] = v
+					changed = append(changed, m)
+				}
+			}
+
+			if len(changed) > 0 {
+				if err := writeMetrics(os.Stdout, opts.Output, changed); err != nil {
+					return err
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+type exportCommand struct {
+	File string `long:"file" short:"f" description:"set output file (stdout if empty)"`
+}
+
+func (c *exportCommand) Execute(args []string) error {
+	cl, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+
+	list, err := cl.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if c.File != "" {
+		f, err := os.Create(c.File)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return writeMetrics(w, opts.Output, list)
+}
+
+type importCommand struct {
+	File     string `long:"file" short:"f" description:"set input file (stdin if empty)"`
+	Format   string `long:"format" choice:"json" choice:"csv" description:"set input format (detected by file extension if empty)"`
+	Strategy string `long:"strategy" default:"overwrite" choice:"overwrite" choice:"keep-existing" choice:"add-counters" description:"set merge strategy with existing metrics"`
+}
+
+func (c *importCommand) Execute(args []string) error {
+	format := c.Format
+	if format == "" {
+		format = "json"
+		if strings.HasSuffix(c.File, ".csv") {
+			format = "csv"
+		}
+	}
+
+	var r io.Reader = os.Stdin
+	if c.File != "" {
+		f, err := os.Open(c.File)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	list, err := readMetrics(r, format)
+	if err != nil {
+		return err
+	}
+
+	cl, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+
+	// counters are not added to the existing values unless requested
+	n, err := cl.Import(ctx, list, c.Strategy)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "imported %d metrics\n", n)
+	return nil
+}
+
+type pingCommand struct{}
+
+func (c *pingCommand) Execute(args []string) error {
+	cl, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := cl.Ping(ctx); err != nil {
+		return fmt.Errorf("storage is unreachable: %w", err)
+	}
+
+	fmt.Printf("ok (%s)\n", time.Since(start).Round(time.Millisecond))
+	return nil
+}
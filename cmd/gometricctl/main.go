@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"gometric/pkg/client"
+
+	"github.com/jessevdk/go-flags"
+)
+
+var (
+	buildVersion = "N/A"
+	buildDate    = "N/A"
+	buildCommit  = "N/A"
+)
+
+// Options описывает общие для всех команд настройки.
+type Options struct {
+	Address      string        `long:"address" short:"a" env:"ADDRESS" default:"127.0.0.1:8080" description:"set server address"`
+	KeySign      string        `long:"key" short:"k" env:"KEY" description:"set key for signing"`
+	RSAPublicKey string        `long:"crypto-key" env:"CRYPTO_KEY" description:"set rsa-public-key file"`
+	RealIP       string        `long:"real-ip" env:"REAL_IP" description:"set X-Real-IP header for trusted subnet check"`
+	Output       string        `long:"output" short:"o" default:"table" choice:"table" choice:"json" choice:"csv" description:"set output format"`
+	Timeout      time.Duration `long:"timeout" default:"10s" description:"set request timeout"`
+}
+
+var opts Options
+
+func main() {
+	parser := flags.NewParser(&opts, flags.HelpFlag|flags.PassDoubleDash)
+
+	parser.AddCommand("get", "Get metric value", "Get metric value by id.", &getCommand{})
+	parser.AddCommand("set", "Set gauge value", "Set gauge metric value.", &setCommand{})
+	parser.AddCommand("inc", "Increment counter", "Increment counter metric by delta.", &incCommand{})
+	parser.AddCommand("delete", "Delete metrics", "Delete metrics by id.", &deleteCommand{})
+	parser.AddCommand("rename", "Rename metric", "Rename metric keeping its value.", &renameCommand{})
+	parser.AddCommand("list", "List metrics", "List all metrics stored on the server.", &listCommand{})
+	parser.AddCommand("watch", "Watch metrics", "Print metric updates as they are received by the server.", &watchCommand{})
+	parser.AddCommand("export", "Export metrics", "Export all metrics to a file or stdout.", &exportCommand{})
+	parser.AddCommand("import", "Import metrics", "Import metrics from a file or stdin.", &importCommand{})
+	parser.AddCommand("ping", "Check server", "Check that the server storage is reachable.", &pingCommand{})
+	parser.AddCommand("version", "Print version", "Print build version.", &versionCommand{})
+
+	if _, err := parser.Parse(); err != nil {
+		var e *flags.Error
+
+		if errors.As(err, &e) && e.Type == flags.ErrHelp {
+			fmt.Println(e.Message)
+			os.Exit(0)
+		}
+
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// newClient создает клиент с общими настройками.
+func newClient() (*client.Client, error) {
+	return client.New(client.Config{
+		Address:      opts.Address,
+		Key:          opts.KeySign,
+		RSAPublicKey: opts.RSAPublicKey,
+		RealIP:       opts.RealIP,
+		Timeout:      opts.Timeout,
+	})
+}
+
+type versionCommand struct{}
+
+func (c *versionCommand) Execute(args []string) error {
+	fmt.Printf(
+		"Build version: %s\nBuild date: %s\nBuild commit: %s\n", buildVersion, buildDate, buildCommit)
+	return nil
+}
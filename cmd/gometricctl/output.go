@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+
+	"gometric/pkg/client"
+)
+
+// writeMetrics выводит метрики в формате table, json или csv.
+func writeMetrics(w io.Writer, format string, list []client.Metric) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(list)
+
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{"id", "type", "value"}); err != nil {
+			return err
+		}
+		for _, m := range list {
+			if err := cw.Write([]string{m.ID, m.MType, formatValue(m)}); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+
+	default:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tTYPE\tVALUE")
+		for _, m := range list {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", m.ID, m.MType, formatValue(m))
+		}
+		return tw.Flush()
+	}
+}
+
+// streamWriter выводит метрики по одной строке по мере поступления:
+// table и csv с заголовком в первой строке, json в виде объекта на строку.
+type streamWriter struct {
+	w       io.Writer
+	format  string
+	started bool
+}
+
+func (s *streamWriter) write(m client.Metric) error {
+	switch s.format {
+	case "json":
+		return json.NewEncoder(s.w).Encode(m)
+
+	case "csv":
+		cw := csv.NewWriter(s.w)
+		if !s.started {
+			s.started = true
+			if err := cw.Write([]string{"id", "type", "value"}); err != nil {
+				return err
+			}
+		}
+		if err := cw.Write([]string{m.ID, m.MType, formatValue(m)}); err != nil {
+			return err
+		}
+		cw.Flush()
+		return cw.Error()
+
+	default:
+		if !s.started {
+			s.started = true
+			if _, err := fmt.Fprintf(s.w, "%-40s %-8s %s\n", "ID", "TYPE", "VALUE"); err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintf(s.w, "%-40s %-8s %s\n", m.ID, m.MType, formatValue(m))
+		return err
+	}
+}
+
+// formatValue возвращает значение метрики в виде строки.
+func formatValue(m client.Metric) string {
+	switch {
+	case m.MType == "counter" && m.Delta != nil:
+		return strconv.FormatInt(*m.Delta, 10)
+	case m.MType == "gauge" && m.Value != nil:
+		return strconv.FormatFloat(*m.Value, 'f', -1, 64)
+	}
+
+	return ""
+}
+
+// readMetrics читает метрики в формате json (массив) или csv с заголовком id,type,value.
+func readMetrics(r io.Reader, format string) ([]client.Metric, error) {
+	var list []client.Metric
+
+	if format == "json" {
+		if err := json.NewDecoder(r).Decode(&list); err != nil {
+			return nil, fmt.Errorf("decode json: %w", err)
+		}
+
+		for _, m := range list {
+			if formatValue(m) == "" {
+				return nil, fmt.Errorf("metric %s: invalid type or value", m.ID)
+			}
+		}
+
+		return list, nil
+	}
+
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("decode csv: %w", err)
+	}
+
+	for i, record := range records {
+		if i == 0 && len(record) > 0 && record[0] == "id" {
+			continue
+		}
+
+		if len(record) != 3 {
+			return nil, fmt.Errorf("csv line %d: expected 3 fields, got %d", i+1, len(record))
+		}
+
+		m, err := parseMetric(record[0], record[1], record[2])
+		if err != nil {
+			return nil, fmt.Errorf("csv line %d: %w", i+1, err)
+		}
+		list = append(list, m)
+	}
+
+	return list, nil
+}
+
+func parseMetric(id, mtype, value string) (client.Metric, error) {
+	m := client.Metric{ID: id, MType: mtype}
+
+	switch mtype {
+	case "gauge":
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return m, fmt.Errorf("invalid gauge value %q", value)
+		}
+		m.Value = &v
+	case "counter":
+		d, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return m, fmt.Errorf("invalid counter value %q", value)
+		}
+		m.Delta = &d
+	default:
+		return m, fmt.Errorf("unknown metric type %q", mtype)
+	}
+
+	return m, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gometric/pkg/client"
+)
+
+func TestWriteReadMetrics(t *testing.T) {
+	v, d := 1.5, int64(3)
+	list := []client.Metric{
+		{ID: "Alloc", MType: "gauge", Value: &v},
+		{ID: "PollCount", MType: "counter", Delta: &d},
+	}
+
+	for _, format := range []string{"json", "csv"} {
+		var b bytes.Buffer
+		if err := writeMetrics(&b, format, list); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+
+		got, err := readMetrics(&b, format)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+
+		if len(got) != 2 || *got[0].Value != 1.5 || *got[1].Delta != 3 {
+			t.Errorf("Error: %s round trip is incorrect", format)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := writeMetrics(&b, "table", list); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	want := "ID         TYPE     VALUE\nAlloc      gauge    1.5\nPollCount  counter  3\n"
+	if b.String() != want {
+		t.Errorf("Error: table output is incorrect:\n%s", b.String())
+	}
+}
+
+func TestReadMetricsInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   string
+	}{
+		{name: "invalid counter #1", format: "csv", data: "id,type,value\nPollCount,counter,1.5\n"},
+		{name: "unknown type #2", format: "csv", data: "PollCount,integer,1\n"},
+		{name: "missing fields #3", format: "csv", data: "PollCount,counter\n"},
+		{name: "gauge without value #4", format: "json", data: `[{"id":"Alloc","type":"gauge","delta":1}]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readMetrics(strings.NewReader(tt.data), tt.format); err == nil {
+				t.Errorf("Error: data must be invalid")
+			}
+		})
+	}
+}
+
+func TestFilterMetrics(t *testing.T) {
+	v, d := 1.5, int64(3)
+	list := []client.Metric{
+		{ID: "CPUutilization1", MType: "gauge", Value: &v},
+		{ID: "CPUutilization2", MType: "gauge", Value: &v},
+		{ID: "PollCount", MType: "counter", Delta: &d},
+	}
+
+	got, err := filterMetrics(list, "gauge", "CPU*")
+	if err != nil || len(got) != 2 {
+		t.Errorf("Error: filter is incorrect")
+	}
+
+	got, _ = filterMetrics(list, "counter", "")
+	if len(got) != 1 || got[0].ID != "PollCount" {
+		t.Errorf("Error: filter by type is incorrect")
+	}
+
+	if _, err := filterMetrics(list, "", "["); err == nil {
+		t.Errorf("Error: invalid pattern must be detected")
+	}
+}
+
+func TestStreamWriter(t *testing.T) {
+	v, d := 1.5, int64(3)
+	list := []client.Metric{
+		{ID: "Alloc", MType: "gauge", Value: &v},
+		{ID: "PollCount", MType: "counter", Delta: &d},
+	}
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{format: "csv", want: "id,type,value\nAlloc,gauge,1.5\nPollCount,counter,3\n"},
+		{format: "json", want: "{\"id\":\"Alloc\",\"type\":\"gauge\",\"value\":1.5}\n{\"id\":\"PollCount\",\"type\":\"counter\",\"delta\":3}\n"},
+	}
+
+	for _, tt := range tests {
+		var b bytes.Buffer
+		w := &streamWriter{w: &b, format: tt.format}
+		for _, m := range list {
+			if err := w.write(m); err != nil {
+				t.Fatalf("Error: %s", err)
+			}
+		}
+
+		if b.String() != tt.want {
+			t.Errorf("Error: %s output is incorrect: %q", tt.format, b.String())
+		}
+	}
+}
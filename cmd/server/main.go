@@ -9,10 +9,10 @@ import (
 	"os/signal"
 	"syscall"
 
+	"gometric/internal/config"
 	"gometric/internal/logger"
 	"gometric/internal/server"
 
-	"github.com/caarlos0/env"
 	"github.com/jessevdk/go-flags"
 )
 
@@ -25,33 +25,38 @@ var (
 func main() {
 	cfg := server.DefaultConfig()
 
-	parser := flags.NewParser(cfg, flags.HelpFlag)
-	if _, err := parser.Parse(); err != nil {
-		var e *flags.Error
+	err := config.Load(cfg, os.Args[1:])
 
-		if errors.As(err, &e) {
-			if e.Type == flags.ErrHelp {
-				log.Printf("%s", e.Message)
-				exit(0)
-			}
+	var e *flags.Error
+	if errors.As(err, &e) {
+		if e.Type == flags.ErrHelp {
+			log.Printf("%s", e.Message)
+			exit(0)
 		}
 		log.Fatalf("error parse arguments:%+v\n", err)
 	}
 
-	// The values of the config is overridden
-	// from the environment variables
-	if err := env.Parse(cfg); err != nil {
-		log.Fatalf("Error parse environment:%+v\n", err)
-	}
-
 	// Print version
 	if cfg.Version {
 		printVersion()
 		exit(0)
 	}
 
-	if err := server.ParseConfigFile(cfg); err != nil {
-		fmt.Printf("parse config error: %+v\n", err)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+
+	// Print or check the resulting config
+	if cfg.PrintConfig != "" {
+		if err := config.Print(os.Stdout, cfg, cfg.PrintConfig); err != nil {
+			log.Fatalf("error print config:%+v\n", err)
+		}
+		exit(0)
+	}
+
+	if cfg.CheckConfig {
+		fmt.Println("config is valid")
 		exit(0)
 	}
 
@@ -64,18 +69,62 @@ func main() {
 	sigint := make(chan os.Signal, 1)
 	signal.Notify(sigint, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
+	// Export or import metrics and exit
+	if cfg.ExportFile != "" || cfg.ImportFile != "" {
+		if err := server.Transfer(ctx, cfg); err != nil {
+			logger.Error("transfer metrics failed", err)
+			logger.Close()
+			exit(1)
+		}
+		return
+	}
+
 	printVersion()
 	serv := server.NewServer(ctx, cfg)
 	go serv.ListenAndServe(cfg.ListenAddr)
 
 	logger.Info("Server started")
 
+	// reload config on SIGHUP or config file change
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	if cfg.ConfigFile != "" && cfg.ConfigWatchInterval > 0 {
+		go server.WatchConfig(ctx, cfg.ConfigFile, cfg.ConfigWatchInterval, func() {
+			select {
+			case sighup <- syscall.SIGHUP:
+			default:
+			}
+		})
+	}
+
+	go func() {
+		for range sighup {
+			reloadConfig(serv)
+		}
+	}()
+
 	<-sigint
 
 	serv.Shutdown()
 	logger.Info("Server stopped")
 }
 
+// reloadConfig заново читает конфигурацию из флагов, переменных окружения и файла
+// и применяет ее к серверу serv. При ошибке сервер продолжает работать с прежними настройками.
+func reloadConfig(serv *server.HTTPServer) {
+	cfg := server.DefaultConfig()
+
+	if err := config.Load(cfg, os.Args[1:]); err != nil {
+		logger.Error("config reload: parse config", err)
+		return
+	}
+
+	if err := serv.Reload(cfg); err != nil {
+		logger.Error("config reload failed", err)
+	}
+}
+
 func exit(code int) {
 	os.Exit(code)
 }
@@ -3,16 +3,17 @@ module gometric
 go 1.19
 
 require (
-	github.com/caarlos0/env v3.5.0+incompatible
-	github.com/caarlos0/env/v7 v7.1.0
+	github.com/BurntSushi/toml v1.3.2
 	github.com/go-chi/chi/v5 v5.0.8
 	github.com/go-critic/go-critic v0.8.1
+	github.com/gorilla/websocket v1.5.0
 	github.com/jackc/pgx/v5 v5.4.2
 	github.com/jessevdk/go-flags v1.5.0
 	github.com/rs/zerolog v1.29.1
 	github.com/securego/gosec/v2 v2.16.0
 	github.com/shirou/gopsutil/v3 v3.23.6
 	golang.org/x/tools v0.11.0
+	gopkg.in/yaml.v3 v3.0.1
 	honnef.co/go/tools v0.4.3
 )
 
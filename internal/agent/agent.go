@@ -4,6 +4,7 @@ import (
 	"context"
 	"math/rand"
 	"runtime"
+	"sync/atomic"
 	"time"
 
 	"gometric/internal/logger"
@@ -15,6 +16,29 @@ import (
 type gauge float64
 type counter int64
 
+// Interval описывает интервал, который можно изменить во время работы сборщиков.
+type Interval struct {
+	d atomic.Int64
+}
+
+// NewInterval создает интервал d.
+func NewInterval(d time.Duration) *Interval {
+	i := &Interval{}
+	i.Set(d)
+
+	return i
+}
+
+// Get возвращает текущее значение интервала.
+func (i *Interval) Get() time.Duration {
+	return time.Duration(i.d.Load())
+}
+
+// Set изменяет интервал, новое значение применяется со следующего опроса.
+func (i *Interval) Set(d time.Duration) {
+	i.d.Store(int64(d))
+}
+
 type MemStats struct {
 	Alloc         gauge
 	BuckHashSys   gauge
@@ -123,33 +147,29 @@ func (c *CPUStat) CPU(ctx context.Context) error {
 	return nil
 }
 
-func MemStatCollector(ctx context.Context, pollInterval int) *MemStats {
+func MemStatCollector(ctx context.Context, poll *Interval) *MemStats {
 	var m MemStats
 
-	go func(ctx context.Context, m *MemStats, pollInterval int) {
-		var interval = time.Duration(pollInterval) * time.Second
-
+	go func(ctx context.Context, m *MemStats, poll *Interval) {
 		for {
 			select {
 			case <-ctx.Done():
 				return
 			default:
 				m.ReadMemStats()
-				<-time.After(interval)
+				<-time.After(poll.Get())
 			}
 		}
-	}(ctx, &m, pollInterval)
+	}(ctx, &m, poll)
 
 	return &m
 }
 
-func VirtualMemoryCollector(ctx context.Context, pollInterval int) *VirtualMemoryStat {
+func VirtualMemoryCollector(ctx context.Context, poll *Interval) *VirtualMemoryStat {
 	var v VirtualMemoryStat
 	var err error
 
-	go func(ctx context.Context, v *VirtualMemoryStat, pollInterval int) {
-		var interval = time.Duration(pollInterval) * time.Second
-
+	go func(ctx context.Context, v *VirtualMemoryStat, poll *Interval) {
 		for {
 			select {
 			case <-ctx.Done():
@@ -160,15 +180,15 @@ func VirtualMemoryCollector(ctx context.Context, pollInterval int) *VirtualMemor
 					logger.Error("", err)
 				}
 
-				<-time.After(interval)
+				<-time.After(poll.Get())
 			}
 		}
-	}(ctx, &v, pollInterval)
+	}(ctx, &v, poll)
 
 	return &v
 }
 
-func CPUCollector(ctx context.Context, pollInterval int) *CPUStat {
+func CPUCollector(ctx context.Context, poll *Interval) *CPUStat {
 	var c CPUStat
 	var err error
 
@@ -179,9 +199,7 @@ func CPUCollector(ctx context.Context, pollInterval int) *CPUStat {
 
 	c.Percent = make([]gauge, c.Counts)
 
-	go func(ctx context.Context, c *CPUStat, pollInterval int) {
-		var interval = time.Duration(pollInterval) * time.Second
-
+	go func(ctx context.Context, c *CPUStat, poll *Interval) {
 		for {
 			select {
 			case <-ctx.Done():
@@ -192,10 +210,10 @@ func CPUCollector(ctx context.Context, pollInterval int) *CPUStat {
 					logger.Error("", err)
 				}
 
-				<-time.After(interval)
+				<-time.After(poll.Get())
 			}
 		}
-	}(ctx, &c, pollInterval)
+	}(ctx, &c, poll)
 
 	return &c
 }
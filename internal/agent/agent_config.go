@@ -1,97 +1,73 @@
 package agent
 
 import (
-	"bufio"
-	"encoding/json"
-	"io"
-	"os"
-	"time"
+	"net"
+
+	"gometric/internal/config"
+	"gometric/internal/logger"
 )
 
+// Config описывает структуру с настройками агента.
 type Config struct {
-	ConfigFile     string `long:"config" short:"c" env:"CONFIG" default:"" description:"set config file"`
+	ConfigFile     string `long:"config" short:"c" env:"CONFIG" default:"" config:"file" description:"set config file (.json, .yaml, .yml or .toml)"`
 	EndpointAddr   string `long:"address" short:"a" env:"ADDRESS" default:"127.0.0.1:8080" description:"set remote metric collector" json:"address,omitempty"`
-	ReportInterval int    `long:"report_interval" short:"r" env:"REPORT_INTERVAL" default:"10" description:"set report interval" json:"report_interval,omitempty"`
-	PollInterval   int    `long:"poll_interval" short:"p" env:"POLL_INTERVAL" default:"2" description:"set poll interval"`
-	KeySign        string `long:"key" short:"k" env:"KEY" description:"set key for signing"`
+	ReportInterval int    `long:"report_interval" short:"r" env:"REPORT_INTERVAL" default:"10" unit:"s" description:"set report interval in seconds" json:"report_interval,omitempty"`
+	PollInterval   int    `long:"poll_interval" short:"p" env:"POLL_INTERVAL" default:"2" unit:"s" description:"set poll interval in seconds"`
+	KeySign        string `long:"key" short:"k" env:"KEY" secret:"yes" description:"set key for signing"`
 	RSAPublicKey   string `long:"crypto-key" env:"CRYPTO_KEY" description:"set rsa-public-key file" json:"crypto_key,omitempty"`
 	LogLevel       string `long:"log_level" env:"LOG_LEVEL" default:"info" description:"set log level"`
 	LogFile        string `long:"log_file" env:"LOG_FILE" default:"" description:"set log file"`
 	RateLimit      int    `long:"rate_limit" short:"l" env:"RATE_LIMIT" default:"1" description:"set rate limit"`
-	Version        bool   `long:"version" short:"v" description:"print current version"`
+	StatsDAddr     string `long:"statsd_address" env:"STATSD_ADDRESS" description:"set statsd udp listen address (example: 127.0.0.1:8125)"`
+	StatsDSocket   string `long:"statsd_socket" env:"STATSD_SOCKET" description:"set statsd unix datagram socket"`
+	PushAddr       string `long:"push_address" env:"PUSH_ADDRESS" description:"set local push api loopback address (example: 127.0.0.1:8081)"`
+	PushSocket     string `long:"push_socket" env:"PUSH_SOCKET" description:"set local push api unix socket"`
+	AgentID        string `long:"agent_id" env:"AGENT_ID" description:"set agent id reported to the server (default: hostname)"`
+	ConfigPoll     int    `long:"config_poll_interval" env:"CONFIG_POLL_INTERVAL" default:"30" unit:"s" description:"set interval of remote config requests to the server in seconds (0 disables)"`
+	Version        bool   `long:"version" short:"v" config:"-" description:"print current version"`
+	PrintConfig    string `long:"print-config" optional:"yes" optional-value:"json" choice:"json" choice:"yaml" choice:"toml" config:"-" description:"print resulting config in format json, yaml or toml and exit"`
+	CheckConfig    bool   `long:"check-config" config:"-" description:"check config and exit"`
 }
 
-func ParseConfigFile(cfg *Config) error {
-	if cfg.ConfigFile == "" {
-		return nil
-	}
-
-	cfgTmp := struct {
-		Address        string `json:"address,omitempty"`
-		ReportInterval string `json:"report_interval,omitempty"`
-		PollInterval   string `json:"poll_interval,omitempty"`
-		RSAPublicKey   string `json:"crypto_key,omitempty"`
-	}{}
+// Validate проверяет настройки агента и возвращает все найденные ошибки.
+func (c *Config) Validate() error {
+	var errs config.Errors
 
-	data, err := readFile(cfg.ConfigFile)
-	if err != nil {
-		return err
+	if _, _, err := net.SplitHostPort(c.EndpointAddr); err != nil {
+		errs.Addf("address: invalid server address %q: %v", c.EndpointAddr, err)
 	}
 
-	err = json.Unmarshal(data, &cfgTmp)
-	if err != nil {
-		return err
+	if _, err := logger.ParseLevel(c.LogLevel); err != nil {
+		errs.Addf("log_level: %v", err)
 	}
 
-	if cfg.EndpointAddr == "127.0.0.1:8080" {
-		cfg.EndpointAddr = cfgTmp.Address
-	}
-
-	if cfg.ReportInterval == 10 {
-		d, err := time.ParseDuration(cfgTmp.ReportInterval)
-		if err != nil {
-			return err
-		}
-		cfg.ReportInterval = int(d / time.Second)
+	if c.ReportInterval < 1 {
+		errs.Addf("report_interval: must be at least 1s")
 	}
 
-	if cfg.PollInterval == 2 {
-		d, err := time.ParseDuration(cfgTmp.PollInterval)
-		if err != nil {
-			return err
-		}
-		cfg.PollInterval = int(d / time.Second)
+	if c.PollInterval < 1 {
+		errs.Addf("poll_interval: must be at least 1s")
 	}
 
-	if cfg.RSAPublicKey == "" {
-		cfg.RSAPublicKey = cfgTmp.RSAPublicKey
+	if c.ConfigPoll < 0 {
+		errs.Addf("config_poll_interval: must not be negative")
 	}
 
-	return nil
-}
-
-func readFile(file string) ([]byte, error) {
-	f, err := os.OpenFile(file, os.O_RDONLY, 0777)
-	if err != nil {
-		return []byte{}, err
+	if c.RateLimit < 1 {
+		errs.Addf("rate_limit: must be at least 1")
 	}
-	defer f.Close()
 
-	data := make([]byte, 0)
-
-	reader := bufio.NewReader(f)
-	for {
-		line, err := reader.ReadBytes('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				return []byte{}, err
-			}
+	for _, a := range []struct{ name, value string }{
+		{"statsd_address", c.StatsDAddr},
+		{"push_address", c.PushAddr},
+	} {
+		if a.value == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(a.value); err != nil {
+			errs.Addf("%s: invalid address %q: %v", a.name, a.value, err)
 		}
-
-		data = append(data, line...)
 	}
 
-	return data, nil
+	return errs.Err()
 }
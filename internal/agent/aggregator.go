@@ -0,0 +1,221 @@
+package agent
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	"gometric/internal/metrics"
+)
+
+// Aggregator накапливает значения метрик между отчетами агента.
+// Счетчики суммируются без потери точности, для gauge сохраняется последнее значение,
+// для таймеров считается статистика, для множеств - число уникальных элементов.
+// Aggregator реализует интерфейс Source и может быть зарегистрирован в Collector.
+type Aggregator struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	gauges   map[string]float64
+	timers   map[string]*timer
+	sets     map[string]map[string]struct{}
+
+	// sampled дробные приращения счетчиков с частотой выборки, остаток переносится в следующий интервал
+	sampled map[string]float64
+}
+
+// timer описывает значения таймера за интервал. Число измерений count учитывает
+// частоту выборки и может быть больше числа полученных значений.
+type timer struct {
+	values []float64
+	count  float64
+}
+
+// NewAggregator создает новый Aggregator.
+func NewAggregator() *Aggregator {
+	return &Aggregator{
+		counters: make(map[string]int64),
+		sampled:  make(map[string]float64),
+		gauges:   make(map[string]float64),
+		timers:   make(map[string]*timer),
+		sets:     make(map[string]map[string]struct{}),
+	}
+}
+
+// Count увеличивает счетчик на значение delta.
+func (a *Aggregator) Count(id string, delta int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.counters[id] += delta
+}
+
+// CountSampled увеличивает счетчик на значение value, полученное с частотой выборки sampleRate.
+// Целые значения без выборки суммируются точно, дробная часть остальных накапливается отдельно.
+func (a *Aggregator) CountSampled(id string, value, sampleRate float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if sampleRate == 1 && value == math.Trunc(value) && math.Abs(value) < 1<<53 {
+		a.counters[id] += int64(value)
+		return
+	}
+
+	a.sampled[id] += value / sampleRate
+}
+
+// Gauge задает значение gauge. Если relative равен true, значение прибавляется к текущему.
+func (a *Aggregator) Gauge(id string, value float64, relative bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if relative {
+		a.gauges[id] += value
+		return
+	}
+
+	a.gauges[id] = value
+}
+
+// Timing добавляет значение таймера или гистограммы, полученное с частотой выборки sampleRate.
+// Значение учитывается в числе измерений как 1/sampleRate измерений.
+func (a *Aggregator) Timing(id string, value, sampleRate float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	t, ok := a.timers[id]
+	if !ok {
+		t = &timer{}
+		a.timers[id] = t
+	}
+
+	t.values = append(t.values, value)
+	t.count += 1 / sampleRate
+}
+
+// SetAdd добавляет элемент во множество.
+func (a *Aggregator) SetAdd(id string, member string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.sets[id]; !ok {
+		a.sets[id] = make(map[string]struct{})
+	}
+	a.sets[id][member] = struct{}{}
+}
+
+// Flush возвращает накопленные за интервал метрики и сбрасывает счетчики, таймеры и множества.
+// Значения gauge сохраняются и отправляются при каждом отчете.
+func (a *Aggregator) Flush() []metrics.Metrics {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	result := make([]metrics.Metrics, 0, len(a.counters)+len(a.gauges))
+
+	for id, v := range a.sampled {
+		n := math.Round(v)
+		if n == 0 {
+			continue
+		}
+
+		a.counters[id] += int64(n)
+		if a.sampled[id] = v - n; a.sampled[id] == 0 {
+			delete(a.sampled, id)
+		}
+	}
+
+	for id, v := range a.counters {
+		result = append(result, newCounter(id, v))
+	}
+
+	for id, v := range a.gauges {
+		result = append(result, newGauge(id, v))
+	}
+
+	for id, t := range a.timers {
+		result = append(result, timerMetrics(id, t)...)
+	}
+
+	for id, members := range a.sets {
+		result = append(result, newGauge(id, float64(len(members))))
+	}
+
+	a.counters = make(map[string]int64)
+	a.timers = make(map[string]*timer)
+	a.sets = make(map[string]map[string]struct{})
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+
+	return result
+}
+
+// Requeue возвращает в Aggregator метрику, которую не удалось отправить.
+// Приращение счетчика прибавляется к текущему, остальные метрики не возвращаются:
+// gauge отправляется при каждом отчете, а статистика таймеров и множеств относится к прошедшему интервалу.
+func (a *Aggregator) Requeue(metric metrics.Metrics) {
+	if metric.MType != "counter" || metric.Delta == nil {
+		return
+	}
+
+	a.Count(metric.ID, *metric.Delta)
+}
+
+// timerMetrics вычисляет статистику таймера: количество, сумму, минимум, максимум, среднее и перцентили.
+// Количество учитывает частоту выборки, остальная статистика считается по полученным значениям.
+func timerMetrics(id string, t *timer) []metrics.Metrics {
+	if len(t.values) == 0 {
+		return nil
+	}
+
+	sorted := make([]float64, len(t.values))
+	copy(sorted, t.values)
+	sort.Float64s(sorted)
+
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+
+	name, labels := metrics.ParseID(id)
+	suffix := func(s string) string {
+		return metrics.FormatID(name+"."+s, labels)
+	}
+
+	return []metrics.Metrics{
+		newCounter(suffix("count"), int64(math.Round(t.count))),
+		newGauge(suffix("sum"), sum),
+		newGauge(suffix("min"), sorted[0]),
+		newGauge(suffix("max"), sorted[len(sorted)-1]),
+		newGauge(suffix("mean"), sum/float64(len(sorted))),
+		newGauge(suffix("p50"), percentile(sorted, 50)),
+		newGauge(suffix("p95"), percentile(sorted, 95)),
+		newGauge(suffix("p99"), percentile(sorted, 99)),
+	}
+}
+
+// percentile возвращает перцентиль p для отсортированного набора значений (nearest-rank).
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
+
+func newCounter(id string, delta int64) metrics.Metrics {
+	return metrics.Metrics{
+		ID:    id,
+		MType: "counter",
+		Delta: &delta,
+	}
+}
+
+func newGauge(id string, value float64) metrics.Metrics {
+	return metrics.Metrics{
+		ID:    id,
+		MType: "gauge",
+		Value: &value,
+	}
+}
@@ -9,15 +9,44 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"gometric/internal/agentconfig"
 	"gometric/internal/crypto"
 	"gometric/internal/logger"
+	"gometric/internal/registry"
 
 	"gometric/internal/metrics"
 )
 
+// Source описывает источник метрик, которые не зарегистрированы заранее,
+// например метрики, полученные агентом от приложений.
+// Flush вызывается при каждом отчете и возвращает накопленные за интервал метрики.
+type Source interface {
+	Flush() []metrics.Metrics
+}
+
+// Requeuer описывает источник, который может вернуть себе метрику, не доставленную серверу.
+// Приращения счетчиков в этом случае учитываются в следующем отчете.
+type Requeuer interface {
+	Requeue(metric metrics.Metrics)
+}
+
+// reportMetric описывает метрику отчета и функцию, которая вызывается, если метрика не доставлена.
+type reportMetric struct {
+	metrics.Metrics
+	failed func()
+}
+
+// request описывает запрос к серверу и функцию, которая вызывается при ошибке отправки.
+type request struct {
+	body   *bytes.Buffer
+	failed func()
+}
+
 type Collector struct {
 	Endpoint          string
 	ReportIntervalSec int
@@ -25,6 +54,24 @@ type Collector struct {
 	KeySign           string
 	RSAPublicKey      string
 	RateLimit         int
+
+	// AgentID, Hostname, Version и Collectors передаются серверу в заголовках каждого отчета.
+	AgentID    string
+	Hostname   string
+	Version    string
+	Collectors []string
+
+	// Poll интервал опроса сборщиков, изменяется настройками с сервера.
+	Poll *Interval
+
+	sourcesMu sync.Mutex
+	sources   []Source
+
+	// mu защищает настройки, которые изменяются во время работы
+	mu       sync.RWMutex
+	groups   map[string]string
+	disabled map[string]bool
+	changed  chan struct{}
 }
 
 func (c *Collector) RegisterMetric(name string, value interface{}) error {
@@ -59,11 +106,137 @@ func (c *Collector) RegisterMetric(name string, value interface{}) error {
 	return nil
 }
 
-func (c *Collector) SendMetric(ctx context.Context, wg *sync.WaitGroup) {
-	var interval = time.Duration(c.ReportIntervalSec) * time.Second
+// RegisterCollectorMetric регистрирует метрику сборщика collector,
+// которую можно отключить настройками с сервера.
+func (c *Collector) RegisterCollectorMetric(collector, name string, value interface{}) error {
+	if err := c.RegisterMetric(name, value); err != nil {
+		return err
+	}
+
+	if c.groups == nil {
+		c.groups = make(map[string]string)
+	}
+	c.groups[name] = collector
+
+	return nil
+}
+
+// RegisterSource добавляет источник метрик, которые отправляются вместе с зарегистрированными метриками.
+func (c *Collector) RegisterSource(source Source) {
+	c.sourcesMu.Lock()
+	defer c.sourcesMu.Unlock()
+
+	c.sources = append(c.sources, source)
+}
+
+// flushSources собирает метрики из всех зарегистрированных источников.
+// Недоставленные метрики возвращаются источникам, которые реализуют Requeuer.
+func (c *Collector) flushSources() []reportMetric {
+	c.sourcesMu.Lock()
+	defer c.sourcesMu.Unlock()
+
+	var result []reportMetric
+	for _, source := range c.sources {
+		r, _ := source.(Requeuer)
+		for _, m := range source.Flush() {
+			rm := reportMetric{Metrics: m}
+			if r != nil {
+				m := m
+				rm.failed = func() { r.Requeue(m) }
+			}
+			result = append(result, rm)
+		}
+	}
+
+	return result
+}
+
+// Apply применяет настройки, полученные с сервера. Пустые поля не изменяют текущие значения.
+// Новые интервалы и число запросов применяются без перезапуска агента.
+func (c *Collector) Apply(rc agentconfig.Config) error {
+	if err := rc.Validate(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+
+	if rc.ReportInterval != "" {
+		d, _ := time.ParseDuration(rc.ReportInterval)
+		c.ReportIntervalSec = int(d / time.Second)
+	}
+
+	if rc.PollInterval != "" && c.Poll != nil {
+		d, _ := time.ParseDuration(rc.PollInterval)
+		c.Poll.Set(d)
+	}
+
+	if rc.RateLimit > 0 {
+		c.RateLimit = rc.RateLimit
+	}
+
+	if rc.Collectors != nil {
+		c.disabled = make(map[string]bool)
+		for _, name := range agentconfig.Collectors {
+			c.disabled[name] = true
+		}
+		for _, name := range rc.Collectors {
+			delete(c.disabled, name)
+		}
+	}
+
+	if c.changed == nil {
+		c.changed = make(chan struct{}, 1)
+	}
+	changed := c.changed
+
+	c.mu.Unlock()
+
+	// wake the report loop to apply a new interval
+	select {
+	case changed <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// settings возвращает текущие интервал отчетов, число запросов и ключ подписи.
+func (c *Collector) settings() (time.Duration, int, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return time.Duration(c.ReportIntervalSec) * time.Second, c.RateLimit, c.KeySign
+}
+
+// report возвращает метрики включенных сборщиков и источников.
+func (c *Collector) report() []reportMetric {
+	c.mu.RLock()
+	report := make([]reportMetric, 0, len(c.Metrics))
+	for _, m := range c.Metrics {
+		if !c.disabled[c.groups[m.ID]] {
+			report = append(report, reportMetric{Metrics: m})
+		}
+	}
+	c.mu.RUnlock()
+
+	return append(report, c.flushSources()...)
+}
+
+// changes возвращает канал, в который Apply сообщает об изменении настроек.
+func (c *Collector) changes() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.changed == nil {
+		c.changed = make(chan struct{}, 1)
+	}
+
+	return c.changed
+}
 
+func (c *Collector) SendMetric(ctx context.Context, wg *sync.WaitGroup) {
 	client := &http.Client{
-		Timeout: interval,
+		Transport: &agentTransport{header: c.header},
 	}
 
 	var pubKey *rsa.PublicKey
@@ -76,25 +249,21 @@ func (c *Collector) SendMetric(ctx context.Context, wg *sync.WaitGroup) {
 		}
 	}
 
-	requestQueue := make(chan *bytes.Buffer)
+	requestQueue := make(chan request)
 
-	// Create worker pool
-	for i := 0; i < c.RateLimit; i++ {
-		workerID := i + 1
-		wg.Add(1)
-		go func(ctx context.Context, wg *sync.WaitGroup, workerID int, client *http.Client, url string, pubKey *rsa.PublicKey, requestQueue <-chan *bytes.Buffer) {
-			for request := range requestQueue {
-				err := MakeRequest(ctx, client, c.Endpoint, pubKey, request)
-				if err != nil {
-					logger.Error(fmt.Sprintf("[Worker #%d]", workerID), err)
-				} else {
-					logger.Debug(fmt.Sprintf("[Worker #%d] the request was executed successfully", workerID))
-				}
-			}
-			wg.Done()
-		}(ctx, wg, workerID, client, c.Endpoint, pubKey, requestQueue)
+	pool := &workerPool{
+		ctx:     ctx,
+		wg:      wg,
+		client:  client,
+		url:     c.Endpoint,
+		pubKey:  pubKey,
+		queue:   requestQueue,
+		stop:    make(chan struct{}),
+		timeout: func() time.Duration { d, _, _ := c.settings(); return d },
 	}
 
+	changed := c.changes()
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -103,23 +272,138 @@ func (c *Collector) SendMetric(ctx context.Context, wg *sync.WaitGroup) {
 			return
 
 		default:
-			for _, metric := range c.Metrics {
+			interval, rateLimit, key := c.settings()
+
+			// the rate limit may be changed by the server
+			pool.resize(rateLimit)
+
+			for _, metric := range c.report() {
 				// sign if key is not empty
-				if c.KeySign == "" {
-					metric.Sign(c.KeySign)
+				if key != "" {
+					metric.Sign(key)
 				}
 
-				metricJSON, err := json.Marshal(metric)
+				metricJSON, err := json.Marshal(metric.Metrics)
 				if err != nil {
 					logger.Error("", err)
 				} else {
-					requestQueue <- bytes.NewBuffer(metricJSON)
+					requestQueue <- request{body: bytes.NewBuffer(metricJSON), failed: metric.failed}
+				}
+			}
+
+			select {
+			case <-time.After(interval):
+			case <-changed:
+				logger.Debug("SendMetric() settings changed")
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+// workerPool описывает пул отправляющих запросы воркеров, размер которого можно изменить.
+type workerPool struct {
+	ctx     context.Context
+	wg      *sync.WaitGroup
+	client  *http.Client
+	url     string
+	pubKey  *rsa.PublicKey
+	queue   <-chan request
+	stop    chan struct{}
+	timeout func() time.Duration
+
+	size   int
+	lastID int
+}
+
+// resize запускает или останавливает воркеры, чтобы их стало n.
+func (p *workerPool) resize(n int) {
+	if n < 1 {
+		n = 1
+	}
+
+	for ; p.size < n; p.size++ {
+		p.lastID++
+		p.wg.Add(1)
+		go p.worker(p.lastID)
+	}
+
+	// an idle worker takes the stop signal
+	for ; p.size > n; p.size-- {
+		p.stop <- struct{}{}
+	}
+}
+
+func (p *workerPool) worker(workerID int) {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case <-p.stop:
+			logger.Debug(fmt.Sprintf("[Worker #%d] stopped", workerID))
+			return
+		case request, ok := <-p.queue:
+			if !ok {
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(p.ctx, p.timeout())
+			err := MakeRequest(ctx, p.client, p.url, p.pubKey, request.body)
+			cancel()
+
+			if err != nil {
+				logger.Error(fmt.Sprintf("[Worker #%d]", workerID), err)
+				// return the delta to its source to send it with the next report
+				if request.failed != nil {
+					request.failed()
 				}
+			} else {
+				logger.Debug(fmt.Sprintf("[Worker #%d] the request was executed successfully", workerID))
 			}
 		}
+	}
+}
+
+// header возвращает заголовки, которыми агент сообщает о себе серверу.
+func (c *Collector) header() http.Header {
+	h := make(http.Header)
+	if c.AgentID == "" {
+		return h
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	collectors := make([]string, 0, len(c.Collectors))
+	for _, name := range c.Collectors {
+		if !c.disabled[name] {
+			collectors = append(collectors, name)
+		}
+	}
 
-		<-time.After(interval)
+	h.Set(registry.HeaderID, c.AgentID)
+	h.Set(registry.HeaderHostname, c.Hostname)
+	h.Set(registry.HeaderVersion, c.Version)
+	h.Set(registry.HeaderCollectors, strings.Join(collectors, ","))
+	h.Set(registry.HeaderInterval, strconv.Itoa(c.ReportIntervalSec))
+
+	return h
+}
+
+// agentTransport добавляет к запросам заголовки агента.
+type agentTransport struct {
+	header func() http.Header
+}
+
+func (t *agentTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if h := t.header(); len(h) > 0 {
+		r = r.Clone(r.Context())
+		for k, v := range h {
+			r.Header[k] = v
+		}
 	}
+
+	return http.DefaultTransport.RoundTrip(r)
 }
 
 func MakeRequest(ctx context.Context, client *http.Client, url string, pubKey *rsa.PublicKey, body *bytes.Buffer) error {
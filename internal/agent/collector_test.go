@@ -1,8 +1,16 @@
 package agent
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
+
+	"gometric/internal/registry"
 )
 
 func TestCollectorRegisterMetric(t *testing.T) {
@@ -53,3 +61,88 @@ func TestReadMemStats(t *testing.T) {
 		t.Errorf("PollCount expected to be 1")
 	}
 }
+
+func TestCollectorHeader(t *testing.T) {
+	var got http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer ts.Close()
+
+	collector := Collector{
+		ReportIntervalSec: 10,
+		AgentID:           "agent-1",
+		Hostname:          "vm-1",
+		Version:           "v1.2.0",
+		Collectors:        []string{"runtime", "statsd"},
+	}
+
+	client := &http.Client{Transport: &agentTransport{header: collector.header}}
+	if err := MakeRequest(context.Background(), client, ts.URL, nil, bytes.NewBufferString(`{}`)); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	a, ok := registry.FromRequest(&http.Request{Header: got})
+	if !ok || a.ID != "agent-1" || a.Hostname != "vm-1" || a.Version != "v1.2.0" ||
+		a.ReportInterval != 10 || len(a.Collectors) != 2 || a.Collectors[1] != "statsd" {
+		t.Errorf("Error: agent headers are incorrect: %v", got)
+	}
+
+	if h := (&Collector{}).header(); len(h) != 0 {
+		t.Errorf("Error: anonymous agent must not send headers: %v", h)
+	}
+}
+
+func TestCollectorRequeue(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	collector := Collector{}
+
+	agg := NewAggregator()
+	agg.Count("hits", 2)
+	agg.Gauge("load", 1, false)
+	collector.RegisterSource(agg)
+
+	queue := make(chan request)
+	wg := sync.WaitGroup{}
+	pool := &workerPool{
+		ctx:     context.Background(),
+		wg:      &wg,
+		client:  http.DefaultClient,
+		url:     ts.URL,
+		queue:   queue,
+		timeout: func() time.Duration { return time.Second },
+	}
+	pool.resize(1)
+
+	for _, m := range collector.report() {
+		body, _ := json.Marshal(m.Metrics)
+		queue <- request{body: bytes.NewBuffer(body), failed: m.failed}
+	}
+	close(queue)
+	wg.Wait()
+
+	// the failed delta is sent with the next report
+	agg.Count("hits", 3)
+	for _, m := range agg.Flush() {
+		if m.ID == "hits" && *m.Delta != 5 {
+			t.Errorf("Error: failed delta is lost: %d", *m.Delta)
+		}
+	}
+}
+
+func TestNextReadBackoff(t *testing.T) {
+	var delay time.Duration
+	for _, want := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond} {
+		if delay = nextReadBackoff(delay); delay != want {
+			t.Errorf("Error: backoff = %s, want %s", delay, want)
+		}
+	}
+
+	if got := nextReadBackoff(800 * time.Millisecond); got != maxReadBackoff {
+		t.Errorf("Error: backoff = %s, want %s", got, maxReadBackoff)
+	}
+}
@@ -0,0 +1,277 @@
+package agent
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"gometric/internal/logger"
+	"gometric/internal/metrics"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// PushServer принимает метрики от приложений на том же хосте через локальный http API.
+// Формат запросов совпадает с /update/ и /updates/ сервера, поэтому приложениям
+// не нужно знать адрес сервера, ключ подписи и настройки шифрования.
+// Метрики накапливаются в Aggregator до очередного отчета агента.
+type PushServer struct {
+	Addr       string
+	SocketPath string
+	Aggregator *Aggregator
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	server    *http.Server
+}
+
+// NewPushServer создает новый PushServer. Адрес должен быть loopback адресом.
+// Пустой адрес или путь к сокету отключают соответствующий listener.
+func NewPushServer(addr, socketPath string) *PushServer {
+	return &PushServer{
+		Addr:       addr,
+		SocketPath: socketPath,
+		Aggregator: NewAggregator(),
+	}
+}
+
+// Flush возвращает метрики, накопленные за интервал.
+func (p *PushServer) Flush() []metrics.Metrics {
+	return p.Aggregator.Flush()
+}
+
+// Requeue возвращает в Aggregator метрику, которую не удалось отправить.
+func (p *PushServer) Requeue(metric metrics.Metrics) {
+	p.Aggregator.Requeue(metric)
+}
+
+// Handler возвращает http.Handler с обработчиками локального API.
+func (p *PushServer) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Use(unzipRequestBody)
+	r.Use(middleware.AllowContentType("application/json"))
+	r.Post("/update/", p.updateHandler)
+	r.Post("/updates/", p.updatesHandler)
+
+	return r
+}
+
+// Listen открывает listener'ы и запускает http сервер до завершения контекста.
+func (p *PushServer) Listen(ctx context.Context, wg *sync.WaitGroup) error {
+	if p.Addr != "" {
+		if err := checkLoopback(p.Addr); err != nil {
+			return err
+		}
+
+		l, err := net.Listen("tcp", p.Addr)
+		if err != nil {
+			return err
+		}
+		p.addListener(l)
+	}
+
+	if p.SocketPath != "" {
+		if err := os.Remove(p.SocketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			p.closeListeners()
+			return err
+		}
+
+		l, err := net.Listen("unix", p.SocketPath)
+		if err != nil {
+			p.closeListeners()
+			return err
+		}
+		p.addListener(l)
+	}
+
+	p.server = &http.Server{
+		Handler:           p.Handler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	p.mu.Lock()
+	listeners := p.listeners
+	p.mu.Unlock()
+
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			if err := p.server.Serve(l); err != nil && err != http.ErrServerClosed {
+				logger.Error("push api serve failed", err)
+			}
+		}(l)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := p.server.Shutdown(shutdownCtx); err != nil {
+			logger.Error("push api shutdown failed", err)
+		}
+		if p.SocketPath != "" {
+			os.Remove(p.SocketPath)
+		}
+		logger.Debug("push api stopped")
+	}()
+
+	return nil
+}
+
+// LocalAddr возвращает адрес tcp listener'а, если он запущен.
+func (p *PushServer) LocalAddr() net.Addr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, l := range p.listeners {
+		if l.Addr().Network() == "tcp" {
+			return l.Addr()
+		}
+	}
+
+	return nil
+}
+
+func (p *PushServer) addListener(l net.Listener) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.listeners = append(p.listeners, l)
+}
+
+func (p *PushServer) closeListeners() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, l := range p.listeners {
+		l.Close()
+	}
+	p.listeners = nil
+}
+
+func (p *PushServer) updateHandler(w http.ResponseWriter, r *http.Request) {
+	var metric metrics.Metrics
+	if err := json.NewDecoder(r.Body).Decode(&metric); err != nil {
+		logger.Debug(fmt.Sprintf("push api: invalid request: %s", err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := p.add(metric); err != nil {
+		logger.Debug(fmt.Sprintf("push api: %s", err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (p *PushServer) updatesHandler(w http.ResponseWriter, r *http.Request) {
+	var batch []metrics.Metrics
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		logger.Debug(fmt.Sprintf("push api: invalid request: %s", err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// validate the whole batch before aggregation
+	for _, metric := range batch {
+		if err := validatePushMetric(metric); err != nil {
+			logger.Debug(fmt.Sprintf("push api: %s", err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	for _, metric := range batch {
+		p.add(metric)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// add добавляет метрику в Aggregator: счетчики суммируются, для gauge сохраняется последнее значение.
+func (p *PushServer) add(metric metrics.Metrics) error {
+	if err := validatePushMetric(metric); err != nil {
+		return err
+	}
+
+	switch metric.MType {
+	case "gauge":
+		p.Aggregator.Gauge(metric.ID, *metric.Value, false)
+	case "counter":
+		p.Aggregator.Count(metric.ID, *metric.Delta)
+	}
+
+	return nil
+}
+
+func validatePushMetric(metric metrics.Metrics) error {
+	if metric.ID == "" {
+		return fmt.Errorf("metric id must not be empty")
+	}
+
+	switch metric.MType {
+	case "gauge":
+		if metric.Value == nil {
+			return fmt.Errorf("metric %s: value must not be empty", metric.ID)
+		}
+	case "counter":
+		if metric.Delta == nil {
+			return fmt.Errorf("metric %s: delta must not be empty", metric.ID)
+		}
+	default:
+		return fmt.Errorf("metric %s: unknown type %s", metric.ID, metric.MType)
+	}
+
+	return nil
+}
+
+// checkLoopback проверяет, что адрес слушает только loopback интерфейс.
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	if host == "localhost" {
+		return nil
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("push api address %s must be a loopback address", addr)
+	}
+
+	return nil
+}
+
+// unzipRequestBody распаковывает тело запроса, сжатое с помощью gzip.
+func unzipRequestBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			reader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			defer reader.Close()
+
+			r.Body = io.NopCloser(reader)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"gometric/internal/metrics"
+)
+
+func pushRequest(t *testing.T, url string, body []byte, gzipped bool) int {
+	t.Helper()
+
+	if gzipped {
+		var b bytes.Buffer
+		g := gzip.NewWriter(&b)
+		g.Write(body)
+		g.Close()
+		body = b.Bytes()
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestPushServer(t *testing.T) {
+	p := NewPushServer("", "")
+
+	ts := httptest.NewServer(p.Handler())
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		body       []byte
+		gzipped    bool
+		statusCode int
+	}{
+		{
+			name:       "update counter #1",
+			path:       "/update/",
+			body:       []byte(`{"id":"orders","type":"counter","delta":2}`),
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "update counter gzip #2",
+			path:       "/update/",
+			body:       []byte(`{"id":"orders","type":"counter","delta":3}`),
+			gzipped:    true,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "update gauge #3",
+			path:       "/update/",
+			body:       []byte(`{"id":"queue","type":"gauge","value":1}`),
+			statusCode: http.StatusOK,
+		},
+		{
+			name: "updates batch #4",
+			path: "/updates/",
+			body: []byte(`[{"id":"orders","type":"counter","delta":5},
+				{"id":"queue","type":"gauge","value":7}]`),
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "update invalid counter #5",
+			path:       "/update/",
+			body:       []byte(`{"id":"orders","type":"counter","value":5}`),
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name: "updates invalid batch is rejected completely #6",
+			path: "/updates/",
+			body: []byte(`[{"id":"orders","type":"counter","delta":100},
+				{"id":"queue","type":"unknown","value":7}]`),
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "update broken json #7",
+			path:       "/update/",
+			body:       []byte(`{"id":`),
+			statusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if statusCode := pushRequest(t, ts.URL+tt.path, tt.body, tt.gzipped); statusCode != tt.statusCode {
+				t.Errorf("Error: status code %d, want %d", statusCode, tt.statusCode)
+			}
+		})
+	}
+
+	got := make(map[string]metrics.Metrics)
+	for _, m := range p.Flush() {
+		got[m.ID] = m
+	}
+
+	if m, ok := got["orders"]; !ok || *m.Delta != 10 {
+		t.Errorf("Error: counters must be summed")
+	}
+
+	if m, ok := got["queue"]; !ok || *m.Value != 7 {
+		t.Errorf("Error: gauge must keep the last value")
+	}
+}
+
+func TestPushServerListen(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+
+	if err := NewPushServer("0.0.0.0:0", "").Listen(ctx, &wg); err == nil {
+		t.Errorf("Error: non loopback address must be rejected")
+	}
+
+	p := NewPushServer("127.0.0.1:0", "")
+	if err := p.Listen(ctx, &wg); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	url := "http://" + p.LocalAddr().String() + "/update/"
+	if statusCode := pushRequest(t, url, []byte(`{"id":"orders","type":"counter","delta":1}`), false); statusCode != http.StatusOK {
+		t.Errorf("Error: status code %d", statusCode)
+	}
+
+	cancel()
+	wg.Wait()
+}
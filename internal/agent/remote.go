@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"gometric/internal/agentconfig"
+	"gometric/internal/logger"
+	"gometric/internal/metrics"
+)
+
+// PollConfig запрашивает настройки агента по адресу url раз в interval до отмены контекста ctx
+// и применяет изменившиеся настройки. Сервер без поддержки настроек агентов не считается ошибкой.
+func (c *Collector) PollConfig(ctx context.Context, url string, interval time.Duration) {
+	client := &http.Client{
+		Timeout:   interval,
+		Transport: &agentTransport{header: c.header},
+	}
+
+	var etag string
+	for {
+		var err error
+		etag, err = c.fetchConfig(ctx, client, url, etag)
+		if err != nil && ctx.Err() == nil {
+			logger.Error("agent config request failed", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Debug("PollConfig() stopped")
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// fetchConfig запрашивает настройки, если они изменились с версии etag, проверяет их подпись,
+// применяет их и возвращает версию примененных настроек.
+func (c *Collector) fetchConfig(ctx context.Context, client *http.Client, url, etag string) (string, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return etag, err
+	}
+
+	if etag != "" {
+		request.Header.Set("If-None-Match", etag)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return etag, err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return etag, nil
+	case http.StatusNotFound:
+		logger.Debug("agent config is not supported by the server")
+		return etag, nil
+	default:
+		return etag, fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return etag, err
+	}
+
+	if err := c.verifyConfig(body, response.Header.Get(metrics.SignHeader)); err != nil {
+		return etag, err
+	}
+
+	var rc agentconfig.Config
+	if err := json.Unmarshal(body, &rc); err != nil {
+		return etag, err
+	}
+
+	if err := c.Apply(rc); err != nil {
+		return etag, err
+	}
+
+	logger.Info("agent config applied")
+
+	newETag := response.Header.Get("ETag")
+	if newETag == "" {
+		newETag = agentconfig.ETag(body)
+	}
+
+	return newETag, nil
+}
+
+// verifyConfig проверяет подпись настроек body, если у агента задан ключ.
+func (c *Collector) verifyConfig(body []byte, signature string) error {
+	_, _, key := c.settings()
+	if key == "" {
+		return nil
+	}
+
+	mac1, err := metrics.Sign(string(body), key)
+	if err != nil {
+		return err
+	}
+
+	mac2, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac1, mac2) {
+		return errors.New("invalid agent config signature")
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gometric/internal/agentconfig"
+	"gometric/internal/metrics"
+	"gometric/internal/registry"
+)
+
+func TestFetchConfig(t *testing.T) {
+	store, _ := agentconfig.NewStore("")
+	store.SetKey("key")
+	store.Set(agentconfig.File{
+		Default: agentconfig.Config{ReportInterval: "20s"},
+		Agents: map[string]agentconfig.Config{
+			"vm-1": {PollInterval: "5s", RateLimit: 4, Collectors: []string{"runtime"}},
+		},
+	})
+
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		store.Handler(w, r)
+	}))
+	defer ts.Close()
+
+	var m MemStats
+	var v VirtualMemoryStat
+
+	c := &Collector{
+		ReportIntervalSec: 10,
+		RateLimit:         1,
+		KeySign:           "wrong",
+		AgentID:           "vm-1",
+		Collectors:        []string{agentconfig.CollectorRuntime, agentconfig.CollectorMemory},
+		Poll:              NewInterval(2 * time.Second),
+	}
+	c.RegisterCollectorMetric(agentconfig.CollectorRuntime, "Alloc", &m.Alloc)
+	c.RegisterCollectorMetric(agentconfig.CollectorMemory, "TotalMemory", &v.Total)
+
+	client := &http.Client{Transport: &agentTransport{header: c.header}}
+
+	// config signed with another key is not applied
+	if _, err := c.fetchConfig(context.Background(), client, ts.URL, ""); err == nil || c.Poll.Get() != 2*time.Second {
+		t.Errorf("Error: config with invalid signature must be rejected: %v", err)
+	}
+
+	c.KeySign = "key"
+
+	etag, err := c.fetchConfig(context.Background(), client, ts.URL, "")
+	if err != nil || etag == "" {
+		t.Fatalf("Error: %v", err)
+	}
+
+	interval, rateLimit, key := c.settings()
+	if interval != 20*time.Second || rateLimit != 4 || key != "key" || c.Poll.Get() != 5*time.Second {
+		t.Errorf("Error: config is not applied: %s %d %s %s", interval, rateLimit, key, c.Poll.Get())
+	}
+
+	if report := c.report(); len(report) != 1 || report[0].ID != "Alloc" {
+		t.Errorf("Error: disabled collector is reported: %v", report)
+	}
+
+	if h := c.header(); h.Get(registry.HeaderCollectors) != "runtime" || h.Get(registry.HeaderInterval) != "20" {
+		t.Errorf("Error: agent headers are incorrect: %v", h)
+	}
+
+	// unchanged config keeps the version
+	if etag2, err := c.fetchConfig(context.Background(), client, ts.URL, etag); err != nil || etag2 != etag || requests != 3 {
+		t.Errorf("Error: unchanged config is incorrect: %s %v", etag2, err)
+	}
+
+	select {
+	case <-c.changes():
+	default:
+		t.Errorf("Error: config change is not signaled")
+	}
+}
+
+func TestSendMetricSign(t *testing.T) {
+	hashes := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m metrics.Metrics
+		reader, err := gzip.NewReader(r.Body)
+		if err == nil {
+			err = json.NewDecoder(reader).Decode(&m)
+		}
+		if err != nil {
+			t.Errorf("Error: %s", err)
+		}
+		hashes <- m.Hash
+	}))
+	defer ts.Close()
+
+	m := MemStats{Alloc: 1}
+	c := &Collector{
+		Endpoint:          ts.URL,
+		ReportIntervalSec: 60,
+		KeySign:           "key",
+	}
+	c.RegisterMetric("Alloc", &m.Alloc)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go c.SendMetric(ctx, &sync.WaitGroup{})
+
+	want := metrics.Metrics{ID: "Alloc", MType: "gauge", Value: (*float64)(&m.Alloc)}
+	want.Sign("key")
+	if hash := <-hashes; hash == "" || hash != want.Hash {
+		t.Errorf("Error: metric must be signed: %q", hash)
+	}
+}
@@ -0,0 +1,266 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gometric/internal/logger"
+	"gometric/internal/metrics"
+)
+
+// maxDatagramSize максимальный размер UDP-датаграммы.
+const maxDatagramSize = 65535
+
+// Задержка чтения после ошибки сокета удваивается при повторных ошибках до maxReadBackoff.
+const (
+	minReadBackoff = 10 * time.Millisecond
+	maxReadBackoff = time.Second
+)
+
+// StatsDMetric описывает одну строку протокола StatsD.
+type StatsDMetric struct {
+	Name       string
+	Value      float64
+	Member     string
+	Type       string
+	SampleRate float64
+	Relative   bool
+	Tags       map[string]string
+}
+
+// ParseStatsDLine разбирает строку вида name:value|type|@rate|#tag1:v1,tag2
+// с поддержкой тегов в формате DogStatsD.
+func ParseStatsDLine(line string) (StatsDMetric, error) {
+	m := StatsDMetric{
+		SampleRate: 1,
+		Tags:       make(map[string]string),
+	}
+
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return m, fmt.Errorf("invalid statsd line %q: missing name", line)
+	}
+	m.Name = name
+
+	parts := strings.Split(rest, "|")
+	if len(parts) < 2 {
+		return m, fmt.Errorf("invalid statsd line %q: missing type", line)
+	}
+
+	m.Type = parts[1]
+	switch m.Type {
+	case "c", "g", "ms", "h", "s":
+	default:
+		return m, fmt.Errorf("invalid statsd line %q: unknown type %s", line, m.Type)
+	}
+
+	value := parts[0]
+	if m.Type == "s" {
+		m.Member = value
+	} else {
+		if m.Type == "g" && (strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-")) {
+			m.Relative = true
+		}
+
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return m, fmt.Errorf("invalid statsd line %q: %w", line, err)
+		}
+		m.Value = v
+	}
+
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			rate, err := strconv.ParseFloat(part[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return m, fmt.Errorf("invalid statsd line %q: invalid sample rate", line)
+			}
+			m.SampleRate = rate
+		case strings.HasPrefix(part, "#"):
+			for _, tag := range strings.Split(part[1:], ",") {
+				if tag == "" {
+					continue
+				}
+				k, v, _ := strings.Cut(tag, ":")
+				m.Tags[k] = v
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// StatsDServer принимает метрики по протоколу StatsD через UDP и Unix datagram сокет
+// и накапливает их в Aggregator до очередного отчета агента.
+type StatsDServer struct {
+	Addr       string
+	SocketPath string
+	Aggregator *Aggregator
+
+	mu    sync.Mutex
+	conns []net.PacketConn
+}
+
+// NewStatsDServer создает новый StatsDServer. Пустой адрес или путь к сокету отключают соответствующий listener.
+func NewStatsDServer(addr, socketPath string) *StatsDServer {
+	return &StatsDServer{
+		Addr:       addr,
+		SocketPath: socketPath,
+		Aggregator: NewAggregator(),
+	}
+}
+
+// Flush возвращает метрики, накопленные за интервал.
+func (s *StatsDServer) Flush() []metrics.Metrics {
+	return s.Aggregator.Flush()
+}
+
+// Requeue возвращает в Aggregator метрику, которую не удалось отправить.
+func (s *StatsDServer) Requeue(metric metrics.Metrics) {
+	s.Aggregator.Requeue(metric)
+}
+
+// Listen открывает сокеты и запускает обработку входящих пакетов до завершения контекста.
+func (s *StatsDServer) Listen(ctx context.Context, wg *sync.WaitGroup) error {
+	if s.Addr != "" {
+		conn, err := net.ListenPacket("udp", s.Addr)
+		if err != nil {
+			return err
+		}
+		s.serve(ctx, wg, conn)
+	}
+
+	if s.SocketPath != "" {
+		if err := os.Remove(s.SocketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.Close()
+			return err
+		}
+
+		conn, err := net.ListenPacket("unixgram", s.SocketPath)
+		if err != nil {
+			s.Close()
+			return err
+		}
+		s.serve(ctx, wg, conn)
+	}
+
+	return nil
+}
+
+// LocalAddr возвращает адрес UDP listener'а, если он запущен.
+func (s *StatsDServer) LocalAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, conn := range s.conns {
+		if conn.LocalAddr().Network() == "udp" {
+			return conn.LocalAddr()
+		}
+	}
+
+	return nil
+}
+
+// Close закрывает все открытые сокеты.
+func (s *StatsDServer) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+
+	if s.SocketPath != "" {
+		os.Remove(s.SocketPath)
+	}
+}
+
+func (s *StatsDServer) serve(ctx context.Context, wg *sync.WaitGroup, conn net.PacketConn) {
+	s.mu.Lock()
+	s.conns = append(s.conns, conn)
+	s.mu.Unlock()
+
+	wg.Add(1)
+	go func() {
+		<-ctx.Done()
+		s.Close()
+		wg.Done()
+	}()
+
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		var delay time.Duration
+
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+					logger.Debug("StatsD listener stopped")
+					return
+				}
+				logger.Error("statsd read failed", err)
+
+				// back off instead of spinning on a persistent error
+				delay = nextReadBackoff(delay)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+				}
+				continue
+			}
+
+			delay = 0
+			s.HandlePacket(buf[:n])
+		}
+	}()
+}
+
+// nextReadBackoff возвращает задержку после очередной ошибки чтения подряд.
+func nextReadBackoff(delay time.Duration) time.Duration {
+	if delay < minReadBackoff {
+		return minReadBackoff
+	}
+	if delay *= 2; delay > maxReadBackoff {
+		return maxReadBackoff
+	}
+
+	return delay
+}
+
+// HandlePacket разбирает пакет, который может содержать несколько строк, и добавляет метрики в Aggregator.
+func (s *StatsDServer) HandlePacket(packet []byte) {
+	for _, line := range strings.Split(string(packet), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		m, err := ParseStatsDLine(line)
+		if err != nil {
+			logger.Debug(err.Error())
+			continue
+		}
+
+		id := metrics.FormatID(m.Name, m.Tags)
+
+		switch m.Type {
+		case "c":
+			s.Aggregator.CountSampled(id, m.Value, m.SampleRate)
+		case "g":
+			s.Aggregator.Gauge(id, m.Value, m.Relative)
+		case "ms", "h":
+			s.Aggregator.Timing(id, m.Value, m.SampleRate)
+		case "s":
+			s.Aggregator.SetAdd(id, m.Member)
+		}
+	}
+}
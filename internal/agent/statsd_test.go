@@ -0,0 +1,220 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"gometric/internal/metrics"
+)
+
+func TestParseStatsDLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    StatsDMetric
+		wantErr bool
+	}{
+		{
+			name: "counter #1",
+			line: "requests:1|c",
+			want: StatsDMetric{Name: "requests", Value: 1, Type: "c", SampleRate: 1},
+		},
+		{
+			name: "counter with sample rate and tags #2",
+			line: "requests:2|c|@0.5|#route:/api,canary",
+			want: StatsDMetric{
+				Name: "requests", Value: 2, Type: "c", SampleRate: 0.5,
+				Tags: map[string]string{"route": "/api", "canary": ""},
+			},
+		},
+		{
+			name: "relative gauge #3",
+			line: "queue:-3|g",
+			want: StatsDMetric{Name: "queue", Value: -3, Type: "g", SampleRate: 1, Relative: true},
+		},
+		{
+			name: "set #4",
+			line: "users:alice|s",
+			want: StatsDMetric{Name: "users", Member: "alice", Type: "s", SampleRate: 1},
+		},
+		{
+			name:    "unknown type #5",
+			line:    "requests:1|x",
+			wantErr: true,
+		},
+		{
+			name:    "invalid value #6",
+			line:    "requests:abc|c",
+			wantErr: true,
+		},
+		{
+			name:    "invalid sample rate #7",
+			line:    "requests:1|c|@2",
+			wantErr: true,
+		},
+		{
+			name:    "missing type #8",
+			line:    "requests:1",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := ParseStatsDLine(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Error: line %q must be invalid", tt.line)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Error: %s", err)
+			}
+
+			if m.Name != tt.want.Name || m.Value != tt.want.Value || m.Member != tt.want.Member ||
+				m.Type != tt.want.Type || m.SampleRate != tt.want.SampleRate || m.Relative != tt.want.Relative {
+				t.Errorf("Error: got %+v, want %+v", m, tt.want)
+			}
+
+			for k, v := range tt.want.Tags {
+				if m.Tags[k] != v {
+					t.Errorf("Error: tag %s is incorrect", k)
+				}
+			}
+		})
+	}
+}
+
+func TestStatsDAggregation(t *testing.T) {
+	s := NewStatsDServer("", "")
+	s.HandlePacket([]byte("requests:1|c\nrequests:1|c|@0.5\nrequests:1|c|#route:/api\n" +
+		"temp:10|g\ntemp:+5|g\n" +
+		"latency:10|ms\nlatency:30|ms\nlatency:20|h\n" +
+		"sampled:5|ms|@0.25\nsampled:15|ms|@0.5\n" +
+		"users:alice|s\nusers:bob|s\nusers:alice|s\nbroken"))
+
+	got := make(map[string]metrics.Metrics)
+	for _, m := range s.Flush() {
+		got[m.ID] = m
+	}
+
+	checkCounter := func(id string, want int64) {
+		m, ok := got[id]
+		if !ok || m.MType != "counter" || *m.Delta != want {
+			t.Errorf("Error: counter %s is incorrect", id)
+		}
+	}
+	checkGauge := func(id string, want float64) {
+		m, ok := got[id]
+		if !ok || m.MType != "gauge" || *m.Value != want {
+			t.Errorf("Error: gauge %s is incorrect", id)
+		}
+	}
+
+	checkCounter("requests", 3)
+	checkCounter("requests{route=/api}", 1)
+	checkGauge("temp", 15)
+	checkCounter("latency.count", 3)
+	checkGauge("latency.sum", 60)
+	checkGauge("latency.min", 10)
+	checkGauge("latency.max", 30)
+	checkGauge("latency.mean", 20)
+	checkGauge("latency.p50", 20)
+	checkGauge("latency.p99", 30)
+	checkGauge("users", 2)
+
+	// timer count is scaled by the sample rate
+	checkCounter("sampled.count", 6)
+	checkGauge("sampled.sum", 20)
+	checkGauge("sampled.mean", 10)
+
+	// counters, timers and sets are reset, gauges are kept
+	got = make(map[string]metrics.Metrics)
+	for _, m := range s.Flush() {
+		got[m.ID] = m
+	}
+
+	if len(got) != 1 {
+		t.Errorf("Error: only gauges must be kept after flush, got %d metrics", len(got))
+	}
+	checkGauge("temp", 15)
+}
+
+func TestAggregatorCounters(t *testing.T) {
+	agg := NewAggregator()
+
+	// int64 deltas are summed exactly
+	agg.Count("big", 1<<53)
+	agg.Count("big", 1)
+
+	// sampled increments keep the remainder for the next interval: 2.5 + 2.5 = 3 + 2
+	agg.CountSampled("sampled", 1, 0.4)
+
+	counters := func() map[string]int64 {
+		got := make(map[string]int64)
+		for _, m := range agg.Flush() {
+			got[m.ID] = *m.Delta
+		}
+		return got
+	}
+
+	if got := counters(); got["big"] != 1<<53+1 || got["sampled"] != 3 {
+		t.Errorf("Error: counters are incorrect: %v", got)
+	}
+
+	agg.CountSampled("sampled", 1, 0.4)
+	if got := counters(); got["sampled"] != 2 {
+		t.Errorf("Error: sampled remainder is lost: %v", got)
+	}
+}
+
+func TestStatsDListen(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+
+	s := NewStatsDServer("127.0.0.1:0", "")
+	if err := s.Listen(ctx, &wg); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	conn, err := net.Dial("udp", s.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("hits:5|c")); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	var flushed []metrics.Metrics
+	for i := 0; i < 50 && len(flushed) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		flushed = s.Flush()
+	}
+
+	if len(flushed) != 1 || flushed[0].ID != "hits" || *flushed[0].Delta != 5 {
+		t.Errorf("Error: metric is not received")
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestCollectorRegisterSource(t *testing.T) {
+	collector := Collector{}
+
+	agg := NewAggregator()
+	agg.Count("hits", 2)
+	collector.RegisterSource(agg)
+
+	flushed := collector.flushSources()
+	if len(flushed) != 1 || flushed[0].ID != "hits" || *flushed[0].Delta != 2 {
+		t.Errorf("Error: source metrics are not flushed")
+	}
+}
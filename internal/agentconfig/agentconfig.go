@@ -0,0 +1,245 @@
+// Пакет agentconfig предназначен для централизованной настройки агентов.
+//
+// Сервер хранит общие настройки агентов и настройки отдельных агентов по их
+// идентификатору. Агенты периодически запрашивают свои настройки с заголовком
+// If-None-Match и применяют изменения без перезапуска: интервалы опроса и отчетов,
+// число одновременных запросов и включенные сборщики.
+// Пустое поле означает, что агент использует собственное значение.
+// Если на сервере задан ключ, ответы подписываются им в заголовке metrics.SignHeader,
+// а агент применяет только настройки с верной подписью. Ключ подписи через настройки не передается.
+package agentconfig
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gometric/internal/metrics"
+)
+
+// Сборщики метрик агента, которые можно включать и отключать.
+const (
+	CollectorRuntime = "runtime"
+	CollectorMemory  = "memory"
+	CollectorCPU     = "cpu"
+)
+
+// Collectors список известных сборщиков.
+var Collectors = []string{CollectorRuntime, CollectorMemory, CollectorCPU}
+
+// Config описывает настройки агента.
+type Config struct {
+	// PollInterval и ReportInterval интервалы в формате time.Duration, например 2s.
+	PollInterval   string `json:"poll_interval,omitempty"`
+	ReportInterval string `json:"report_interval,omitempty"`
+	RateLimit      int    `json:"rate_limit,omitempty"`
+	// Collectors включенные сборщики, nil не изменяет набор сборщиков агента.
+	Collectors []string `json:"collectors,omitempty"`
+}
+
+// Validate проверяет настройки.
+func (c Config) Validate() error {
+	for _, d := range []struct{ name, value string }{
+		{"poll_interval", c.PollInterval},
+		{"report_interval", c.ReportInterval},
+	} {
+		if d.value == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d.value); err != nil || v < time.Second {
+			return fmt.Errorf("invalid %s %q: want duration of at least 1s", d.name, d.value)
+		}
+	}
+
+	if c.RateLimit < 0 {
+		return errors.New("invalid rate_limit: must not be negative")
+	}
+
+	for _, name := range c.Collectors {
+		if !known(name) {
+			return fmt.Errorf("unknown collector %q", name)
+		}
+	}
+
+	return nil
+}
+
+// merge возвращает настройки c, дополненные непустыми полями o.
+func (c Config) merge(o Config) Config {
+	if o.PollInterval != "" {
+		c.PollInterval = o.PollInterval
+	}
+	if o.ReportInterval != "" {
+		c.ReportInterval = o.ReportInterval
+	}
+	if o.RateLimit != 0 {
+		c.RateLimit = o.RateLimit
+	}
+	if o.Collectors != nil {
+		c.Collectors = o.Collectors
+	}
+	return c
+}
+
+func known(name string) bool {
+	for _, c := range Collectors {
+		if c == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// File описывает настройки всех агентов.
+type File struct {
+	// Default общие настройки.
+	Default Config `json:"default"`
+	// Agents настройки агентов по идентификатору, дополняют общие.
+	Agents map[string]Config `json:"agents,omitempty"`
+}
+
+// Validate проверяет настройки всех агентов.
+func (f File) Validate() error {
+	if err := f.Default.Validate(); err != nil {
+		return fmt.Errorf("default: %w", err)
+	}
+
+	for id, c := range f.Agents {
+		if err := c.Validate(); err != nil {
+			return fmt.Errorf("agent %s: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+// ETag возвращает тег версии настроек body для заголовка ETag.
+func ETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// Store описывает хранилище настроек агентов.
+type Store struct {
+	mu   sync.RWMutex
+	file File
+	path string
+	key  metrics.Key
+}
+
+// NewStore создает хранилище настроек, сохраняемых в файл path.
+// Если файл существует, настройки загружаются из него. Пустой path отключает сохранение.
+func NewStore(path string) (*Store, error) {
+	s := &Store{path: path}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &s.file); err != nil {
+		return nil, fmt.Errorf("agent config %s: %w", path, err)
+	}
+
+	if err := s.file.Validate(); err != nil {
+		return nil, fmt.Errorf("agent config %s: %w", path, err)
+	}
+
+	return s, nil
+}
+
+// Reload заново загружает настройки из файла. При ошибке действующие настройки не изменяются.
+func (s *Store) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+
+	loaded, err := NewStore(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.file = loaded.file
+	s.mu.Unlock()
+
+	return nil
+}
+
+// SetKey заменяет ключ подписи ответов, пустой ключ отключает подпись.
+func (s *Store) SetKey(key string) {
+	s.key.Set(key)
+}
+
+// File возвращает настройки всех агентов.
+func (s *Store) File() File {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.file
+}
+
+// For возвращает настройки агента id.
+func (s *Store) For(id string) Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.file.Default.merge(s.file.Agents[id])
+}
+
+// Set проверяет, сохраняет в файл и применяет настройки f.
+func (s *Store) Set(f File) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.path != "" {
+		if err := writeFile(s.path, f); err != nil {
+			return err
+		}
+	}
+
+	s.file = f
+
+	return nil
+}
+
+// writeFile атомарно записывает настройки f в файл path.
+func writeFile(path string, f File) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,124 @@
+package agentconfig
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gometric/internal/registry"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		c  Config
+		ok bool
+	}{
+		{c: Config{}, ok: true},
+		{c: Config{PollInterval: "2s", ReportInterval: "1m", RateLimit: 4, Collectors: []string{"cpu"}}, ok: true},
+		{c: Config{PollInterval: "100ms"}},
+		{c: Config{ReportInterval: "often"}},
+		{c: Config{RateLimit: -1}},
+		{c: Config{Collectors: []string{"disk"}}},
+	}
+
+	for _, tt := range tests {
+		if err := tt.c.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Error: %+v validation: %v", tt.c, err)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agents.json")
+
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	f := File{
+		Default: Config{ReportInterval: "10s", RateLimit: 2},
+		Agents: map[string]Config{
+			"vm-1": {ReportInterval: "30s", Collectors: []string{"runtime"}},
+		},
+	}
+
+	if err := s.Set(File{Default: Config{RateLimit: -1}}); err == nil {
+		t.Errorf("Error: invalid config must be rejected")
+	}
+
+	if err := s.Set(f); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	want := Config{ReportInterval: "30s", RateLimit: 2, Collectors: []string{"runtime"}}
+	if c := s.For("vm-1"); !reflect.DeepEqual(c, want) {
+		t.Errorf("Error: agent config is incorrect: %+v", c)
+	}
+
+	if c := s.For("vm-2"); !reflect.DeepEqual(c, f.Default) {
+		t.Errorf("Error: default config is incorrect: %+v", c)
+	}
+
+	// the config is saved
+	s, err = NewStore(path)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if !reflect.DeepEqual(s.File(), f) {
+		t.Errorf("Error: saved config is incorrect: %+v", s.File())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	s, _ := NewStore("")
+	s.Set(File{Default: Config{PollInterval: "5s"}, Agents: map[string]Config{"vm-1": {RateLimit: 3}}})
+
+	get := func(id, etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/agent/config", nil)
+		r.Header.Set(registry.HeaderID, id)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+
+		w := httptest.NewRecorder()
+		s.Handler(w, r)
+		return w
+	}
+
+	w := get("vm-1", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || w.Body.String() != `{"poll_interval":"5s","rate_limit":3}` {
+		t.Fatalf("Error: config response is incorrect: %d %s", w.Code, w.Body)
+	}
+
+	if w = get("vm-1", etag); w.Code != http.StatusNotModified {
+		t.Errorf("Error: unchanged config must not be sent: %d", w.Code)
+	}
+
+	// another agent has another config
+	if w = get("vm-2", etag); w.Code != http.StatusOK {
+		t.Errorf("Error: changed config must be sent: %d", w.Code)
+	}
+
+	r := httptest.NewRequest(http.MethodPut, "/agent/configs", strings.NewReader(`{"default":{"collectors":["gpu"]}}`))
+	w = httptest.NewRecorder()
+	s.UpdateHandler(w, r)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "gpu") {
+		t.Errorf("Error: invalid config must be rejected: %d %s", w.Code, w.Body)
+	}
+
+	r = httptest.NewRequest(http.MethodPut, "/agent/configs", strings.NewReader(`{"default":{"poll_interval":"10s"}}`))
+	w = httptest.NewRecorder()
+	s.UpdateHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Error: config update failed: %d %s", w.Code, w.Body)
+	}
+
+	if w = get("vm-1", etag); w.Code != http.StatusOK || w.Body.String() != `{"poll_interval":"10s"}` {
+		t.Errorf("Error: updated config is incorrect: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,101 @@
+package agentconfig
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"gometric/internal/logger"
+	"gometric/internal/metrics"
+	"gometric/internal/registry"
+)
+
+// Handler возвращает настройки агента, идентификатор которого передан в заголовке registry.HeaderID.
+// Если настройки не изменились с версии из заголовка If-None-Match, возвращается статус 304.
+// Ответ подписывается текущим ключом.
+func (s *Store) Handler(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(s.For(r.Header.Get(registry.HeaderID)))
+	if err != nil {
+		logger.Error("", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	etag := ETag(body)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	s.write(w, body)
+}
+
+// FileHandler возвращает настройки всех агентов, ответ подписывается текущим ключом.
+func (s *Store) FileHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(s.File())
+	if err != nil {
+		logger.Error("", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	s.write(w, body)
+}
+
+// write отправляет настройки body с подписью в заголовке metrics.SignHeader, если задан ключ.
+func (s *Store) write(w http.ResponseWriter, body []byte) {
+	if key := s.key.Get(); key != "" {
+		sign, err := metrics.Sign(string(body), key)
+		if err != nil {
+			logger.Error("", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(metrics.SignHeader, hex.EncodeToString(sign))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// UpdateHandler заменяет настройки всех агентов настройками из тела запроса.
+func (s *Store) UpdateHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Error("agent config could not read request body", err)
+		writeError(w, http.StatusBadRequest, "could not read request body")
+		return
+	}
+
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+
+	if err := f.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.Set(f); err != nil {
+		logger.Error("agent config could not be saved", err)
+		writeError(w, http.StatusInternalServerError, "could not save agent config")
+		return
+	}
+
+	logger.Info("agent config updated")
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	ret, _ := json.Marshal(map[string]string{"error": msg})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(ret)
+}
@@ -0,0 +1,434 @@
+// Пакет alert предназначен для вычисления правил оповещения по метрикам хранилища.
+//
+// Engine с заданным интервалом проверяет правила и ведет состояние оповещения
+// каждого правила: pending, пока условие выполняется меньше For, firing после этого
+// и resolved, когда условие перестает выполняться. Решенные оповещения показываются
+// еще ResolvedRetention, после чего удаляются.
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"gometric/internal/logger"
+	"gometric/internal/metrics"
+	"gometric/internal/storage"
+)
+
+// Состояния оповещения.
+const (
+	StatePending  = "pending"
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// Значения по умолчанию.
+const (
+	DefaultInterval          = 15 * time.Second
+	DefaultResolvedRetention = 15 * time.Minute
+)
+
+// Clock источник текущего времени, в тестах подменяется.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// Alert описывает состояние оповещения правила.
+type Alert struct {
+	Rule        string            `json:"rule"`
+	Metric      string            `json:"metric"`
+	State       string            `json:"state"`
+	Value       *float64          `json:"value,omitempty"`
+	ActiveAt    time.Time         `json:"active_at"`
+	FiredAt     *time.Time        `json:"fired_at,omitempty"`
+	ResolvedAt  *time.Time        `json:"resolved_at,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// sample значение метрики в момент проверки.
+type sample struct {
+	at    time.Time
+	value float64
+}
+
+// series история значений метрики.
+type series struct {
+	samples []sample
+	// updated время последнего обновления метрики. Если хранилище не ведет
+	// сведения об обновлениях, это время последнего изменения значения.
+	updated time.Time
+}
+
+// Notifier получает оповещения, состояние которых изменилось.
+type Notifier interface {
+	Notify(alerts []Alert)
+}
+
+// Engine вычисляет правила оповещения.
+type Engine struct {
+	storage storage.Storage
+
+	// Interval период проверки правил.
+	Interval time.Duration
+	// ResolvedRetention время, в течение которого показываются решенные оповещения.
+	ResolvedRetention time.Duration
+	// Clock источник времени.
+	Clock Clock
+
+	mu        sync.Mutex
+	notifiers []Notifier
+	rules     []Rule
+	alerts    map[string]*Alert
+	series    map[string]*series
+}
+
+// NewEngine создает Engine для правил rules над хранилищем st.
+func NewEngine(st storage.Storage, rules []Rule) (*Engine, error) {
+	if err := ValidateRules(rules); err != nil {
+		return nil, err
+	}
+
+	return &Engine{
+		storage:           st,
+		Interval:          DefaultInterval,
+		ResolvedRetention: DefaultResolvedRetention,
+		Clock:             realClock{},
+		rules:             rules,
+		alerts:            make(map[string]*Alert),
+		series:            make(map[string]*series),
+	}, nil
+}
+
+// AddNotifier добавляет получателя изменений состояния оповещений.
+func (e *Engine) AddNotifier(n Notifier) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.notifiers = append(e.notifiers, n)
+}
+
+// Rules возвращает правила.
+func (e *Engine) Rules() []Rule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]Rule(nil), e.rules...)
+}
+
+// Run проверяет правила с периодом Interval до отмены контекста ctx.
+func (e *Engine) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.Eval(ctx); err != nil {
+				logger.Error("alert evaluation failed", err)
+			}
+		}
+	}
+}
+
+// Eval один раз проверяет все правила и передает изменившиеся оповещения получателям.
+func (e *Engine) Eval(ctx context.Context) error {
+	changed, err := e.eval(ctx)
+	if err != nil || len(changed) == 0 {
+		return err
+	}
+
+	e.mu.Lock()
+	notifiers := append([]Notifier(nil), e.notifiers...)
+	e.mu.Unlock()
+
+	for _, n := range notifiers {
+		n.Notify(changed)
+	}
+
+	return nil
+}
+
+func (e *Engine) eval(ctx context.Context) ([]Alert, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.Clock.Now()
+
+	// read every metric once
+	values := make(map[string]*float64)
+	for _, r := range e.rules {
+		if _, ok := values[r.Metric]; ok {
+			continue
+		}
+
+		v, err := e.storage.GetCtx(ctx, r.Metric)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			values[r.Metric] = nil
+			continue
+		}
+
+		f, ok := toFloat(v)
+		if !ok {
+			values[r.Metric] = nil
+			continue
+		}
+		values[r.Metric] = &f
+	}
+
+	updated, err := e.updated(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for metric, v := range values {
+		e.record(metric, v, updated[metric].Updated, now)
+	}
+
+	var changed []Alert
+	for _, r := range e.rules {
+		active, value := e.check(r, values[r.Metric], now)
+		if a, ok := e.transition(r, active, value, now); ok {
+			changed = append(changed, a)
+		}
+	}
+
+	e.prune(now)
+
+	return changed, nil
+}
+
+// updated возвращает сведения об обновлениях метрик правил TypeAbsent,
+// если хранилище их ведет.
+func (e *Engine) updated(ctx context.Context) (map[string]metrics.Meta, error) {
+	reader, ok := storage.Meta(e.storage)
+	if !ok {
+		return nil, nil
+	}
+
+	var keys []string
+	for _, r := range e.rules {
+		if r.Type == TypeAbsent {
+			keys = append(keys, r.Metric)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	meta, err := reader.MetaCtx(ctx, keys...)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		logger.Error("alert metrics meta is unavailable", err)
+		return nil, nil
+	}
+
+	return meta, nil
+}
+
+// record добавляет значение метрики в историю.
+// updated время последнего обновления метрики или нулевое время, если оно неизвестно.
+func (e *Engine) record(metric string, v *float64, updated, now time.Time) {
+	s, ok := e.series[metric]
+	if !ok {
+		// a missing metric is absent since the first check
+		s = &series{updated: now}
+		if !updated.IsZero() {
+			s.updated = updated
+		}
+		e.series[metric] = s
+	}
+
+	if updated.After(s.updated) {
+		s.updated = updated
+	}
+
+	if v == nil {
+		return
+	}
+
+	if n := len(s.samples); updated.IsZero() && n > 0 && s.samples[n-1].value != *v {
+		s.updated = now
+	}
+
+	s.samples = append(s.samples, sample{at: now, value: *v})
+}
+
+// check вычисляет условие правила.
+func (e *Engine) check(r Rule, v *float64, now time.Time) (bool, *float64) {
+	switch r.Type {
+	case TypeThreshold:
+		if v == nil {
+			return false, nil
+		}
+		active, _ := compare(r.Op, *v, r.Value)
+		return active, v
+
+	case TypeRate:
+		s := e.series[r.Metric]
+		if v == nil || len(s.samples) < 2 {
+			return false, nil
+		}
+
+		// the oldest sample inside the window
+		from := now.Add(-time.Duration(r.Window))
+		first := s.samples[len(s.samples)-1]
+		for i := len(s.samples) - 2; i >= 0 && !s.samples[i].at.Before(from); i-- {
+			first = s.samples[i]
+		}
+
+		elapsed := now.Sub(first.at).Seconds()
+		if elapsed <= 0 {
+			return false, nil
+		}
+
+		rate := (*v - first.value) / elapsed
+		active, _ := compare(r.Op, rate, r.Value)
+		return active, &rate
+
+	case TypeAbsent:
+		return now.Sub(e.series[r.Metric].updated) >= time.Duration(r.Window), v
+	}
+
+	return false, nil
+}
+
+// transition изменяет состояние оповещения правила r.
+// Возвращает оповещение, если его состояние изменилось.
+func (e *Engine) transition(r Rule, active bool, value *float64, now time.Time) (Alert, bool) {
+	a, ok := e.alerts[r.Name]
+
+	if active {
+		if !ok || a.State == StateResolved {
+			a = &Alert{
+				Rule:        r.Name,
+				Metric:      r.Metric,
+				State:       StatePending,
+				ActiveAt:    now,
+				Labels:      r.Labels,
+				Annotations: r.Annotations,
+			}
+			e.alerts[r.Name] = a
+			ok = false
+		}
+		a.Value = value
+
+		if a.State == StatePending && now.Sub(a.ActiveAt) >= time.Duration(r.For) {
+			fired := now
+			a.State = StateFiring
+			a.FiredAt = &fired
+			logger.Info("alert " + r.Name + " is firing")
+			return *a, true
+		}
+
+		return *a, !ok
+	}
+
+	if !ok || a.State == StateResolved {
+		return Alert{}, false
+	}
+
+	if a.State == StatePending {
+		// never fired
+		delete(e.alerts, r.Name)
+		return Alert{}, false
+	}
+
+	resolved := now
+	a.State = StateResolved
+	a.ResolvedAt = &resolved
+	a.Value = value
+	logger.Info("alert " + r.Name + " is resolved")
+
+	return *a, true
+}
+
+// prune удаляет устаревшие значения и решенные оповещения.
+func (e *Engine) prune(now time.Time) {
+	windows := make(map[string]time.Duration)
+	for _, r := range e.rules {
+		if time.Duration(r.Window) > windows[r.Metric] {
+			windows[r.Metric] = time.Duration(r.Window)
+		}
+	}
+
+	for metric, s := range e.series {
+		// keep one sample before the window start
+		from := now.Add(-windows[metric])
+		i := 0
+		for i < len(s.samples)-1 && s.samples[i+1].at.Before(from) {
+			i++
+		}
+		s.samples = s.samples[i:]
+	}
+
+	for name, a := range e.alerts {
+		if a.State == StateResolved && now.Sub(*a.ResolvedAt) >= e.ResolvedRetention {
+			delete(e.alerts, name)
+		}
+	}
+}
+
+// Alerts возвращает текущие оповещения, отсортированные по имени правила.
+// Если state не пустой, возвращаются только оповещения в этом состоянии.
+func (e *Engine) Alerts(state string) []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	result := make([]Alert, 0, len(e.alerts))
+	for _, a := range e.alerts {
+		if state == "" || a.State == state {
+			result = append(result, *a)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Rule < result[j].Rule
+	})
+
+	return result
+}
+
+// Handler возвращает оповещения в формате json, параметр state фильтрует по состоянию.
+func (e *Engine) Handler(w http.ResponseWriter, r *http.Request) {
+	ret, err := json.Marshal(e.Alerts(r.URL.Query().Get("state")))
+	if err != nil {
+		logger.Error("", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(ret)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch value := v.(type) {
+	case float64:
+		return value, true
+	case int64:
+		return float64(value), true
+	case int:
+		return float64(value), true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,256 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"gometric/internal/memstorage"
+)
+
+// fakeClock время, которое изменяется только вызовом Add.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestEngine(t *testing.T, rules ...Rule) (*Engine, *memstorage.MemStorage, *fakeClock) {
+	st := memstorage.NewMemStorage()
+
+	e, err := NewEngine(st, rules)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	clock := &fakeClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	e.Clock = clock
+
+	return e, st, clock
+}
+
+// step сдвигает время и проверяет правила.
+func step(t *testing.T, e *Engine, clock *fakeClock, d time.Duration) {
+	clock.Add(d)
+	if err := e.Eval(context.Background()); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+}
+
+func state(e *Engine, rule string) string {
+	for _, a := range e.Alerts("") {
+		if a.Rule == rule {
+			return a.State
+		}
+	}
+
+	return ""
+}
+
+func TestThreshold(t *testing.T) {
+	e, st, clock := newTestEngine(t, Rule{
+		Name:   "LowMemory",
+		Metric: "FreeMemory",
+		Type:   TypeThreshold,
+		Op:     "<",
+		Value:  100,
+		For:    Duration(time.Minute),
+	})
+	e.ResolvedRetention = 5 * time.Minute
+
+	st.Set("FreeMemory", float64(500))
+	step(t, e, clock, 0)
+	if s := state(e, "LowMemory"); s != "" {
+		t.Errorf("Error: alert must be inactive, got %s", s)
+	}
+
+	st.Set("FreeMemory", float64(50))
+	step(t, e, clock, 15*time.Second)
+	if s := state(e, "LowMemory"); s != StatePending {
+		t.Errorf("Error: alert must be pending, got %s", s)
+	}
+
+	// short spike does not fire
+	st.Set("FreeMemory", float64(500))
+	step(t, e, clock, 15*time.Second)
+	if s := state(e, "LowMemory"); s != "" {
+		t.Errorf("Error: pending alert must be dropped, got %s", s)
+	}
+
+	st.Set("FreeMemory", float64(50))
+	step(t, e, clock, 15*time.Second)
+	step(t, e, clock, 45*time.Second)
+	if s := state(e, "LowMemory"); s != StatePending {
+		t.Errorf("Error: alert must be pending, got %s", s)
+	}
+
+	step(t, e, clock, 15*time.Second)
+	firing := e.Alerts(StateFiring)
+	if len(firing) != 1 || *firing[0].Value != 50 || firing[0].FiredAt == nil {
+		t.Fatalf("Error: alert must be firing: %+v", firing)
+	}
+
+	st.Set("FreeMemory", float64(500))
+	step(t, e, clock, 15*time.Second)
+	if s := state(e, "LowMemory"); s != StateResolved {
+		t.Errorf("Error: alert must be resolved, got %s", s)
+	}
+
+	step(t, e, clock, 5*time.Minute)
+	if s := state(e, "LowMemory"); s != "" {
+		t.Errorf("Error: resolved alert must be removed, got %s", s)
+	}
+}
+
+func TestRate(t *testing.T) {
+	e, st, clock := newTestEngine(t, Rule{
+		Name:   "HighPollRate",
+		Metric: "PollCount",
+		Type:   TypeRate,
+		Op:     ">",
+		Value:  1,
+		Window: Duration(time.Minute),
+	})
+
+	// 0.5 per second
+	for i := 0; i < 5; i++ {
+		st.Set("PollCount", int64(i*10))
+		step(t, e, clock, 20*time.Second)
+	}
+	if s := state(e, "HighPollRate"); s != "" {
+		t.Errorf("Error: alert must be inactive, got %s", s)
+	}
+
+	// 2 per second
+	for i := 0; i < 4; i++ {
+		st.Set("PollCount", int64(40+i*40))
+		step(t, e, clock, 20*time.Second)
+	}
+	firing := e.Alerts(StateFiring)
+	if len(firing) != 1 || *firing[0].Value != 2 {
+		t.Errorf("Error: alert must be firing: %+v", firing)
+	}
+}
+
+// update записывает значение метрики в момент времени часов clock.
+func update(st *memstorage.MemStorage, clock *fakeClock, k string, v interface{}) {
+	st.Set(k, v)
+
+	meta := st.Meta[k]
+	meta.Updated = clock.now
+	st.Meta[k] = meta
+}
+
+func TestAbsent(t *testing.T) {
+	e, st, clock := newTestEngine(t, Rule{
+		Name:   "NoPolls",
+		Metric: "PollCount",
+		Type:   TypeAbsent,
+		Window: Duration(30 * time.Second),
+	})
+
+	step(t, e, clock, 0)
+	if s := state(e, "NoPolls"); s != "" {
+		t.Errorf("Error: missing metric must fire after the window, got %s", s)
+	}
+
+	step(t, e, clock, 30*time.Second)
+	if s := state(e, "NoPolls"); s != StateFiring {
+		t.Errorf("Error: missing metric must fire, got %s", s)
+	}
+
+	update(st, clock, "PollCount", int64(1))
+	step(t, e, clock, 10*time.Second)
+	if s := state(e, "NoPolls"); s != StateResolved {
+		t.Errorf("Error: alert must be resolved, got %s", s)
+	}
+
+	step(t, e, clock, 20*time.Second)
+	step(t, e, clock, 10*time.Second)
+	if s := state(e, "NoPolls"); s != StateFiring {
+		t.Errorf("Error: not updated metric must fire, got %s", s)
+	}
+
+	// an update with the same value is still an update
+	update(st, clock, "PollCount", int64(1))
+	step(t, e, clock, 10*time.Second)
+	if s := state(e, "NoPolls"); s != StateResolved {
+		t.Errorf("Error: updated metric must not fire, got %s", s)
+	}
+}
+
+func TestRulesValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{name: "empty name #1", rule: Rule{Metric: "a", Type: TypeThreshold, Op: ">"}},
+		{name: "unknown type #2", rule: Rule{Name: "a", Metric: "a", Type: "median"}},
+		{name: "unknown op #3", rule: Rule{Name: "a", Metric: "a", Type: TypeThreshold, Op: "=>"}},
+		{name: "rate without window #4", rule: Rule{Name: "a", Metric: "a", Type: TypeRate, Op: ">"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rule.Validate(); err == nil {
+				t.Errorf("Error: rule must be invalid")
+			}
+		})
+	}
+
+	rule := Rule{Name: "a", Metric: "a", Type: TypeAbsent, Window: Duration(time.Second)}
+	if err := ValidateRules([]Rule{rule, rule}); err == nil {
+		t.Errorf("Error: duplicate rules must be rejected")
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	file := "/tmp/test_alert_rules.json"
+	data := `{"rules":[{"name":"LowMemory","metric":"FreeMemory","type":"threshold","op":"<","value":100,"for":"1m"},
+		{"name":"NoPolls","metric":"PollCount","type":"absent","window":30}]}`
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer os.Remove(file)
+
+	rules, err := LoadRules(file)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if len(rules) != 2 || time.Duration(rules[0].For) != time.Minute || time.Duration(rules[1].Window) != 30*time.Second {
+		t.Errorf("Error: rules are incorrect: %+v", rules)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	e, st, clock := newTestEngine(t,
+		Rule{Name: "LowMemory", Metric: "FreeMemory", Type: TypeThreshold, Op: "<", Value: 100},
+		Rule{Name: "HighMemory", Metric: "FreeMemory", Type: TypeThreshold, Op: ">", Value: 100, For: Duration(time.Hour)},
+	)
+
+	st.Set("FreeMemory", float64(50))
+	step(t, e, clock, 0)
+
+	w := httptest.NewRecorder()
+	e.Handler(w, httptest.NewRequest("GET", "/alerts?state=firing", nil))
+
+	var alerts []Alert
+	if err := json.Unmarshal(w.Body.Bytes(), &alerts); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if w.Code != http.StatusOK || len(alerts) != 1 || alerts[0].Rule != "LowMemory" {
+		t.Errorf("Error: alerts are incorrect: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,156 @@
+package alert
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Типы правил.
+const (
+	// TypeThreshold сравнивает значение метрики с порогом.
+	TypeThreshold = "threshold"
+	// TypeRate сравнивает скорость изменения метрики в секунду за окно Window с порогом.
+	TypeRate = "rate"
+	// TypeAbsent срабатывает, если метрика не обновлялась или отсутствует дольше Window.
+	TypeAbsent = "absent"
+)
+
+// Duration длительность, которая в JSON записывается строкой вида "30s".
+type Duration time.Duration
+
+// UnmarshalJSON разбирает длительность из строки или числа секунд.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	switch value := v.(type) {
+	case float64:
+		*d = Duration(time.Duration(value * float64(time.Second)))
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+
+	return nil
+}
+
+// MarshalJSON записывает длительность строкой.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Rule описывает правило оповещения.
+type Rule struct {
+	Name   string `json:"name"`
+	Metric string `json:"metric"`
+	Type   string `json:"type"`
+	// Op оператор сравнения: >, >=, <, <=, ==, !=.
+	Op    string  `json:"op,omitempty"`
+	Value float64 `json:"value,omitempty"`
+	// Window окно для rate и absent.
+	Window Duration `json:"window,omitempty"`
+	// For время, в течение которого условие должно выполняться, чтобы оповещение сработало.
+	For Duration `json:"for,omitempty"`
+
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Validate проверяет правило.
+func (r Rule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("rule name must not be empty")
+	}
+
+	if r.Metric == "" {
+		return fmt.Errorf("rule %s: metric must not be empty", r.Name)
+	}
+
+	switch r.Type {
+	case TypeThreshold, TypeRate:
+		if _, err := compare(r.Op, 0, 0); err != nil {
+			return fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+	case TypeAbsent:
+	default:
+		return fmt.Errorf("rule %s: unknown type %q", r.Name, r.Type)
+	}
+
+	if (r.Type == TypeRate || r.Type == TypeAbsent) && r.Window <= 0 {
+		return fmt.Errorf("rule %s: window must be positive", r.Name)
+	}
+
+	if r.For < 0 {
+		return fmt.Errorf("rule %s: for must not be negative", r.Name)
+	}
+
+	return nil
+}
+
+// LoadRules читает правила из JSON файла вида {"rules": [...]}.
+func LoadRules(file string) ([]Rule, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg struct {
+		Rules []Rule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	if err := ValidateRules(cfg.Rules); err != nil {
+		return nil, err
+	}
+
+	return cfg.Rules, nil
+}
+
+// ValidateRules проверяет правила и уникальность их имен.
+func ValidateRules(rules []Rule) error {
+	names := make(map[string]bool, len(rules))
+
+	for _, r := range rules {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+
+		if names[r.Name] {
+			return fmt.Errorf("duplicate rule %s", r.Name)
+		}
+		names[r.Name] = true
+	}
+
+	return nil
+}
+
+// compare применяет оператор op к a и b.
+func compare(op string, a, b float64) (bool, error) {
+	switch op {
+	case ">":
+		return a > b, nil
+	case ">=":
+		return a >= b, nil
+	case "<":
+		return a < b, nil
+	case "<=":
+		return a <= b, nil
+	case "==":
+		return a == b, nil
+	case "!=":
+		return a != b, nil
+	}
+
+	return false, fmt.Errorf("unknown operator %q", op)
+}
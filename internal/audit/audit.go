@@ -0,0 +1,248 @@
+// Пакет audit предназначен для журнала аудита записей метрик и административных действий.
+//
+// Middleware Handler записывает каждый изменяющий запрос: для запросов с метриками
+// по одной записи на метрику, для остальных одну запись на запрос.
+// Запись содержит адрес клиента, идентификатор агента, идентификатор ключа подписи,
+// идентификатор запроса и результат. Записи хранятся в файле JSON lines
+// с ротацией по размеру (FileStore) или в таблице Postgres (PostgresStore).
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"gometric/internal/logger"
+	"gometric/internal/metrics"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// AgentHeader заголовок с идентификатором агента.
+const AgentHeader = "X-Agent-ID"
+
+// DefaultLimit максимальное число записей в ответе по умолчанию.
+const DefaultLimit = 1000
+
+// Результаты запросов.
+const (
+	OutcomeSuccess = "success"
+	// OutcomeRejected запрос отклонен: неверная подпись, данные или доступ.
+	OutcomeRejected = "rejected"
+	OutcomeError    = "error"
+)
+
+// Record описывает запись журнала аудита.
+type Record struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// Name идентификатор метрики, пустой для действий без метрик.
+	Name     string `json:"name,omitempty"`
+	Type     string `json:"type,omitempty"`
+	ClientIP string `json:"client_ip"`
+	Agent    string `json:"agent,omitempty"`
+	// KeyID идентификатор ключа, которым подписана метрика, пустой для неподписанных.
+	KeyID     string `json:"key_id,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Status    int    `json:"status"`
+	Outcome   string `json:"outcome"`
+}
+
+// Filter отбирает записи журнала.
+type Filter struct {
+	// From и To ограничивают время записи, нулевое значение не ограничивает.
+	From time.Time
+	To   time.Time
+	// Name шаблон glob идентификатора метрики.
+	Name     string
+	Agent    string
+	ClientIP string
+	// Limit максимальное число последних записей.
+	Limit int
+}
+
+// Match проверяет запись r.
+func (f Filter) Match(r Record) bool {
+	if !f.From.IsZero() && r.Time.Before(f.From) {
+		return false
+	}
+
+	if !f.To.IsZero() && r.Time.After(f.To) {
+		return false
+	}
+
+	if f.Name != "" {
+		if ok, _ := path.Match(f.Name, r.Name); !ok {
+			return false
+		}
+	}
+
+	if f.Agent != "" && r.Agent != f.Agent {
+		return false
+	}
+
+	return f.ClientIP == "" || r.ClientIP == f.ClientIP
+}
+
+// Store описывает хранилище журнала.
+type Store interface {
+	Write(ctx context.Context, records []Record) error
+	// Query возвращает записи, подходящие под фильтр, в порядке времени.
+	Query(ctx context.Context, f Filter) ([]Record, error)
+	Close() error
+}
+
+// KeyID возвращает идентификатор ключа подписи key, по которому нельзя восстановить ключ.
+func KeyID(key string) string {
+	if key == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+// Log описывает журнал аудита.
+type Log struct {
+	store Store
+	// keyID идентификатор ключа подписи сервера.
+	keyID metrics.Key
+}
+
+// New создает журнал над хранилищем store.
+func New(store Store) *Log {
+	return &Log{store: store}
+}
+
+// SetKey задает ключ подписи сервера, в записях сохраняется только его идентификатор.
+func (l *Log) SetKey(key string) {
+	l.keyID.Set(KeyID(key))
+}
+
+// Close закрывает хранилище журнала.
+func (l *Log) Close() error {
+	return l.store.Close()
+}
+
+// Handler записывает изменяющие запросы к next. Запросы GET и HEAD не записываются.
+// Адрес клиента берется из RemoteAddr, поэтому middleware.RealIP должен быть подключен раньше.
+func (l *Log) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger.Error("audit could not read request body", err)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		records := l.records(r, body, ww.Status())
+
+		// the request context may be canceled after the response
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := l.store.Write(ctx, records); err != nil {
+			logger.Error("audit write failed", err)
+		}
+	})
+}
+
+// records создает записи запроса r с телом body и статусом ответа status.
+func (l *Log) records(r *http.Request, body []byte, status int) []Record {
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	base := Record{
+		Time:      time.Now().UTC(),
+		Action:    strings.Trim(r.URL.Path, "/"),
+		ClientIP:  clientIP(r),
+		Agent:     r.Header.Get(AgentHeader),
+		RequestID: middleware.GetReqID(r.Context()),
+		Status:    status,
+		Outcome:   outcome(status),
+	}
+
+	if base.Agent == "" {
+		base.Agent = r.UserAgent()
+	}
+
+	ms := parseMetrics(body)
+	if len(ms) == 0 {
+		return []Record{base}
+	}
+
+	records := make([]Record, 0, len(ms))
+	for _, m := range ms {
+		rec := base
+		rec.Name = m.ID
+		rec.Type = m.MType
+		if m.Hash != "" {
+			rec.KeyID = l.keyID.Get()
+		}
+		records = append(records, rec)
+	}
+
+	return records
+}
+
+// parseMetrics возвращает метрики тела запроса в формате json: одну метрику или список.
+func parseMetrics(body []byte) []metrics.Metrics {
+	body = bytes.TrimSpace(body)
+
+	var list []metrics.Metrics
+	if len(body) > 0 && body[0] == '[' {
+		if err := json.Unmarshal(body, &list); err != nil {
+			return nil
+		}
+	} else {
+		var m metrics.Metrics
+		if err := json.Unmarshal(body, &m); err != nil || m.ID == "" {
+			return nil
+		}
+		list = append(list, m)
+	}
+
+	result := list[:0]
+	for _, m := range list {
+		if m.ID != "" {
+			result = append(result, m)
+		}
+	}
+
+	return result
+}
+
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+
+	return r.RemoteAddr
+}
+
+func outcome(status int) string {
+	switch {
+	case status < http.StatusBadRequest:
+		return OutcomeSuccess
+	case status < http.StatusInternalServerError:
+		return OutcomeRejected
+	}
+
+	return OutcomeError
+}
@@ -0,0 +1,173 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+func TestFileStore(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	// every record rotates the file
+	s, err := NewFileStore(name, 10, 2)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	now := time.Now()
+	for i, n := range []string{"Alloc", "PollCount", "Alloc", "CPU1"} {
+		err := s.Write(context.Background(), []Record{{Time: now.Add(time.Duration(i) * time.Second), Name: n, Status: i}})
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Error: old backups must be removed")
+	}
+
+	records, err := s.Query(context.Background(), Filter{})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if len(records) != 3 || records[0].Status != 1 || records[2].Status != 3 {
+		t.Errorf("Error: records are incorrect: %+v", records)
+	}
+
+	records, _ = s.Query(context.Background(), Filter{Name: "Alloc", From: now.Add(time.Second)})
+	if len(records) != 1 || records[0].Status != 2 {
+		t.Errorf("Error: filtered records are incorrect: %+v", records)
+	}
+
+	records, _ = s.Query(context.Background(), Filter{Limit: 1})
+	if len(records) != 1 || records[0].Status != 3 {
+		t.Errorf("Error: limited records are incorrect: %+v", records)
+	}
+
+	s.Close()
+
+	// the current file is appended after restart
+	s, err = NewFileStore(name, 1000, 2)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer s.Close()
+
+	s.Write(context.Background(), []Record{{Time: now, Name: "Alloc", Status: 4}})
+	records, _ = s.Query(context.Background(), Filter{})
+	if len(records) != 4 || records[3].Status != 4 {
+		t.Errorf("Error: records after restart are incorrect: %+v", records)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	s, err := NewFileStore(filepath.Join(t.TempDir(), "audit.jsonl"), 0, 0)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	l := New(s)
+	l.SetKey("secret")
+	defer l.Close()
+
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Group(func(r chi.Router) {
+		r.Use(l.Handler)
+		r.Post("/update/", func(w http.ResponseWriter, r *http.Request) {
+			io.ReadAll(r.Body)
+		})
+		r.Post("/updates/", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		})
+		r.Get("/audit", l.QueryHandler)
+	})
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	post := func(path, body string) {
+		req, _ := http.NewRequest("POST", ts.URL+path, bytes.NewBufferString(body))
+		req.Header.Set(AgentHeader, "host-1")
+		req.Header.Set("X-Request-Id", "req-1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		resp.Body.Close()
+	}
+
+	post("/update/", `{"id":"Alloc","type":"gauge","value":1,"hash":"abc"}`)
+	post("/updates/", `[{"id":"PollCount","type":"counter","delta":1},{"id":"Alloc","type":"gauge","value":2}]`)
+
+	resp, err := http.Get(ts.URL + "/audit?name=Alloc")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var records []Record
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("Error: records are incorrect: %+v", records)
+	}
+
+	r0, r1 := records[0], records[1]
+	if r0.Action != "update" || r0.Type != "gauge" || r0.ClientIP != "127.0.0.1" || r0.Agent != "host-1" ||
+		r0.KeyID != KeyID("secret") || r0.RequestID != "req-1" || r0.Status != http.StatusOK || r0.Outcome != OutcomeSuccess {
+		t.Errorf("Error: record is incorrect: %+v", r0)
+	}
+	if r1.Action != "updates" || r1.KeyID != "" || r1.Status != http.StatusForbidden || r1.Outcome != OutcomeRejected {
+		t.Errorf("Error: record is incorrect: %+v", r1)
+	}
+
+	resp, err = http.Get(ts.URL + "/audit?from=yesterday")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Error: invalid filter status %d", resp.StatusCode)
+	}
+}
+
+func TestGlobRegexp(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"CPU*", "CPUutilization1", true},
+		{"CPU?", "CPU12", false},
+		{"Req.*", "Requests", false},
+		{"[A-C]lloc", "Alloc", true},
+		{"[^A]lloc", "Alloc", false},
+		{"Requests{host=a}", "Requests{host=a}", true},
+	}
+
+	for _, tt := range tests {
+		ok := regexp.MustCompile(globRegexp(tt.pattern)).MatchString(tt.name)
+		if ok != tt.want {
+			t.Errorf("Error: %s (%s) on %s = %v", tt.pattern, globRegexp(tt.pattern), tt.name, ok)
+		}
+	}
+
+	if KeyID("") != "" || len(KeyID("secret")) != 8 {
+		t.Errorf("Error: key id is incorrect")
+	}
+}
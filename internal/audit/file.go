@@ -0,0 +1,193 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Значения по умолчанию для FileStore.
+const (
+	DefaultMaxSize    = 10 << 20
+	DefaultMaxBackups = 5
+)
+
+// FileStore хранит журнал в файле JSON lines. Когда размер файла превышает MaxSize,
+// файл переименовывается в path.1, предыдущие копии сдвигаются, и хранится
+// не больше MaxBackups копий.
+type FileStore struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewFileStore открывает файл журнала path.
+func NewFileStore(path string, maxSize int64, maxBackups int) (*FileStore, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+
+	if maxBackups < 0 {
+		maxBackups = DefaultMaxBackups
+	}
+
+	s := &FileStore{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *FileStore) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.file = f
+	s.size = info.Size()
+
+	return nil
+}
+
+// backup возвращает имя n-й копии журнала.
+func (s *FileStore) backup(n int) string {
+	return fmt.Sprintf("%s.%d", s.path, n)
+}
+
+// rotate сдвигает копии журнала и открывает новый файл. Вызывается под s.mu.
+func (s *FileStore) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	if s.maxBackups == 0 {
+		if err := os.Remove(s.path); err != nil {
+			return err
+		}
+		return s.open()
+	}
+
+	os.Remove(s.backup(s.maxBackups))
+	for n := s.maxBackups - 1; n > 0; n-- {
+		if err := os.Rename(s.backup(n), s.backup(n+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	if err := os.Rename(s.path, s.backup(1)); err != nil {
+		return err
+	}
+
+	return s.open()
+}
+
+// Write добавляет записи в журнал.
+func (s *FileStore) Write(ctx context.Context, records []Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		line = append(line, '\n')
+
+		if s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+			if err := s.rotate(); err != nil {
+				return err
+			}
+		}
+
+		n, err := s.file.Write(line)
+		s.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Query читает журнал и его копии от старых записей к новым.
+func (s *FileStore) Query(ctx context.Context, f Filter) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []Record
+
+	files := []string{s.path}
+	for n := 1; n <= s.maxBackups; n++ {
+		files = append([]string{s.backup(n)}, files...)
+	}
+
+	for _, name := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		records, err := readFile(name, f)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		result = append(result, records...)
+		if f.Limit > 0 && len(result) > f.Limit {
+			result = result[len(result)-f.Limit:]
+		}
+	}
+
+	return result, nil
+}
+
+func readFile(name string, f Filter) ([]Record, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var result []Record
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// a partially written line after a crash
+			continue
+		}
+
+		if f.Match(r) {
+			result = append(result, r)
+		}
+	}
+
+	return result, scanner.Err()
+}
+
+// Close закрывает файл журнала.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
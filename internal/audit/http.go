@@ -0,0 +1,98 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"gometric/internal/logger"
+)
+
+// QueryHandler возвращает записи журнала в формате json.
+// Параметры: from и to (RFC3339 или unix время в секундах), name (шаблон glob),
+// agent, client_ip и limit (по умолчанию DefaultLimit).
+func (l *Log) QueryHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := parseFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	records, err := l.store.Query(r.Context(), f)
+	if err != nil {
+		logger.Error("audit query failed", err)
+		writeError(w, http.StatusInternalServerError, "audit query failed")
+		return
+	}
+
+	if records == nil {
+		records = []Record{}
+	}
+
+	ret, err := json.Marshal(records)
+	if err != nil {
+		logger.Error("", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(ret)
+}
+
+func parseFilter(r *http.Request) (Filter, error) {
+	q := r.URL.Query()
+
+	f := Filter{
+		Name:     q.Get("name"),
+		Agent:    q.Get("agent"),
+		ClientIP: q.Get("client_ip"),
+		Limit:    DefaultLimit,
+	}
+
+	var err error
+	if v := q.Get("from"); v != "" {
+		if f.From, err = parseTime(v); err != nil {
+			return f, errors.New("invalid from time")
+		}
+	}
+
+	if v := q.Get("to"); v != "" {
+		if f.To, err = parseTime(v); err != nil {
+			return f, errors.New("invalid to time")
+		}
+	}
+
+	if f.Name != "" {
+		if _, err := path.Match(f.Name, ""); err != nil {
+			return f, errors.New("invalid name pattern")
+		}
+	}
+
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 {
+			return f, errors.New("invalid limit")
+		}
+	}
+
+	return f, nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	if sec, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(sec*float64(time.Second))), nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	ret, _ := json.Marshal(map[string]string{"error": msg})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(ret)
+}
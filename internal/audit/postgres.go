@@ -0,0 +1,133 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PostgresStore хранит журнал в таблице audit_log, которую создают миграции пакета postgres.
+type PostgresStore struct {
+	DB *pgxpool.Pool
+}
+
+// NewPostgresStore возвращает хранилище журнала в БД db.
+func NewPostgresStore(db *pgxpool.Pool) *PostgresStore {
+	return &PostgresStore{DB: db}
+}
+
+// Write добавляет записи в журнал одним пакетом.
+func (s *PostgresStore) Write(ctx context.Context, records []Record) error {
+	batch := &pgx.Batch{}
+	for _, r := range records {
+		batch.Queue(`INSERT INTO audit_log (time, action, name, type, client_ip, agent, key_id, request_id, status, outcome)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+			r.Time, r.Action, r.Name, r.Type, r.ClientIP, r.Agent, r.KeyID, r.RequestID, r.Status, r.Outcome)
+	}
+
+	return s.DB.SendBatch(ctx, batch).Close()
+}
+
+// Query возвращает последние записи, подходящие под фильтр, в порядке времени.
+func (s *PostgresStore) Query(ctx context.Context, f Filter) ([]Record, error) {
+	var where []string
+	var args []interface{}
+
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+
+	if !f.From.IsZero() {
+		add("time >= $%d", f.From)
+	}
+	if !f.To.IsZero() {
+		add("time <= $%d", f.To)
+	}
+	if f.Name != "" {
+		add("name ~ $%d", globRegexp(f.Name))
+	}
+	if f.Agent != "" {
+		add("agent = $%d", f.Agent)
+	}
+	if f.ClientIP != "" {
+		add("client_ip = $%d", f.ClientIP)
+	}
+
+	query := `SELECT time, action, name, type, client_ip, agent, key_id, request_id, status, outcome FROM audit_log`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY time DESC, id DESC"
+	if f.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", f.Limit)
+	}
+
+	rows, err := s.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Record
+	for rows.Next() {
+		var r Record
+		if err := rows.Scan(&r.Time, &r.Action, &r.Name, &r.Type, &r.ClientIP, &r.Agent,
+			&r.KeyID, &r.RequestID, &r.Status, &r.Outcome); err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+
+	return result, nil
+}
+
+// Close не закрывает пул соединений, он принадлежит хранилищу метрик.
+func (s *PostgresStore) Close() error {
+	return nil
+}
+
+// globRegexp преобразует шаблон glob в регулярное выражение.
+func globRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			// path.Match classes use the regexp syntax
+			b.WriteString(pattern[i : i+end+2])
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	b.WriteString("$")
+	return b.String()
+}
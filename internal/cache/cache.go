@@ -0,0 +1,491 @@
+// Пакет cache предназначен для кэширования метрик поверх любого хранилища storage.Storage.
+//
+// Чтения обслуживаются из памяти, промахи загружаются из хранилища.
+// При нулевом интервале записи сразу передаются в хранилище (write-through),
+// иначе накапливаются и сбрасываются одним MSet раз в интервал (write-behind).
+// Кэш не сохраняется между запусками, поэтому после рестарта значения
+// заново читаются из хранилища.
+//
+// Кэш рассчитан на единственный экземпляр сервера над хранилищем:
+// изменения, сделанные в хранилище в обход кэша, не отслеживаются.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gometric/internal/logger"
+	"gometric/internal/metrics"
+	"gometric/internal/storage"
+)
+
+// errNoMeta возвращается MetaCtx, если хранилище не ведет сведения об обновлениях.
+var errNoMeta = errors.New("storage does not track update time")
+
+// DefaultSize максимальное число метрик в кэше по умолчанию.
+const DefaultSize = 10000
+
+// entry элемент списка LRU.
+type entry struct {
+	key   string
+	value interface{}
+}
+
+// load описывает загрузку ключа из хранилища при промахе.
+type load struct {
+	// n число одновременных загрузок ключа
+	n int
+	// stale ключ изменен или удален во время загрузки, загруженное значение не кэшируется
+	stale bool
+}
+
+// Cache описывает кэширующий декоратор хранилища.
+type Cache struct {
+	backend  storage.Storage
+	size     int
+	interval time.Duration
+
+	mu      sync.Mutex
+	items   map[string]*list.Element
+	lru     *list.List
+	pending map[string]interface{}
+	// written время последней ожидающей записи ключа
+	written map[string]time.Time
+	loads   map[string]*load
+
+	// flushMu упорядочивает запись в хранилище: не допускает одновременных сбросов
+	// и сквозных записей, чтобы более старые значения не перезаписали более новые
+	// ни в хранилище, ни в кэше.
+	flushMu sync.Mutex
+}
+
+// New создает кэш над хранилищем backend на size метрик.
+// Если interval больше нуля, записи сбрасываются в хранилище раз в interval,
+// для этого должен быть запущен Run.
+func New(backend storage.Storage, size int, interval time.Duration) *Cache {
+	if size <= 0 {
+		size = DefaultSize
+	}
+
+	return &Cache{
+		backend:  backend,
+		size:     size,
+		interval: interval,
+		items:    make(map[string]*list.Element),
+		lru:      list.New(),
+		pending:  make(map[string]interface{}),
+		written:  make(map[string]time.Time),
+		loads:    make(map[string]*load),
+	}
+}
+
+// Unwrap возвращает хранилище, над которым построен кэш.
+func (c *Cache) Unwrap() storage.Storage {
+	return c.backend
+}
+
+// Run периодически сбрасывает накопленные записи в хранилище
+// до отмены контекста ctx, после чего выполняет последний сброс.
+func (c *Cache) Run(ctx context.Context) {
+	if c.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := c.Flush(context.Background()); err != nil {
+				logger.Error("cache final flush failed", err)
+			}
+			return
+		case <-ticker.C:
+			if err := c.Flush(ctx); err != nil {
+				logger.Error("cache flush failed", err)
+			}
+		}
+	}
+}
+
+// Flush записывает накопленные значения в хранилище одним MSet.
+// При ошибке значения остаются в очереди до следующего сброса.
+func (c *Cache) Flush(ctx context.Context) error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	return c.flush(ctx)
+}
+
+// flush записывает накопленные значения. Вызывается под c.flushMu.
+func (c *Cache) flush(ctx context.Context) error {
+	c.mu.Lock()
+	data, written := c.pending, c.written
+	c.pending = make(map[string]interface{})
+	c.written = make(map[string]time.Time)
+	c.mu.Unlock()
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	if err := c.backend.MSetCtx(ctx, data); err != nil {
+		c.mu.Lock()
+		for k, v := range data {
+			// a newer value is already pending
+			if _, ok := c.pending[k]; !ok {
+				c.pending[k] = v
+				c.written[k] = written[k]
+			}
+		}
+		c.mu.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+// Pending возвращает число значений, ожидающих записи в хранилище.
+func (c *Cache) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.pending)
+}
+
+// Invalidate удаляет ключи из кэша, без аргументов очищает кэш целиком.
+// Ожидающие записи не удаляются.
+func (c *Cache) Invalidate(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(keys) == 0 {
+		c.items = make(map[string]*list.Element)
+		c.lru.Init()
+		for _, l := range c.loads {
+			l.stale = true
+		}
+		return
+	}
+
+	for _, k := range keys {
+		if e, ok := c.items[k]; ok {
+			c.lru.Remove(e)
+			delete(c.items, k)
+		}
+		c.stale(k)
+	}
+}
+
+// Close сбрасывает накопленные значения и закрывает хранилище.
+func (c *Cache) Close() error {
+	if err := c.Flush(context.Background()); err != nil {
+		logger.Error("cache flush on close failed", err)
+	}
+
+	return c.backend.Close()
+}
+
+// Set задает значение value для ключа key.
+func (c *Cache) Set(k string, v interface{}) error {
+	return c.SetCtx(context.Background(), k, v)
+}
+
+// SetCtx задает значение value для ключа key с учетом контекста ctx.
+func (c *Cache) SetCtx(ctx context.Context, k string, v interface{}) error {
+	return c.MSetCtx(ctx, map[string]interface{}{k: v})
+}
+
+// MSet устанавливает несколько ключей одновременно.
+func (c *Cache) MSet(data map[string]interface{}) error {
+	return c.MSetCtx(context.Background(), data)
+}
+
+// MSetCtx устанавливает несколько ключей одновременно с учетом контекста ctx.
+func (c *Cache) MSetCtx(ctx context.Context, data map[string]interface{}) error {
+	if c.interval <= 0 {
+		// the backend write and the cache update must happen in the same order
+		c.flushMu.Lock()
+		defer c.flushMu.Unlock()
+
+		if err := c.backend.MSetCtx(ctx, data); err != nil {
+			// the backend state is unknown
+			keys := make([]string, 0, len(data))
+			for k := range data {
+				keys = append(keys, k)
+			}
+			c.Invalidate(keys...)
+
+			return err
+		}
+
+		c.mu.Lock()
+		for k, v := range data {
+			c.put(k, v)
+			c.stale(k)
+		}
+		c.mu.Unlock()
+
+		return nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := storage.ValidData(data); err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	c.mu.Lock()
+	for k, v := range data {
+		c.put(k, v)
+		c.stale(k)
+		c.pending[k] = v
+		c.written[k] = now
+	}
+	c.mu.Unlock()
+
+	return nil
+}
+
+// Get извлекает значение value для ключа key.
+func (c *Cache) Get(k string) (interface{}, error) {
+	return c.GetCtx(context.Background(), k)
+}
+
+// GetCtx извлекает значение value для ключа key с учетом контекста ctx.
+// При промахе значение загружается из хранилища.
+func (c *Cache) GetCtx(ctx context.Context, k string) (interface{}, error) {
+	c.mu.Lock()
+	if v, ok := c.pending[k]; ok {
+		c.mu.Unlock()
+		return v, nil
+	}
+	if e, ok := c.items[k]; ok {
+		c.lru.MoveToFront(e)
+		v := e.Value.(*entry).value
+		c.mu.Unlock()
+		return v, nil
+	}
+	l, ok := c.loads[k]
+	if !ok {
+		l = &load{}
+		c.loads[k] = l
+	}
+	l.n++
+	c.mu.Unlock()
+
+	v, err := c.backend.GetCtx(ctx, k)
+
+	c.mu.Lock()
+	// do not cache a value written or deleted while loading
+	if _, ok := c.items[k]; !ok && err == nil && !l.stale {
+		c.put(k, v)
+	}
+	if l.n--; l.n == 0 {
+		delete(c.loads, k)
+	}
+	c.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// List выводит список всех ключей.
+func (c *Cache) List() []string {
+	s, err := c.ListCtx(context.Background())
+	if err != nil {
+		logger.Error("cache list failed", err)
+	}
+
+	return s
+}
+
+// ListCtx выводит список всех ключей хранилища вместе с ожидающими записи.
+func (c *Cache) ListCtx(ctx context.Context) ([]string, error) {
+	s, err := c.backend.ListCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.pending) == 0 {
+		return s, nil
+	}
+
+	keys := make(map[string]struct{}, len(s)+len(c.pending))
+	for _, k := range s {
+		keys[k] = struct{}{}
+	}
+	for k := range c.pending {
+		keys[k] = struct{}{}
+	}
+
+	s = make([]string, 0, len(keys))
+	for k := range keys {
+		s = append(s, k)
+	}
+
+	sort.Strings(s)
+	return s, nil
+}
+
+// Delete удаляет метрику.
+func (c *Cache) Delete(k string) error {
+	return c.DeleteCtx(context.Background(), k)
+}
+
+// DeleteCtx удаляет метрику из кэша, очереди записи и хранилища.
+// Метрика, которая еще не записана в хранилище, считается удаленной.
+func (c *Cache) DeleteCtx(ctx context.Context, k string) error {
+	// a concurrent flush must not write the deleted value back
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.mu.Lock()
+	_, pending := c.pending[k]
+	delete(c.pending, k)
+	delete(c.written, k)
+	c.mu.Unlock()
+	c.Invalidate(k)
+
+	err := c.backend.DeleteCtx(ctx, k)
+	// a load started before the delete may return the old value
+	c.Invalidate(k)
+
+	if pending && errors.Is(err, metrics.ErrNotFound) {
+		return nil
+	}
+
+	return err
+}
+
+// DeleteStaleCtx удаляет метрику, если она не обновлялась после before.
+// Метрика со значением, ожидающим записи, считается обновленной.
+func (c *Cache) DeleteStaleCtx(ctx context.Context, k string, before time.Time) error {
+	// no flush is in flight, so a key that is not pending is stored in the backend;
+	// a write queued after the check stays pending and recreates the metric
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.mu.Lock()
+	_, pending := c.pending[k]
+	c.mu.Unlock()
+
+	if pending {
+		return fmt.Errorf("metric %s: %w", k, metrics.ErrUpdated)
+	}
+
+	err := storage.DeleteStale(ctx, c.backend, k, before)
+	if err == nil || errors.Is(err, metrics.ErrNotFound) {
+		c.Invalidate(k)
+	}
+
+	return err
+}
+
+// Rename переименовывает метрику.
+func (c *Cache) Rename(k, newKey string) error {
+	return c.RenameCtx(context.Background(), k, newKey)
+}
+
+// RenameCtx записывает ожидающие значения и переименовывает метрику в хранилище.
+func (c *Cache) RenameCtx(ctx context.Context, k, newKey string) error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	if err := c.flush(ctx); err != nil {
+		return err
+	}
+
+	err := c.backend.RenameCtx(ctx, k, newKey)
+	c.Invalidate(k, newKey)
+
+	return err
+}
+
+// MetaCtx возвращает сведения об обновлениях метрик keys или всех метрик, если keys пуст.
+// Для значений, ожидающих записи, время обновления берется из очереди, а число обновлений
+// учитывает предстоящую запись. Если хранилище не ведет сведения, возвращается ошибка.
+func (c *Cache) MetaCtx(ctx context.Context, keys ...string) (map[string]metrics.Meta, error) {
+	reader, ok := storage.Meta(c.backend)
+	if !ok {
+		return nil, errNoMeta
+	}
+
+	meta, err := reader.MetaCtx(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	if meta == nil {
+		meta = make(map[string]metrics.Meta)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	merge := func(k string) {
+		t, ok := c.written[k]
+		if !ok {
+			return
+		}
+		m := meta[k]
+		m.Updated = t
+		m.Updates++
+		meta[k] = m
+	}
+
+	if len(keys) == 0 {
+		for k := range c.written {
+			merge(k)
+		}
+		return meta, nil
+	}
+
+	for _, k := range keys {
+		merge(k)
+	}
+
+	return meta, nil
+}
+
+// stale помечает загрузки ключа k, начатые до его изменения. Вызывается под c.mu.
+func (c *Cache) stale(k string) {
+	if l, ok := c.loads[k]; ok {
+		l.stale = true
+	}
+}
+
+// put помещает значение в кэш, вытесняя давно не использованные ключи.
+// Вызывается под c.mu.
+func (c *Cache) put(k string, v interface{}) {
+	if e, ok := c.items[k]; ok {
+		e.Value.(*entry).value = v
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.items[k] = c.lru.PushFront(&entry{key: k, value: v})
+
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.items, e.Value.(*entry).key)
+	}
+}
@@ -0,0 +1,305 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"gometric/internal/memstorage"
+	"gometric/internal/metrics"
+)
+
+// backend считает обращения к хранилищу и может возвращать ошибку записи.
+type backend struct {
+	*memstorage.MemStorage
+	gets   int
+	msets  int
+	failed bool
+	// loaded вызывается после чтения значения из хранилища
+	loaded func()
+}
+
+func newBackend() *backend {
+	return &backend{MemStorage: memstorage.NewMemStorage()}
+}
+
+func (b *backend) GetCtx(ctx context.Context, k string) (interface{}, error) {
+	b.gets++
+	v, err := b.MemStorage.GetCtx(ctx, k)
+	if b.loaded != nil {
+		b.loaded()
+	}
+	return v, err
+}
+
+func (b *backend) MSetCtx(ctx context.Context, data map[string]interface{}) error {
+	b.msets++
+	if b.failed {
+		return fmt.Errorf("backend is unavailable")
+	}
+	return b.MemStorage.MSetCtx(ctx, data)
+}
+
+func (b *backend) Close() error {
+	return nil
+}
+
+func TestWriteThrough(t *testing.T) {
+	b := newBackend()
+	b.MemStorage.Set("PollCount", int64(5))
+
+	c := New(b, 10, 0)
+
+	for i := 0; i < 3; i++ {
+		if v, err := c.Get("PollCount"); err != nil || v != int64(5) {
+			t.Fatalf("Error: value is incorrect: %v", v)
+		}
+	}
+
+	if b.gets != 1 {
+		t.Errorf("Error: backend is read %d times, want 1", b.gets)
+	}
+
+	if err := c.Set("Alloc", float64(1.5)); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if v, _ := b.MemStorage.Get("Alloc"); v != float64(1.5) {
+		t.Errorf("Error: value must be written to backend")
+	}
+
+	if _, err := c.Get("Unknown"); err == nil {
+		t.Errorf("Error: key is not exist")
+	}
+
+	// failed write invalidates the key
+	b.failed = true
+	if err := c.Set("PollCount", int64(6)); err == nil {
+		t.Errorf("Error: backend error must be returned")
+	}
+
+	if v, _ := c.Get("PollCount"); v != int64(5) {
+		t.Errorf("Error: value must be reloaded from backend: %v", v)
+	}
+}
+
+func TestWriteThroughConcurrent(t *testing.T) {
+	b := newBackend()
+	c := New(b, 10, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				c.Set("Alloc", float64(i*100+j))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	cached, _ := c.Get("Alloc")
+	stored, _ := b.MemStorage.Get("Alloc")
+	if cached != stored {
+		t.Errorf("Error: cache %v differs from backend %v", cached, stored)
+	}
+}
+
+func TestWriteBehind(t *testing.T) {
+	b := newBackend()
+	b.MemStorage.Set("Old", int64(1))
+
+	c := New(b, 10, time.Hour)
+
+	c.Set("PollCount", int64(1))
+	c.Set("PollCount", int64(2))
+	c.MSet(map[string]interface{}{"Alloc": float64(1.5)})
+
+	if b.msets != 0 || c.Pending() != 2 {
+		t.Fatalf("Error: writes must be coalesced, pending %d", c.Pending())
+	}
+
+	if v, _ := c.Get("PollCount"); v != int64(2) {
+		t.Errorf("Error: pending value must be read: %v", v)
+	}
+
+	if list := c.List(); !reflect.DeepEqual(list, []string{"Alloc", "Old", "PollCount"}) {
+		t.Errorf("Error: list is incorrect: %v", list)
+	}
+
+	if err := c.MSet(map[string]interface{}{"": int64(1)}); err == nil {
+		t.Errorf("Error: empty key must be rejected")
+	}
+
+	// failed flush keeps values
+	b.failed = true
+	if err := c.Flush(context.Background()); err == nil || c.Pending() != 2 {
+		t.Errorf("Error: values must stay pending")
+	}
+
+	b.failed = false
+	if err := c.Close(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if b.msets != 2 || c.Pending() != 0 {
+		t.Errorf("Error: values must be flushed on close")
+	}
+
+	if v, _ := b.MemStorage.Get("PollCount"); v != int64(2) {
+		t.Errorf("Error: value is not flushed: %v", v)
+	}
+}
+
+func TestRun(t *testing.T) {
+	b := newBackend()
+	c := New(b, 10, 10*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+
+	c.Set("PollCount", int64(1))
+
+	deadline := time.Now().Add(time.Second)
+	for c.Pending() != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+
+	if v, err := b.MemStorage.Get("PollCount"); err != nil || v != int64(1) {
+		t.Errorf("Error: value is not flushed")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	b := newBackend()
+	c := New(b, 2, 0)
+
+	c.Set("a", int64(1))
+	c.Set("b", int64(2))
+	c.Get("a")
+	c.Set("c", int64(3))
+
+	// b is least recently used
+	b.gets = 0
+	c.Get("a")
+	c.Get("c")
+	if b.gets != 0 {
+		t.Errorf("Error: hot keys must be cached")
+	}
+
+	c.Get("b")
+	if b.gets != 1 {
+		t.Errorf("Error: evicted key must be loaded from backend")
+	}
+
+	c.Invalidate()
+	b.gets = 0
+	c.Get("a")
+	if b.gets != 1 {
+		t.Errorf("Error: cache must be cleared")
+	}
+}
+
+func TestDeleteRename(t *testing.T) {
+	b := newBackend()
+	b.MemStorage.Set("Alloc", float64(1))
+
+	c := New(b, 10, time.Hour)
+
+	c.Set("PollCount", int64(1))
+	c.Get("Alloc")
+
+	// the pending value is never written
+	if err := c.Delete("PollCount"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err := c.Flush(context.Background()); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if _, err := c.Get("PollCount"); err == nil {
+		t.Errorf("Error: deleted metric must not be flushed")
+	}
+
+	if err := c.Delete("PollCount"); !errors.Is(err, metrics.ErrNotFound) {
+		t.Errorf("Error: missing metric must be reported: %v", err)
+	}
+
+	c.Set("Alloc", float64(2))
+	if err := c.Rename("Alloc", "HeapAlloc"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if _, err := c.Get("Alloc"); err == nil {
+		t.Errorf("Error: cached old name must be invalidated")
+	}
+	if v, err := c.Get("HeapAlloc"); err != nil || v != float64(2) {
+		t.Errorf("Error: pending value must be renamed: %v", v)
+	}
+}
+
+func TestDeleteWhileLoading(t *testing.T) {
+	b := newBackend()
+	b.MemStorage.Set("PollCount", int64(1))
+
+	c := New(b, 10, 0)
+
+	// the metric is deleted after the backend read, but before the value is cached
+	b.loaded = func() {
+		b.loaded = nil
+		if err := c.Delete("PollCount"); err != nil {
+			t.Errorf("Error: %s", err)
+		}
+	}
+
+	if v, err := c.Get("PollCount"); err != nil || v != int64(1) {
+		t.Fatalf("Error: %v %v", v, err)
+	}
+
+	if v, err := c.Get("PollCount"); err == nil {
+		t.Errorf("Error: deleted value is cached: %v", v)
+	}
+}
+
+func TestMetaPending(t *testing.T) {
+	b := newBackend()
+	b.MemStorage.Set("Alloc", float64(1))
+
+	c := New(b, 10, time.Hour)
+
+	before := time.Now()
+	c.Set("Alloc", float64(2))
+	c.Set("PollCount", int64(1))
+
+	meta, err := c.MetaCtx(context.Background())
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if m := meta["Alloc"]; m.Updates != 2 || m.Updated.Before(before) {
+		t.Errorf("Error: pending write is not counted: %+v", m)
+	}
+	if m := meta["PollCount"]; m.Updates != 1 || m.Updated.Before(before) {
+		t.Errorf("Error: pending metric has no meta: %+v", m)
+	}
+
+	if err := c.Flush(context.Background()); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	meta, err = c.MetaCtx(context.Background(), "Alloc")
+	if err != nil || len(meta) != 1 || meta["Alloc"].Updates != 2 {
+		t.Errorf("Error: meta is incorrect after flush: %v %v", meta, err)
+	}
+}
@@ -0,0 +1,450 @@
+// Пакет config загружает настройки сервера и агента.
+//
+// Настройки описываются структурой с тегами go-flags и применяются в порядке возрастания
+// приоритета: значения по умолчанию (тег default), файл настроек, переменные окружения
+// (тег env) и флаги командной строки. Файл настроек может быть в формате JSON, YAML или TOML,
+// формат определяется по расширению файла. Ключ поля в файле задается тегом json,
+// иначе совпадает с именем флага, в котором дефис заменен подчеркиванием.
+//
+// Дополнительные теги полей:
+//   - config:"file" путь к файлу настроек, не читается из файла;
+//   - config:"-" поле не читается из файла и не выводится;
+//   - unit:"s" целое число секунд, в файле и окружении задается как "10s" или 10;
+//   - secret:"yes" значение скрывается при выводе настроек.
+//
+// Длительности в файле задаются строками, например "10s" или "5m".
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v3"
+)
+
+// Форматы файла настроек.
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// Validator описывает настройки, которые проверяют себя после загрузки.
+type Validator interface {
+	Validate() error
+}
+
+// Errors описывает ошибки настроек.
+type Errors []string
+
+// Addf добавляет ошибку.
+func (e *Errors) Addf(format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf(format, args...))
+}
+
+// Err возвращает e или nil, если ошибок нет.
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+func (e Errors) Error() string {
+	return "invalid config:\n  - " + strings.Join(e, "\n  - ")
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// field описывает поле настроек.
+type field struct {
+	name    string
+	long    string
+	key     string
+	env     string
+	file    bool
+	skip    bool
+	seconds bool
+	secret  bool
+}
+
+// fields возвращает поля структуры t с флагами.
+func fields(t reflect.Type) []field {
+	var fs []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+
+		long := sf.Tag.Get("long")
+		if long == "" || sf.PkgPath != "" {
+			continue
+		}
+
+		f := field{
+			name:    sf.Name,
+			long:    long,
+			key:     strings.ReplaceAll(long, "-", "_"),
+			env:     sf.Tag.Get("env"),
+			file:    sf.Tag.Get("config") == "file",
+			skip:    sf.Tag.Get("config") == "-",
+			seconds: sf.Tag.Get("unit") == "s",
+			secret:  sf.Tag.Get("secret") == "yes",
+		}
+
+		if name, _, _ := strings.Cut(sf.Tag.Get("json"), ","); name != "" && name != "-" {
+			f.key = name
+		}
+
+		fs = append(fs, f)
+	}
+
+	return fs
+}
+
+// Load заполняет структуру cfg из значений по умолчанию, файла настроек, переменных окружения
+// и аргументов командной строки args. Ошибки значений собираются вместе и возвращаются как Errors.
+// Если cfg реализует Validator, загруженные настройки проверяются.
+// Запрос справки возвращается как *flags.Error с типом flags.ErrHelp.
+func Load(cfg interface{}, args []string) error {
+	parser := flags.NewParser(cfg, flags.HelpFlag)
+
+	var options []*flags.Option
+	for _, g := range parser.Groups() {
+		options = append(options, g.Options()...)
+	}
+
+	// environment is applied after the file
+	for _, o := range options {
+		o.EnvDefaultKey = ""
+	}
+
+	if _, err := parser.ParseArgs(args); err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(cfg).Elem()
+	fs := fields(v.Type())
+
+	// flags have the highest priority
+	cli := make(map[string]reflect.Value)
+	for _, o := range options {
+		if o.IsSet() && !o.IsSetDefault() {
+			name := o.Field().Name
+			cli[name] = reflect.ValueOf(v.FieldByName(name).Interface())
+		}
+	}
+
+	var errs Errors
+
+	for _, f := range fs {
+		if !f.file {
+			continue
+		}
+
+		if _, ok := cli[f.name]; !ok && f.env != "" {
+			if s, ok := os.LookupEnv(f.env); ok {
+				v.FieldByName(f.name).SetString(s)
+			}
+		}
+
+		if path := v.FieldByName(f.name).String(); path != "" {
+			if err := loadFile(v, fs, path); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, f := range fs {
+		if f.env == "" || f.file {
+			continue
+		}
+
+		s, ok := os.LookupEnv(f.env)
+		if !ok {
+			continue
+		}
+
+		if err := set(v.FieldByName(f.name), s, f.seconds); err != nil {
+			errs.Addf("environment %s: %v", f.env, err)
+		}
+	}
+
+	for name, value := range cli {
+		v.FieldByName(name).Set(value)
+	}
+
+	for _, o := range options {
+		if len(o.Choices) == 0 {
+			continue
+		}
+
+		value := fmt.Sprint(v.FieldByName(o.Field().Name).Interface())
+		if value != "" && !contains(o.Choices, value) {
+			errs.Addf("%s: invalid value %q, want one of %s", o.LongName, value, strings.Join(o.Choices, ", "))
+		}
+	}
+
+	if err := errs.Err(); err != nil {
+		return err
+	}
+
+	if c, ok := cfg.(Validator); ok {
+		return c.Validate()
+	}
+
+	return nil
+}
+
+// loadFile применяет к структуре v настройки из файла path.
+func loadFile(v reflect.Value, fs []field, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+
+	values, err := decode(data, filepath.Ext(path))
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	byKey := make(map[string]field)
+	for _, f := range fs {
+		if !f.file && !f.skip {
+			byKey[f.key] = f
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var errs Errors
+	for _, k := range keys {
+		f, ok := byKey[k]
+		if !ok {
+			if s := suggest(byKey, k); s != "" {
+				errs.Addf("%s: unknown option %q, did you mean %q?", path, k, s)
+			} else {
+				errs.Addf("%s: unknown option %q", path, k)
+			}
+			continue
+		}
+
+		raw := values[k]
+		if raw == nil {
+			continue
+		}
+
+		s, err := scalar(raw, v.FieldByName(f.name).Type() == durationType)
+		if err == nil {
+			err = set(v.FieldByName(f.name), s, f.seconds)
+		}
+		if err != nil {
+			errs.Addf("%s: %s: %v", path, k, err)
+		}
+	}
+
+	return errs.Err()
+}
+
+// decode разбирает настройки в формате, определяемом расширением ext.
+func decode(data []byte, ext string) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+
+	switch strings.ToLower(ext) {
+	case ".json", "":
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		if err := d.Decode(&values); err != nil {
+			return nil, err
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &values); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		if err := toml.Unmarshal(data, &values); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported format %q, want .json, .yaml, .yml or .toml", ext)
+	}
+
+	return values, nil
+}
+
+// scalar возвращает значение raw из файла в виде строки.
+// Длительности принимаются только строками, чтобы не путать секунды и наносекунды.
+func scalar(raw interface{}, duration bool) (string, error) {
+	if s, ok := raw.(string); ok {
+		return s, nil
+	}
+
+	if duration {
+		return "", fmt.Errorf("want duration string such as \"10s\", got %v", raw)
+	}
+
+	switch x := raw.(type) {
+	case bool:
+		return strconv.FormatBool(x), nil
+	case json.Number:
+		return x.String(), nil
+	case int:
+		return strconv.Itoa(x), nil
+	case int64:
+		return strconv.FormatInt(x, 10), nil
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64), nil
+	}
+
+	return "", fmt.Errorf("want a single value, got %T", raw)
+}
+
+// set устанавливает значение s в поле v. Если seconds, значение задается
+// числом секунд или длительностью, кратной секунде.
+func set(v reflect.Value, s string, seconds bool) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		if seconds {
+			n, err := parseSeconds(s)
+			if err != nil {
+				return err
+			}
+			v.SetInt(n)
+			return nil
+		}
+
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		v.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+func parseSeconds(s string) (int64, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	if d%time.Second != 0 {
+		return 0, fmt.Errorf("invalid duration %q: want whole seconds", s)
+	}
+
+	return int64(d / time.Second), nil
+}
+
+// suggest возвращает известный ключ, похожий на key или совпадающий с именем флага.
+func suggest(byKey map[string]field, key string) string {
+	norm := strings.ToLower(strings.NewReplacer("-", "_", ".", "_").Replace(key))
+	if _, ok := byKey[norm]; ok {
+		return norm
+	}
+
+	for k, f := range byKey {
+		if f.long == key || strings.ReplaceAll(f.long, "-", "_") == norm {
+			return k
+		}
+	}
+
+	return ""
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Print выводит в w настройки cfg в формате format, пригодном для файла настроек.
+// Значения полей с тегом secret скрываются.
+func Print(w io.Writer, cfg interface{}, format string) error {
+	v := reflect.ValueOf(cfg).Elem()
+
+	values := make(map[string]interface{})
+	for _, f := range fields(v.Type()) {
+		if f.file || f.skip {
+			continue
+		}
+
+		fv := v.FieldByName(f.name)
+		switch {
+		case f.secret:
+			if fv.String() != "" {
+				values[f.key] = "******"
+			} else {
+				values[f.key] = ""
+			}
+		case fv.Type() == durationType:
+			values[f.key] = time.Duration(fv.Int()).String()
+		case f.seconds:
+			values[f.key] = (time.Duration(fv.Int()) * time.Second).String()
+		default:
+			values[f.key] = fv.Interface()
+		}
+	}
+
+	switch format {
+	case FormatJSON:
+		data, err := json.MarshalIndent(values, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	case FormatYAML:
+		e := yaml.NewEncoder(w)
+		e.SetIndent(2)
+		if err := e.Encode(values); err != nil {
+			return err
+		}
+		return e.Close()
+	case FormatTOML:
+		return toml.NewEncoder(w).Encode(values)
+	}
+
+	return errors.New("unsupported format " + format)
+}
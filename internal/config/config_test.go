@@ -0,0 +1,172 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	ConfigFile string        `long:"config" env:"TEST_CONFIG" config:"file"`
+	Address    string        `long:"address" env:"TEST_ADDRESS" default:"127.0.0.1:8080"`
+	Interval   int           `long:"interval" env:"TEST_INTERVAL" default:"10" unit:"s"`
+	Timeout    time.Duration `long:"timeout" env:"TEST_TIMEOUT" default:"5s"`
+	Restore    bool          `long:"restore" env:"TEST_RESTORE"`
+	Size       int64         `long:"size" env:"TEST_SIZE" default:"1"`
+	Mode       string        `long:"mode" env:"TEST_MODE" default:"label" choice:"label" choice:"none"`
+	Key        string        `long:"crypto-key" env:"TEST_KEY" json:"key" secret:"yes"`
+	Version    bool          `long:"version" config:"-"`
+}
+
+func (c *testConfig) Validate() error {
+	if c.Size > 100 {
+		return Errors{"size: too big"}
+	}
+
+	return nil
+}
+
+func writeFile(t *testing.T, name, data string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	return path
+}
+
+func TestLoadFormats(t *testing.T) {
+	want := testConfig{Address: "10.0.0.1:80", Interval: 60, Timeout: 2 * time.Second, Restore: true, Size: 7, Mode: "none", Key: "k"}
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"config.json", `{"address":"10.0.0.1:80","interval":"1m","timeout":"2s","restore":true,"size":7,"mode":"none","key":"k"}`},
+		{"config.yaml", "address: 10.0.0.1:80\ninterval: 60\ntimeout: 2s\nrestore: true\nsize: 7\nmode: none\nkey: k\n"},
+		{"config.toml", "address = \"10.0.0.1:80\"\ninterval = \"60s\"\ntimeout = \"2s\"\nrestore = true\nsize = 7\nmode = \"none\"\nkey = \"k\"\n"},
+	}
+
+	for _, tt := range tests {
+		path := writeFile(t, tt.name, tt.data)
+
+		var cfg testConfig
+		if err := Load(&cfg, []string{"--config", path}); err != nil {
+			t.Errorf("Error: %s: %s", tt.name, err)
+			continue
+		}
+
+		want.ConfigFile = path
+		if cfg != want {
+			t.Errorf("Error: %s: config is incorrect: %+v", tt.name, cfg)
+		}
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, "config.yaml", "address: file:80\ninterval: 20s\ntimeout: 3s\n")
+
+	t.Setenv("TEST_CONFIG", path)
+	t.Setenv("TEST_INTERVAL", "30")
+	t.Setenv("TEST_TIMEOUT", "4s")
+
+	var cfg testConfig
+	if err := Load(&cfg, []string{"--timeout", "6s"}); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	// default < file < env < flags
+	if cfg.Size != 1 || cfg.Address != "file:80" || cfg.Interval != 30 || cfg.Timeout != 6*time.Second {
+		t.Errorf("Error: config precedence is incorrect: %+v", cfg)
+	}
+
+	// a flag equal to the default still wins over the file
+	cfg = testConfig{}
+	if err := Load(&cfg, []string{"--address", "127.0.0.1:8080"}); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if cfg.Address != "127.0.0.1:8080" {
+		t.Errorf("Error: explicit flag is overridden: %s", cfg.Address)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	path := writeFile(t, "config.json", `{"adress":"x","interval":"1.5s","timeout":5,"restore":"maybe","version":true}`)
+
+	var cfg testConfig
+	err := Load(&cfg, []string{"--config", path})
+	if err == nil {
+		t.Fatalf("Error: invalid config must be rejected")
+	}
+
+	var errs Errors
+	if !errors.As(err, &errs) || len(errs) != 5 {
+		t.Fatalf("Error: all problems must be reported: %v", err)
+	}
+
+	for _, s := range []string{`"adress"`, "interval", `"10s"`, "restore", "version"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("Error: %q is not reported: %s", s, err)
+		}
+	}
+
+	path = writeFile(t, "config.json", `{"Restore":true,"crypto-key":"k"}`)
+	if err := Load(&cfg, []string{"--config", path}); err == nil || !strings.Contains(err.Error(), `did you mean "restore"`) || !strings.Contains(err.Error(), `did you mean "key"`) {
+		t.Errorf("Error: similar key must be suggested: %v", err)
+	}
+
+	t.Setenv("TEST_MODE", "prefix")
+	cfg = testConfig{}
+	if err := Load(&cfg, nil); err == nil || !strings.Contains(err.Error(), "label, none") {
+		t.Errorf("Error: invalid choice must be rejected: %v", err)
+	}
+
+	t.Setenv("TEST_MODE", "")
+	t.Setenv("TEST_SIZE", "1000")
+	cfg = testConfig{}
+	if err := Load(&cfg, nil); err == nil || !strings.Contains(err.Error(), "too big") {
+		t.Errorf("Error: config must be validated: %v", err)
+	}
+
+	if err := Load(&cfg, []string{"--config", writeFile(t, "config.ini", "")}); err == nil {
+		t.Errorf("Error: unknown format must be rejected")
+	}
+}
+
+func TestPrint(t *testing.T) {
+	cfg := testConfig{Address: "a:1", Interval: 90, Timeout: time.Minute, Key: "secret"}
+
+	for _, format := range []string{FormatJSON, FormatYAML, FormatTOML} {
+		var buf bytes.Buffer
+		if err := Print(&buf, &cfg, format); err != nil {
+			t.Fatalf("Error: %s: %s", format, err)
+		}
+
+		out := buf.String()
+		if !strings.Contains(out, "1m30s") || !strings.Contains(out, "1m0s") || strings.Contains(out, "secret") || strings.Contains(out, "version") {
+			t.Errorf("Error: %s: printed config is incorrect:\n%s", format, out)
+		}
+
+		// the printed config is loaded back, except the secret
+		path := writeFile(t, "config."+format, out)
+
+		var loaded testConfig
+		if err := Load(&loaded, []string{"--config", path}); err != nil {
+			t.Errorf("Error: %s: printed config could not be loaded: %s", format, err)
+			continue
+		}
+
+		loaded.ConfigFile, loaded.Key = "", cfg.Key
+		if loaded != cfg {
+			t.Errorf("Error: %s: loaded config is incorrect: %+v", format, loaded)
+		}
+	}
+
+	if err := Print(&bytes.Buffer{}, &cfg, "xml"); err == nil {
+		t.Errorf("Error: unknown format must be rejected")
+	}
+}
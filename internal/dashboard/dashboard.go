@@ -0,0 +1,377 @@
+// Пакет dashboard предназначен для веб-интерфейса просмотра метрик.
+//
+// Интерфейс встроен в бинарный файл через go:embed и состоит из таблицы метрик
+// с поиском, сортировкой и фильтром по типу и страницы метрики с графиком.
+// Таблица обновляется событиями SSE: при подключении отправляются все метрики,
+// затем только изменения из stream.Hub. Для метрик с историей выводится sparkline.
+package dashboard
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sort"
+	"time"
+
+	"gometric/internal/logger"
+	"gometric/internal/metrics"
+	"gometric/internal/query"
+	"gometric/internal/storage"
+	"gometric/internal/stream"
+
+	"github.com/go-chi/chi/v5"
+)
+
+//go:embed static
+var static embed.FS
+
+// Значения по умолчанию.
+const (
+	DefaultInterval = 2 * time.Second
+	// DefaultSparkWindow окно истории, по которому строится sparkline.
+	DefaultSparkWindow = 15 * time.Minute
+	// sparkPoints максимальное число точек sparkline.
+	sparkPoints = 60
+)
+
+// Metric описывает метрику для интерфейса.
+type Metric struct {
+	ID     string            `json:"id"`
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Type   string            `json:"type"`
+	Value  float64           `json:"value"`
+	// Spark значения для sparkline, если есть история.
+	Spark []float64 `json:"spark,omitempty"`
+}
+
+// Changes описывает изменения метрик в событии changes.
+type Changes struct {
+	Updated []Metric `json:"updated,omitempty"`
+	Deleted []string `json:"deleted,omitempty"`
+}
+
+// Details описывает метрику для страницы метрики.
+type Details struct {
+	Metric
+	History []query.Sample `json:"history"`
+}
+
+// Dashboard веб-интерфейс метрик.
+type Dashboard struct {
+	storage storage.Storage
+	history *query.History
+
+	// Stream источник изменений метрик. Если не задан, все метрики
+	// отправляются событием metrics с периодом Interval.
+	Stream *stream.Hub
+	// Interval период отправки событий SSE без Stream.
+	Interval time.Duration
+	// SparkWindow окно истории для sparkline.
+	SparkWindow time.Duration
+}
+
+// New создает Dashboard над хранилищем st. Если history равна nil, графики не выводятся.
+func New(st storage.Storage, history *query.History) *Dashboard {
+	return &Dashboard{
+		storage:     st,
+		history:     history,
+		Interval:    DefaultInterval,
+		SparkWindow: DefaultSparkWindow,
+	}
+}
+
+// Handler возвращает обработчик страниц и API интерфейса,
+// который монтируется по пути /dashboard.
+func (d *Dashboard) Handler() http.Handler {
+	r := chi.NewRouter()
+
+	assets, _ := fs.Sub(static, "static")
+	r.Get("/", d.Index)
+	r.Get("/metric", serveFile("metric.html"))
+	r.Handle("/static/*", http.StripPrefix("/dashboard/static/", http.FileServer(http.FS(assets))))
+	r.Get("/api/metrics", d.metricsHandler)
+	r.Get("/api/metric", d.metricHandler)
+	r.Get("/api/events", d.eventsHandler)
+
+	return r
+}
+
+// Index возвращает страницу с таблицей метрик.
+func (d *Dashboard) Index(w http.ResponseWriter, r *http.Request) {
+	serveFile("index.html")(w, r)
+}
+
+func serveFile(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := static.ReadFile("static/" + name)
+		if err != nil {
+			logger.Error("", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(data)
+	}
+}
+
+// metric читает метрику id. Возвращает false для значений неизвестного типа.
+func metric(id string, v interface{}) (Metric, bool) {
+	name, labels := metrics.ParseID(id)
+	m := Metric{ID: id, Name: name, Labels: labels}
+
+	switch value := v.(type) {
+	case float64:
+		m.Type, m.Value = "gauge", value
+	case int64:
+		m.Type, m.Value = "counter", float64(value)
+	default:
+		return m, false
+	}
+
+	return m, true
+}
+
+// Metrics возвращает все метрики, отсортированные по идентификатору.
+func (d *Dashboard) Metrics(ctx context.Context) ([]Metric, error) {
+	ids, err := d.storage.ListCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+
+	now := time.Now()
+	result := make([]Metric, 0, len(ids))
+	for _, id := range ids {
+		v, err := d.storage.GetCtx(ctx, id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+
+		m, ok := metric(id, v)
+		if !ok {
+			continue
+		}
+
+		result = append(result, d.withSpark(m, now))
+	}
+
+	return result, nil
+}
+
+// withSpark добавляет к метрике sparkline, если есть история.
+func (d *Dashboard) withSpark(m Metric, now time.Time) Metric {
+	if d.history != nil {
+		m.Spark = spark(d.history.Samples(m.ID, now.Add(-d.SparkWindow), now))
+	}
+
+	return m
+}
+
+// spark прореживает значения до sparkPoints точек.
+func spark(samples []query.Sample) []float64 {
+	if len(samples) < 2 {
+		return nil
+	}
+
+	step := 1
+	if len(samples) > sparkPoints {
+		step = (len(samples) + sparkPoints - 1) / sparkPoints
+	}
+
+	values := make([]float64, 0, sparkPoints+1)
+	for i := 0; i < len(samples); i += step {
+		values = append(values, samples[i].Value)
+	}
+	// the latest value is always shown
+	if (len(samples)-1)%step != 0 {
+		values = append(values, samples[len(samples)-1].Value)
+	}
+
+	return values
+}
+
+func (d *Dashboard) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := d.Metrics(r.Context())
+	if err != nil {
+		logger.Error("dashboard metrics", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, result)
+}
+
+func (d *Dashboard) metricHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+
+	v, err := d.storage.GetCtx(r.Context(), id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	m, ok := metric(id, v)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	details := Details{Metric: m, History: []query.Sample{}}
+	if d.history != nil {
+		now := time.Now()
+		if samples := d.history.Samples(id, time.Time{}, now); samples != nil {
+			details.History = samples
+		}
+	}
+
+	writeJSON(w, details)
+}
+
+// eventsHandler отправляет все метрики событием metrics, а затем изменения событием changes.
+// Если подписчик отстал от Stream, метрики отправляются заново. Без Stream все метрики
+// отправляются с периодом Interval.
+func (d *Dashboard) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ctx := r.Context()
+
+	if d.Stream == nil {
+		ticker := time.NewTicker(d.Interval)
+		defer ticker.Stop()
+
+		for {
+			if !d.sendMetrics(ctx, w) {
+				return
+			}
+			flusher.Flush()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+
+	for {
+		// subscribe before reading, so no change is lost between the two
+		sub := d.Stream.Subscribe(stream.Filter{}, 0, false)
+
+		if !d.sendMetrics(ctx, w) {
+			sub.Close()
+			return
+		}
+		flusher.Flush()
+
+		if !d.sendChanges(ctx, w, flusher, sub) {
+			return
+		}
+	}
+}
+
+// sendMetrics отправляет все метрики событием metrics.
+func (d *Dashboard) sendMetrics(ctx context.Context, w http.ResponseWriter) bool {
+	result, err := d.Metrics(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.Error("dashboard events", err)
+		}
+		return false
+	}
+
+	return writeEvent(w, "metrics", result)
+}
+
+// sendChanges отправляет изменения из подписки sub, пока она не закрыта.
+// Возвращает false, если клиент отключился.
+func (d *Dashboard) sendChanges(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, sub *stream.Subscription) bool {
+	defer sub.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+
+		case e, ok := <-sub.C():
+			if !ok {
+				// the subscriber lagged behind, the table is sent again
+				return true
+			}
+
+			var changes Changes
+			now := time.Now()
+			add := func(e stream.Event) {
+				if e.Deleted {
+					changes.Deleted = append(changes.Deleted, e.Metric.ID)
+				} else if m, ok := eventMetric(e.Metric); ok {
+					changes.Updated = append(changes.Updated, d.withSpark(m, now))
+				}
+			}
+
+			add(e)
+			// send the queued changes at once
+			for n := len(sub.C()); n > 0; n-- {
+				if e, ok = <-sub.C(); ok {
+					add(e)
+				}
+			}
+
+			if !writeEvent(w, "changes", changes) {
+				return false
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// eventMetric преобразует метрику события в метрику интерфейса.
+func eventMetric(m metrics.Metrics) (Metric, bool) {
+	switch {
+	case m.MType == "gauge" && m.Value != nil:
+		return metric(m.ID, *m.Value)
+	case m.MType == "counter" && m.Delta != nil:
+		return metric(m.ID, *m.Delta)
+	}
+
+	return Metric{}, false
+}
+
+// writeEvent записывает событие SSE name с данными v в формате JSON.
+func writeEvent(w http.ResponseWriter, name string, v interface{}) bool {
+	data, err := json.Marshal(v)
+	if err != nil {
+		logger.Error("", err)
+		return false
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+	return err == nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	ret, err := json.Marshal(v)
+	if err != nil {
+		logger.Error("", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(ret)
+}
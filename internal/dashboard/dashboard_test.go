@@ -0,0 +1,213 @@
+package dashboard
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gometric/internal/memstorage"
+	"gometric/internal/metrics"
+	"gometric/internal/query"
+	"gometric/internal/stream"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func newTestServer(t *testing.T) (*memstorage.MemStorage, *query.History, *httptest.Server) {
+	st := memstorage.NewMemStorage()
+	st.Set("Alloc", float64(1024.5))
+	st.Set("PollCount", int64(7))
+	st.Set("Requests{host=a}", int64(3))
+
+	history := query.NewHistory(time.Hour)
+
+	d := New(st, history)
+	d.Interval = 10 * time.Millisecond
+
+	r := chi.NewRouter()
+	r.Mount("/dashboard", d.Handler())
+	ts := httptest.NewServer(r)
+	t.Cleanup(ts.Close)
+
+	return st, history, ts
+}
+
+func get(t *testing.T, url string) (int, string, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var b strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		b.WriteString(scanner.Text() + "\n")
+	}
+
+	return resp.StatusCode, resp.Header.Get("Content-Type"), b.String()
+}
+
+func TestPages(t *testing.T) {
+	_, _, ts := newTestServer(t)
+
+	tests := []struct {
+		path        string
+		contentType string
+		contains    string
+	}{
+		{path: "/dashboard/", contentType: "text/html", contains: `<table id="metrics">`},
+		{path: "/dashboard/metric?id=Alloc", contentType: "text/html", contains: `<dl id="details">`},
+		{path: "/dashboard/static/app.js", contentType: "javascript", contains: "EventSource"},
+		{path: "/dashboard/static/style.css", contentType: "text/css", contains: "polyline"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			code, contentType, body := get(t, ts.URL+tt.path)
+			if code != http.StatusOK || !strings.Contains(contentType, tt.contentType) || !strings.Contains(body, tt.contains) {
+				t.Errorf("Error: %d %s: %s", code, contentType, body)
+			}
+		})
+	}
+}
+
+func TestMetricsAPI(t *testing.T) {
+	st, history, ts := newTestServer(t)
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		st.Set("Alloc", float64(i))
+		history.Record(context.Background(), st, now.Add(time.Duration(i-3)*time.Second))
+	}
+
+	code, _, body := get(t, ts.URL+"/dashboard/api/metrics")
+	if code != http.StatusOK {
+		t.Fatalf("Error: status %d", code)
+	}
+
+	var list []Metric
+	if err := json.Unmarshal([]byte(body), &list); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if len(list) != 3 || list[0].ID != "Alloc" || list[0].Type != "gauge" || len(list[0].Spark) != 3 ||
+		list[1].Type != "counter" || list[1].Value != 7 || list[2].Labels["host"] != "a" {
+		t.Errorf("Error: metrics are incorrect: %s", body)
+	}
+
+	code, _, body = get(t, ts.URL+"/dashboard/api/metric?id=Alloc")
+	var details Details
+	if err := json.Unmarshal([]byte(body), &details); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if code != http.StatusOK || details.Value != 2 || len(details.History) != 3 {
+		t.Errorf("Error: details are incorrect: %s", body)
+	}
+
+	if code, _, _ := get(t, ts.URL+"/dashboard/api/metric?id=Unknown"); code != http.StatusNotFound {
+		t.Errorf("Error: unknown metric status %d", code)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	st, _, ts := newTestServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/dashboard/api/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Error: content type %s", resp.Header.Get("Content-Type"))
+	}
+
+	var events []string
+	scanner := bufio.NewScanner(resp.Body)
+	for len(events) < 2 && scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+			events = append(events, strings.TrimPrefix(line, "data: "))
+			st.Set("Alloc", float64(1))
+		}
+	}
+
+	if len(events) != 2 || !strings.Contains(events[0], `"value":1024.5`) || !strings.Contains(events[1], `"id":"Alloc","name":"Alloc","type":"gauge","value":1}`) {
+		t.Errorf("Error: events are incorrect: %v", events)
+	}
+}
+
+func TestEventsStream(t *testing.T) {
+	st := memstorage.NewMemStorage()
+	st.Set("Alloc", float64(1024.5))
+
+	hub := stream.NewHub(0, 0)
+	d := New(st, nil)
+	d.Stream = hub
+
+	r := chi.NewRouter()
+	r.Mount("/dashboard", d.Handler())
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/dashboard/api/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var events []string
+	scanner := bufio.NewScanner(resp.Body)
+	for len(events) < 4 && scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "event: ") || strings.HasPrefix(line, "data: ") {
+			events = append(events, line)
+		}
+
+		// the store is read once, then only the changes are sent
+		if len(events) == 2 && strings.HasPrefix(line, "data: ") {
+			v := int64(3)
+			st.Set("Alloc", float64(1))
+			hub.Publish([]metrics.Metrics{{ID: "PollCount", MType: "counter", Delta: &v}})
+		}
+	}
+
+	want := []string{
+		"event: metrics",
+		`data: [{"id":"Alloc","name":"Alloc","type":"gauge","value":1024.5}]`,
+		"event: changes",
+		`data: {"updated":[{"id":"PollCount","name":"PollCount","type":"counter","value":3}]}`,
+	}
+	if strings.Join(events, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Error: events are incorrect: %v", events)
+	}
+}
+
+func TestSpark(t *testing.T) {
+	samples := make([]query.Sample, 150)
+	for i := range samples {
+		samples[i].Value = float64(i)
+	}
+
+	values := spark(samples)
+	if len(values) > sparkPoints+1 || values[0] != 0 || values[len(values)-1] != 149 {
+		t.Errorf("Error: spark is incorrect: %v", values)
+	}
+
+	if spark(samples[:1]) != nil {
+		t.Errorf("Error: single value must not be drawn")
+	}
+}
@@ -0,0 +1,134 @@
+"use strict";
+
+var state = {
+  metrics: [],
+  sort: "id",
+  desc: false,
+};
+
+var tbody = document.querySelector("#metrics tbody");
+var search = document.getElementById("search");
+var count = document.getElementById("count");
+var statusEl = document.getElementById("status");
+
+function visibleTypes() {
+  var types = {};
+  document.querySelectorAll(".type-filter").forEach(function (el) {
+    types[el.value] = el.checked;
+  });
+  return types;
+}
+
+function matches(m, text) {
+  if (!text) {
+    return true;
+  }
+  return (m.id + " " + formatLabels(m.labels)).toLowerCase().indexOf(text) >= 0;
+}
+
+function compare(a, b) {
+  var x = a[state.sort];
+  var y = b[state.sort];
+  var r = x < y ? -1 : x > y ? 1 : 0;
+  if (r === 0 && state.sort !== "id") {
+    r = a.id < b.id ? -1 : 1;
+  }
+  return state.desc ? -r : r;
+}
+
+function render() {
+  var text = search.value.trim().toLowerCase();
+  var types = visibleTypes();
+
+  var rows = state.metrics.filter(function (m) {
+    return types[m.type] && matches(m, text);
+  }).sort(compare);
+
+  var fragment = document.createDocumentFragment();
+  rows.forEach(function (m) {
+    var tr = document.createElement("tr");
+
+    var name = document.createElement("td");
+    var link = document.createElement("a");
+    link.href = "/dashboard/metric?id=" + encodeURIComponent(m.id);
+    link.textContent = m.id;
+    name.appendChild(link);
+
+    var type = document.createElement("td");
+    type.textContent = m.type;
+    type.className = "type " + m.type;
+
+    var value = document.createElement("td");
+    value.className = "num";
+    value.textContent = formatValue(m.type, m.value);
+
+    var trend = document.createElement("td");
+    trend.className = "spark";
+    trend.appendChild(polyline(m.spark, 120, 24));
+
+    tr.append(name, type, value, trend);
+    fragment.appendChild(tr);
+  });
+
+  tbody.replaceChildren(fragment);
+  count.textContent = rows.length + " of " + state.metrics.length;
+
+  document.querySelectorAll("th[data-sort]").forEach(function (th) {
+    th.classList.toggle("sorted", th.dataset.sort === state.sort);
+    th.classList.toggle("desc", th.dataset.sort === state.sort && state.desc);
+  });
+}
+
+function update(metrics) {
+  state.metrics = metrics;
+  render();
+}
+
+document.querySelectorAll("th[data-sort]").forEach(function (th) {
+  th.addEventListener("click", function () {
+    if (state.sort === th.dataset.sort) {
+      state.desc = !state.desc;
+    } else {
+      state.sort = th.dataset.sort;
+      state.desc = false;
+    }
+    render();
+  });
+});
+
+search.addEventListener("input", render);
+document.querySelectorAll(".type-filter").forEach(function (el) {
+  el.addEventListener("change", render);
+});
+
+fetch("/dashboard/api/metrics")
+  .then(function (resp) { return resp.json(); })
+  .then(update)
+  .catch(function () { statusEl.textContent = "failed to load metrics"; });
+
+if (window.EventSource) {
+  var events = new EventSource("/dashboard/api/events");
+  var updated = function () {
+    statusEl.textContent = "updated " + new Date().toLocaleTimeString();
+    statusEl.classList.remove("offline");
+  };
+  events.addEventListener("metrics", function (e) {
+    update(JSON.parse(e.data));
+    updated();
+  });
+  events.addEventListener("changes", function (e) {
+    var changes = JSON.parse(e.data);
+    var byID = {};
+    state.metrics.forEach(function (m) { byID[m.id] = m; });
+    (changes.deleted || []).forEach(function (id) { delete byID[id]; });
+    (changes.updated || []).forEach(function (m) { byID[m.id] = m; });
+    update(Object.keys(byID).sort().map(function (id) { return byID[id]; }));
+    updated();
+  });
+  events.onerror = function () {
+    statusEl.textContent = "disconnected, retrying…";
+    statusEl.classList.add("offline");
+  };
+} else {
+  statusEl.textContent = "live updates are not supported by the browser";
+}
@@ -0,0 +1,47 @@
+"use strict";
+
+// formatValue prints counters as integers and gauges with up to 6 digits.
+function formatValue(type, value) {
+  if (type === "counter") {
+    return String(Math.round(value));
+  }
+  return Number(value.toPrecision(6)).toString();
+}
+
+function formatLabels(labels) {
+  if (!labels) {
+    return "";
+  }
+  return Object.keys(labels).sort().map(function (k) {
+    return k + "=" + labels[k];
+  }).join(", ");
+}
+
+// polyline draws values as an svg polyline of the given size.
+function polyline(values, width, height) {
+  var ns = "http://www.w3.org/2000/svg";
+  var svg = document.createElementNS(ns, "svg");
+  svg.setAttribute("width", width);
+  svg.setAttribute("height", height);
+  svg.setAttribute("viewBox", "0 0 " + width + " " + height);
+
+  if (!values || values.length < 2) {
+    return svg;
+  }
+
+  var min = Math.min.apply(null, values);
+  var max = Math.max.apply(null, values);
+  var span = max - min || 1;
+
+  var points = values.map(function (v, i) {
+    var x = i * (width - 2) / (values.length - 1) + 1;
+    var y = height - 1 - (v - min) * (height - 2) / span;
+    return x.toFixed(1) + "," + y.toFixed(1);
+  });
+
+  var line = document.createElementNS(ns, "polyline");
+  line.setAttribute("points", points.join(" "));
+  svg.appendChild(line);
+
+  return svg;
+}
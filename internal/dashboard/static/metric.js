@@ -0,0 +1,51 @@
+"use strict";
+
+var id = new URLSearchParams(window.location.search).get("id") || "";
+
+function show(m) {
+  document.title = m.id;
+  document.getElementById("name").textContent = m.name;
+  document.getElementById("id").textContent = m.id;
+  document.getElementById("type").textContent = m.type;
+  document.getElementById("value").textContent = formatValue(m.type, m.value);
+  document.getElementById("labels").textContent = formatLabels(m.labels) || "none";
+
+  if (m.history.length < 2) {
+    return;
+  }
+
+  var values = m.history.map(function (s) { return s.value; });
+  var chart = document.getElementById("chart");
+  var svg = polyline(values, 800, 200);
+  svg.setAttribute("width", "100%");
+  svg.setAttribute("preserveAspectRatio", "none");
+
+  var from = new Date(m.history[0].at).toLocaleTimeString();
+  var to = new Date(m.history[m.history.length - 1].at).toLocaleTimeString();
+  var legend = document.createElement("p");
+  legend.className = "muted";
+  legend.textContent = from + " – " + to + ", min " +
+    formatValue(m.type, Math.min.apply(null, values)) + ", max " +
+    formatValue(m.type, Math.max.apply(null, values));
+
+  chart.replaceChildren(svg, legend);
+}
+
+function load() {
+  fetch("/dashboard/api/metric?id=" + encodeURIComponent(id))
+    .then(function (resp) {
+      if (!resp.ok) {
+        throw new Error("metric " + id + " not found");
+      }
+      return resp.json();
+    })
+    .then(show)
+    .catch(function (err) {
+      var el = document.getElementById("error");
+      el.textContent = err.message;
+      el.hidden = false;
+    });
+}
+
+load();
+setInterval(load, 5000);
@@ -0,0 +1,453 @@
+// Пакет federation предназначен для объединения метрик нескольких серверов
+// и отправки их на вышестоящий сервер.
+//
+// Federator периодически забирает все метрики источников (других серверов через /values/
+// или локального хранилища), помечает их источником и отправляет на вышестоящий сервер
+// через /updates/. Дополнительно могут отправляться агрегаты по всем источникам:
+// сумма счетчиков и среднее, максимум, минимум или сумма gauge.
+//
+// Сервер прибавляет полученные счетчики к сохраненным, поэтому Federator
+// отправляет приращения счетчиков с прошлого опроса. Первый опрос источника
+// только запоминает значения его счетчиков: они могли быть отправлены до перезапуска.
+// Счетчики, появившиеся у источника позже, отправляются полным значением.
+package federation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gometric/internal/logger"
+	"gometric/internal/metrics"
+	"gometric/internal/storage"
+	"gometric/internal/transfer"
+	"gometric/pkg/client"
+)
+
+// Способы пометки метрик источником.
+const (
+	// ModeLabel добавляет метку с именем источника: Alloc{source=eu}.
+	ModeLabel = "label"
+	// ModePrefix добавляет имя источника к имени метрики: eu.Alloc.
+	ModePrefix = "prefix"
+	// ModeNone не отправляет метрики источников, только агрегаты.
+	ModeNone = "none"
+)
+
+// Агрегации gauge.
+const (
+	AggregateAvg = "avg"
+	AggregateMax = "max"
+	AggregateMin = "min"
+	AggregateSum = "sum"
+)
+
+// DefaultLabel имя метки источника по умолчанию.
+const DefaultLabel = "source"
+
+// Source описывает источник метрик.
+type Source interface {
+	// Name возвращает имя источника.
+	Name() string
+	// Fetch возвращает все метрики источника.
+	Fetch(ctx context.Context) ([]client.Metric, error)
+}
+
+// Config описывает настройки объединения.
+type Config struct {
+	// Mode способ пометки метрик источником.
+	Mode string
+	// Label имя метки источника для ModeLabel.
+	Label string
+	// Aggregate включает отправку агрегатов по всем источникам без пометки источником.
+	Aggregate bool
+	// GaugeAggregation агрегация gauge, по умолчанию avg. Счетчики суммируются.
+	GaugeAggregation string
+	// Interval период опроса источников.
+	Interval time.Duration
+}
+
+// Federator описывает объединение метрик источников.
+type Federator struct {
+	cfg      Config
+	sources  []Source
+	upstream *client.Client
+
+	mu sync.Mutex
+	// last последние доставленные значения счетчиков по источникам
+	last map[string]map[string]int64
+	// aggregated последние значения счетчиков источников, доставленные в агрегатах
+	aggregated map[string]map[string]int64
+}
+
+// update значение счетчика источника, которое запоминается после доставки метрики batch[index].
+// Значения первого опроса источника имеют индекс -1 и запоминаются всегда.
+type update struct {
+	aggregate bool
+	source    string
+	id        string
+	value     int64
+	index     int
+}
+
+// New создает Federator, отправляющий метрики источников sources на upstream.
+func New(cfg Config, upstream *client.Client, sources ...Source) (*Federator, error) {
+	if cfg.Mode == "" {
+		cfg.Mode = ModeLabel
+	}
+
+	switch cfg.Mode {
+	case ModeLabel, ModePrefix:
+	case ModeNone:
+		if !cfg.Aggregate {
+			return nil, fmt.Errorf("mode %s requires aggregation", cfg.Mode)
+		}
+	default:
+		return nil, fmt.Errorf("unknown federation mode %q", cfg.Mode)
+	}
+
+	if cfg.Label == "" {
+		cfg.Label = DefaultLabel
+	}
+
+	if cfg.GaugeAggregation == "" {
+		cfg.GaugeAggregation = AggregateAvg
+	}
+
+	switch cfg.GaugeAggregation {
+	case AggregateAvg, AggregateMax, AggregateMin, AggregateSum:
+	default:
+		return nil, fmt.Errorf("unknown gauge aggregation %q", cfg.GaugeAggregation)
+	}
+
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("federation sources must not be empty")
+	}
+
+	return &Federator{
+		cfg:        cfg,
+		sources:    sources,
+		upstream:   upstream,
+		last:       make(map[string]map[string]int64),
+		aggregated: make(map[string]map[string]int64),
+	}, nil
+}
+
+// SetKey заменяет ключ подписи метрик вышестоящего сервера и источников.
+func (f *Federator) SetKey(key string) {
+	f.upstream.SetKey(key)
+
+	for _, src := range f.sources {
+		if s, ok := src.(interface{ SetKey(key string) }); ok {
+			s.SetKey(key)
+		}
+	}
+}
+
+// Run отправляет метрики с периодом Interval до отмены контекста ctx.
+func (f *Federator) Run(ctx context.Context) {
+	ticker := time.NewTicker(f.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := f.Push(ctx); err != nil {
+				logger.Error("federation push failed", err)
+			}
+		}
+	}
+}
+
+// Push опрашивает источники и отправляет метрики на вышестоящий сервер.
+func (f *Federator) Push(ctx context.Context) error {
+	batch, commit := f.Collect(ctx)
+	if len(batch) == 0 {
+		commit(0)
+		return nil
+	}
+
+	if err := f.upstream.Send(ctx, batch); err != nil {
+		// counters are remembered only after they are delivered
+		var sendErr *client.SendError
+		if errors.As(err, &sendErr) {
+			commit(len(batch) - len(sendErr.Failed))
+		} else {
+			commit(0)
+		}
+
+		return err
+	}
+
+	commit(len(batch))
+
+	return nil
+}
+
+// Collect опрашивает источники и возвращает метрики для отправки.
+// Значения счетчиков запоминаются только после вызова commit с числом
+// доставленных метрик: запоминаются счетчики из первых delivered метрик batch.
+// Недоступные источники пропускаются.
+func (f *Federator) Collect(ctx context.Context) ([]client.Metric, func(delivered int)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var batch []client.Metric
+	var updates []update
+
+	counters := make(map[string]int64)
+	gauges := make(map[string][]float64)
+	// aggregated counters get their batch index after sorting
+	pending := make(map[string][]update)
+	var polled []string
+
+	for _, src := range f.sources {
+		list, err := src.Fetch(ctx)
+		if err != nil {
+			logger.Error("federation source "+src.Name()+" is unavailable", err)
+			continue
+		}
+
+		polled = append(polled, src.Name())
+		_, known := f.last[src.Name()]
+
+		for _, m := range list {
+			switch {
+			case m.MType == "counter" && m.Delta != nil && !known:
+				// the first value is only a baseline
+				updates = append(updates,
+					update{source: src.Name(), id: m.ID, value: *m.Delta, index: -1},
+					update{aggregate: true, source: src.Name(), id: m.ID, value: *m.Delta, index: -1})
+			case m.MType == "counter" && m.Delta != nil:
+				if f.cfg.Mode != ModeNone {
+					if delta, ok := counterDelta(f.last[src.Name()], m.ID, *m.Delta); ok {
+						updates = append(updates, update{source: src.Name(), id: m.ID, value: *m.Delta, index: len(batch)})
+						batch = append(batch, counter(f.sourceID(src.Name(), m.ID), delta))
+					}
+				}
+
+				if f.cfg.Aggregate {
+					if delta, ok := counterDelta(f.aggregated[src.Name()], m.ID, *m.Delta); ok {
+						counters[m.ID] += delta
+						pending[m.ID] = append(pending[m.ID], update{aggregate: true, source: src.Name(), id: m.ID, value: *m.Delta})
+					}
+				}
+			case m.MType == "gauge" && m.Value != nil:
+				gauges[m.ID] = append(gauges[m.ID], *m.Value)
+				if f.cfg.Mode != ModeNone {
+					batch = append(batch, gauge(f.sourceID(src.Name(), m.ID), *m.Value))
+				}
+			}
+		}
+	}
+
+	if f.cfg.Aggregate {
+		for _, m := range f.aggregate(counters, gauges) {
+			if m.MType == "counter" {
+				for _, u := range pending[m.ID] {
+					u.index = len(batch)
+					updates = append(updates, u)
+				}
+			}
+			batch = append(batch, m)
+		}
+	}
+
+	commit := func(delivered int) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		for _, name := range polled {
+			if f.last[name] == nil {
+				f.last[name] = make(map[string]int64)
+				f.aggregated[name] = make(map[string]int64)
+			}
+		}
+
+		for _, u := range updates {
+			if u.index >= delivered {
+				continue
+			}
+
+			last := f.last
+			if u.aggregate {
+				last = f.aggregated
+			}
+
+			if last[u.source] == nil {
+				last[u.source] = make(map[string]int64)
+			}
+			last[u.source][u.id] = u.value
+		}
+	}
+
+	return batch, commit
+}
+
+// counterDelta возвращает приращение счетчика id со значением value
+// относительно last и false, если счетчик не изменился.
+func counterDelta(last map[string]int64, id string, value int64) (int64, bool) {
+	prev, ok := last[id]
+	if !ok {
+		return value, true
+	}
+
+	if value < prev {
+		// the source counter is reset
+		return value, value != 0
+	}
+
+	return value - prev, value != prev
+}
+
+// aggregate возвращает агрегаты по всем источникам, отсортированные по имени.
+func (f *Federator) aggregate(counters map[string]int64, gauges map[string][]float64) []client.Metric {
+	result := make([]client.Metric, 0, len(counters)+len(gauges))
+
+	for id, delta := range counters {
+		result = append(result, counter(id, delta))
+	}
+
+	for id, values := range gauges {
+		result = append(result, gauge(id, aggregateGauge(f.cfg.GaugeAggregation, values)))
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+
+	return result
+}
+
+func aggregateGauge(aggregation string, values []float64) float64 {
+	result := values[0]
+
+	for _, v := range values[1:] {
+		switch aggregation {
+		case AggregateMax:
+			if v > result {
+				result = v
+			}
+		case AggregateMin:
+			if v < result {
+				result = v
+			}
+		default:
+			result += v
+		}
+	}
+
+	if aggregation == AggregateAvg {
+		result /= float64(len(values))
+	}
+
+	return result
+}
+
+// sourceID помечает идентификатор метрики источником.
+func (f *Federator) sourceID(source, id string) string {
+	name, labels := metrics.ParseID(id)
+
+	if f.cfg.Mode == ModePrefix {
+		return metrics.FormatID(source+"."+name, labels)
+	}
+
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[f.cfg.Label] = source
+
+	return metrics.FormatID(name, labels)
+}
+
+func counter(id string, delta int64) client.Metric {
+	return client.Metric{ID: id, MType: "counter", Delta: &delta}
+}
+
+func gauge(id string, value float64) client.Metric {
+	return client.Metric{ID: id, MType: "gauge", Value: &value}
+}
+
+// RemoteSource забирает метрики другого сервера через /values/.
+type RemoteSource struct {
+	name   string
+	client *client.Client
+}
+
+// NewRemoteSource создает источник из строки вида [name=]address.
+// Если имя не задано, используется host:port адреса.
+func NewRemoteSource(spec string, cfg client.Config) (*RemoteSource, error) {
+	name, address, ok := strings.Cut(spec, "=")
+	if !ok {
+		address = spec
+		name = address
+		if u, err := url.Parse(address); err == nil && u.Host != "" {
+			name = u.Host
+		}
+	}
+
+	cfg.Address = address
+	c, err := client.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RemoteSource{name: name, client: c}, nil
+}
+
+// Name возвращает имя источника.
+func (s *RemoteSource) Name() string {
+	return s.name
+}
+
+// SetKey заменяет ключ проверки подписи метрик сервера.
+func (s *RemoteSource) SetKey(key string) {
+	s.client.SetKey(key)
+}
+
+// Fetch возвращает все метрики сервера.
+func (s *RemoteSource) Fetch(ctx context.Context) ([]client.Metric, error) {
+	return s.client.List(ctx)
+}
+
+// StorageSource забирает метрики из локального хранилища.
+type StorageSource struct {
+	name    string
+	storage storage.Storage
+}
+
+// NewStorageSource создает источник name для хранилища st.
+func NewStorageSource(name string, st storage.Storage) *StorageSource {
+	return &StorageSource{name: name, storage: st}
+}
+
+// Name возвращает имя источника.
+func (s *StorageSource) Name() string {
+	return s.name
+}
+
+// Fetch возвращает все метрики хранилища.
+func (s *StorageSource) Fetch(ctx context.Context) ([]client.Metric, error) {
+	list, err := transfer.Collect(ctx, s.storage)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]client.Metric, 0, len(list))
+	for _, m := range list {
+		result = append(result, client.Metric{ID: m.ID, MType: m.MType, Delta: m.Delta, Value: m.Value})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,266 @@
+package federation
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"gometric/internal/memstorage"
+	"gometric/pkg/client"
+)
+
+// upstream собирает метрики, полученные через /updates/, как это делает сервер.
+type upstream struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	gauges   map[string]float64
+	failed   bool
+	// accept число запросов, после которых запросы отклоняются, если больше нуля
+	accept int
+	url    string
+}
+
+func newUpstream(t *testing.T) (*upstream, *client.Client) {
+	u := &upstream{counters: make(map[string]int64), gauges: make(map[string]float64)}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+
+		if u.failed {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if u.accept > 0 {
+			u.accept--
+			u.failed = u.accept == 0
+		}
+
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var list []client.Metric
+		if err := json.NewDecoder(reader).Decode(&list); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		for _, m := range list {
+			if m.MType == "counter" {
+				u.counters[m.ID] += *m.Delta
+			} else {
+				u.gauges[m.ID] = *m.Value
+			}
+		}
+	}))
+	t.Cleanup(ts.Close)
+	u.url = ts.URL
+
+	c, err := client.New(client.Config{Address: ts.URL})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	return u, c
+}
+
+// source возвращает заданный набор метрик.
+type source struct {
+	name string
+	list []client.Metric
+	err  error
+}
+
+func (s *source) Name() string {
+	return s.name
+}
+
+func (s *source) Fetch(ctx context.Context) ([]client.Metric, error) {
+	return s.list, s.err
+}
+
+func (s *source) set(count int64, alloc float64) {
+	s.list = []client.Metric{counter("PollCount", count), gauge("Alloc{pid=1}", alloc)}
+}
+
+func TestFederator(t *testing.T) {
+	u, c := newUpstream(t)
+
+	eu := &source{name: "eu"}
+	us := &source{name: "us"}
+	eu.set(10, 1)
+	us.set(5, 3)
+
+	f, err := New(Config{Aggregate: true, GaugeAggregation: AggregateMax}, c, eu, us)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if err := f.Push(context.Background()); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	eu.set(12, 2)
+	us.set(1, 4) // counter is reset
+	if err := f.Push(context.Background()); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	// the first poll is a baseline
+	wantCounters := map[string]int64{
+		"PollCount{source=eu}": 2,
+		"PollCount{source=us}": 1,
+		"PollCount":            3,
+	}
+	for id, want := range wantCounters {
+		if u.counters[id] != want {
+			t.Errorf("Error: counter %s is %d, want %d", id, u.counters[id], want)
+		}
+	}
+
+	wantGauges := map[string]float64{
+		"Alloc{pid=1,source=eu}": 2,
+		"Alloc{pid=1,source=us}": 4,
+		"Alloc{pid=1}":           4,
+	}
+	for id, want := range wantGauges {
+		if u.gauges[id] != want {
+			t.Errorf("Error: gauge %s is %f, want %f", id, u.gauges[id], want)
+		}
+	}
+
+	// undelivered counters are sent again
+	u.failed = true
+	eu.set(20, 2)
+	if err := f.Push(context.Background()); err == nil {
+		t.Fatalf("Error: upstream error must be returned")
+	}
+
+	u.failed = false
+	us.err = fmt.Errorf("unavailable")
+	if err := f.Push(context.Background()); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if u.counters["PollCount{source=eu}"] != 10 || u.counters["PollCount"] != 11 {
+		t.Errorf("Error: counters are incorrect: %v", u.counters)
+	}
+}
+
+func TestFederatorPartialSend(t *testing.T) {
+	u, _ := newUpstream(t)
+
+	c, err := client.New(client.Config{Address: u.url, BatchSize: 1})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	eu := &source{name: "eu", list: []client.Metric{counter("A", 1), counter("B", 1)}}
+	f, err := New(Config{Aggregate: true}, c, eu)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if err := f.Push(context.Background()); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	// batch: A{source=eu}, B{source=eu}, A, B; only the first two are delivered
+	eu.list = []client.Metric{counter("A", 3), counter("B", 5)}
+	u.accept = 2
+	if err := f.Push(context.Background()); err == nil {
+		t.Fatalf("Error: upstream error must be returned")
+	}
+
+	u.failed = false
+	if err := f.Push(context.Background()); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	want := map[string]int64{"A{source=eu}": 2, "B{source=eu}": 4, "A": 2, "B": 4}
+	for id, v := range want {
+		if u.counters[id] != v {
+			t.Errorf("Error: counter %s is %d, want %d", id, u.counters[id], v)
+		}
+	}
+}
+
+func TestFederatorModes(t *testing.T) {
+	u, c := newUpstream(t)
+
+	st := memstorage.NewMemStorage()
+	st.Set("Alloc", float64(1.5))
+	st.Set("PollCount", int64(3))
+
+	f, err := New(Config{Mode: ModePrefix}, c, NewStorageSource("eu", st))
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if err := f.Push(context.Background()); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	st.Set("PollCount", int64(5))
+	st.Set("Requests", int64(2))
+	if err := f.Push(context.Background()); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	// a counter created after the first poll is sent in full
+	if u.gauges["eu.Alloc"] != 1.5 || u.counters["eu.PollCount"] != 2 || u.counters["eu.Requests"] != 2 || len(u.gauges)+len(u.counters) != 3 {
+		t.Errorf("Error: prefixed metrics are incorrect: %v %v", u.gauges, u.counters)
+	}
+
+	if _, err := New(Config{Mode: ModeNone}, c, NewStorageSource("eu", st)); err == nil {
+		t.Errorf("Error: mode none requires aggregation")
+	}
+
+	if _, err := New(Config{GaugeAggregation: "median"}, c, NewStorageSource("eu", st)); err == nil {
+		t.Errorf("Error: unknown aggregation must be rejected")
+	}
+}
+
+func TestNewRemoteSource(t *testing.T) {
+	tests := []struct {
+		spec string
+		name string
+	}{
+		{spec: "eu=http://10.0.0.1:8080", name: "eu"},
+		{spec: "http://10.0.0.1:8080", name: "10.0.0.1:8080"},
+		{spec: "10.0.0.1:8080", name: "10.0.0.1:8080"},
+	}
+
+	for _, tt := range tests {
+		src, err := NewRemoteSource(tt.spec, client.Config{})
+		if err != nil || src.Name() != tt.name {
+			t.Errorf("Error: source name of %s is incorrect", tt.spec)
+		}
+	}
+}
+
+func TestAggregateGauge(t *testing.T) {
+	values := []float64{1, 4, 2, 5}
+
+	tests := map[string]float64{
+		AggregateAvg: 3,
+		AggregateMax: 5,
+		AggregateMin: 1,
+		AggregateSum: 12,
+	}
+
+	for aggregation, want := range tests {
+		if got := aggregateGauge(aggregation, values); got != want {
+			t.Errorf("Error: %s is %f, want %f", aggregation, got, want)
+		}
+	}
+}
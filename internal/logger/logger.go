@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"time"
@@ -18,22 +19,9 @@ var Log Logger
 func NewLogger(level string, logFile string) {
 	zerolog.TimeFieldFormat = time.RFC3339
 
-	switch level {
-	case "debug":
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	case "info":
-		zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	case "warn":
-		zerolog.SetGlobalLevel(zerolog.WarnLevel)
-	case "error":
-		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
-	case "fatal":
-		zerolog.SetGlobalLevel(zerolog.FatalLevel)
-	case "panic":
-		zerolog.SetGlobalLevel(zerolog.PanicLevel)
-	default:
-		zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	}
+	// unknown levels fall back to info
+	lvl, _ := ParseLevel(level)
+	zerolog.SetGlobalLevel(lvl)
 
 	var err error
 	if logFile != "" {
@@ -49,6 +37,37 @@ func NewLogger(level string, logFile string) {
 	Log.logger = zerolog.New(os.Stdout).With().Timestamp().Logger()
 }
 
+// ParseLevel возвращает уровень логирования по имени: debug, info, warn, error, fatal или panic.
+func ParseLevel(level string) (zerolog.Level, error) {
+	switch level {
+	case "debug":
+		return zerolog.DebugLevel, nil
+	case "info":
+		return zerolog.InfoLevel, nil
+	case "warn":
+		return zerolog.WarnLevel, nil
+	case "error":
+		return zerolog.ErrorLevel, nil
+	case "fatal":
+		return zerolog.FatalLevel, nil
+	case "panic":
+		return zerolog.PanicLevel, nil
+	}
+
+	return zerolog.InfoLevel, fmt.Errorf("unknown log level %q", level)
+}
+
+// SetLevel изменяет уровень логирования во время работы.
+func SetLevel(level string) error {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	zerolog.SetGlobalLevel(lvl)
+	return nil
+}
+
 func Close() error {
 	if Log.flog != nil {
 		err := Log.flog.Close()
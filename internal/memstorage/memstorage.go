@@ -2,12 +2,16 @@
 package memstorage
 
 import (
-	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"sort"
 	"sync"
+	"time"
+
+	"gometric/internal/metrics"
 )
 
 // MemStorage описывает структуру.
@@ -17,6 +21,8 @@ type MemStorage struct {
 	File      *os.File
 	SyncMode  bool
 	Metrics   map[string]interface{}
+	// Meta сведения об обновлениях метрик.
+	Meta map[string]metrics.Meta
 }
 
 // NewMemStorage создает новую структуру.
@@ -25,6 +31,7 @@ func NewMemStorage() *MemStorage {
 		StoreFile: "/tmp/memstorage.json",
 		SyncMode:  false,
 		Metrics:   make(map[string]interface{}),
+		Meta:      make(map[string]metrics.Meta),
 	}
 }
 
@@ -55,9 +62,10 @@ func (m *MemStorage) Set(k string, v interface{}) error {
 	}
 
 	m.Metrics[k] = v
+	m.touch(k, time.Now())
 
 	if m.SyncMode {
-		err := m.SaveDump()
+		err := m.saveDump()
 		if err != nil {
 			return err
 		}
@@ -76,13 +84,16 @@ func (m *MemStorage) MSet(data map[string]interface{}) error {
 	}
 
 	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	now := time.Now()
 	for k, v := range data {
 		m.Metrics[k] = v
+		m.touch(k, now)
 	}
-	m.Mutex.Unlock()
 
 	if m.SyncMode {
-		err := m.SaveDump()
+		err := m.saveDump()
 		if err != nil {
 			return err
 		}
@@ -120,10 +131,217 @@ func (m *MemStorage) List() []string {
 	return s
 }
 
+// touch учитывает запись метрики в момент t. Вызывается под m.Mutex.
+func (m *MemStorage) touch(k string, t time.Time) {
+	if m.Meta == nil {
+		m.Meta = make(map[string]metrics.Meta)
+	}
+
+	meta := m.Meta[k]
+	meta.Updated = t
+	meta.Updates++
+	m.Meta[k] = meta
+}
+
+// Delete удаляет метрику.
+func (m *MemStorage) Delete(k string) error {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	if _, ok := m.Metrics[k]; !ok {
+		return fmt.Errorf("metric %s: %w", k, metrics.ErrNotFound)
+	}
+
+	delete(m.Metrics, k)
+	delete(m.Meta, k)
+
+	if m.SyncMode {
+		return m.saveDump()
+	}
+
+	return nil
+}
+
+// DeleteStaleCtx удаляет метрику, если она не обновлялась после before.
+func (m *MemStorage) DeleteStaleCtx(ctx context.Context, k string, before time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	if _, ok := m.Metrics[k]; !ok {
+		return fmt.Errorf("metric %s: %w", k, metrics.ErrNotFound)
+	}
+
+	if m.Meta[k].Updated.After(before) {
+		return fmt.Errorf("metric %s: %w", k, metrics.ErrUpdated)
+	}
+
+	delete(m.Metrics, k)
+	delete(m.Meta, k)
+
+	if m.SyncMode {
+		return m.saveDump()
+	}
+
+	return nil
+}
+
+// Rename переименовывает метрику, сохраняя сведения об обновлениях.
+func (m *MemStorage) Rename(k, newKey string) error {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	v, ok := m.Metrics[k]
+	if !ok {
+		return fmt.Errorf("metric %s: %w", k, metrics.ErrNotFound)
+	}
+
+	if newKey == "" {
+		return fmt.Errorf("new name must not be empty")
+	}
+
+	if _, ok := m.Metrics[newKey]; ok {
+		return fmt.Errorf("metric %s: %w", newKey, metrics.ErrExists)
+	}
+
+	m.Metrics[newKey] = v
+	delete(m.Metrics, k)
+
+	if meta, ok := m.Meta[k]; ok {
+		if m.Meta == nil {
+			m.Meta = make(map[string]metrics.Meta)
+		}
+		m.Meta[newKey] = meta
+		delete(m.Meta, k)
+	}
+
+	if m.SyncMode {
+		return m.saveDump()
+	}
+
+	return nil
+}
+
+// SetCtx задает значение value для ключа key, если контекст не отменен.
+func (m *MemStorage) SetCtx(ctx context.Context, k string, v interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return m.Set(k, v)
+}
+
+// MSetCtx устанавливает несколько ключей одновременно, если контекст не отменен.
+func (m *MemStorage) MSetCtx(ctx context.Context, data map[string]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return m.MSet(data)
+}
+
+// GetCtx извлекает значение value для ключа key, если контекст не отменен.
+func (m *MemStorage) GetCtx(ctx context.Context, k string) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return m.Get(k)
+}
+
+// ListCtx выводит список всех ключей, если контекст не отменен.
+func (m *MemStorage) ListCtx(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return m.List(), nil
+}
+
+// DeleteCtx удаляет метрику, если контекст не отменен.
+func (m *MemStorage) DeleteCtx(ctx context.Context, k string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return m.Delete(k)
+}
+
+// RenameCtx переименовывает метрику, если контекст не отменен.
+func (m *MemStorage) RenameCtx(ctx context.Context, k, newKey string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return m.Rename(k, newKey)
+}
+
+// MetaCtx возвращает сведения об обновлениях метрик keys или всех метрик, если контекст не отменен.
+func (m *MemStorage) MetaCtx(ctx context.Context, keys ...string) (map[string]metrics.Meta, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	if len(keys) == 0 {
+		result := make(map[string]metrics.Meta, len(m.Meta))
+		for k, meta := range m.Meta {
+			result[k] = meta
+		}
+		return result, nil
+	}
+
+	result := make(map[string]metrics.Meta, len(keys))
+	for _, k := range keys {
+		if meta, ok := m.Meta[k]; ok {
+			result[k] = meta
+		}
+	}
+
+	return result, nil
+}
+
+// dumpVersion версия формата файла дампа.
+// Файлы без версии содержат только значения метрик.
+const dumpVersion = 2
+
+// dump описывает файл дампа.
+type dump struct {
+	Version int                    `json:"version"`
+	Metrics map[string]interface{} `json:"metrics"`
+	// Counters ключи метрик типа counter (int64).
+	Counters []string `json:"counters,omitempty"`
+	// Meta сведения об обновлениях метрик.
+	Meta map[string]metrics.Meta `json:"meta,omitempty"`
+}
+
+// legacyCounter метрика, которая в файлах без версии восстанавливается как counter.
+const legacyCounter = "PollCount"
+
 // SaveDump сохраняет текущую БД в json файл.
 func (m *MemStorage) SaveDump() error {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	return m.saveDump()
+}
+
+// saveDump сохраняет БД в файл. Вызывается под m.Mutex.
+func (m *MemStorage) saveDump() error {
+	d := dump{Version: dumpVersion, Metrics: m.Metrics, Meta: m.Meta}
+	for k, v := range m.Metrics {
+		if _, ok := v.(int64); ok {
+			d.Counters = append(d.Counters, k)
+		}
+	}
+	sort.Strings(d.Counters)
 
-	db, err := json.Marshal(m.Metrics)
+	db, err := json.Marshal(d)
 	if err != nil {
 		return err
 	}
@@ -136,23 +354,147 @@ func (m *MemStorage) SaveDump() error {
 	return nil
 }
 
+// readDump читает файл дампа. Для файлов без версии Version равна 0.
+func (m *MemStorage) readDump() (*dump, error) {
+	data, err := os.ReadFile(m.StoreFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// a new store file has no metrics yet
+	if len(bytes.TrimSpace(data)) == 0 {
+		return &dump{}, nil
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	d := &dump{}
+	_, hasVersion := raw["version"]
+	_, hasMetrics := raw["metrics"]
+	if !hasVersion || !hasMetrics {
+		if err := unmarshalNumbers(data, &d.Metrics); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+
+	if err := json.Unmarshal(raw["version"], &d.Version); err != nil {
+		return nil, fmt.Errorf("dump version: %w", err)
+	}
+	if d.Version != dumpVersion {
+		return nil, fmt.Errorf("unsupported dump version %d", d.Version)
+	}
+
+	if err := unmarshalNumbers(raw["metrics"], &d.Metrics); err != nil {
+		return nil, err
+	}
+	if c, ok := raw["counters"]; ok {
+		if err := json.Unmarshal(c, &d.Counters); err != nil {
+			return nil, err
+		}
+	}
+	if meta, ok := raw["meta"]; ok {
+		if err := json.Unmarshal(meta, &d.Meta); err != nil {
+			return nil, fmt.Errorf("dump meta: %w", err)
+		}
+	}
+
+	return d, nil
+}
+
+func unmarshalNumbers(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	return decoder.Decode(v)
+}
+
 // LoadDump json файл в БД.
+// Числа возвращаются как float64.
 func (m *MemStorage) LoadDump() (map[string]interface{}, error) {
-	dataTmp := make(map[string]interface{})
+	d, err := m.readDump()
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range d.Metrics {
+		if n, ok := v.(json.Number); ok {
+			f, err := n.Float64()
+			if err != nil {
+				return nil, fmt.Errorf("metric %s: %w", k, err)
+			}
+			d.Metrics[k] = f
+		}
+	}
+
+	return d.Metrics, nil
+}
 
-	file, err := os.OpenFile(m.StoreFile, os.O_RDONLY, 0777)
+// LoadMetrics загружает json файл, сохраняя типы значений:
+// метрики типа counter возвращаются как int64, остальные числа как float64 (gauge).
+// В файлах без версии типы не сохранены, и counter считается только PollCount.
+func (m *MemStorage) LoadMetrics() (map[string]interface{}, error) {
+	d, err := m.readDump()
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	reader := bufio.NewReader(file)
-	data, _ := reader.ReadBytes('\n')
+	counters := map[string]bool{legacyCounter: d.Version == 0}
+	for _, k := range d.Counters {
+		counters[k] = true
+	}
+
+	for k, v := range d.Metrics {
+		n, ok := v.(json.Number)
+		if !ok {
+			continue
+		}
+
+		if counters[k] {
+			i, err := n.Int64()
+			if err != nil {
+				return nil, fmt.Errorf("metric %s: %w", k, err)
+			}
+			d.Metrics[k] = i
+			continue
+		}
+
+		f, err := n.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("metric %s: %w", k, err)
+		}
+		d.Metrics[k] = f
+	}
+
+	return d.Metrics, nil
+}
 
-	err = json.Unmarshal(data, &dataTmp)
+// LoadMeta загружает из json файла сведения об обновлениях метрик.
+// Файлы без версии их не содержат, для них возвращается nil.
+func (m *MemStorage) LoadMeta() (map[string]metrics.Meta, error) {
+	d, err := m.readDump()
 	if err != nil {
 		return nil, err
 	}
 
-	return dataTmp, nil
+	return d.Meta, nil
+}
+
+// SetMeta заменяет сведения об обновлениях существующих метрик, например восстановленные из файла.
+func (m *MemStorage) SetMeta(meta map[string]metrics.Meta) {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	if m.Meta == nil {
+		m.Meta = make(map[string]metrics.Meta)
+	}
+
+	for k, v := range meta {
+		if _, ok := m.Metrics[k]; ok {
+			m.Meta[k] = v
+		}
+	}
 }
@@ -2,10 +2,15 @@ package memstorage
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"reflect"
 	"testing"
+	"time"
+
+	"gometric/internal/metrics"
 )
 
 func TestOpenClose(t *testing.T) {
@@ -144,6 +149,8 @@ func TestSaveLoadDump(t *testing.T) {
 	memStor.Set("a", int(1))
 	memStor.Set("b", float64(3.14))
 	memStor.Set("c", "foo")
+	// meta is checked in TestSaveLoadMeta
+	memStor.Meta = nil
 
 	err := memStor.SaveDump()
 	if err != nil {
@@ -159,7 +166,7 @@ func TestSaveLoadDump(t *testing.T) {
 
 	reader := bufio.NewReader(file)
 	str, _ := reader.ReadBytes('\n')
-	strTest := []byte(`{"a":1,"b":3.14,"c":"foo"}`)
+	strTest := []byte(`{"version":2,"metrics":{"a":1,"b":3.14,"c":"foo"}}`)
 	if !reflect.DeepEqual(str, strTest) {
 		t.Errorf("Error: %s", err)
 	}
@@ -241,3 +248,230 @@ func ExampleMemStorage_MSet() {
 	// 1
 	// 3.14
 }
+
+func TestSaveLoadMetrics(t *testing.T) {
+	storeFile := "/tmp/test_storeFile_typed.json"
+	memStor := NewMemStorage()
+	memStor.StoreFile = storeFile
+	memStor.Open()
+	defer memStor.Close()
+	defer os.Remove(storeFile)
+
+	memStor.Set("PollCount", int64(5))
+	memStor.Set("Alloc", float64(1907608))
+	memStor.Set("Random", float64(0.25))
+
+	if err := memStor.SaveDump(); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+
+	data, err := memStor.LoadMetrics()
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if data["PollCount"] != int64(5) || data["Alloc"] != float64(1907608) || data["Random"] != float64(0.25) {
+		t.Errorf("Error: types are not restored: %v", data)
+	}
+}
+
+func TestSaveLoadMeta(t *testing.T) {
+	storeFile := "/tmp/test_storeFile_meta.json"
+	memStor := NewMemStorage()
+	memStor.StoreFile = storeFile
+	memStor.Open()
+	defer memStor.Close()
+	defer os.Remove(storeFile)
+
+	updated := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	memStor.Set("Alloc", float64(1))
+	memStor.Meta["Alloc"] = metrics.Meta{Updated: updated, Updates: 3}
+
+	if err := memStor.SaveDump(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	restored := NewMemStorage()
+	restored.StoreFile = storeFile
+	restored.Set("Alloc", float64(1))
+	restored.Set("PollCount", int64(1))
+
+	meta, err := restored.LoadMeta()
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	restored.SetMeta(meta)
+
+	if m := restored.Meta["Alloc"]; !m.Updated.Equal(updated) || m.Updates != 3 {
+		t.Errorf("Error: meta is not restored: %+v", m)
+	}
+
+	if m := restored.Meta["PollCount"]; m.Updates != 1 {
+		t.Errorf("Error: meta of other metrics must be kept: %+v", m)
+	}
+}
+
+func TestLoadLegacyDump(t *testing.T) {
+	storeFile := "/tmp/test_storeFile_legacy.json"
+	defer os.Remove(storeFile)
+
+	if err := os.WriteFile(storeFile, []byte(`{"PollCount":5,"Alloc":1907608,"Random":0.25}`), 0600); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	memStor := NewMemStorage()
+	memStor.StoreFile = storeFile
+
+	data, err := memStor.LoadMetrics()
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	// integral gauges of old dumps have no fraction
+	if data["PollCount"] != int64(5) || data["Alloc"] != float64(1907608) || data["Random"] != float64(0.25) {
+		t.Errorf("Error: types are not restored: %v", data)
+	}
+
+	if data, err := memStor.LoadDump(); err != nil || data["PollCount"] != float64(5) {
+		t.Errorf("Error: old dump is not loaded: %v %v", data, err)
+	}
+
+	if meta, err := memStor.LoadMeta(); err != nil || meta != nil {
+		t.Errorf("Error: old dump has no meta: %v %v", meta, err)
+	}
+
+	// a new store file is empty
+	if err := os.WriteFile(storeFile, nil, 0600); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if data, err := memStor.LoadMetrics(); err != nil || len(data) != 0 {
+		t.Errorf("Error: empty dump is not loaded: %v %v", data, err)
+	}
+}
+
+func TestStorageCtx(t *testing.T) {
+	memStor := NewMemStorage()
+
+	ctx := context.Background()
+	if err := memStor.SetCtx(ctx, "abc", int64(1)); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+
+	if v, err := memStor.GetCtx(ctx, "abc"); err != nil || v != int64(1) {
+		t.Errorf("Error: value is incorrect")
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if err := memStor.MSetCtx(canceled, map[string]interface{}{"def": int64(2)}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Error: canceled context must be detected")
+	}
+
+	if _, err := memStor.GetCtx(canceled, "def"); err == nil {
+		t.Errorf("Error: canceled context must be detected")
+	}
+
+	if list, err := memStor.ListCtx(ctx); err != nil || !reflect.DeepEqual(list, []string{"abc"}) {
+		t.Errorf("Error: list is incorrect: %v", list)
+	}
+}
+
+func TestDeleteRename(t *testing.T) {
+	memStor := NewMemStorage()
+	memStor.MSet(map[string]interface{}{"Alloc": float64(1), "PollCount": int64(2)})
+
+	memStor.Set("Alloc", float64(3))
+
+	meta, _ := memStor.MetaCtx(context.Background())
+	allocMeta := meta["Alloc"]
+	if len(meta) != 2 || allocMeta.Updated.IsZero() || allocMeta.Updates != 2 || meta["PollCount"].Updates != 1 {
+		t.Fatalf("Error: meta is incorrect: %v", meta)
+	}
+
+	if err := memStor.Rename("Alloc", "PollCount"); !errors.Is(err, metrics.ErrExists) {
+		t.Errorf("Error: existing name must be rejected: %v", err)
+	}
+
+	if err := memStor.Rename("Alloc", "HeapAlloc"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if v, err := memStor.Get("HeapAlloc"); err != nil || v != float64(3) {
+		t.Errorf("Error: renamed value is incorrect: %v", v)
+	}
+
+	if err := memStor.Delete("PollCount"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if err := memStor.Delete("PollCount"); !errors.Is(err, metrics.ErrNotFound) {
+		t.Errorf("Error: missing metric must be reported: %v", err)
+	}
+
+	if err := memStor.Rename("Alloc", "Alloc2"); !errors.Is(err, metrics.ErrNotFound) {
+		t.Errorf("Error: missing metric must be reported: %v", err)
+	}
+
+	// rename keeps the meta
+	meta, _ = memStor.MetaCtx(context.Background(), "HeapAlloc", "Alloc")
+	if len(meta) != 1 || meta["HeapAlloc"] != allocMeta {
+		t.Errorf("Error: meta is incorrect: %v", meta)
+	}
+
+	if list := memStor.List(); !reflect.DeepEqual(list, []string{"HeapAlloc"}) {
+		t.Errorf("Error: list is incorrect: %v", list)
+	}
+}
+
+// run with -race: sync mode is switched by the server reload
+func TestSyncModeSwitch(t *testing.T) {
+	memStor := NewMemStorage()
+	memStor.StoreFile = "/tmp/test_storeFile_sync.json"
+	memStor.Open()
+	defer memStor.Close()
+	defer os.Remove(memStor.StoreFile)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			memStor.Mutex.Lock()
+			memStor.SyncMode = i%2 == 0
+			memStor.Mutex.Unlock()
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		if err := memStor.MSet(map[string]interface{}{"PollCount": int64(i)}); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+	<-done
+}
+
+// run with -race: the dump is saved by the server in background
+func TestSaveDumpConcurrent(t *testing.T) {
+	memStor := NewMemStorage()
+	memStor.StoreFile = "/tmp/test_storeFile_concurrent.json"
+	memStor.Open()
+	defer memStor.Close()
+	defer os.Remove(memStor.StoreFile)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if err := memStor.SaveDump(); err != nil {
+				t.Errorf("Error: %s", err)
+			}
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		if err := memStor.Set(fmt.Sprintf("m%d", i), float64(i)); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+	<-done
+}
@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+)
+
+// FormatID формирует идентификатор метрики из имени и набора меток.
+// Метки сортируются по ключу и записываются в виде name{k1=v1,k2=v2},
+// поэтому одинаковый набор меток всегда дает одинаковый идентификатор.
+// Если меток нет, возвращается имя без изменений.
+func FormatID(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(escapeLabel(k))
+		b.WriteByte('=')
+		b.WriteString(escapeLabel(labels[k]))
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+// ParseID разбирает идентификатор, сформированный FormatID, на имя и метки.
+// Для идентификатора без меток возвращается пустой набор меток.
+func ParseID(id string) (string, map[string]string) {
+	labels := make(map[string]string)
+
+	start := strings.IndexByte(id, '{')
+	if start < 0 || !strings.HasSuffix(id, "}") {
+		return id, labels
+	}
+
+	for _, pair := range strings.Split(id[start+1:len(id)-1], ",") {
+		if pair == "" {
+			continue
+		}
+
+		k, v, _ := strings.Cut(pair, "=")
+		labels[k] = v
+	}
+
+	return id[:start], labels
+}
+
+// escapeLabel заменяет символы, которые используются как разделители в идентификаторе.
+func escapeLabel(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '{', '}', ',', '=':
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFormatID(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric string
+		labels map[string]string
+		id     string
+	}{
+		{
+			name:   "without labels #1",
+			metric: "Alloc",
+			labels: nil,
+			id:     "Alloc",
+		},
+		{
+			name:   "sorted labels #2",
+			metric: "requests",
+			labels: map[string]string{"route": "/api", "method": "GET"},
+			id:     "requests{method=GET,route=/api}",
+		},
+		{
+			name:   "escaped labels #3",
+			metric: "requests",
+			labels: map[string]string{"host": "a,b=c{}"},
+			id:     "requests{host=a_b_c__}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if id := FormatID(tt.metric, tt.labels); id != tt.id {
+				t.Errorf("Error: got %s, want %s", id, tt.id)
+			}
+		})
+	}
+}
+
+func TestParseID(t *testing.T) {
+	name, labels := ParseID("requests{method=GET,route=/api,flag=}")
+	if name != "requests" {
+		t.Errorf("Error: name is incorrect: %s", name)
+	}
+
+	want := map[string]string{"method": "GET", "route": "/api", "flag": ""}
+	if !reflect.DeepEqual(labels, want) {
+		t.Errorf("Error: labels is incorrect: %v", labels)
+	}
+
+	name, labels = ParseID("Alloc")
+	if name != "Alloc" || len(labels) != 0 {
+		t.Errorf("Error: id without labels is parsed incorrectly")
+	}
+
+	if FormatID(ParseID("requests{method=GET,route=/api}")) != "requests{method=GET,route=/api}" {
+		t.Errorf("Error: FormatID(ParseID(id)) must return id")
+	}
+}
@@ -5,9 +5,31 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"sync/atomic"
+	"time"
 )
 
+// Ошибки хранилищ метрик.
+var (
+	ErrNotFound = errors.New("metric not found")
+	ErrExists   = errors.New("metric already exists")
+	ErrUpdated  = errors.New("metric is updated")
+)
+
+// SignHeader заголовок с подписью HMAC SHA256 тела запроса в hex. Подпись проверяется
+// в запросах, которые изменяют хранилище, но не содержат подписанных метрик.
+const SignHeader = "X-Signature"
+
+// Meta описывает сведения об обновлениях метрики.
+type Meta struct {
+	// Updated время последней записи.
+	Updated time.Time `json:"updated"`
+	// Updates число записей.
+	Updates int64 `json:"updates"`
+}
+
 // Metrics описывает структуру.
 type Metrics struct {
 	ID    string   `json:"id"`
@@ -89,3 +111,23 @@ func Sign(message, key string) ([]byte, error) {
 
 	return mac.Sum(nil), nil
 }
+
+// Key ключ подписи, который можно заменить во время работы, например при перезагрузке настроек.
+// Нулевое значение соответствует пустому ключу.
+type Key struct {
+	v atomic.Pointer[string]
+}
+
+// Set заменяет ключ.
+func (k *Key) Set(key string) {
+	k.v.Store(&key)
+}
+
+// Get возвращает текущий ключ.
+func (k *Key) Get() string {
+	if p := k.v.Load(); p != nil {
+		return *p
+	}
+
+	return ""
+}
@@ -0,0 +1,500 @@
+// Пакет notify предназначен для отправки изменений состояния оповещений на webhook.
+//
+// Изменения группируются по меткам GroupBy и копятся GroupWait, после чего
+// одна группа отправляется одним сообщением. Состояние правила, доставленное
+// в пределах DedupWindow, повторно не отправляется, если правило с тех пор не меняло состояние. Тело сообщения
+// формируется шаблоном text/template и должно быть корректным JSON.
+// Если задан ключ, тело подписывается HMAC SHA256 в заголовке X-Signature.
+// Сообщения разным webhook отправляются параллельно, одному webhook по порядку:
+// пока сообщение ждет повторной попытки, следующие сообщения webhook не отправляются.
+// Неотправленные сообщения повторяются с увеличивающейся задержкой,
+// очередь сохраняется в файл QueueFile и переживает перезапуск сервера.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"gometric/internal/alert"
+	"gometric/internal/logger"
+	"gometric/internal/metrics"
+)
+
+// SignHeader заголовок с подписью тела сообщения.
+const SignHeader = "X-Signature"
+
+// DefaultTemplate шаблон тела сообщения по умолчанию.
+const DefaultTemplate = `{"status":{{json .Status}},"group":{{json .Group}},"alerts":{{json .Alerts}}}`
+
+// Значения по умолчанию.
+const (
+	DefaultRetryInterval = 10 * time.Second
+	DefaultMaxRetry      = 10 * time.Minute
+	DefaultMaxAttempts   = 20
+)
+
+// Webhook описывает получателя сообщений.
+type Webhook struct {
+	URL string `json:"url"`
+	// Template шаблон тела сообщения, по умолчанию DefaultTemplate.
+	Template string `json:"template,omitempty"`
+}
+
+// Config описывает настройки отправки.
+type Config struct {
+	Webhooks []Webhook `json:"webhooks"`
+	// GroupBy метки правил, по которым группируются оповещения.
+	GroupBy []string `json:"group_by,omitempty"`
+	// GroupWait время накопления группы перед отправкой.
+	GroupWait alert.Duration `json:"group_wait,omitempty"`
+	// DedupWindow окно, в котором не повторяется то же состояние правила.
+	DedupWindow alert.Duration `json:"dedup_window,omitempty"`
+	// RetryInterval задержка перед первой повторной попыткой.
+	RetryInterval alert.Duration `json:"retry_interval,omitempty"`
+	// MaxAttempts число попыток отправки сообщения.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// QueueFile файл очереди неотправленных сообщений.
+	QueueFile string `json:"queue_file,omitempty"`
+	// Key ключ подписи, задается ключом сервера.
+	Key string `json:"-"`
+}
+
+// LoadConfig читает настройки из JSON файла.
+func LoadConfig(file string) (Config, error) {
+	var cfg Config
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return cfg, err
+	}
+
+	err = json.Unmarshal(data, &cfg)
+	return cfg, err
+}
+
+// Message данные шаблона сообщения.
+type Message struct {
+	// Status firing, если в группе есть сработавшие оповещения, иначе resolved.
+	Status string
+	// Group значения меток группировки.
+	Group map[string]string
+	// Alerts оповещения группы, отсортированные по имени правила.
+	Alerts []alert.Alert
+}
+
+// delivery сообщение в очереди отправки.
+type delivery struct {
+	URL      string    `json:"url"`
+	Body     string    `json:"body"`
+	Attempts int       `json:"attempts"`
+	Next     time.Time `json:"next"`
+	// States состояния правил сообщения, после доставки учитываются при дедупликации.
+	States map[string]string `json:"states,omitempty"`
+}
+
+// sentState последнее доставленное состояние правила.
+type sentState struct {
+	state string
+	at    time.Time
+}
+
+// group накопленные изменения одной группы.
+type group struct {
+	labels map[string]string
+	since  time.Time
+	alerts map[string]alert.Alert
+}
+
+type hook struct {
+	url  string
+	tmpl *template.Template
+}
+
+// Notifier отправляет изменения состояния оповещений на webhook.
+type Notifier struct {
+	cfg    Config
+	hooks  []hook
+	client *http.Client
+	// key ключ подписи, заменяет cfg.Key после SetKey
+	key metrics.Key
+
+	// Clock источник времени.
+	Clock alert.Clock
+
+	mu     sync.Mutex
+	groups map[string]*group
+	// sent последние доставленные, latest последние принятые состояния правил
+	sent   map[string]sentState
+	latest map[string]string
+	queue  []delivery
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// New создает Notifier и загружает сохраненную очередь.
+func New(cfg Config) (*Notifier, error) {
+	if len(cfg.Webhooks) == 0 {
+		return nil, fmt.Errorf("webhooks must not be empty")
+	}
+
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = alert.Duration(DefaultRetryInterval)
+	}
+
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = DefaultMaxAttempts
+	}
+
+	n := &Notifier{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		Clock:  realClock{},
+		groups: make(map[string]*group),
+		sent:   make(map[string]sentState),
+		latest: make(map[string]string),
+	}
+	n.key.Set(cfg.Key)
+
+	funcs := template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}
+
+	for _, w := range cfg.Webhooks {
+		if w.URL == "" {
+			return nil, fmt.Errorf("webhook url must not be empty")
+		}
+
+		text := w.Template
+		if text == "" {
+			text = DefaultTemplate
+		}
+
+		tmpl, err := template.New(w.URL).Funcs(funcs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s: %w", w.URL, err)
+		}
+
+		n.hooks = append(n.hooks, hook{url: w.URL, tmpl: tmpl})
+	}
+
+	if err := n.load(); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// SetKey заменяет ключ подписи сообщений.
+func (n *Notifier) SetKey(key string) {
+	n.key.Set(key)
+}
+
+// Notify добавляет изменения состояния в группы. Pending оповещения не отправляются.
+func (n *Notifier) Notify(alerts []alert.Alert) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := n.Clock.Now()
+
+	for _, a := range alerts {
+		if a.State == alert.StatePending {
+			continue
+		}
+
+		// a state is repeated only if it is delivered and not changed since
+		if sent, ok := n.sent[a.Rule]; ok && sent.state == a.State && n.latest[a.Rule] == a.State &&
+			now.Sub(sent.at) < time.Duration(n.cfg.DedupWindow) {
+			logger.Debug("notification " + a.Rule + "/" + a.State + " is deduplicated")
+			continue
+		}
+		n.latest[a.Rule] = a.State
+
+		labels := make(map[string]string, len(n.cfg.GroupBy))
+		for _, l := range n.cfg.GroupBy {
+			labels[l] = a.Labels[l]
+		}
+		gkey := groupKey(labels)
+
+		g, ok := n.groups[gkey]
+		if !ok {
+			g = &group{labels: labels, since: now, alerts: make(map[string]alert.Alert)}
+			n.groups[gkey] = g
+		}
+		// the latest state of the rule replaces the previous one
+		g.alerts[a.Rule] = a
+	}
+}
+
+func groupKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k, v := range labels {
+		keys = append(keys, k+"="+v)
+	}
+	sort.Strings(keys)
+
+	return strings.Join(keys, ",")
+}
+
+// Run отправляет группы и очередь с периодом interval до отмены контекста ctx.
+func (n *Notifier) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.Flush(ctx, false)
+		}
+	}
+}
+
+// Flush формирует сообщения из групп, накопленных дольше GroupWait
+// (всех групп, если force), и отправляет очередь.
+func (n *Notifier) Flush(ctx context.Context, force bool) {
+	n.mu.Lock()
+	now := n.Clock.Now()
+
+	for key, g := range n.groups {
+		if !force && now.Sub(g.since) < time.Duration(n.cfg.GroupWait) {
+			continue
+		}
+		delete(n.groups, key)
+
+		msg := newMessage(g)
+		states := make(map[string]string, len(msg.Alerts))
+		for _, a := range msg.Alerts {
+			states[a.Rule] = a.State
+		}
+
+		for _, h := range n.hooks {
+			body, err := render(h.tmpl, msg)
+			if err != nil {
+				logger.Error("render notification for "+h.url, err)
+				continue
+			}
+			n.queue = append(n.queue, delivery{URL: h.url, Body: body, Next: now, States: states})
+		}
+	}
+
+	for rule, sent := range n.sent {
+		if now.Sub(sent.at) >= time.Duration(n.cfg.DedupWindow) {
+			delete(n.sent, rule)
+		}
+	}
+
+	queue := n.queue
+	n.queue = nil
+	n.mu.Unlock()
+
+	// webhooks are independent, a slow one must not delay the others
+	byURL := make(map[string][]int)
+	delayed := make(map[string]bool)
+	for i, d := range queue {
+		// later messages must not overtake a message waiting for retry
+		if delayed[d.URL] {
+			continue
+		}
+		if d.Next.After(now) {
+			delayed[d.URL] = true
+			continue
+		}
+		byURL[d.URL] = append(byURL[d.URL], i)
+	}
+
+	delivered := make([]bool, len(queue))
+
+	var wg sync.WaitGroup
+	for _, list := range byURL {
+		wg.Add(1)
+		go func(list []int) {
+			defer wg.Done()
+			n.deliver(ctx, queue, list, delivered, now)
+		}(list)
+	}
+	wg.Wait()
+
+	var failed []delivery
+	for i, d := range queue {
+		if !delivered[i] {
+			failed = append(failed, d)
+		}
+	}
+
+	n.mu.Lock()
+	n.queue = append(failed, n.queue...)
+	if err := n.save(); err != nil {
+		logger.Error("save notification queue", err)
+	}
+	n.mu.Unlock()
+}
+
+// deliver по порядку отправляет сообщения queue[i] одного webhook для i из list.
+// Отправленные и отброшенные сообщения отмечаются в done. После ошибки
+// остальные сообщения webhook откладываются до следующей отправки без учета попытки.
+func (n *Notifier) deliver(ctx context.Context, queue []delivery, list []int, done []bool, now time.Time) {
+	for _, i := range list {
+		d := &queue[i]
+
+		err := n.send(ctx, *d)
+		if err == nil {
+			done[i] = true
+			n.delivered(d.States, now)
+			continue
+		}
+
+		d.Attempts++
+		if d.Attempts >= n.cfg.MaxAttempts {
+			logger.Error(fmt.Sprintf("notification to %s dropped after %d attempts", d.URL, d.Attempts), err)
+			done[i] = true
+		} else {
+			logger.Debug("notification to " + d.URL + " failed: " + err.Error())
+			d.Next = now.Add(backoff(time.Duration(n.cfg.RetryInterval), d.Attempts))
+		}
+
+		return
+	}
+}
+
+// delivered отмечает состояния правил доставленными в момент now.
+func (n *Notifier) delivered(states map[string]string, now time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for rule, state := range states {
+		n.sent[rule] = sentState{state: state, at: now}
+	}
+}
+
+// Pending возвращает число сообщений в очереди отправки.
+func (n *Notifier) Pending() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return len(n.queue)
+}
+
+func newMessage(g *group) Message {
+	msg := Message{Status: alert.StateResolved, Group: g.labels}
+
+	for _, a := range g.alerts {
+		if a.State == alert.StateFiring {
+			msg.Status = alert.StateFiring
+		}
+		msg.Alerts = append(msg.Alerts, a)
+	}
+
+	sort.Slice(msg.Alerts, func(i, j int) bool {
+		return msg.Alerts[i].Rule < msg.Alerts[j].Rule
+	})
+
+	return msg
+}
+
+func render(tmpl *template.Template, msg Message) (string, error) {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, msg); err != nil {
+		return "", err
+	}
+
+	if !json.Valid(b.Bytes()) {
+		return "", fmt.Errorf("template result is not valid json: %s", b.String())
+	}
+
+	return b.String(), nil
+}
+
+// backoff возвращает задержку перед попыткой attempt.
+func backoff(interval time.Duration, attempt int) time.Duration {
+	d := interval
+	for i := 1; i < attempt && d < DefaultMaxRetry; i++ {
+		d *= 2
+	}
+
+	if d > DefaultMaxRetry {
+		d = DefaultMaxRetry
+	}
+
+	return d
+}
+
+func (n *Notifier) send(ctx context.Context, d delivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, strings.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if key := n.key.Get(); key != "" {
+		sign, err := metrics.Sign(d.Body, key)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(SignHeader, hex.EncodeToString(sign))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// load загружает очередь из файла. Вызывается до запуска отправки.
+func (n *Notifier) load() error {
+	if n.cfg.QueueFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(n.cfg.QueueFile)
+	if os.IsNotExist(err) || len(data) == 0 {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, &n.queue)
+}
+
+// save сохраняет очередь в файл. Вызывается под n.mu.
+func (n *Notifier) save() error {
+	if n.cfg.QueueFile == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(n.queue)
+	if err != nil {
+		return err
+	}
+
+	tmp := n.cfg.QueueFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, n.cfg.QueueFile)
+}
@@ -0,0 +1,325 @@
+package notify
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"gometric/internal/alert"
+	"gometric/internal/metrics"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// receiver принимает сообщения webhook.
+type receiver struct {
+	mu     sync.Mutex
+	bodies []string
+	signs  []string
+	failed bool
+}
+
+func newReceiver(t *testing.T) (*receiver, *httptest.Server) {
+	r := &receiver{}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		if r.failed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := io.ReadAll(req.Body)
+		r.bodies = append(r.bodies, string(body))
+		r.signs = append(r.signs, req.Header.Get(SignHeader))
+	}))
+	t.Cleanup(ts.Close)
+
+	return r, ts
+}
+
+func (r *receiver) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.bodies...)
+}
+
+func firing(rule, team string) alert.Alert {
+	return alert.Alert{Rule: rule, Metric: "FreeMemory", State: alert.StateFiring, Labels: map[string]string{"team": team}}
+}
+
+func TestNotifier(t *testing.T) {
+	r, ts := newReceiver(t)
+
+	n, err := New(Config{
+		Webhooks:    []Webhook{{URL: ts.URL}},
+		GroupBy:     []string{"team"},
+		GroupWait:   alert.Duration(30 * time.Second),
+		DedupWindow: alert.Duration(time.Hour),
+		Key:         "secret",
+	})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	clock := &fakeClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	n.Clock = clock
+
+	n.Notify([]alert.Alert{firing("LowMemory", "ops"), firing("HighCPU", "ops"), firing("NoPolls", "dev")})
+	n.Notify([]alert.Alert{{Rule: "Pending", State: alert.StatePending}})
+
+	n.Flush(context.Background(), false)
+	if len(r.received()) != 0 {
+		t.Fatalf("Error: groups must wait")
+	}
+
+	// a repeated state replaces the previous one in the group
+	clock.now = clock.now.Add(10 * time.Second)
+	n.Notify([]alert.Alert{firing("LowMemory", "ops")})
+
+	clock.now = clock.now.Add(30 * time.Second)
+	n.Flush(context.Background(), false)
+
+	bodies := r.received()
+	if len(bodies) != 2 {
+		t.Fatalf("Error: %d messages received, want 2", len(bodies))
+	}
+
+	var msg struct {
+		Status string            `json:"status"`
+		Group  map[string]string `json:"group"`
+		Alerts []alert.Alert     `json:"alerts"`
+	}
+	for i, body := range bodies {
+		if err := json.Unmarshal([]byte(body), &msg); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+
+		if msg.Status != alert.StateFiring || (msg.Group["team"] == "ops" && len(msg.Alerts) != 2) {
+			t.Errorf("Error: message is incorrect: %s", body)
+		}
+
+		sign, _ := metrics.Sign(body, "secret")
+		if r.signs[i] != hex.EncodeToString(sign) {
+			t.Errorf("Error: message signature is incorrect")
+		}
+	}
+}
+
+func TestNotifierTemplate(t *testing.T) {
+	r, ts := newReceiver(t)
+
+	n, err := New(Config{Webhooks: []Webhook{{
+		URL:      ts.URL,
+		Template: `{"text":"{{.Status}}: {{range .Alerts}}{{.Rule}} {{end}}"}`,
+	}}})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	n.Notify([]alert.Alert{{Rule: "LowMemory", State: alert.StateResolved}})
+	n.Flush(context.Background(), true)
+
+	if bodies := r.received(); len(bodies) != 1 || bodies[0] != `{"text":"resolved: LowMemory "}` {
+		t.Errorf("Error: message is incorrect: %v", bodies)
+	}
+
+	if _, err := New(Config{Webhooks: []Webhook{{URL: ts.URL, Template: "{{.Status"}}}); err == nil {
+		t.Errorf("Error: invalid template must be rejected")
+	}
+}
+
+func TestNotifierRetry(t *testing.T) {
+	r, ts := newReceiver(t)
+	r.failed = true
+
+	file := "/tmp/test_notify_queue.json"
+	defer os.Remove(file)
+
+	cfg := Config{
+		Webhooks:      []Webhook{{URL: ts.URL}},
+		RetryInterval: alert.Duration(time.Minute),
+		QueueFile:     file,
+	}
+
+	n, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	clock := &fakeClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	n.Clock = clock
+
+	n.Notify([]alert.Alert{firing("LowMemory", "ops")})
+	n.Flush(context.Background(), true)
+
+	if n.Pending() != 1 {
+		t.Fatalf("Error: failed message must stay in queue")
+	}
+
+	// restart: the queue is restored from file
+	r.mu.Lock()
+	r.failed = false
+	r.mu.Unlock()
+
+	n, err = New(cfg)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	n.Clock = clock
+
+	n.Flush(context.Background(), false)
+	if len(r.received()) != 0 {
+		t.Errorf("Error: message must wait for retry interval")
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	n.Flush(context.Background(), false)
+	if len(r.received()) != 1 || n.Pending() != 0 {
+		t.Errorf("Error: message must be delivered after restart")
+	}
+}
+
+func TestNotifierRetryOrder(t *testing.T) {
+	r, ts := newReceiver(t)
+	r.failed = true
+
+	n, err := New(Config{Webhooks: []Webhook{{
+		URL:      ts.URL,
+		Template: `{"text":"{{.Status}}"}`,
+	}}, RetryInterval: alert.Duration(time.Minute)})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	clock := &fakeClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	n.Clock = clock
+
+	n.Notify([]alert.Alert{firing("LowMemory", "ops")})
+	n.Flush(context.Background(), true)
+
+	r.mu.Lock()
+	r.failed = false
+	r.mu.Unlock()
+
+	// the resolved message waits for the firing one
+	n.Notify([]alert.Alert{{Rule: "LowMemory", State: alert.StateResolved}})
+	n.Flush(context.Background(), true)
+	if len(r.received()) != 0 || n.Pending() != 2 {
+		t.Fatalf("Error: later message is sent before the delayed one: %v", r.received())
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	n.Flush(context.Background(), false)
+
+	if bodies := r.received(); len(bodies) != 2 || bodies[0] != `{"text":"firing"}` || bodies[1] != `{"text":"resolved"}` {
+		t.Errorf("Error: messages are out of order: %v", bodies)
+	}
+}
+
+func TestNotifierDedup(t *testing.T) {
+	r, ts := newReceiver(t)
+	r.failed = true
+
+	n, err := New(Config{Webhooks: []Webhook{{
+		URL:      ts.URL,
+		Template: `{"text":"{{.Status}}"}`,
+	}}, DedupWindow: alert.Duration(time.Hour), MaxAttempts: 1})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	resolved := alert.Alert{Rule: "LowMemory", State: alert.StateResolved}
+	notify := func(a alert.Alert) {
+		n.Notify([]alert.Alert{a})
+		n.Flush(context.Background(), true)
+	}
+
+	// an undelivered state is not deduplicated
+	notify(firing("LowMemory", "ops"))
+
+	r.mu.Lock()
+	r.failed = false
+	r.mu.Unlock()
+
+	notify(firing("LowMemory", "ops"))
+	notify(firing("LowMemory", "ops"))
+	notify(resolved)
+	notify(firing("LowMemory", "ops"))
+
+	want := []string{`{"text":"firing"}`, `{"text":"resolved"}`, `{"text":"firing"}`}
+	if bodies := r.received(); !reflect.DeepEqual(bodies, want) {
+		t.Errorf("Error: messages are incorrect: %v", bodies)
+	}
+}
+
+func TestNotifierSlowWebhook(t *testing.T) {
+	r, fast := newReceiver(t)
+
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+
+	n, err := New(Config{Webhooks: []Webhook{{URL: slow.URL}, {URL: fast.URL}}})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	n.Notify([]alert.Alert{firing("LowMemory", "ops")})
+
+	done := make(chan struct{})
+	go func() {
+		n.Flush(context.Background(), true)
+		close(done)
+	}()
+
+	// the fast webhook does not wait for the slow one
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.received()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	before := len(r.received())
+	close(release)
+	<-done
+
+	if before != 1 || n.Pending() != 0 {
+		t.Errorf("Error: messages must be delivered independently")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{attempt: 1, want: 10 * time.Second},
+		{attempt: 2, want: 20 * time.Second},
+		{attempt: 4, want: 80 * time.Second},
+		{attempt: 20, want: DefaultMaxRetry},
+	}
+
+	for _, tt := range tests {
+		if got := backoff(10*time.Second, tt.attempt); got != tt.want {
+			t.Errorf("Error: backoff(%d) = %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+// Пакет observer предназначен для наблюдения за записями в любое хранилище storage.Storage.
+//
+// Observer оборачивает хранилище и после каждой успешной записи рассылает
+// подписчикам события Change с новым значением метрики. Старое значение
+// читается из хранилища перед записью, только если его запросил подписчик.
+// Записи одного ключа публикуются в порядке записи в хранилище.
+// У каждого подписчика ограниченная очередь: если подписчик не успевает
+// читать события, новые события для него отбрасываются и учитываются в Stats,
+// а запись в хранилище не блокируется.
+package observer
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"gometric/internal/storage"
+)
+
+// DefaultBufferSize размер очереди подписчика по умолчанию.
+const DefaultBufferSize = 256
+
+// lockStripes число блокировок, по которым распределяются ключи записей.
+const lockStripes = 64
+
+// Типы метрик.
+const (
+	TypeGauge   = "gauge"
+	TypeCounter = "counter"
+)
+
+// Операции изменения.
+const (
+	OpSet    = "set"
+	OpDelete = "delete"
+	// OpRename переименование метрики Name в NewName, значения Old и New равны.
+	OpRename = "rename"
+)
+
+// Change описывает изменение метрики.
+type Change struct {
+	// Op операция: OpSet, OpDelete или OpRename.
+	Op string
+	// Name идентификатор метрики.
+	Name    string
+	NewName string
+	// Type тип метрики: gauge или counter.
+	Type string
+	// Old предыдущее значение, nil для новой метрики. При записи заполняется,
+	// только если есть подписчик SubscribeWithOld.
+	Old interface{}
+	// New сохраненное значение, nil для удаленной метрики.
+	New interface{}
+	// Source источник записи, например адрес агента. Пустой для внутренних записей.
+	Source string
+	Time   time.Time
+}
+
+// TypeOf возвращает тип метрики по значению v или пустую строку.
+func TypeOf(v interface{}) string {
+	switch v.(type) {
+	case float64:
+		return TypeGauge
+	case int64:
+		return TypeCounter
+	}
+
+	return ""
+}
+
+type sourceKey struct{}
+
+// WithSource возвращает контекст с источником записи source.
+func WithSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, sourceKey{}, source)
+}
+
+// Source возвращает источник записи из контекста ctx.
+func Source(ctx context.Context) string {
+	source, _ := ctx.Value(sourceKey{}).(string)
+	return source
+}
+
+// Subscription подписка на изменения.
+type Subscription struct {
+	observer *Observer
+	name     string
+	events   chan Change
+	old      bool
+
+	// счетчики изменяются под observer.mu
+	delivered uint64
+	dropped   uint64
+}
+
+// C возвращает канал событий. Канал закрывается при отмене подписки.
+func (s *Subscription) C() <-chan Change {
+	return s.events
+}
+
+// Dropped возвращает число событий, отброшенных из-за переполнения очереди.
+func (s *Subscription) Dropped() uint64 {
+	s.observer.mu.Lock()
+	defer s.observer.mu.Unlock()
+
+	return s.dropped
+}
+
+// Close отменяет подписку.
+func (s *Subscription) Close() {
+	s.observer.mu.Lock()
+	defer s.observer.mu.Unlock()
+
+	if _, ok := s.observer.subs[s]; ok {
+		delete(s.observer.subs, s)
+		close(s.events)
+		if s.old {
+			s.observer.olds--
+		}
+	}
+}
+
+// SubscriberStats описывает состояние подписчика.
+type SubscriberStats struct {
+	Name      string `json:"name"`
+	Queued    int    `json:"queued"`
+	Delivered uint64 `json:"delivered"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+// Stats описывает состояние Observer.
+type Stats struct {
+	Published   uint64            `json:"published"`
+	Dropped     uint64            `json:"dropped"`
+	Subscribers []SubscriberStats `json:"subscribers"`
+}
+
+// Observer описывает наблюдающий декоратор хранилища.
+type Observer struct {
+	backend storage.Storage
+
+	// locks упорядочивают записи одного ключа, чтобы события и старые значения
+	// соответствовали порядку записей в хранилище
+	locks [lockStripes]sync.Mutex
+
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+	// olds число подписчиков, которым нужны старые значения
+	olds      int
+	published uint64
+	dropped   uint64
+}
+
+// New создает Observer над хранилищем backend.
+func New(backend storage.Storage) *Observer {
+	return &Observer{
+		backend: backend,
+		subs:    make(map[*Subscription]struct{}),
+	}
+}
+
+// Unwrap возвращает хранилище, над которым построен Observer.
+func (o *Observer) Unwrap() storage.Storage {
+	return o.backend
+}
+
+// Subscribe создает подписку name с очередью на size событий.
+// Старые значения при записи не читаются.
+func (o *Observer) Subscribe(name string, size int) *Subscription {
+	return o.subscribe(name, size, false)
+}
+
+// SubscribeWithOld создает подписку, как Subscribe, но события записи содержат
+// старые значения Old. Пока есть такая подписка, каждая запись читает старые
+// значения из хранилища.
+func (o *Observer) SubscribeWithOld(name string, size int) *Subscription {
+	return o.subscribe(name, size, true)
+}
+
+func (o *Observer) subscribe(name string, size int, old bool) *Subscription {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+
+	s := &Subscription{
+		observer: o,
+		name:     name,
+		events:   make(chan Change, size),
+		old:      old,
+	}
+
+	o.mu.Lock()
+	o.subs[s] = struct{}{}
+	if old {
+		o.olds++
+	}
+	o.mu.Unlock()
+
+	return s
+}
+
+// Stats возвращает состояние Observer и его подписчиков.
+func (o *Observer) Stats() Stats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	stats := Stats{
+		Published:   o.published,
+		Dropped:     o.dropped,
+		Subscribers: make([]SubscriberStats, 0, len(o.subs)),
+	}
+
+	for s := range o.subs {
+		stats.Subscribers = append(stats.Subscribers, SubscriberStats{
+			Name:      s.name,
+			Queued:    len(s.events),
+			Delivered: s.delivered,
+			Dropped:   s.dropped,
+		})
+	}
+
+	sort.Slice(stats.Subscribers, func(i, j int) bool {
+		return stats.Subscribers[i].Name < stats.Subscribers[j].Name
+	})
+
+	return stats
+}
+
+// observed возвращает true, если есть подписчики, и true вторым значением,
+// если подписчикам нужны старые значения.
+func (o *Observer) observed() (bool, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return len(o.subs) > 0, o.olds > 0
+}
+
+// lock блокирует записи ключей keys и возвращает функцию снятия блокировки.
+// Блокировки берутся по возрастанию номера, поэтому записи пересекающихся
+// наборов ключей не блокируют друг друга навсегда.
+func (o *Observer) lock(keys ...string) func() {
+	var stripes [lockStripes]bool
+	for _, k := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(k))
+		stripes[h.Sum32()%lockStripes] = true
+	}
+
+	var locked []int
+	for i, ok := range stripes {
+		if ok {
+			o.locks[i].Lock()
+			locked = append(locked, i)
+		}
+	}
+
+	return func() {
+		for _, i := range locked {
+			o.locks[i].Unlock()
+		}
+	}
+}
+
+// publish рассылает события. Не блокируется на медленных подписчиках.
+func (o *Observer) publish(changes []Change) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, c := range changes {
+		o.published++
+
+		for s := range o.subs {
+			select {
+			case s.events <- c:
+				s.delivered++
+			default:
+				s.dropped++
+				o.dropped++
+			}
+		}
+	}
+}
+
+// Close закрывает хранилище. Подписки остаются открытыми до вызова их Close.
+func (o *Observer) Close() error {
+	return o.backend.Close()
+}
+
+// Set задает значение value для ключа key.
+func (o *Observer) Set(k string, v interface{}) error {
+	return o.SetCtx(context.Background(), k, v)
+}
+
+// SetCtx задает значение value для ключа key с учетом контекста ctx.
+func (o *Observer) SetCtx(ctx context.Context, k string, v interface{}) error {
+	return o.MSetCtx(ctx, map[string]interface{}{k: v})
+}
+
+// MSet устанавливает несколько ключей одновременно.
+func (o *Observer) MSet(data map[string]interface{}) error {
+	return o.MSetCtx(context.Background(), data)
+}
+
+// MSetCtx устанавливает несколько ключей одновременно с учетом контекста ctx
+// и рассылает изменения в порядке ключей.
+func (o *Observer) MSetCtx(ctx context.Context, data map[string]interface{}) error {
+	observed, withOld := o.observed()
+	if !observed {
+		return o.backend.MSetCtx(ctx, data)
+	}
+
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	defer o.lock(keys...)()
+
+	var old map[string]interface{}
+	if withOld {
+		old = make(map[string]interface{}, len(keys))
+		for _, k := range keys {
+			// a missing key is a new metric
+			if v, err := o.backend.GetCtx(ctx, k); err == nil {
+				old[k] = v
+			} else if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+	}
+
+	if err := o.backend.MSetCtx(ctx, data); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	source := Source(ctx)
+
+	changes := make([]Change, 0, len(keys))
+	for _, k := range keys {
+		changes = append(changes, Change{
+			Op:     OpSet,
+			Name:   k,
+			Type:   TypeOf(data[k]),
+			Old:    old[k],
+			New:    data[k],
+			Source: source,
+			Time:   now,
+		})
+	}
+
+	o.publish(changes)
+
+	return nil
+}
+
+// Delete удаляет метрику.
+func (o *Observer) Delete(k string) error {
+	return o.DeleteCtx(context.Background(), k)
+}
+
+// DeleteCtx удаляет метрику с учетом контекста ctx.
+// Удаленное значение читается всегда, по нему определяется тип метрики.
+func (o *Observer) DeleteCtx(ctx context.Context, k string) error {
+	if observed, _ := o.observed(); !observed {
+		return o.backend.DeleteCtx(ctx, k)
+	}
+
+	defer o.lock(k)()
+
+	old, _ := o.backend.GetCtx(ctx, k)
+
+	if err := o.backend.DeleteCtx(ctx, k); err != nil {
+		return err
+	}
+
+	o.publish([]Change{{
+		Op:     OpDelete,
+		Name:   k,
+		Type:   TypeOf(old),
+		Old:    old,
+		Source: Source(ctx),
+		Time:   time.Now(),
+	}})
+
+	return nil
+}
+
+// DeleteStaleCtx удаляет метрику, если она не обновлялась после before.
+func (o *Observer) DeleteStaleCtx(ctx context.Context, k string, before time.Time) error {
+	if observed, _ := o.observed(); !observed {
+		return storage.DeleteStale(ctx, o.backend, k, before)
+	}
+
+	defer o.lock(k)()
+
+	old, _ := o.backend.GetCtx(ctx, k)
+
+	if err := storage.DeleteStale(ctx, o.backend, k, before); err != nil {
+		return err
+	}
+
+	o.publish([]Change{{
+		Op:     OpDelete,
+		Name:   k,
+		Type:   TypeOf(old),
+		Old:    old,
+		Source: Source(ctx),
+		Time:   time.Now(),
+	}})
+
+	return nil
+}
+
+// Rename переименовывает метрику.
+func (o *Observer) Rename(k, newKey string) error {
+	return o.RenameCtx(context.Background(), k, newKey)
+}
+
+// RenameCtx переименовывает метрику с учетом контекста ctx.
+func (o *Observer) RenameCtx(ctx context.Context, k, newKey string) error {
+	if observed, _ := o.observed(); !observed {
+		return o.backend.RenameCtx(ctx, k, newKey)
+	}
+
+	defer o.lock(k, newKey)()
+
+	if err := o.backend.RenameCtx(ctx, k, newKey); err != nil {
+		return err
+	}
+
+	v, _ := o.backend.GetCtx(ctx, newKey)
+
+	o.publish([]Change{{
+		Op:      OpRename,
+		Name:    k,
+		NewName: newKey,
+		Type:    TypeOf(v),
+		Old:     v,
+		New:     v,
+		Source:  Source(ctx),
+		Time:    time.Now(),
+	}})
+
+	return nil
+}
+
+// Get извлекает значение value для ключа key.
+func (o *Observer) Get(k string) (interface{}, error) {
+	return o.backend.Get(k)
+}
+
+// GetCtx извлекает значение value для ключа key с учетом контекста ctx.
+func (o *Observer) GetCtx(ctx context.Context, k string) (interface{}, error) {
+	return o.backend.GetCtx(ctx, k)
+}
+
+// List выводит список всех ключей.
+func (o *Observer) List() []string {
+	return o.backend.List()
+}
+
+// ListCtx выводит список всех ключей с учетом контекста ctx.
+func (o *Observer) ListCtx(ctx context.Context) ([]string, error) {
+	return o.backend.ListCtx(ctx)
+}
@@ -0,0 +1,209 @@
+package observer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"gometric/internal/memstorage"
+	"gometric/internal/storage"
+)
+
+func TestObserver(t *testing.T) {
+	o := New(memstorage.NewMemStorage())
+
+	// unobserved writes are not published
+	if err := o.Set("Alloc", float64(1)); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	sub := o.SubscribeWithOld("test", 10)
+	defer sub.Close()
+
+	ctx := WithSource(context.Background(), "10.0.0.10")
+	if err := o.SetCtx(ctx, "Alloc", float64(2)); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err := o.MSet(map[string]interface{}{"PollCount": int64(3), "Alloc": float64(4)}); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	var changes []Change
+	for len(sub.C()) > 0 {
+		changes = append(changes, <-sub.C())
+	}
+
+	if len(changes) != 3 {
+		t.Fatalf("Error: changes are incorrect: %+v", changes)
+	}
+
+	c := changes[0]
+	if c.Name != "Alloc" || c.Type != TypeGauge || c.Old != float64(1) || c.New != float64(2) || c.Source != "10.0.0.10" || c.Time.IsZero() {
+		t.Errorf("Error: change is incorrect: %+v", c)
+	}
+
+	// keys of a batch are published in order
+	if changes[1].Name != "Alloc" || changes[1].Old != float64(2) || changes[1].Source != "" {
+		t.Errorf("Error: change is incorrect: %+v", changes[1])
+	}
+	if c := changes[2]; c.Name != "PollCount" || c.Type != TypeCounter || c.Old != nil || c.New != int64(3) {
+		t.Errorf("Error: new metric change is incorrect: %+v", c)
+	}
+
+	if storage.Unwrap(o) == o {
+		t.Errorf("Error: observer must unwrap to backend")
+	}
+}
+
+// getCounter считает чтения из хранилища.
+type getCounter struct {
+	*memstorage.MemStorage
+	gets int
+}
+
+func (g *getCounter) GetCtx(ctx context.Context, k string) (interface{}, error) {
+	g.gets++
+	return g.MemStorage.GetCtx(ctx, k)
+}
+
+func TestObserverWithoutOld(t *testing.T) {
+	backend := &getCounter{MemStorage: memstorage.NewMemStorage()}
+	o := New(backend)
+
+	sub := o.Subscribe("test", 10)
+	if err := o.MSet(map[string]interface{}{"PollCount": int64(3), "Alloc": float64(4)}); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	// old values are not read, if no subscriber needs them
+	if c := <-sub.C(); backend.gets != 0 || c.Name != "Alloc" || c.Old != nil || c.New != float64(4) {
+		t.Errorf("Error: change is incorrect: %+v, %d reads", c, backend.gets)
+	}
+
+	old := o.SubscribeWithOld("old", 10)
+	o.Set("Alloc", float64(5))
+	if c := <-old.C(); backend.gets != 1 || c.Old != float64(4) {
+		t.Errorf("Error: old value is not read: %+v", c)
+	}
+
+	old.Close()
+	o.Set("Alloc", float64(6))
+	if backend.gets != 1 {
+		t.Errorf("Error: old values are read after the subscription is closed")
+	}
+	sub.Close()
+}
+
+func TestObserverSlowSubscriber(t *testing.T) {
+	o := New(memstorage.NewMemStorage())
+
+	slow := o.Subscribe("slow", 1)
+	fast := o.Subscribe("fast", 10)
+
+	for i := 0; i < 3; i++ {
+		if err := o.Set("Alloc", float64(i)); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+
+	if len(fast.C()) != 3 || len(slow.C()) != 1 || slow.Dropped() != 2 {
+		t.Errorf("Error: slow subscriber must not block writes: fast %d, slow %d", len(fast.C()), len(slow.C()))
+	}
+
+	slow.Close()
+	slow.Close()
+
+	stats := o.Stats()
+	if stats.Published != 3 || stats.Dropped != 2 || len(stats.Subscribers) != 1 ||
+		stats.Subscribers[0].Name != "fast" || stats.Subscribers[0].Delivered != 3 || stats.Subscribers[0].Queued != 3 {
+		t.Errorf("Error: stats are incorrect: %+v", stats)
+	}
+}
+
+type failingStorage struct {
+	storage.Storage
+}
+
+func (failingStorage) MSetCtx(context.Context, map[string]interface{}) error {
+	return errors.New("backend failed")
+}
+
+func (failingStorage) GetCtx(context.Context, string) (interface{}, error) {
+	return nil, errors.New("not found")
+}
+
+func TestObserverFailedWrite(t *testing.T) {
+	o := New(failingStorage{})
+
+	sub := o.Subscribe("test", 10)
+	defer sub.Close()
+
+	if err := o.Set("Alloc", float64(1)); err == nil {
+		t.Fatalf("Error: backend error is lost")
+	}
+
+	if len(sub.C()) != 0 {
+		t.Errorf("Error: failed write must not be published")
+	}
+}
+
+func TestObserverDeleteRename(t *testing.T) {
+	o := New(memstorage.NewMemStorage())
+	o.MSet(map[string]interface{}{"Alloc": float64(1), "PollCount": int64(2)})
+
+	sub := o.Subscribe("test", 10)
+	defer sub.Close()
+
+	if err := o.Delete("PollCount"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err := o.Rename("Alloc", "HeapAlloc"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err := o.Delete("PollCount"); err == nil {
+		t.Errorf("Error: missing metric must be reported")
+	}
+
+	if len(sub.C()) != 2 {
+		t.Fatalf("Error: changes are incorrect: %d", len(sub.C()))
+	}
+
+	if c := <-sub.C(); c.Op != OpDelete || c.Name != "PollCount" || c.Type != TypeCounter || c.Old != int64(2) || c.New != nil {
+		t.Errorf("Error: delete change is incorrect: %+v", c)
+	}
+	if c := <-sub.C(); c.Op != OpRename || c.Name != "Alloc" || c.NewName != "HeapAlloc" || c.New != float64(1) {
+		t.Errorf("Error: rename change is incorrect: %+v", c)
+	}
+}
+
+// run with -race: the last change of a key matches the stored value
+func TestObserverConcurrentWrites(t *testing.T) {
+	o := New(memstorage.NewMemStorage())
+	sub := o.Subscribe("test", 1000)
+	defer sub.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				o.MSet(map[string]interface{}{"Alloc": float64(i*100 + j), fmt.Sprintf("m%d", i): int64(j)})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var last interface{}
+	for len(sub.C()) > 0 {
+		if c := <-sub.C(); c.Name == "Alloc" {
+			last = c.New
+		}
+	}
+
+	if v, _ := o.Get("Alloc"); v != last {
+		t.Errorf("Error: last change %v, stored %v", last, v)
+	}
+}
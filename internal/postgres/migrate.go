@@ -0,0 +1,211 @@
+package postgres
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// migrationLockID идентификатор advisory lock, который защищает от одновременного запуска миграций.
+const migrationLockID = 7246031
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration описывает один шаг изменения схемы.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// LoadMigrations читает миграции из каталога dir файловой системы fsys.
+// Файлы должны называться NNNN_name.up.sql и NNNN_name.down.sql.
+func LoadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+
+	for _, entry := range entries {
+		match := migrationName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %s", entry.Name())
+		}
+
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has different names: %s and %s", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	result := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have up and down steps", m.Version, m.Name)
+		}
+		result = append(result, *m)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Version < result[j].Version
+	})
+
+	return result, nil
+}
+
+// Migrate применяет все миграции, которые еще не применены.
+func (p *Postgres) Migrate(ctx context.Context) error {
+	migrations, err := LoadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return err
+	}
+
+	return p.MigrateTo(ctx, migrations[len(migrations)-1].Version)
+}
+
+// MigrateTo приводит схему к версии version: применяет up шаги для более новых версий
+// или down шаги для уже примененных версий больше version.
+// На время миграции берется advisory lock, поэтому несколько серверов
+// не выполняют миграции одновременно.
+func (p *Postgres) MigrateTo(ctx context.Context, version int) error {
+	migrations, err := LoadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return err
+	}
+
+	conn, err := p.DB.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return fmt.Errorf("acquire migration lock: %w", err)
+	}
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockID)
+
+	_, err = conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version bigint PRIMARY KEY,
+		name text NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	);`)
+	if err != nil {
+		return err
+	}
+
+	applied, err := appliedVersions(ctx, conn.Conn())
+	if err != nil {
+		return err
+	}
+
+	// up
+	for _, m := range migrations {
+		if m.Version > version || applied[m.Version] {
+			continue
+		}
+
+		err := applyMigration(ctx, conn.Conn(), m.Up,
+			`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.Version, m.Name)
+		if err != nil {
+			return fmt.Errorf("migration %d_%s up: %w", m.Version, m.Name, err)
+		}
+	}
+
+	// down in reverse order
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version <= version || !applied[m.Version] {
+			continue
+		}
+
+		err := applyMigration(ctx, conn.Conn(), m.Down,
+			`DELETE FROM schema_migrations WHERE version = $1`, m.Version)
+		if err != nil {
+			return fmt.Errorf("migration %d_%s down: %w", m.Version, m.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// SchemaVersion возвращает номер последней примененной миграции или 0, если миграции не применялись.
+func (p *Postgres) SchemaVersion(ctx context.Context) (int, error) {
+	var version int
+
+	err := p.DB.QueryRow(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+func appliedVersions(ctx context.Context, conn *pgx.Conn) (map[int]bool, error) {
+	rows, err := conn.Query(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+
+	return applied, rows.Err()
+}
+
+// applyMigration выполняет шаг миграции и обновление schema_migrations в одной транзакции.
+func applyMigration(ctx context.Context, conn *pgx.Conn, step, query string, args ...interface{}) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, step); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, query, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
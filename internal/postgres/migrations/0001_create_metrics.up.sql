@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS metrics (
+	name text unique not null,
+	type text not null,
+	delta integer,
+	value double precision
+);
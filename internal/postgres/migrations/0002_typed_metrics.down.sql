@@ -0,0 +1,12 @@
+DROP INDEX IF EXISTS metrics_updated_at_idx;
+DROP INDEX IF EXISTS metrics_type_idx;
+
+ALTER TABLE metrics
+	DROP COLUMN IF EXISTS updated_at,
+	DROP COLUMN IF EXISTS created_at;
+
+ALTER TABLE metrics
+	DROP CONSTRAINT IF EXISTS metrics_value_check,
+	DROP CONSTRAINT IF EXISTS metrics_type_check;
+
+ALTER TABLE metrics ALTER COLUMN delta TYPE integer;
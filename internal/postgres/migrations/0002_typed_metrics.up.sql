@@ -0,0 +1,15 @@
+-- counters are int64 on agents, integer overflows for TotalAlloc-scale values
+ALTER TABLE metrics ALTER COLUMN delta TYPE bigint;
+
+ALTER TABLE metrics
+	ADD CONSTRAINT metrics_type_check CHECK (type IN ('float64', 'int', 'int64')),
+	ADD CONSTRAINT metrics_value_check CHECK (
+		(type = 'float64' AND value IS NOT NULL) OR (type IN ('int', 'int64') AND delta IS NOT NULL)
+	);
+
+ALTER TABLE metrics
+	ADD COLUMN created_at timestamptz NOT NULL DEFAULT now(),
+	ADD COLUMN updated_at timestamptz NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS metrics_type_idx ON metrics (type);
+CREATE INDEX IF NOT EXISTS metrics_updated_at_idx ON metrics (updated_at);
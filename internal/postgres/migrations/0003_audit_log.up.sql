@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS audit_log (
+	id bigserial PRIMARY KEY,
+	time timestamptz NOT NULL,
+	action text NOT NULL,
+	name text NOT NULL DEFAULT '',
+	type text NOT NULL DEFAULT '',
+	client_ip text NOT NULL DEFAULT '',
+	agent text NOT NULL DEFAULT '',
+	key_id text NOT NULL DEFAULT '',
+	request_id text NOT NULL DEFAULT '',
+	status integer NOT NULL,
+	outcome text NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_time_idx ON audit_log (time);
+CREATE INDEX IF NOT EXISTS audit_log_name_idx ON audit_log (name);
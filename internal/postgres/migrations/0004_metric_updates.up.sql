@@ -0,0 +1 @@
+ALTER TABLE metrics ADD COLUMN updates bigint NOT NULL DEFAULT 1;
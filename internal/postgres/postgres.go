@@ -3,16 +3,23 @@ package postgres
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"sort"
+	"time"
 
+	"gometric/internal/metrics"
+
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 // Postgres описывает структуру.
 type Postgres struct {
 	DB *pgxpool.Pool
+	// Timeout ограничивает длительность каждой операции с БД, 0 - без ограничения.
+	Timeout time.Duration
 }
 
 // NewPostgresDB возвращает указатель на структуру Postgres.
@@ -22,18 +29,18 @@ func NewPostgresDB(db *pgxpool.Pool) *Postgres {
 	}
 }
 
-// InitDB создает новую таблицу, если она отсутствует.
+// InitDB приводит схему БД к последней версии с помощью миграций.
 func (p *Postgres) InitDB() error {
-	queryStr := `CREATE TABLE IF NOT EXISTS metrics (
-		name text unique not null,
-		type text not null,
-		delta integer,
-		value double precision
-	  );`
+	return p.Migrate(context.Background())
+}
 
-	_, err := p.DB.Exec(context.Background(), queryStr)
+// withTimeout ограничивает контекст операции значением Timeout.
+func (p *Postgres) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
 
-	return err
+	return context.WithTimeout(ctx, p.Timeout)
 }
 
 // Clear очищает таблицу.
@@ -43,46 +50,116 @@ func (p *Postgres) Clear() error {
 	return err
 }
 
-// Set задает значение value для ключа key.
-func (p *Postgres) Set(k string, v interface{}) error {
-	if v == nil {
-		return fmt.Errorf("invalid value")
-	}
+// upsertQuery записывает метрику, заменяя значение существующей.
+const upsertQuery = `INSERT INTO metrics (name, type, delta, value) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (name) DO UPDATE SET type=EXCLUDED.type, delta=EXCLUDED.delta, value=EXCLUDED.value, updated_at=now(), updates=metrics.updates+1`
 
-	var vtype, column, queryStr string
+// upsertStmt имя подготовленного выражения upsertQuery.
+const upsertStmt = "metrics_upsert"
 
-	switch v.(type) {
+// copyThreshold число метрик, начиная с которого MSet загружает данные
+// через COPY во временную таблицу вместо пакета INSERT.
+const copyThreshold = 500
+
+// row описывает строку таблицы metrics.
+type row struct {
+	name  string
+	vtype string
+	delta *int64
+	value *float64
+}
+
+// newRow преобразует значение метрики в строку таблицы.
+func newRow(k string, v interface{}) (row, error) {
+	r := row{name: k}
+
+	switch value := v.(type) {
 	case float64:
-		vtype = "float64"
-		column = "value"
+		r.vtype = "float64"
+		r.value = &value
 	case int:
-		vtype = "int"
-		column = "delta"
+		delta := int64(value)
+		r.vtype = "int"
+		r.delta = &delta
 	case int64:
-		vtype = "int64"
-		column = "delta"
+		r.vtype = "int64"
+		r.delta = &value
 	default:
-		return fmt.Errorf("invalid type value")
+		return r, fmt.Errorf("invalid type value")
+	}
+
+	return r, nil
+}
+
+// newRows проверяет данные и возвращает строки, отсортированные по имени.
+// Постоянный порядок обновления строк исключает взаимные блокировки
+// между параллельными транзакциями.
+func newRows(data map[string]interface{}) ([]row, error) {
+	rows := make([]row, 0, len(data))
+
+	for k, v := range data {
+		if k == "" || v == nil {
+			return nil, fmt.Errorf("key or value no must be empty")
+		}
+
+		r, err := newRow(k, v)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, r)
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].name < rows[j].name
+	})
+
+	return rows, nil
+}
+
+// Set задает значение value для ключа key.
+func (p *Postgres) Set(k string, v interface{}) error {
+	return p.SetCtx(context.Background(), k, v)
+}
+
+// SetCtx задает значение value для ключа key с учетом контекста ctx.
+func (p *Postgres) SetCtx(ctx context.Context, k string, v interface{}) error {
+	if v == nil {
+		return fmt.Errorf("invalid value")
+	}
+
+	r, err := newRow(k, v)
+	if err != nil {
+		return err
 	}
 
-	queryStr = `INSERT INTO metrics (name, type, ` + column + `) VALUES ($1, $2, $3) 
-		ON CONFLICT (name) DO UPDATE SET type=$2, ` + column + `=$3`
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
 
-	_, err := p.DB.Exec(context.Background(), queryStr, k, vtype, v)
+	_, err = p.DB.Exec(ctx, upsertQuery, r.name, r.vtype, r.delta, r.value)
 
 	return err
 }
 
 // MSet устанавливает несколько ключей одновременно, заменяяя существующие значения, аналогично SET.
+// Все значения записываются в одной транзакции: небольшие наборы отправляются
+// одним пакетом подготовленных выражений, большие загружаются через COPY.
 func (p *Postgres) MSet(data map[string]interface{}) error {
-	// check valid data
-	for k, v := range data {
-		if k == "" || v == nil {
-			return fmt.Errorf("key or value no must be empty")
-		}
+	return p.MSetCtx(context.Background(), data)
+}
+
+// MSetCtx устанавливает несколько ключей одновременно с учетом контекста ctx.
+func (p *Postgres) MSetCtx(ctx context.Context, data map[string]interface{}) error {
+	rows, err := newRows(data)
+	if err != nil {
+		return err
 	}
 
-	ctx := context.Background()
+	if len(rows) == 0 {
+		return nil
+	}
+
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
 
 	tx, err := p.DB.Begin(ctx)
 	if err != nil {
@@ -90,44 +167,82 @@ func (p *Postgres) MSet(data map[string]interface{}) error {
 	}
 	defer tx.Rollback(ctx)
 
-	for k, v := range data {
-		var vtype, column, queryStr string
-
-		switch v.(type) {
-		case float64:
-			vtype = "float64"
-			column = "value"
-		case int:
-			vtype = "int"
-			column = "delta"
-		case int64:
-			vtype = "int64"
-			column = "delta"
-		default:
-			return fmt.Errorf("invalid type value")
-		}
+	if len(rows) < copyThreshold {
+		err = batchUpsert(ctx, tx, rows)
+	} else {
+		err = copyUpsert(ctx, tx, rows)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
 
-		queryStr = `INSERT INTO metrics (name, type, ` + column + `) VALUES ($1, $2, $3) 
-				ON CONFLICT (name) DO UPDATE SET type=$2, ` + column + `=$3`
+// batchUpsert отправляет upsert всех строк одним пакетом за один проход к БД.
+func batchUpsert(ctx context.Context, tx pgx.Tx, rows []row) error {
+	if _, err := tx.Prepare(ctx, upsertStmt, upsertQuery); err != nil {
+		return err
+	}
 
-		_, err := p.DB.Exec(context.Background(), queryStr, k, vtype, v)
-		if err != nil {
-			return err
-		}
+	batch := &pgx.Batch{}
+	for _, r := range rows {
+		batch.Queue(upsertStmt, r.name, r.vtype, r.delta, r.value)
 	}
 
-	return tx.Commit(ctx)
+	return tx.SendBatch(ctx, batch).Close()
+}
+
+// copyUpsert загружает строки во временную таблицу через COPY
+// и переносит их в metrics одним запросом.
+func copyUpsert(ctx context.Context, tx pgx.Tx, rows []row) error {
+	_, err := tx.Exec(ctx, `CREATE TEMP TABLE metrics_import (
+		name text NOT NULL,
+		type text NOT NULL,
+		delta bigint,
+		value double precision
+	) ON COMMIT DROP;`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.CopyFrom(ctx,
+		pgx.Identifier{"metrics_import"},
+		[]string{"name", "type", "delta", "value"},
+		pgx.CopyFromSlice(len(rows), func(i int) ([]interface{}, error) {
+			return []interface{}{rows[i].name, rows[i].vtype, rows[i].delta, rows[i].value}, nil
+		}),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO metrics (name, type, delta, value)
+		SELECT name, type, delta, value FROM metrics_import ORDER BY name
+		ON CONFLICT (name) DO UPDATE SET type=EXCLUDED.type, delta=EXCLUDED.delta, value=EXCLUDED.value, updated_at=now(), updates=metrics.updates+1`)
+
+	return err
 }
 
 // Get извлекает значение value для ключа key.
 func (p *Postgres) Get(k string) (interface{}, error) {
+	return p.GetCtx(context.Background(), k)
+}
+
+// GetCtx извлекает значение value для ключа key с учетом контекста ctx.
+func (p *Postgres) GetCtx(ctx context.Context, k string) (interface{}, error) {
 	var vtype string
 	var delta *int64
 	var value *float64
 
-	err := p.DB.QueryRow(context.Background(), `SELECT type, delta, value FROM metrics WHERE name=$1 LIMIT 1;`, k).Scan(&vtype, &delta, &value)
-	if err != nil {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	err := p.DB.QueryRow(ctx, `SELECT type, delta, value FROM metrics WHERE name=$1 LIMIT 1;`, k).Scan(&vtype, &delta, &value)
+	if errors.Is(err, pgx.ErrNoRows) {
 		return nil, fmt.Errorf("metric %s not found", k)
+	} else if err != nil {
+		return nil, err
 	}
 
 	switch vtype {
@@ -144,26 +259,155 @@ func (p *Postgres) Get(k string) (interface{}, error) {
 
 // List выводит списко всех ключей.
 func (p *Postgres) List() []string {
-	var s []string
-
-	rows, err := p.DB.Query(context.Background(), `SELECT name FROM metrics;`)
+	s, err := p.ListCtx(context.Background())
 	if err != nil {
 		log.Printf("Error: %s", err.Error())
 		return nil
 	}
 
+	return s
+}
+
+// ListCtx выводит список всех ключей с учетом контекста ctx.
+func (p *Postgres) ListCtx(ctx context.Context) ([]string, error) {
+	var s []string
+
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := p.DB.Query(ctx, `SELECT name FROM metrics;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
 	for rows.Next() {
 		var l string
-		err := rows.Scan(&l)
-		if err != nil {
-			log.Printf("Error: %s", err.Error())
-			return nil
+		if err := rows.Scan(&l); err != nil {
+			return nil, err
 		}
 		s = append(s, l)
 	}
 
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
 	sort.Strings(s)
-	return s
+	return s, nil
+}
+
+// Delete удаляет метрику.
+func (p *Postgres) Delete(k string) error {
+	return p.DeleteCtx(context.Background(), k)
+}
+
+// DeleteCtx удаляет метрику с учетом контекста ctx.
+func (p *Postgres) DeleteCtx(ctx context.Context, k string) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tag, err := p.DB.Exec(ctx, `DELETE FROM metrics WHERE name=$1;`, k)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("metric %s: %w", k, metrics.ErrNotFound)
+	}
+
+	return nil
+}
+
+// DeleteStaleCtx удаляет метрику, если она не обновлялась после before.
+func (p *Postgres) DeleteStaleCtx(ctx context.Context, k string, before time.Time) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	// the subquery sees the row as it was before the delete
+	var deleted, exists bool
+	err := p.DB.QueryRow(ctx, `WITH d AS (DELETE FROM metrics WHERE name=$1 AND updated_at <= $2 RETURNING 1)
+		SELECT EXISTS (SELECT 1 FROM d), EXISTS (SELECT 1 FROM metrics WHERE name=$1);`, k, before).Scan(&deleted, &exists)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case deleted:
+		return nil
+	case exists:
+		return fmt.Errorf("metric %s: %w", k, metrics.ErrUpdated)
+	}
+
+	return fmt.Errorf("metric %s: %w", k, metrics.ErrNotFound)
+}
+
+// Rename переименовывает метрику, сохраняя время обновления.
+func (p *Postgres) Rename(k, newKey string) error {
+	return p.RenameCtx(context.Background(), k, newKey)
+}
+
+// RenameCtx переименовывает метрику с учетом контекста ctx.
+func (p *Postgres) RenameCtx(ctx context.Context, k, newKey string) error {
+	if newKey == "" {
+		return fmt.Errorf("new name must not be empty")
+	}
+
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	// the unique name constraint rejects an existing new name
+	tag, err := p.DB.Exec(ctx, `UPDATE metrics SET name=$2 WHERE name=$1
+		AND NOT EXISTS (SELECT 1 FROM metrics WHERE name=$2);`, k, newKey)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() > 0 {
+		return nil
+	}
+
+	var exists bool
+	err = p.DB.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM metrics WHERE name=$1);`, newKey).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return fmt.Errorf("metric %s: %w", newKey, metrics.ErrExists)
+	}
+
+	return fmt.Errorf("metric %s: %w", k, metrics.ErrNotFound)
+}
+
+// MetaCtx возвращает сведения об обновлениях метрик keys или всех метрик, если keys пуст.
+func (p *Postgres) MetaCtx(ctx context.Context, keys ...string) (map[string]metrics.Meta, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	var rows pgx.Rows
+	var err error
+	if len(keys) == 0 {
+		rows, err = p.DB.Query(ctx, `SELECT name, updated_at, updates FROM metrics;`)
+	} else {
+		rows, err = p.DB.Query(ctx, `SELECT name, updated_at, updates FROM metrics WHERE name = ANY($1);`, keys)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]metrics.Meta)
+	for rows.Next() {
+		var name string
+		var meta metrics.Meta
+		if err := rows.Scan(&name, &meta.Updated, &meta.Updates); err != nil {
+			return nil, err
+		}
+		result[name] = meta
+	}
+
+	return result, rows.Err()
 }
 
 // Close закрывает БД.
@@ -175,5 +419,13 @@ func (p *Postgres) Close() error {
 
 // Ping посылает Ping к БД, если ошибок нет, то запрос считается успешным.
 func (p *Postgres) Ping() error {
-	return p.DB.Ping(context.Background())
+	return p.PingCtx(context.Background())
+}
+
+// PingCtx посылает Ping к БД с учетом контекста ctx.
+func (p *Postgres) PingCtx(ctx context.Context) error {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	return p.DB.Ping(ctx)
 }
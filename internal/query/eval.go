@@ -0,0 +1,467 @@
+// Пакет query предназначен для вычисления запросов к метрикам хранилища.
+//
+// Запрос выбирает метрики по шаблону имени и условиям на метки,
+// например sum(CPUutilization*) или Requests{host="a",code=~"5.."},
+// и допускает арифметику между числами и наборами метрик, а также функции
+// rate, sum, avg, min, max, count, topk и bottomk. Для rate используется
+// History с недавними значениями метрик.
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"gometric/internal/metrics"
+	"gometric/internal/storage"
+)
+
+// Типы результата запроса.
+const (
+	TypeScalar = "scalar"
+	TypeVector = "vector"
+)
+
+// ErrStorage оборачивает ошибки чтения хранилища.
+var ErrStorage = errors.New("storage error")
+
+// storageError ошибка чтения хранилища, которая совпадает с ErrStorage
+// и с исходной ошибкой при проверке errors.Is.
+type storageError struct {
+	err error
+}
+
+func (e storageError) Error() string {
+	return ErrStorage.Error() + ": " + e.err.Error()
+}
+
+func (e storageError) Unwrap() error {
+	return e.err
+}
+
+func (e storageError) Is(target error) bool {
+	return target == ErrStorage
+}
+
+// Series значение одной метрики результата.
+type Series struct {
+	ID     string            `json:"id"`
+	Name   string            `json:"name,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+// Result результат запроса: число или набор метрик.
+type Result struct {
+	Type   string
+	Scalar float64
+	Vector []Series
+}
+
+// MarshalJSON кодирует результат в виде {"type":...,"result":...}.
+func (r Result) MarshalJSON() ([]byte, error) {
+	var result interface{} = r.Scalar
+	if r.Type == TypeVector {
+		vector := r.Vector
+		if vector == nil {
+			vector = []Series{}
+		}
+		result = vector
+	}
+
+	return json.Marshal(struct {
+		Type   string      `json:"type"`
+		Result interface{} `json:"result"`
+	}{Type: r.Type, Result: result})
+}
+
+// функции запроса и число их аргументов
+var funcs = map[string]int{
+	"rate":    1,
+	"sum":     1,
+	"avg":     1,
+	"min":     1,
+	"max":     1,
+	"count":   1,
+	"topk":    2,
+	"bottomk": 2,
+}
+
+func isFunc(name string) bool {
+	_, ok := funcs[name]
+	return ok
+}
+
+func isAggregation(name string) bool {
+	return name != "rate"
+}
+
+func checkCall(n *CallNode) error {
+	if len(n.Args) != funcs[n.Func] {
+		return fmt.Errorf("%s expects %d argument(s), got %d", n.Func, funcs[n.Func], len(n.Args))
+	}
+
+	if n.By != nil && !isAggregation(n.Func) {
+		return fmt.Errorf("%s does not support by", n.Func)
+	}
+
+	if n.Func == "rate" {
+		if sel, ok := n.Args[0].(*SelectorNode); !ok || sel.Range == 0 {
+			return fmt.Errorf("rate expects a range selector, e.g. rate(PollCount[5m])")
+		}
+	}
+
+	return nil
+}
+
+// Engine вычисляет запросы над хранилищем.
+type Engine struct {
+	storage storage.Storage
+	history *History
+}
+
+// NewEngine создает Engine над хранилищем st. Если history равна nil, функция rate недоступна.
+func NewEngine(st storage.Storage, history *History) *Engine {
+	return &Engine{storage: st, history: history}
+}
+
+// value промежуточный результат вычисления.
+type value struct {
+	scalar bool
+	num    float64
+	vector []Series
+}
+
+// Query разбирает и вычисляет запрос q на момент now.
+func (e *Engine) Query(ctx context.Context, q string, now time.Time) (Result, error) {
+	n, err := Parse(q)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return e.Eval(ctx, n, now)
+}
+
+// Eval вычисляет разобранный запрос n на момент now.
+func (e *Engine) Eval(ctx context.Context, n Node, now time.Time) (Result, error) {
+	v, err := e.eval(ctx, n, now)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if v.scalar {
+		return Result{Type: TypeScalar, Scalar: v.num}, nil
+	}
+
+	return Result{Type: TypeVector, Vector: v.vector}, nil
+}
+
+func (e *Engine) eval(ctx context.Context, n Node, now time.Time) (value, error) {
+	switch n := n.(type) {
+	case *NumberNode:
+		return value{scalar: true, num: n.Value}, nil
+
+	case *SelectorNode:
+		if n.Range > 0 {
+			return value{}, fmt.Errorf("range selector %s is allowed only in rate", n)
+		}
+		vector, err := e.selectVector(ctx, n)
+		return value{vector: vector}, err
+
+	case *BinaryNode:
+		left, err := e.eval(ctx, n.Left, now)
+		if err != nil {
+			return value{}, err
+		}
+		right, err := e.eval(ctx, n.Right, now)
+		if err != nil {
+			return value{}, err
+		}
+		return binary(n.Op, left, right)
+
+	case *CallNode:
+		return e.call(ctx, n, now)
+	}
+
+	return value{}, fmt.Errorf("unknown node %T", n)
+}
+
+// matches проверяет имя и метки метрики.
+func matches(sel *SelectorNode, name string, labels map[string]string) bool {
+	for _, m := range sel.Matchers {
+		v := labels[m.Label]
+		if m.Label == nameLabel {
+			v = name
+		}
+
+		if !m.Match(v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (e *Engine) selectVector(ctx context.Context, sel *SelectorNode) ([]Series, error) {
+	ids, err := e.storage.ListCtx(ctx)
+	if err != nil {
+		return nil, storageError{err}
+	}
+	sort.Strings(ids)
+
+	var vector []Series
+	for _, id := range ids {
+		name, labels := metrics.ParseID(id)
+		if !matches(sel, name, labels) {
+			continue
+		}
+
+		v, err := e.storage.GetCtx(ctx, id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, storageError{ctx.Err()}
+			}
+			// removed after listing
+			continue
+		}
+
+		if f, ok := toFloat(v); ok {
+			vector = append(vector, Series{ID: id, Name: name, Labels: labels, Value: f})
+		}
+	}
+
+	return vector, nil
+}
+
+// rate вычисляет среднее изменение в секунду за окно range-селектора.
+func (e *Engine) rate(sel *SelectorNode, now time.Time) ([]Series, error) {
+	if e.history == nil {
+		return nil, fmt.Errorf("rate is not available: history is disabled")
+	}
+
+	var vector []Series
+	for _, id := range e.history.IDs() {
+		name, labels := metrics.ParseID(id)
+		if !matches(sel, name, labels) {
+			continue
+		}
+
+		samples := e.history.Samples(id, now.Add(-sel.Range), now)
+		if len(samples) < 2 {
+			continue
+		}
+
+		first, last := samples[0], samples[len(samples)-1]
+		elapsed := last.At.Sub(first.At).Seconds()
+		vector = append(vector, Series{ID: id, Name: name, Labels: labels, Value: (last.Value - first.Value) / elapsed})
+	}
+
+	return vector, nil
+}
+
+func (e *Engine) call(ctx context.Context, n *CallNode, now time.Time) (value, error) {
+	if n.Func == "rate" {
+		vector, err := e.rate(n.Args[0].(*SelectorNode), now)
+		return value{vector: vector}, err
+	}
+
+	args := make([]value, 0, len(n.Args))
+	for _, a := range n.Args {
+		v, err := e.eval(ctx, a, now)
+		if err != nil {
+			return value{}, err
+		}
+		args = append(args, v)
+	}
+
+	vec := args[len(args)-1]
+	if vec.scalar {
+		return value{}, fmt.Errorf("%s expects a vector argument", n.Func)
+	}
+
+	switch n.Func {
+	case "topk", "bottomk":
+		if !args[0].scalar || args[0].num < 0 {
+			return value{}, fmt.Errorf("%s expects a non-negative number as the first argument", n.Func)
+		}
+		return value{vector: topk(int(args[0].num), vec.vector, n.By, n.Func == "bottomk")}, nil
+	}
+
+	return value{vector: aggregate(n.Func, vec.vector, n.By)}, nil
+}
+
+// groupKey возвращает метки группы by метрики s и ключ группы.
+func groupKey(s Series, by []string) (map[string]string, string) {
+	labels := make(map[string]string, len(by))
+	for _, l := range by {
+		if v, ok := s.Labels[l]; ok {
+			labels[l] = v
+		}
+	}
+
+	return labels, metrics.FormatID("", labels)
+}
+
+func aggregate(fn string, vector []Series, by []string) []Series {
+	type group struct {
+		series Series
+		count  int
+	}
+
+	groups := make(map[string]*group)
+	for _, s := range vector {
+		labels, key := groupKey(s, by)
+
+		g, ok := groups[key]
+		if !ok {
+			g = &group{series: Series{ID: key, Labels: labels, Value: s.Value}}
+			groups[key] = g
+		} else {
+			switch fn {
+			case "sum", "avg":
+				g.series.Value += s.Value
+			case "min":
+				g.series.Value = math.Min(g.series.Value, s.Value)
+			case "max":
+				g.series.Value = math.Max(g.series.Value, s.Value)
+			}
+		}
+		g.count++
+	}
+
+	result := make([]Series, 0, len(groups))
+	for _, g := range groups {
+		switch fn {
+		case "avg":
+			g.series.Value /= float64(g.count)
+		case "count":
+			g.series.Value = float64(g.count)
+		}
+
+		if len(g.series.Labels) == 0 {
+			g.series.Labels = nil
+		}
+		result = append(result, g.series)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+
+	return result
+}
+
+func topk(k int, vector []Series, by []string, bottom bool) []Series {
+	sorted := append([]Series(nil), vector...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Value == sorted[j].Value {
+			return sorted[i].ID < sorted[j].ID
+		}
+		return (sorted[i].Value > sorted[j].Value) != bottom
+	})
+
+	taken := make(map[string]int)
+	var result []Series
+	for _, s := range sorted {
+		_, key := groupKey(s, by)
+		if taken[key] < k {
+			taken[key]++
+			result = append(result, s)
+		}
+	}
+
+	return result
+}
+
+func apply(op string, a, b float64) float64 {
+	switch op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	}
+
+	return a / b
+}
+
+// signature ключ сопоставления метрик по меткам без учета имени.
+func signature(s Series) string {
+	keys := make([]string, 0, len(s.Labels))
+	for k, v := range s.Labels {
+		keys = append(keys, k+"="+v)
+	}
+	sort.Strings(keys)
+
+	return strings.Join(keys, ",")
+}
+
+// binary выполняет операцию op. Операция над двумя наборами сопоставляет
+// метрики с одинаковыми метками, имя в результате отбрасывается.
+// Результаты, не являющиеся конечными числами, отбрасываются.
+func binary(op string, left, right value) (value, error) {
+	if left.scalar && right.scalar {
+		if op == "/" && right.num == 0 {
+			return value{}, fmt.Errorf("division by zero")
+		}
+		return value{scalar: true, num: apply(op, left.num, right.num)}, nil
+	}
+
+	var result []Series
+	add := func(s Series, v float64) {
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			s.Value = v
+			result = append(result, s)
+		}
+	}
+
+	switch {
+	case right.scalar:
+		for _, s := range left.vector {
+			add(s, apply(op, s.Value, right.num))
+		}
+
+	case left.scalar:
+		for _, s := range right.vector {
+			add(s, apply(op, left.num, s.Value))
+		}
+
+	default:
+		index := make(map[string]Series, len(right.vector))
+		for _, s := range right.vector {
+			sig := signature(s)
+			if _, ok := index[sig]; ok {
+				return value{}, fmt.Errorf("many-to-many matching: several series on the right side have labels {%s}", sig)
+			}
+			index[sig] = s
+		}
+
+		seen := make(map[string]bool, len(left.vector))
+		for _, s := range left.vector {
+			sig := signature(s)
+			if seen[sig] {
+				return value{}, fmt.Errorf("many-to-many matching: several series on the left side have labels {%s}", sig)
+			}
+			seen[sig] = true
+
+			r, ok := index[sig]
+			if !ok {
+				continue
+			}
+
+			labels := s.Labels
+			if len(labels) == 0 {
+				labels = nil
+			}
+			add(Series{ID: metrics.FormatID("", labels), Labels: labels}, apply(op, s.Value, r.Value))
+		}
+	}
+
+	return value{vector: result}, nil
+}
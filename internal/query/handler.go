@@ -0,0 +1,78 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gometric/internal/logger"
+)
+
+// Handler вычисляет запрос из параметра q и возвращает результат в формате json.
+// Необязательный параметр time задает момент вычисления в формате RFC3339 или unix секундах.
+// Ошибки запроса возвращаются с кодом 400 в виде {"error":"..."}.
+func (e *Engine) Handler(w http.ResponseWriter, r *http.Request) {
+	q := r.FormValue("q")
+	if q == "" {
+		writeError(w, http.StatusBadRequest, "query parameter q is required")
+		return
+	}
+
+	now := time.Now()
+	if t := r.FormValue("time"); t != "" {
+		var err error
+		if now, err = parseTime(t); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid time: "+t)
+			return
+		}
+	}
+
+	n, err := Parse(q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := e.Eval(r.Context(), n, now)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled):
+		writeError(w, http.StatusGatewayTimeout, err.Error())
+		return
+	case errors.Is(err, ErrStorage):
+		logger.Error("query "+q, err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ret, err := json.Marshal(result)
+	if err != nil {
+		logger.Error("", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(ret)
+}
+
+func parseTime(s string) (time.Time, error) {
+	if sec, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Unix(0, int64(sec*float64(time.Second))), nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	ret, _ := json.Marshal(map[string]string{"error": msg})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(ret)
+}
@@ -0,0 +1,165 @@
+package query
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"gometric/internal/logger"
+	"gometric/internal/storage"
+)
+
+// DefaultRetention время хранения значений в истории по умолчанию.
+const DefaultRetention = time.Hour
+
+// Sample значение метрики в момент времени.
+type Sample struct {
+	At    time.Time `json:"at"`
+	Value float64   `json:"value"`
+}
+
+// History хранит в памяти недавние значения числовых метрик.
+// Используется функцией rate, так как хранилище содержит только текущие значения.
+type History struct {
+	retention time.Duration
+
+	mu     sync.RWMutex
+	series map[string][]Sample
+}
+
+// NewHistory создает History, хранящую значения retention.
+func NewHistory(retention time.Duration) *History {
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+
+	return &History{
+		retention: retention,
+		series:    make(map[string][]Sample),
+	}
+}
+
+// Add добавляет значение метрики id и удаляет устаревшие.
+func (h *History) Add(id string, at time.Time, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.add(id, at, v)
+}
+
+func (h *History) add(id string, at time.Time, v float64) {
+	samples := h.series[id]
+	if n := len(samples); n > 0 && !at.After(samples[n-1].At) {
+		// out of order sample replaces the last one
+		samples[n-1] = Sample{At: samples[n-1].At, Value: v}
+		return
+	}
+
+	from := at.Add(-h.retention)
+	i := 0
+	for i < len(samples) && samples[i].At.Before(from) {
+		i++
+	}
+
+	h.series[id] = append(samples[i:], Sample{At: at, Value: v})
+}
+
+// Record добавляет в историю текущие значения всех числовых метрик хранилища.
+func (h *History) Record(ctx context.Context, st storage.Storage, at time.Time) error {
+	ids, err := st.ListCtx(ctx)
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string]float64, len(ids))
+	for _, id := range ids {
+		v, err := st.GetCtx(ctx, id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+
+		if f, ok := toFloat(v); ok {
+			values[id] = f
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for id, v := range values {
+		h.add(id, at, v)
+	}
+
+	// forget metrics that were not updated during retention
+	from := at.Add(-h.retention)
+	for id, samples := range h.series {
+		if samples[len(samples)-1].At.Before(from) {
+			delete(h.series, id)
+		}
+	}
+
+	return nil
+}
+
+// Run записывает значения хранилища st с периодом interval до отмены контекста ctx.
+func (h *History) Run(ctx context.Context, st storage.Storage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := h.Record(ctx, st, now); err != nil && ctx.Err() == nil {
+				logger.Error("history record failed", err)
+			}
+		}
+	}
+}
+
+// IDs возвращает отсортированные идентификаторы метрик истории.
+func (h *History) IDs() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	ids := make([]string, 0, len(h.series))
+	for id := range h.series {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Samples возвращает значения метрики id в интервале [from, to].
+func (h *History) Samples(id string, from, to time.Time) []Sample {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var result []Sample
+	for _, s := range h.series[id] {
+		if !s.At.Before(from) && !s.At.After(to) {
+			result = append(result, s)
+		}
+	}
+
+	return result
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch value := v.(type) {
+	case float64:
+		return value, true
+	case int64:
+		return float64(value), true
+	case int:
+		return float64(value), true
+	}
+
+	return 0, false
+}
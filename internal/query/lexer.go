@@ -0,0 +1,137 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokDuration
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of query"
+	}
+
+	return fmt.Sprintf("%q at %d", t.text, t.pos)
+}
+
+// isIdentRune допускает в именах метрик точки, двоеточия и символы glob.
+func isIdentRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_.:*?", r)
+}
+
+// lex разбивает запрос на лексемы.
+func lex(input string) ([]token, error) {
+	var tokens []token
+
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '"':
+			j := i + 1
+			var b strings.Builder
+			for ; j < len(runes) && runes[j] != '"'; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					j++
+				}
+				b.WriteRune(runes[j])
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, token{kind: tokString, text: b.String(), pos: i})
+			i = j + 1
+
+		case r == '[':
+			j := i + 1
+			for j < len(runes) && runes[j] != ']' {
+				j++
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unterminated range at %d", i)
+			}
+			tokens = append(tokens, token{kind: tokDuration, text: strings.TrimSpace(string(runes[i+1 : j])), pos: i})
+			i = j + 1
+
+		case unicode.IsDigit(r) && !startsIdent(runes[i:]):
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.' || runes[j] == 'e' || runes[j] == 'E' ||
+				((runes[j] == '-' || runes[j] == '+') && (runes[j-1] == 'e' || runes[j-1] == 'E'))) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: string(runes[i:j]), pos: i})
+			i = j
+
+		case isIdentRune(r) && (unicode.IsLetter(r) || r == '_' || startsGlob(runes[i:])):
+			j := i
+			for j < len(runes) && isIdentRune(runes[j]) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: string(runes[i:j]), pos: i})
+			i = j
+
+		default:
+			op := string(r)
+			if i+1 < len(runes) {
+				if two := string(runes[i : i+2]); two == "!=" || two == "=~" || two == "!~" {
+					op = two
+				}
+			}
+			if !strings.Contains("+-*/(){},=", op) && op != "!=" && op != "=~" && op != "!~" {
+				return nil, fmt.Errorf("unexpected %q at %d", r, i)
+			}
+			tokens = append(tokens, token{kind: tokOp, text: op, pos: i})
+			i += len([]rune(op))
+		}
+	}
+
+	return append(tokens, token{kind: tokEOF, pos: len(runes)}), nil
+}
+
+// startsIdent проверяет, что последовательность, начинающаяся с цифры,
+// является именем метрики, например 5xxErrors, а не числом.
+func startsIdent(runes []rune) bool {
+	for i, r := range runes {
+		if unicode.IsDigit(r) || r == '.' {
+			continue
+		}
+		// exponent of a number
+		if (r == 'e' || r == 'E') && i+1 < len(runes) && (unicode.IsDigit(runes[i+1]) || runes[i+1] == '-' || runes[i+1] == '+') {
+			return false
+		}
+		return unicode.IsLetter(r) || r == '_'
+	}
+
+	return false
+}
+
+// startsGlob проверяет, что * или ? начинает шаблон имени, например *Memory,
+// а не является оператором умножения.
+func startsGlob(runes []rune) bool {
+	if runes[0] != '*' && runes[0] != '?' {
+		return false
+	}
+
+	return len(runes) > 1 && (unicode.IsLetter(runes[1]) || runes[1] == '_')
+}
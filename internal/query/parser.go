@@ -0,0 +1,427 @@
+package query
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Node узел разобранного запроса.
+type Node interface {
+	String() string
+}
+
+// NumberNode числовая константа.
+type NumberNode struct {
+	Value float64
+}
+
+func (n *NumberNode) String() string {
+	return strconv.FormatFloat(n.Value, 'g', -1, 64)
+}
+
+// Matcher условие на имя или значение метки.
+type Matcher struct {
+	Label string
+	// Op один из =, !=, =~, !~. Значение с = и != может содержать символы glob.
+	Op    string
+	Value string
+	re    *regexp.Regexp
+}
+
+func newMatcher(label, op, value string) (*Matcher, error) {
+	m := &Matcher{Label: label, Op: op, Value: value}
+
+	switch op {
+	case "=~", "!~":
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regexp %q: %w", value, err)
+		}
+		m.re = re
+	default:
+		if _, err := path.Match(value, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", value, err)
+		}
+	}
+
+	return m, nil
+}
+
+// Match проверяет значение v.
+func (m *Matcher) Match(v string) bool {
+	switch m.Op {
+	case "=~":
+		return m.re.MatchString(v)
+	case "!~":
+		return !m.re.MatchString(v)
+	case "!=":
+		ok, _ := path.Match(m.Value, v)
+		return !ok
+	}
+
+	ok, _ := path.Match(m.Value, v)
+	return ok
+}
+
+func (m *Matcher) String() string {
+	return m.Label + m.Op + strconv.Quote(m.Value)
+}
+
+// nameLabel метка, условие на которую проверяет имя метрики.
+const nameLabel = "__name__"
+
+// SelectorNode выбирает метрики хранилища по имени и меткам.
+type SelectorNode struct {
+	Matchers []*Matcher
+	// Range окно range-селектора, например rate(PollCount[5m]).
+	Range time.Duration
+}
+
+func (n *SelectorNode) String() string {
+	parts := make([]string, 0, len(n.Matchers))
+	for _, m := range n.Matchers {
+		parts = append(parts, m.String())
+	}
+
+	s := "{" + strings.Join(parts, ",") + "}"
+	if n.Range > 0 {
+		s += "[" + n.Range.String() + "]"
+	}
+
+	return s
+}
+
+// BinaryNode арифметическая операция.
+type BinaryNode struct {
+	Op          string
+	Left, Right Node
+}
+
+func (n *BinaryNode) String() string {
+	return "(" + n.Left.String() + " " + n.Op + " " + n.Right.String() + ")"
+}
+
+// CallNode вызов функции.
+type CallNode struct {
+	Func string
+	Args []Node
+	// By метки группировки агрегирующей функции.
+	By []string
+}
+
+func (n *CallNode) String() string {
+	args := make([]string, 0, len(n.Args))
+	for _, a := range n.Args {
+		args = append(args, a.String())
+	}
+
+	s := n.Func + "(" + strings.Join(args, ", ") + ")"
+	if len(n.By) > 0 {
+		s += " by (" + strings.Join(n.By, ", ") + ")"
+	}
+
+	return s
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse разбирает запрос.
+//
+// Грамматика:
+//
+//	expr     = term {("+" | "-") term}
+//	term     = unary {("*" | "/") unary}
+//	unary    = "-" unary | primary
+//	primary  = number | "(" expr ")" | call | selector
+//	call     = func ["by" labels] "(" [expr {"," expr}] ")" ["by" labels]
+//	selector = [name] ["{" matcher {"," matcher} "}"] ["[" duration "]"]
+//	matcher  = label ("=" | "!=" | "=~" | "!~") string
+//
+// Имя метрики может содержать символы glob * и ?.
+func Parse(q string) (Node, error) {
+	tokens, err := lex(q)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+
+	n, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %s", t)
+	}
+
+	return n, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+func (p *parser) isOp(ops ...string) bool {
+	t := p.peek()
+	if t.kind != tokOp {
+		return false
+	}
+
+	for _, op := range ops {
+		if t.text == op {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.isOp(op) {
+		return fmt.Errorf("expected %q, got %s", op, p.peek())
+	}
+	p.next()
+
+	return nil
+}
+
+func (p *parser) expr() (Node, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOp("+", "-") {
+		op := p.next().text
+
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryNode{Op: op, Left: left, Right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) term() (Node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOp("*", "/") {
+		op := p.next().text
+
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryNode{Op: op, Left: left, Right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) unary() (Node, error) {
+	if p.isOp("-") {
+		p.next()
+
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		if num, ok := n.(*NumberNode); ok {
+			return &NumberNode{Value: -num.Value}, nil
+		}
+		return &BinaryNode{Op: "*", Left: &NumberNode{Value: -1}, Right: n}, nil
+	}
+
+	return p.primary()
+}
+
+func (p *parser) primary() (Node, error) {
+	t := p.peek()
+
+	switch {
+	case t.kind == tokNumber:
+		p.next()
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", t)
+		}
+		return &NumberNode{Value: v}, nil
+
+	case p.isOp("("):
+		p.next()
+		n, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(")")
+
+	case t.kind == tokIdent && isFunc(t.text) && p.callFollows():
+		return p.call()
+
+	case t.kind == tokIdent || p.isOp("{"):
+		return p.selector()
+	}
+
+	return nil, fmt.Errorf("unexpected %s", t)
+}
+
+// callFollows отличает вызов функции от метрики с именем функции.
+func (p *parser) callFollows() bool {
+	t := p.tokens[p.pos+1]
+	return (t.kind == tokOp && t.text == "(") || (t.kind == tokIdent && t.text == "by")
+}
+
+func (p *parser) call() (Node, error) {
+	n := &CallNode{Func: p.next().text}
+
+	var err error
+	if p.peek().kind == tokIdent && p.peek().text == "by" {
+		if n.By, err = p.labels(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	for !p.isOp(")") {
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		n.Args = append(n.Args, arg)
+
+		if !p.isOp(",") {
+			break
+		}
+		p.next()
+	}
+
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	if p.peek().kind == tokIdent && p.peek().text == "by" {
+		if n.By != nil {
+			return nil, fmt.Errorf("duplicate by clause in %s", n.Func)
+		}
+		if n.By, err = p.labels(); err != nil {
+			return nil, err
+		}
+	}
+
+	return n, checkCall(n)
+}
+
+// labels разбирает список меток после by.
+func (p *parser) labels() ([]string, error) {
+	p.next()
+
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	labels := []string{}
+	for !p.isOp(")") {
+		t := p.next()
+		if t.kind != tokIdent {
+			return nil, fmt.Errorf("expected label name, got %s", t)
+		}
+		labels = append(labels, t.text)
+
+		if !p.isOp(",") {
+			break
+		}
+		p.next()
+	}
+
+	return labels, p.expect(")")
+}
+
+func (p *parser) selector() (Node, error) {
+	n := &SelectorNode{}
+
+	if t := p.peek(); t.kind == tokIdent {
+		p.next()
+		m, err := newMatcher(nameLabel, "=", t.text)
+		if err != nil {
+			return nil, err
+		}
+		n.Matchers = append(n.Matchers, m)
+	}
+
+	if p.isOp("{") {
+		p.next()
+
+		for !p.isOp("}") {
+			label := p.next()
+			if label.kind != tokIdent {
+				return nil, fmt.Errorf("expected label name, got %s", label)
+			}
+
+			op := p.next()
+			if op.kind != tokOp || (op.text != "=" && op.text != "!=" && op.text != "=~" && op.text != "!~") {
+				return nil, fmt.Errorf("expected matcher operator, got %s", op)
+			}
+
+			value := p.next()
+			if value.kind != tokString {
+				return nil, fmt.Errorf("expected quoted label value, got %s", value)
+			}
+
+			m, err := newMatcher(label.text, op.text, value.text)
+			if err != nil {
+				return nil, err
+			}
+			n.Matchers = append(n.Matchers, m)
+
+			if !p.isOp(",") {
+				break
+			}
+			p.next()
+		}
+
+		if err := p.expect("}"); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(n.Matchers) == 0 {
+		return nil, fmt.Errorf("empty selector at %d", p.peek().pos)
+	}
+
+	if t := p.peek(); t.kind == tokDuration {
+		p.next()
+		d, err := time.ParseDuration(t.text)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid range %s", t)
+		}
+		n.Range = d
+	}
+
+	return n, nil
+}
@@ -0,0 +1,230 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"gometric/internal/memstorage"
+)
+
+func newTestStorage() *memstorage.MemStorage {
+	st := memstorage.NewMemStorage()
+
+	st.Set("CPUutilization1", float64(10))
+	st.Set("CPUutilization2", float64(30))
+	st.Set("CPUutilization3", float64(20))
+	st.Set("FreeMemory", float64(256))
+	st.Set("TotalMemory", float64(1024))
+	st.Set("PollCount", int64(5))
+	st.Set("Requests{code=200,host=a}", int64(90))
+	st.Set("Requests{code=500,host=a}", int64(10))
+	st.Set("Requests{code=200,host=b}", int64(40))
+	st.Set("Latency{host=a}", float64(0.5))
+	st.Set("Latency{host=b}", float64(2))
+
+	return st
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+		err   bool
+	}{
+		{query: "1 + 2 * 3", want: "(1 + (2 * 3))"},
+		{query: "(1 + 2) * -3", want: "((1 + 2) * -3)"},
+		{query: "CPU*", want: `{__name__="CPU*"}`},
+		{query: `Requests{host="a", code!~"5.."}`, want: `{__name__="Requests",host="a",code!~"5.."}`},
+		{query: `{__name__=~"CPU.*"}`, want: `{__name__=~"CPU.*"}`},
+		{query: "rate(PollCount[5m])", want: `rate({__name__="PollCount"}[5m0s])`},
+		{query: "sum by (host) (Requests)", want: `sum({__name__="Requests"}) by (host)`},
+		{query: "topk(2, CPU*) ", want: `topk(2, {__name__="CPU*"})`},
+		{query: "1.5e3", want: "1500"},
+		{query: "", err: true},
+		{query: "sum(", err: true},
+		{query: "1 +", err: true},
+		{query: `Requests{host=a}`, err: true},
+		{query: `Requests{host=~"("}`, err: true},
+		{query: "rate(PollCount)", err: true},
+		{query: "rate(PollCount[abc])", err: true},
+		{query: "topk(CPU*)", err: true},
+		{query: "Requests @", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			n, err := Parse(tt.query)
+			if tt.err {
+				if err == nil {
+					t.Errorf("Error: query must be rejected, got %s", n)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Error: %s", err)
+			}
+
+			if n.String() != tt.want {
+				t.Errorf("Error: got %s, want %s", n, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuery(t *testing.T) {
+	e := NewEngine(newTestStorage(), nil)
+
+	tests := []struct {
+		query string
+		want  map[string]float64
+		err   bool
+	}{
+		{query: "sum(CPUutilization*)", want: map[string]float64{"": 60}},
+		{query: "avg(CPUutilization?)", want: map[string]float64{"": 20}},
+		{query: "max(CPUutilization*)", want: map[string]float64{"": 30}},
+		{query: "count({__name__=~\"CPU.+\"})", want: map[string]float64{"": 3}},
+		{query: "topk(2, CPUutilization*)", want: map[string]float64{"CPUutilization2": 30, "CPUutilization3": 20}},
+		{query: "bottomk(1, CPUutilization*)", want: map[string]float64{"CPUutilization1": 10}},
+		{query: "FreeMemory / TotalMemory * 100", want: map[string]float64{"": 25}},
+		{query: "PollCount * 2", want: map[string]float64{"PollCount": 10}},
+		{query: `Requests{code="200"}`, want: map[string]float64{"Requests{code=200,host=a}": 90, "Requests{code=200,host=b}": 40}},
+		{query: `Requests{code!="200"}`, want: map[string]float64{"Requests{code=500,host=a}": 10}},
+		{query: "sum by (host) (Requests)", want: map[string]float64{"{host=a}": 100, "{host=b}": 40}},
+		{query: "sum(Latency) by (host) * 1000", want: map[string]float64{"{host=a}": 500, "{host=b}": 2000}},
+		{query: "sum by (host) (Requests) / sum by (host) (Latency)", want: map[string]float64{"{host=a}": 200, "{host=b}": 20}},
+		{query: "Unknown", want: map[string]float64{}},
+		{query: "CPUutilization1 / 0", want: map[string]float64{}},
+		{query: "*Memory", want: map[string]float64{"FreeMemory": 256, "TotalMemory": 1024}},
+		{query: "CPUutilization* + FreeMemory", err: true},
+		{query: "sum(1)", err: true},
+		{query: "rate(PollCount[1m])", err: true},
+		{query: "PollCount[1m]", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			result, err := e.Query(context.Background(), tt.query, time.Now())
+			if tt.err {
+				if err == nil {
+					t.Errorf("Error: query must fail, got %+v", result)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Error: %s", err)
+			}
+
+			got := make(map[string]float64)
+			for _, s := range result.Vector {
+				got[s.ID] = s.Value
+			}
+
+			if result.Type != TypeVector || len(got) != len(tt.want) {
+				t.Fatalf("Error: got %+v, want %v", result, tt.want)
+			}
+			for id, v := range tt.want {
+				if got[id] != v {
+					t.Errorf("Error: %s = %v, want %v", id, got[id], v)
+				}
+			}
+		})
+	}
+
+	result, err := e.Query(context.Background(), "(1 + 2) * 4", time.Now())
+	if err != nil || result.Type != TypeScalar || result.Scalar != 12 {
+		t.Errorf("Error: scalar result is incorrect: %+v, %v", result, err)
+	}
+
+	if _, err := e.Query(context.Background(), "1 / 0", time.Now()); err == nil {
+		t.Errorf("Error: division by zero must fail")
+	}
+}
+
+func TestRate(t *testing.T) {
+	st := newTestStorage()
+	h := NewHistory(10 * time.Minute)
+	e := NewEngine(st, h)
+
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i <= 10; i++ {
+		st.Set("PollCount", int64(i*30))
+		if err := h.Record(context.Background(), st, now.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+	now = now.Add(10 * time.Minute)
+
+	result, err := e.Query(context.Background(), "rate(PollCount[5m])", now)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if len(result.Vector) != 1 || result.Vector[0].Value != 0.5 {
+		t.Errorf("Error: rate is incorrect: %+v", result)
+	}
+
+	// retention keeps 10 minutes of samples
+	if samples := h.Samples("PollCount", time.Time{}, now); len(samples) != 11 {
+		t.Errorf("Error: history has %d samples, want 11", len(samples))
+	}
+
+	h.Add("PollCount", now.Add(time.Minute), 330)
+	if samples := h.Samples("PollCount", time.Time{}, now.Add(time.Hour)); len(samples) != 11 || samples[0].Value != 30 {
+		t.Errorf("Error: old samples must be removed: %+v", samples)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	e := NewEngine(newTestStorage(), nil)
+
+	tests := []struct {
+		query string
+		code  int
+		want  string
+	}{
+		{query: "sum(CPUutilization*)", code: http.StatusOK, want: `{"type":"vector","result":[{"id":"","value":60}]}`},
+		{query: "PollCount", code: http.StatusOK, want: `{"type":"vector","result":[{"id":"PollCount","name":"PollCount","value":5}]}`},
+		{query: "Unknown", code: http.StatusOK, want: `{"type":"vector","result":[]}`},
+		{query: "2 * 3", code: http.StatusOK, want: `{"type":"scalar","result":6}`},
+		{query: "sum(", code: http.StatusBadRequest},
+		{query: "", code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			e.Handler(w, httptest.NewRequest("GET", "/query?q="+url.QueryEscape(tt.query), nil))
+
+			if w.Code != tt.code {
+				t.Fatalf("Error: status %d, want %d: %s", w.Code, tt.code, w.Body.String())
+			}
+
+			if tt.want != "" && w.Body.String() != tt.want {
+				t.Errorf("Error: got %s, want %s", w.Body.String(), tt.want)
+			}
+
+			if tt.code != http.StatusOK {
+				var resp map[string]string
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp["error"] == "" {
+					t.Errorf("Error: error response is incorrect: %s", w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestStorageError(t *testing.T) {
+	err := error(storageError{context.DeadlineExceeded})
+
+	if !errors.Is(err, ErrStorage) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Error: storage error must match both ErrStorage and the cause")
+	}
+}
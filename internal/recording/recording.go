@@ -0,0 +1,211 @@
+// Пакет recording предназначен для вычисления производных метрик по правилам записи.
+//
+// Правило записи содержит имя новой метрики и запрос на языке пакета query,
+// например {"record":"MemoryUsedPct","expr":"100*(TotalMemory-FreeMemory)/TotalMemory"}.
+// Recorder с заданным интервалом вычисляет правила по порядку и записывает
+// результаты в хранилище как gauge, поэтому правило может использовать
+// результаты предыдущих правил.
+package recording
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gometric/internal/logger"
+	"gometric/internal/metrics"
+	"gometric/internal/query"
+	"gometric/internal/storage"
+)
+
+// DefaultInterval период вычисления правил по умолчанию.
+const DefaultInterval = 15 * time.Second
+
+// Rule описывает правило записи.
+type Rule struct {
+	// Record имя записываемой метрики.
+	Record string `json:"record"`
+	// Expr запрос, результат которого записывается.
+	Expr string `json:"expr"`
+	// Labels метки, добавляемые к записываемым метрикам.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	expr query.Node
+}
+
+// Validate проверяет правило и разбирает запрос.
+func (r *Rule) Validate() error {
+	if r.Record == "" {
+		return fmt.Errorf("record name must not be empty")
+	}
+
+	if strings.ContainsAny(r.Record, "{}") {
+		return fmt.Errorf("rule %s: record name must not contain labels", r.Record)
+	}
+
+	n, err := query.Parse(r.Expr)
+	if err != nil {
+		return fmt.Errorf("rule %s: %w", r.Record, err)
+	}
+	r.expr = n
+
+	return nil
+}
+
+// LoadRules читает правила из JSON файла вида {"rules": [...]}.
+func LoadRules(file string) ([]Rule, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg struct {
+		Rules []Rule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	if err := ValidateRules(cfg.Rules); err != nil {
+		return nil, err
+	}
+
+	return cfg.Rules, nil
+}
+
+// ValidateRules проверяет правила и уникальность записываемых имен.
+func ValidateRules(rules []Rule) error {
+	names := make(map[string]bool, len(rules))
+
+	for i := range rules {
+		if err := rules[i].Validate(); err != nil {
+			return err
+		}
+
+		if names[rules[i].Record] {
+			return fmt.Errorf("duplicate rule %s", rules[i].Record)
+		}
+		names[rules[i].Record] = true
+	}
+
+	return nil
+}
+
+// Recorder вычисляет правила записи.
+type Recorder struct {
+	storage storage.Storage
+	engine  *query.Engine
+	rules   []Rule
+
+	// Interval период вычисления правил.
+	Interval time.Duration
+}
+
+// NewRecorder создает Recorder, который вычисляет правила rules движком engine
+// и записывает результаты в хранилище st.
+func NewRecorder(st storage.Storage, engine *query.Engine, rules []Rule) (*Recorder, error) {
+	if err := ValidateRules(rules); err != nil {
+		return nil, err
+	}
+
+	return &Recorder{
+		storage:  st,
+		engine:   engine,
+		rules:    rules,
+		Interval: DefaultInterval,
+	}, nil
+}
+
+// Run вычисляет правила с периодом Interval до отмены контекста ctx.
+func (r *Recorder) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := r.Eval(ctx, now); err != nil {
+				logger.Error("recording rules evaluation failed", err)
+			}
+		}
+	}
+}
+
+// Eval один раз вычисляет правила на момент now.
+// Ошибка одного правила не прерывает вычисление остальных, возвращается первая ошибка.
+func (r *Recorder) Eval(ctx context.Context, now time.Time) error {
+	var first error
+
+	for _, rule := range r.rules {
+		if err := r.eval(ctx, rule, now); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			logger.Debug("recording rule " + rule.Record + ": " + err.Error())
+			if first == nil {
+				first = fmt.Errorf("rule %s: %w", rule.Record, err)
+			}
+		}
+	}
+
+	return first
+}
+
+func (r *Recorder) eval(ctx context.Context, rule Rule, now time.Time) error {
+	result, err := r.engine.Eval(ctx, rule.expr, now)
+	if err != nil {
+		return err
+	}
+
+	data := make(map[string]interface{})
+	add := func(labels map[string]string, v float64) error {
+		merged := make(map[string]string, len(labels)+len(rule.Labels))
+		for k, v := range labels {
+			merged[k] = v
+		}
+		for k, v := range rule.Labels {
+			merged[k] = v
+		}
+
+		id := metrics.FormatID(rule.Record, merged)
+		if _, ok := data[id]; ok {
+			return fmt.Errorf("several results have labels of %s", id)
+		}
+		data[id] = v
+
+		return nil
+	}
+
+	if result.Type == query.TypeScalar {
+		if err := add(nil, result.Scalar); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range result.Vector {
+		if err := add(s.Labels, s.Value); err != nil {
+			return err
+		}
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	// a recorded gauge must not overwrite a counter
+	for id := range data {
+		if v, err := r.storage.GetCtx(ctx, id); err == nil {
+			if _, ok := v.(float64); !ok {
+				return fmt.Errorf("metric %s exists and is not a gauge", id)
+			}
+		}
+	}
+
+	return r.storage.MSetCtx(ctx, data)
+}
@@ -0,0 +1,112 @@
+package recording
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"gometric/internal/memstorage"
+	"gometric/internal/query"
+)
+
+func TestRecorder(t *testing.T) {
+	st := memstorage.NewMemStorage()
+	history := query.NewHistory(time.Hour)
+
+	r, err := NewRecorder(st, query.NewEngine(st, history), []Rule{
+		{Record: "MemoryUsedPct", Expr: "100*(TotalMemory-FreeMemory)/TotalMemory"},
+		{Record: "MemoryUsedPctDouble", Expr: "MemoryUsedPct * 2"},
+		{Record: "PollRate", Expr: "rate(PollCount[1m])"},
+		{Record: "CPUTotal", Expr: "sum by (host) (CPUutilization)", Labels: map[string]string{"source": "rule"}},
+		{Record: "Answer", Expr: "6 * 7"},
+	})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	st.Set("TotalMemory", float64(1000))
+	st.Set("FreeMemory", float64(250))
+	st.Set("CPUutilization{core=1,host=a}", float64(10))
+	st.Set("CPUutilization{core=2,host=a}", float64(30))
+
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		st.Set("PollCount", int64(i*20))
+		history.Record(context.Background(), st, now.Add(time.Duration(i)*10*time.Second))
+	}
+	now = now.Add(20 * time.Second)
+
+	if err := r.Eval(context.Background(), now); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	want := map[string]float64{
+		"MemoryUsedPct":                75,
+		"MemoryUsedPctDouble":          150,
+		"PollRate":                     2,
+		"CPUTotal{host=a,source=rule}": 40,
+		"Answer":                       42,
+	}
+	for id, v := range want {
+		got, err := st.Get(id)
+		if err != nil || got != v {
+			t.Errorf("Error: %s = %v, want %v (%v)", id, got, v, err)
+		}
+	}
+}
+
+func TestRecorderErrors(t *testing.T) {
+	st := memstorage.NewMemStorage()
+	st.Set("PollCount", int64(1))
+
+	r, err := NewRecorder(st, query.NewEngine(st, nil), []Rule{
+		{Record: "PollCount", Expr: "PollCount * 2"},
+		{Record: "Answer", Expr: "42"},
+	})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	// the failed rule does not stop the next ones
+	if err := r.Eval(context.Background(), time.Now()); err == nil {
+		t.Errorf("Error: counter must not be overwritten")
+	}
+
+	if v, _ := st.Get("PollCount"); v != int64(1) {
+		t.Errorf("Error: counter is overwritten: %v", v)
+	}
+	if v, _ := st.Get("Answer"); v != float64(42) {
+		t.Errorf("Error: next rule is not recorded: %v", v)
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	file := "/tmp/test_recording_rules.json"
+	defer os.Remove(file)
+
+	tests := []struct {
+		name  string
+		rules string
+		err   bool
+	}{
+		{name: "valid #1", rules: `{"rules":[{"record":"MemoryUsedPct","expr":"100*(TotalMemory-FreeMemory)/TotalMemory"}]}`},
+		{name: "empty record #2", rules: `{"rules":[{"expr":"1"}]}`, err: true},
+		{name: "invalid expr #3", rules: `{"rules":[{"record":"a","expr":"sum("}]}`, err: true},
+		{name: "labels in record #4", rules: `{"rules":[{"record":"a{b=c}","expr":"1"}]}`, err: true},
+		{name: "duplicate #5", rules: `{"rules":[{"record":"a","expr":"1"},{"record":"a","expr":"2"}]}`, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(file, []byte(tt.rules), 0644); err != nil {
+				t.Fatalf("Error: %s", err)
+			}
+
+			_, err := LoadRules(file)
+			if (err != nil) != tt.err {
+				t.Errorf("Error: got %v, want error %v", err, tt.err)
+			}
+		})
+	}
+}
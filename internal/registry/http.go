@@ -0,0 +1,57 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"gometric/internal/logger"
+)
+
+// agentsResponse описывает ответ /agents.
+type agentsResponse struct {
+	Online  int     `json:"online"`
+	Offline int     `json:"offline"`
+	Agents  []Agent `json:"agents"`
+}
+
+// ListHandler возвращает агентов в формате json.
+// Параметр status (online или offline) отбирает агентов по состоянию.
+func (r *Registry) ListHandler(w http.ResponseWriter, req *http.Request) {
+	status := req.URL.Query().Get("status")
+	if status != "" && status != StatusOnline && status != StatusOffline {
+		writeError(w, http.StatusBadRequest, "invalid status")
+		return
+	}
+
+	resp := agentsResponse{Agents: make([]Agent, 0)}
+	for _, a := range r.List(time.Now()) {
+		if a.Status == StatusOnline {
+			resp.Online++
+		} else {
+			resp.Offline++
+		}
+
+		if status == "" || a.Status == status {
+			resp.Agents = append(resp.Agents, a)
+		}
+	}
+
+	ret, err := json.Marshal(resp)
+	if err != nil {
+		logger.Error("", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(ret)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	ret, _ := json.Marshal(map[string]string{"error": msg})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(ret)
+}
@@ -0,0 +1,249 @@
+// Пакет registry предназначен для учета агентов, которые отправляют метрики на сервер.
+//
+// Агент передает в заголовках запросов свой идентификатор, имя хоста, версию,
+// включенные сборщики и интервал отчетов. Middleware Handler регистрирует агента
+// при первом запросе и обновляет время последнего запроса (heartbeat) при каждом
+// следующем. Агент считается отключенным, если он не присылал запросы дольше
+// MissedReports интервалов отчетов. Run периодически записывает в хранилище
+// метрики агентов: время последнего отчета, состояние, число запросов и ошибок.
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gometric/internal/logger"
+	"gometric/internal/metrics"
+	"gometric/internal/replication"
+	"gometric/internal/storage"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Заголовки, которыми агент сообщает о себе.
+const (
+	HeaderID       = "X-Agent-ID"
+	HeaderHostname = "X-Agent-Hostname"
+	HeaderVersion  = "X-Agent-Version"
+	// HeaderCollectors список включенных сборщиков через запятую.
+	HeaderCollectors = "X-Agent-Collectors"
+	// HeaderInterval интервал отчетов в секундах.
+	HeaderInterval = "X-Agent-Interval"
+)
+
+// Состояния агента.
+const (
+	StatusOnline  = "online"
+	StatusOffline = "offline"
+)
+
+// DefaultMissedReports число пропущенных отчетов, после которого агент считается отключенным.
+const DefaultMissedReports = 3
+
+// DefaultTimeout время без запросов, после которого отключенным считается агент,
+// не сообщивший интервал отчетов.
+const DefaultTimeout = time.Minute
+
+// DefaultInterval период записи метрик агентов по умолчанию.
+const DefaultInterval = 10 * time.Second
+
+// Agent описывает агента.
+type Agent struct {
+	ID         string   `json:"id"`
+	Hostname   string   `json:"hostname,omitempty"`
+	Version    string   `json:"version,omitempty"`
+	Collectors []string `json:"collectors,omitempty"`
+	// ReportInterval интервал отчетов в секундах, 0 если неизвестен.
+	ReportInterval int       `json:"report_interval"`
+	Addr           string    `json:"addr"`
+	FirstSeen      time.Time `json:"first_seen"`
+	LastSeen       time.Time `json:"last_seen"`
+	// Requests число запросов агента, Errors число запросов, завершившихся ошибкой.
+	Requests  int64   `json:"requests"`
+	Errors    int64   `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	Status    string  `json:"status"`
+}
+
+// FromRequest возвращает сведения об агенте из заголовков запроса r.
+// Если запрос отправлен не агентом, ok равно false.
+func FromRequest(r *http.Request) (a Agent, ok bool) {
+	a.ID = strings.TrimSpace(r.Header.Get(HeaderID))
+	if a.ID == "" {
+		return a, false
+	}
+
+	a.Hostname = r.Header.Get(HeaderHostname)
+	a.Version = r.Header.Get(HeaderVersion)
+	for _, c := range strings.Split(r.Header.Get(HeaderCollectors), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			a.Collectors = append(a.Collectors, c)
+		}
+	}
+	a.ReportInterval, _ = strconv.Atoi(r.Header.Get(HeaderInterval))
+
+	a.Addr = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		a.Addr = host
+	}
+
+	return a, true
+}
+
+// Registry описывает реестр агентов.
+type Registry struct {
+	mu     sync.Mutex
+	agents map[string]*Agent
+
+	// MissedReports число пропущенных отчетов до отключения агента.
+	MissedReports int
+	// Timeout время без запросов до отключения агента с неизвестным интервалом отчетов.
+	Timeout time.Duration
+	// Interval период записи метрик агентов.
+	Interval time.Duration
+}
+
+// New создает пустой реестр.
+func New() *Registry {
+	return &Registry{
+		agents:        make(map[string]*Agent),
+		MissedReports: DefaultMissedReports,
+		Timeout:       DefaultTimeout,
+		Interval:      DefaultInterval,
+	}
+}
+
+// Heartbeat регистрирует агента a или обновляет сведения о нем на момент now.
+// failed отмечает запрос, завершившийся ошибкой.
+func (r *Registry) Heartbeat(a Agent, failed bool, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	agent, ok := r.agents[a.ID]
+	if !ok {
+		agent = &Agent{ID: a.ID, FirstSeen: now}
+		r.agents[a.ID] = agent
+		logger.Info(fmt.Sprintf("agent %s registered from %s", a.ID, a.Addr))
+	}
+
+	agent.Hostname = a.Hostname
+	agent.Version = a.Version
+	agent.Collectors = a.Collectors
+	agent.ReportInterval = a.ReportInterval
+	agent.Addr = a.Addr
+	agent.LastSeen = now
+	agent.Requests++
+	if failed {
+		agent.Errors++
+	}
+}
+
+// status возвращает состояние агента a на момент now.
+func (r *Registry) status(a *Agent, now time.Time) string {
+	timeout := r.Timeout
+	if a.ReportInterval > 0 {
+		timeout = time.Duration(r.MissedReports*a.ReportInterval) * time.Second
+	}
+
+	if now.Sub(a.LastSeen) > timeout {
+		return StatusOffline
+	}
+
+	return StatusOnline
+}
+
+// List возвращает агентов, отсортированных по идентификатору, с состоянием на момент now.
+func (r *Registry) List(now time.Time) []Agent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := make([]Agent, 0, len(r.agents))
+	for _, a := range r.agents {
+		agent := *a
+		agent.Collectors = append([]string(nil), a.Collectors...)
+		agent.Status = r.status(a, now)
+		if agent.Requests > 0 {
+			agent.ErrorRate = float64(agent.Errors) / float64(agent.Requests)
+		}
+		result = append(result, agent)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+
+	return result
+}
+
+// Handler учитывает запросы агентов к next. Запросы без заголовка HeaderID не учитываются.
+func (r *Registry) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		a, ok := FromRequest(req)
+		if !ok {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, req.ProtoMajor)
+		next.ServeHTTP(ww, req)
+
+		r.Heartbeat(a, ww.Status() >= http.StatusBadRequest, time.Now())
+	})
+}
+
+// Metrics возвращает метрики агентов на момент now.
+func (r *Registry) Metrics(now time.Time) map[string]interface{} {
+	data := make(map[string]interface{})
+
+	for _, a := range r.List(now) {
+		labels := map[string]string{"agent": a.ID}
+
+		online := 0.0
+		if a.Status == StatusOnline {
+			online = 1
+		}
+
+		data[metrics.FormatID("agent_last_report", labels)] = float64(a.LastSeen.Unix())
+		data[metrics.FormatID("agent_online", labels)] = online
+		data[metrics.FormatID("agent_requests", labels)] = a.Requests
+		data[metrics.FormatID("agent_errors", labels)] = a.Errors
+		data[metrics.FormatID("agent_error_rate", labels)] = a.ErrorRate
+	}
+
+	return data
+}
+
+// Run записывает метрики агентов в хранилище st раз в Interval до отмены контекста ctx.
+func (r *Registry) Run(ctx context.Context, st storage.Storage) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			data := r.Metrics(now)
+			if len(data) == 0 {
+				continue
+			}
+
+			err := st.MSetCtx(ctx, data)
+			switch {
+			case errors.Is(err, replication.ErrReadOnly):
+				// followers receive agent metrics from the primary
+				logger.Debug("registry: agent metrics skipped on read-only replica")
+			case err != nil && ctx.Err() == nil:
+				logger.Error("registry: could not write agent metrics", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	r := New()
+	now := time.Now()
+
+	r.Heartbeat(Agent{ID: "b", Addr: "10.0.0.2"}, false, now.Add(-2*time.Minute))
+	r.Heartbeat(Agent{ID: "a", Hostname: "vm-1", ReportInterval: 10}, false, now.Add(-time.Minute))
+	r.Heartbeat(Agent{ID: "a", Hostname: "vm-1", ReportInterval: 10, Version: "v2"}, true, now.Add(-20*time.Second))
+
+	agents := r.List(now)
+	if len(agents) != 2 || agents[0].ID != "a" || agents[1].ID != "b" {
+		t.Fatalf("Error: agents are incorrect: %v", agents)
+	}
+
+	a := agents[0]
+	if a.Status != StatusOnline || a.Version != "v2" || a.Requests != 2 || a.Errors != 1 || a.ErrorRate != 0.5 ||
+		!a.FirstSeen.Equal(now.Add(-time.Minute)) {
+		t.Errorf("Error: agent is incorrect: %+v", a)
+	}
+
+	// unknown interval uses the timeout
+	if agents[1].Status != StatusOffline {
+		t.Errorf("Error: agent must be offline: %+v", agents[1])
+	}
+
+	// three missed reports
+	if agents = r.List(now.Add(11 * time.Second)); agents[0].Status != StatusOffline {
+		t.Errorf("Error: agent must be offline: %+v", agents[0])
+	}
+
+	data := r.Metrics(now)
+	if data["agent_online{agent=a}"] != 1.0 || data["agent_online{agent=b}"] != 0.0 ||
+		data["agent_requests{agent=a}"] != int64(2) || data["agent_errors{agent=a}"] != int64(1) ||
+		data["agent_error_rate{agent=a}"] != 0.5 || data["agent_last_report{agent=b}"] != float64(now.Add(-2*time.Minute).Unix()) {
+		t.Errorf("Error: agent metrics are incorrect: %v", data)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := New()
+
+	h := r.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/bad" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+
+	for _, path := range []string{"/update/", "/bad", "/update/"} {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set(HeaderID, "agent-1")
+		req.Header.Set(HeaderCollectors, "runtime, cpu")
+		req.Header.Set(HeaderInterval, "5")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// requests without the agent header are not counted
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/update/", nil))
+
+	rec := httptest.NewRecorder()
+	r.ListHandler(rec, httptest.NewRequest(http.MethodGet, "/agents?status=online", nil))
+
+	var resp agentsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if resp.Online != 1 || resp.Offline != 0 || len(resp.Agents) != 1 {
+		t.Fatalf("Error: agents are incorrect: %s", rec.Body)
+	}
+
+	a := resp.Agents[0]
+	if a.ID != "agent-1" || a.Addr != "192.0.2.1" || a.Requests != 3 || a.Errors != 1 ||
+		a.ReportInterval != 5 || len(a.Collectors) != 2 || a.Collectors[1] != "cpu" {
+		t.Errorf("Error: agent is incorrect: %+v", a)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ListHandler(rec, httptest.NewRequest(http.MethodGet, "/agents?status=lost", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Error: invalid status must be rejected: %d", rec.Code)
+	}
+}
@@ -0,0 +1,382 @@
+package replication
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"gometric/internal/logger"
+	"gometric/internal/metrics"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// signHeader заголовок с подписью тела сообщения.
+const signHeader = "X-Replication-Hash"
+
+// maxMessageAge допустимое расхождение времени отправки снимка или команды и времени узла.
+// Более старые сообщения считаются повторно отправленными и отклоняются.
+const maxMessageAge = time.Minute
+
+type applyRequest struct {
+	Primary string  `json:"primary"`
+	Entries []Entry `json:"entries"`
+}
+
+type snapshotRequest struct {
+	Primary string            `json:"primary"`
+	Seq     uint64            `json:"seq"`
+	Metrics []metrics.Metrics `json:"metrics"`
+	// Time время отправки в наносекундах Unix, входит в подписанное тело
+	Time int64 `json:"time"`
+}
+
+// controlRequest описывает команду смены роли.
+type controlRequest struct {
+	// Time время отправки в наносекундах Unix, входит в подписанное тело
+	Time int64 `json:"time"`
+}
+
+// Handler возвращает обработчики репликации:
+//
+//	GET  /status   состояние узла
+//	POST /apply    применение записей журнала (follower)
+//	POST /snapshot применение снимка (follower)
+//	POST /promote  повышение до primary
+//	POST /demote   понижение до follower
+//
+// Если задан ключ, тела POST запросов должны быть подписаны. Снимок и команды
+// содержат время отправки, устаревшие сообщения отклоняются.
+func (n *Node) Handler() http.Handler {
+	r := chi.NewRouter()
+
+	r.Get("/status", n.statusHandler)
+	r.Group(func(r chi.Router) {
+		r.Use(n.verifyHandler)
+		r.Post("/apply", n.applyHandler)
+		r.Post("/snapshot", n.snapshotHandler)
+		r.Post("/promote", n.controlHandler(n.Promote))
+		r.Post("/demote", n.controlHandler(n.Demote))
+	})
+
+	return r
+}
+
+func (n *Node) statusHandler(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, http.StatusOK, n.Status())
+}
+
+// controlHandler выполняет команду смены роли action, если она отправлена недавно.
+func (n *Node) controlHandler(action func() Status) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req controlRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !fresh(req.Time, time.Now()) {
+			logger.Debug("replication: stale command")
+			http.Error(w, "stale request", http.StatusForbidden)
+			return
+		}
+
+		writeStatus(w, http.StatusOK, action())
+	}
+}
+
+// fresh проверяет, что сообщение отправлено в пределах maxMessageAge от now.
+func fresh(sent int64, now time.Time) bool {
+	d := now.Sub(time.Unix(0, sent))
+	return d < maxMessageAge && d > -maxMessageAge
+}
+
+// applyHandler применяет записи журнала. Если записи не продолжают журнал follower,
+// возвращается 409 Conflict с его состоянием.
+func (n *Node) applyHandler(w http.ResponseWriter, r *http.Request) {
+	var req applyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.role != RoleFollower || req.Primary != n.primary {
+		writeStatus(w, http.StatusConflict, Status{Role: n.role, Primary: n.primary, Seq: n.seq})
+		return
+	}
+
+	for _, e := range req.Entries {
+		if e.Seq <= n.seq {
+			// already applied
+			continue
+		}
+
+		if e.Seq != n.seq+1 {
+			writeStatus(w, http.StatusConflict, Status{Role: n.role, Primary: n.primary, Seq: n.seq})
+			return
+		}
+
+		if err := n.apply(r.Context(), e); err != nil {
+			logger.Error("replication: apply entry failed", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		n.seq = e.Seq
+	}
+
+	writeStatus(w, http.StatusOK, Status{Role: n.role, Primary: n.primary, Seq: n.seq})
+}
+
+// snapshotHandler применяет снимок метрик primary. Снимок того же primary,
+// который не новее состояния follower, возвращает 409 Conflict.
+func (n *Node) snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	var req snapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !fresh(req.Time, time.Now()) {
+		logger.Debug("replication: stale snapshot")
+		http.Error(w, "stale request", http.StatusForbidden)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.role != RoleFollower || req.Primary == n.primary && req.Seq <= n.seq {
+		writeStatus(w, http.StatusConflict, Status{Role: n.role, Primary: n.primary, Seq: n.seq})
+		return
+	}
+
+	if err := n.applySnapshot(r.Context(), req.Metrics); err != nil {
+		logger.Error("replication: apply snapshot failed", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	n.primary = req.Primary
+	n.seq = req.Seq
+	logger.Info(fmt.Sprintf("replication: snapshot %s/%d applied", req.Primary, req.Seq))
+
+	writeStatus(w, http.StatusOK, Status{Role: n.role, Primary: n.primary, Seq: n.seq})
+}
+
+// apply применяет запись журнала. Уже удаленные метрики пропускаются.
+func (n *Node) apply(ctx context.Context, e Entry) error {
+	if data := toData(e.Metrics); len(data) > 0 {
+		if err := n.backend.MSetCtx(ctx, data); err != nil {
+			return err
+		}
+	}
+
+	for _, k := range e.Deleted {
+		if err := n.backend.DeleteCtx(ctx, k); err != nil && !errors.Is(err, metrics.ErrNotFound) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applySnapshot записывает метрики снимка и удаляет метрики, которых нет в снимке.
+func (n *Node) applySnapshot(ctx context.Context, list []metrics.Metrics) error {
+	data := toData(list)
+
+	if len(data) > 0 {
+		if err := n.backend.MSetCtx(ctx, data); err != nil {
+			return err
+		}
+	}
+
+	names, err := n.backend.ListCtx(ctx)
+	if err != nil {
+		return err
+	}
+
+	var deleted []string
+	for _, k := range names {
+		if _, ok := data[k]; !ok {
+			deleted = append(deleted, k)
+		}
+	}
+
+	return n.apply(ctx, Entry{Deleted: deleted})
+}
+
+// verifyHandler проверяет подпись тела запроса, если задан ключ.
+func (n *Node) verifyHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := n.key.Get()
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		mac1, err := metrics.Sign(string(body), key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		mac2, err := hex.DecodeString(r.Header.Get(signHeader))
+		if err != nil || !hmac.Equal(mac1, mac2) {
+			logger.Debug("replication: invalid signature")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewBuffer(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeStatus(w http.ResponseWriter, code int, st Status) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(st)
+}
+
+// followerStatus запрашивает состояние follower.
+func (n *Node) followerStatus(ctx context.Context, f *follower) (Status, error) {
+	var st Status
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.endpoint("/status"), nil)
+	if err != nil {
+		return st, err
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return st, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return st, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&st)
+	return st, err
+}
+
+// sendEntries отправляет записи журнала и обновляет известное состояние follower.
+func (n *Node) sendEntries(ctx context.Context, f *follower, primary string, entries []Entry) error {
+	st, code, err := n.post(ctx, f.endpoint("/apply"), applyRequest{Primary: primary, Entries: entries})
+	if err != nil {
+		return err
+	}
+
+	switch code {
+	case http.StatusOK:
+		f.primary, f.acked = primary, st.Seq
+	case http.StatusConflict:
+		if st.Role == RolePrimary {
+			return fmt.Errorf("follower %s is primary", f.url)
+		}
+		// resync: the status is requested again and a snapshot is sent if needed
+		f.primary, f.acked = "", 0
+	default:
+		return fmt.Errorf("unexpected status %d", code)
+	}
+
+	return nil
+}
+
+// sendSnapshot отправляет follower снимок всех метрик.
+func (n *Node) sendSnapshot(ctx context.Context, f *follower) error {
+	primary, seq, list, err := n.snapshot(ctx)
+	if err != nil {
+		return err
+	}
+
+	st, code, err := n.post(ctx, f.endpoint("/snapshot"), snapshotRequest{
+		Primary: primary,
+		Seq:     seq,
+		Metrics: list,
+		Time:    time.Now().UnixNano(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if code != http.StatusOK {
+		return fmt.Errorf("snapshot rejected with status %d", code)
+	}
+
+	f.primary, f.acked = st.Primary, st.Seq
+	logger.Info(fmt.Sprintf("replication: snapshot %s/%d sent to %s", primary, seq, f.url))
+
+	return nil
+}
+
+// post отправляет сжатое и подписанное сообщение и возвращает состояние follower из ответа.
+func (n *Node) post(ctx context.Context, url string, msg interface{}) (Status, int, error) {
+	var st Status
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return st, 0, err
+	}
+
+	var b bytes.Buffer
+	g := gzip.NewWriter(&b)
+	if _, err := g.Write(body); err != nil {
+		return st, 0, err
+	}
+	if err := g.Close(); err != nil {
+		return st, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &b)
+	if err != nil {
+		return st, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	if key := n.key.Get(); key != "" {
+		sign, err := metrics.Sign(string(body), key)
+		if err != nil {
+			return st, 0, err
+		}
+		req.Header.Set(signHeader, hex.EncodeToString(sign))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return st, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusConflict {
+		if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+			return st, resp.StatusCode, err
+		}
+	}
+
+	return st, resp.StatusCode, nil
+}
+
+func (f *follower) endpoint(path string) string {
+	return strings.TrimRight(f.url, "/") + "/replication" + path
+}
@@ -0,0 +1,553 @@
+// Пакет replication предназначен для репликации метрик с основного сервера (primary)
+// на резервные (followers) по HTTP.
+//
+// Node оборачивает хранилище сервера. На primary каждая успешная запись получает
+// порядковый номер и попадает в журнал, откуда отправляется всем followers.
+// Follower принимает записи строго по порядку и не принимает записи от клиентов.
+// Если follower отстал больше, чем хранит журнал, перезапущен или следовал за другим
+// primary, ему отправляется снимок всех метрик, после чего передача журнала продолжается.
+// Follower может быть повышен до primary, при этом у журнала меняется идентификатор
+// и его собственные followers синхронизируются заново.
+package replication
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"gometric/internal/logger"
+	"gometric/internal/metrics"
+	"gometric/internal/storage"
+)
+
+// Роли узла.
+const (
+	RolePrimary  = "primary"
+	RoleFollower = "follower"
+)
+
+// Значения по умолчанию.
+const (
+	DefaultLogSize   = 10000
+	DefaultBatchSize = 500
+	DefaultInterval  = time.Second
+)
+
+// ErrReadOnly возвращается при попытке записи на follower.
+var ErrReadOnly = errors.New("replica is read-only")
+
+// Entry описывает одну запись журнала репликации.
+type Entry struct {
+	Seq     uint64            `json:"seq"`
+	Metrics []metrics.Metrics `json:"metrics"`
+	// Deleted удаленные метрики, применяются после записи Metrics.
+	Deleted []string `json:"deleted,omitempty"`
+}
+
+// Status описывает состояние узла.
+type Status struct {
+	Role    string `json:"role"`
+	Primary string `json:"primary"`
+	Seq     uint64 `json:"seq"`
+}
+
+// Config описывает настройки репликации.
+type Config struct {
+	// Role начальная роль узла: primary или follower.
+	Role string
+	// Followers адреса followers, например http://10.0.0.2:8080.
+	Followers []string
+	// Key ключ подписи сообщений репликации, если не пустой.
+	Key string
+	// Interval период повторных попыток отправки.
+	Interval time.Duration
+	// LogSize число записей, хранимых в журнале для догоняющих followers.
+	LogSize int
+	// BatchSize максимальное число записей в одном запросе.
+	BatchSize int
+}
+
+// Node описывает узел репликации.
+type Node struct {
+	backend storage.Storage
+	cfg     Config
+	client  *http.Client
+	// key ключ подписи, заменяет cfg.Key после SetKey
+	key metrics.Key
+
+	mu      sync.Mutex
+	role    string
+	primary string
+	seq     uint64
+	log     []Entry
+
+	followers []*follower
+}
+
+// follower описывает состояние отправки на один follower.
+type follower struct {
+	url    string
+	notify chan struct{}
+
+	// primary и acked известное состояние follower
+	primary string
+	acked   uint64
+}
+
+// NewNode создает узел репликации над хранилищем backend.
+func NewNode(backend storage.Storage, cfg Config) (*Node, error) {
+	if cfg.Role != RolePrimary && cfg.Role != RoleFollower {
+		return nil, errors.New("unknown replication role " + cfg.Role)
+	}
+
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+
+	if cfg.LogSize <= 0 {
+		cfg.LogSize = DefaultLogSize
+	}
+
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+
+	n := &Node{
+		backend: backend,
+		cfg:     cfg,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		role:    cfg.Role,
+	}
+	n.key.Set(cfg.Key)
+
+	if n.role == RolePrimary {
+		n.primary = newID()
+	}
+
+	for _, url := range cfg.Followers {
+		n.followers = append(n.followers, &follower{
+			url:    url,
+			notify: make(chan struct{}, 1),
+		})
+	}
+
+	return n, nil
+}
+
+// newID возвращает случайный идентификатор журнала.
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// Unwrap возвращает хранилище, над которым построен узел.
+func (n *Node) Unwrap() storage.Storage {
+	return n.backend
+}
+
+// SetKey заменяет ключ подписи сообщений репликации.
+func (n *Node) SetKey(key string) {
+	n.key.Set(key)
+}
+
+// Status возвращает текущее состояние узла.
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return Status{Role: n.role, Primary: n.primary, Seq: n.seq}
+}
+
+// Promote делает узел primary. Номера записей продолжаются,
+// но журнал получает новый идентификатор.
+func (n *Node) Promote() Status {
+	n.mu.Lock()
+	if n.role != RolePrimary {
+		n.role = RolePrimary
+		n.primary = newID()
+		n.log = nil
+		logger.Info("replication: promoted to primary")
+	}
+	n.mu.Unlock()
+
+	n.notifyFollowers()
+
+	return n.Status()
+}
+
+// Demote делает узел follower. Узел будет синхронизирован новым primary.
+func (n *Node) Demote() Status {
+	n.mu.Lock()
+	if n.role != RoleFollower {
+		n.role = RoleFollower
+		n.primary = ""
+		n.log = nil
+		logger.Info("replication: demoted to follower")
+	}
+	n.mu.Unlock()
+
+	return n.Status()
+}
+
+// Run отправляет журнал всем followers до отмены контекста ctx.
+func (n *Node) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for _, f := range n.followers {
+		wg.Add(1)
+		go func(f *follower) {
+			defer wg.Done()
+			n.runFollower(ctx, f)
+		}(f)
+	}
+
+	wg.Wait()
+}
+
+func (n *Node) runFollower(ctx context.Context, f *follower) {
+	ticker := time.NewTicker(n.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := n.sync(ctx, f); err != nil && ctx.Err() == nil {
+			logger.Debug("replication to " + f.url + " failed: " + err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-f.notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (n *Node) notifyFollowers() {
+	for _, f := range n.followers {
+		select {
+		case f.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// sync отправляет follower все записи, которых у него нет.
+func (n *Node) sync(ctx context.Context, f *follower) error {
+	for {
+		n.mu.Lock()
+		if n.role != RolePrimary {
+			n.mu.Unlock()
+			return nil
+		}
+		primary, seq := n.primary, n.seq
+		known := f.primary == primary
+		var entries []Entry
+		if known {
+			if f.acked >= seq {
+				n.mu.Unlock()
+				return nil
+			}
+			entries = n.entriesAfter(f.acked)
+		}
+		n.mu.Unlock()
+
+		if !known {
+			// follower state is unknown after start or promotion
+			st, err := n.followerStatus(ctx, f)
+			if err != nil {
+				return err
+			}
+
+			if st.Primary == primary && st.Seq <= seq {
+				f.primary, f.acked = primary, st.Seq
+				continue
+			}
+
+			if err := n.sendSnapshot(ctx, f); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if entries == nil {
+			// the log is truncated
+			if err := n.sendSnapshot(ctx, f); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := n.sendEntries(ctx, f, primary, entries); err != nil {
+			return err
+		}
+	}
+}
+
+// entriesAfter возвращает записи после seq или nil, если они уже удалены из журнала.
+// Вызывается под n.mu.
+func (n *Node) entriesAfter(seq uint64) []Entry {
+	if len(n.log) == 0 {
+		return nil
+	}
+
+	first := n.log[0].Seq
+	if seq+1 < first {
+		return nil
+	}
+
+	start := int(seq + 1 - first)
+	end := start + n.cfg.BatchSize
+	if end > len(n.log) {
+		end = len(n.log)
+	}
+
+	return append([]Entry(nil), n.log[start:end]...)
+}
+
+// snapshot возвращает номер записи и все метрики хранилища.
+// Метрики читаются после номера, поэтому снимок может содержать более новые значения,
+// которые затем повторно придут в журнале: записи содержат абсолютные значения
+// и их повторное применение безопасно.
+func (n *Node) snapshot(ctx context.Context) (string, uint64, []metrics.Metrics, error) {
+	n.mu.Lock()
+	primary, seq := n.primary, n.seq
+	n.mu.Unlock()
+
+	names, err := n.backend.ListCtx(ctx)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	data := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		v, err := n.backend.GetCtx(ctx, name)
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", 0, nil, ctx.Err()
+			}
+			continue
+		}
+		data[name] = v
+	}
+
+	return primary, seq, toMetrics(data), nil
+}
+
+// Storage
+
+// Close закрывает хранилище.
+func (n *Node) Close() error {
+	return n.backend.Close()
+}
+
+// Set задает значение value для ключа key.
+func (n *Node) Set(k string, v interface{}) error {
+	return n.SetCtx(context.Background(), k, v)
+}
+
+// SetCtx задает значение value для ключа key с учетом контекста ctx.
+func (n *Node) SetCtx(ctx context.Context, k string, v interface{}) error {
+	return n.MSetCtx(ctx, map[string]interface{}{k: v})
+}
+
+// MSet устанавливает несколько ключей одновременно.
+func (n *Node) MSet(data map[string]interface{}) error {
+	return n.MSetCtx(context.Background(), data)
+}
+
+// MSetCtx записывает данные в хранилище и добавляет их в журнал.
+// На follower возвращает ErrReadOnly.
+func (n *Node) MSetCtx(ctx context.Context, data map[string]interface{}) error {
+	n.mu.Lock()
+
+	if n.role != RolePrimary {
+		n.mu.Unlock()
+		return ErrReadOnly
+	}
+
+	// the lock keeps the log order equal to the order of writes
+	if err := n.backend.MSetCtx(ctx, data); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+
+	n.appendEntry(Entry{Metrics: toMetrics(data)})
+	n.mu.Unlock()
+
+	n.notifyFollowers()
+
+	return nil
+}
+
+// appendEntry добавляет запись в журнал. Вызывается под n.mu.
+func (n *Node) appendEntry(e Entry) {
+	n.seq++
+	e.Seq = n.seq
+
+	n.log = append(n.log, e)
+	if len(n.log) > n.cfg.LogSize {
+		n.log = append([]Entry(nil), n.log[len(n.log)-n.cfg.LogSize:]...)
+	}
+}
+
+// Delete удаляет метрику.
+func (n *Node) Delete(k string) error {
+	return n.DeleteCtx(context.Background(), k)
+}
+
+// DeleteCtx удаляет метрику и добавляет удаление в журнал.
+// На follower возвращает ErrReadOnly.
+func (n *Node) DeleteCtx(ctx context.Context, k string) error {
+	n.mu.Lock()
+
+	if n.role != RolePrimary {
+		n.mu.Unlock()
+		return ErrReadOnly
+	}
+
+	if err := n.backend.DeleteCtx(ctx, k); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+
+	n.appendEntry(Entry{Deleted: []string{k}})
+	n.mu.Unlock()
+
+	n.notifyFollowers()
+
+	return nil
+}
+
+// DeleteStaleCtx удаляет метрику, если она не обновлялась после before,
+// и добавляет удаление в журнал. На follower возвращает ErrReadOnly.
+func (n *Node) DeleteStaleCtx(ctx context.Context, k string, before time.Time) error {
+	n.mu.Lock()
+
+	if n.role != RolePrimary {
+		n.mu.Unlock()
+		return ErrReadOnly
+	}
+
+	if err := storage.DeleteStale(ctx, n.backend, k, before); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+
+	n.appendEntry(Entry{Deleted: []string{k}})
+	n.mu.Unlock()
+
+	n.notifyFollowers()
+
+	return nil
+}
+
+// Rename переименовывает метрику.
+func (n *Node) Rename(k, newKey string) error {
+	return n.RenameCtx(context.Background(), k, newKey)
+}
+
+// RenameCtx переименовывает метрику. В журнал добавляется запись новой метрики
+// и удаление старой. На follower возвращает ErrReadOnly.
+func (n *Node) RenameCtx(ctx context.Context, k, newKey string) error {
+	n.mu.Lock()
+
+	if n.role != RolePrimary {
+		n.mu.Unlock()
+		return ErrReadOnly
+	}
+
+	if err := n.backend.RenameCtx(ctx, k, newKey); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+
+	v, err := n.backend.GetCtx(ctx, newKey)
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+
+	n.appendEntry(Entry{Metrics: toMetrics(map[string]interface{}{newKey: v}), Deleted: []string{k}})
+	n.mu.Unlock()
+
+	n.notifyFollowers()
+
+	return nil
+}
+
+// Get извлекает значение value для ключа key.
+func (n *Node) Get(k string) (interface{}, error) {
+	return n.backend.Get(k)
+}
+
+// GetCtx извлекает значение value для ключа key с учетом контекста ctx.
+func (n *Node) GetCtx(ctx context.Context, k string) (interface{}, error) {
+	return n.backend.GetCtx(ctx, k)
+}
+
+// List выводит список всех ключей.
+func (n *Node) List() []string {
+	return n.backend.List()
+}
+
+// ListCtx выводит список всех ключей с учетом контекста ctx.
+func (n *Node) ListCtx(ctx context.Context) ([]string, error) {
+	return n.backend.ListCtx(ctx)
+}
+
+// toMetrics преобразует значения хранилища в метрики, отсортированные по имени.
+func toMetrics(data map[string]interface{}) []metrics.Metrics {
+	result := make([]metrics.Metrics, 0, len(data))
+
+	for k, v := range data {
+		m := metrics.Metrics{ID: k}
+
+		switch value := v.(type) {
+		case float64:
+			m.MType = "gauge"
+			m.Value = &value
+		case int64:
+			m.MType = "counter"
+			m.Delta = &value
+		case int:
+			delta := int64(value)
+			m.MType = "counter"
+			m.Delta = &delta
+		default:
+			continue
+		}
+
+		result = append(result, m)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+
+	return result
+}
+
+// toData преобразует метрики в значения хранилища.
+func toData(list []metrics.Metrics) map[string]interface{} {
+	data := make(map[string]interface{}, len(list))
+
+	for _, m := range list {
+		switch {
+		case m.MType == "gauge" && m.Value != nil:
+			data[m.ID] = *m.Value
+		case m.MType == "counter" && m.Delta != nil:
+			data[m.ID] = *m.Delta
+		}
+	}
+
+	return data
+}
@@ -0,0 +1,300 @@
+package replication
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gometric/internal/memstorage"
+	"gometric/internal/metrics"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// testServer запускает узел в httptest сервере. Пока down истинно, сервер недоступен.
+type testServer struct {
+	*httptest.Server
+	node *Node
+	down atomic.Bool
+}
+
+func newTestServer(t *testing.T, cfg Config) *testServer {
+	node, err := NewNode(memstorage.NewMemStorage(), cfg)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	ts := &testServer{node: node}
+
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ts.down.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				reader, err := gzip.NewReader(r.Body)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				r.Body = reader
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	})
+	r.Mount("/replication", node.Handler())
+
+	ts.Server = httptest.NewServer(r)
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+// waitSeq ждет, пока follower применит записи до seq.
+func waitSeq(t *testing.T, n *Node, seq uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if n.Status().Seq >= seq {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("Error: follower seq %d, want %d", n.Status().Seq, seq)
+}
+
+func TestReplication(t *testing.T) {
+	f1 := newTestServer(t, Config{Role: RoleFollower, Key: "secret"})
+	f2 := newTestServer(t, Config{Role: RoleFollower, Key: "secret"})
+
+	p := newTestServer(t, Config{
+		Role:      RolePrimary,
+		Followers: []string{f1.URL, f2.URL},
+		Key:       "secret",
+		Interval:  20 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.node.Run(ctx)
+
+	p.node.Set("PollCount", int64(1))
+	p.node.MSet(map[string]interface{}{"PollCount": int64(2), "Alloc": float64(1.5)})
+
+	for _, f := range []*testServer{f1, f2} {
+		waitSeq(t, f.node, 2)
+
+		if v, _ := f.node.Get("PollCount"); v != int64(2) {
+			t.Errorf("Error: counter is not replicated: %v", v)
+		}
+		if v, _ := f.node.Get("Alloc"); v != float64(1.5) {
+			t.Errorf("Error: gauge is not replicated: %v", v)
+		}
+		if st := f.node.Status(); st.Primary != p.node.Status().Primary {
+			t.Errorf("Error: follower must follow primary")
+		}
+	}
+
+	if err := f1.node.Set("PollCount", int64(10)); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Error: follower must be read-only")
+	}
+}
+
+func TestSnapshotCatchUp(t *testing.T) {
+	f := newTestServer(t, Config{Role: RoleFollower})
+	f.down.Store(true)
+
+	p := newTestServer(t, Config{
+		Role:      RolePrimary,
+		Followers: []string{f.URL},
+		Interval:  20 * time.Millisecond,
+		LogSize:   2,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.node.Run(ctx)
+
+	for i := 1; i <= 5; i++ {
+		p.node.Set("PollCount", int64(i))
+	}
+
+	// the log keeps only two entries
+	f.down.Store(false)
+	waitSeq(t, f.node, 5)
+
+	if v, _ := f.node.Get("PollCount"); v != int64(5) {
+		t.Errorf("Error: snapshot is not applied: %v", v)
+	}
+
+	// the log is sent after the snapshot
+	p.node.Set("Alloc", float64(3))
+	waitSeq(t, f.node, 6)
+
+	if v, _ := f.node.Get("Alloc"); v != float64(3) {
+		t.Errorf("Error: entry is not applied: %v", v)
+	}
+}
+
+func TestPromote(t *testing.T) {
+	f := newTestServer(t, Config{Role: RoleFollower})
+	p := newTestServer(t, Config{Role: RolePrimary, Followers: []string{f.URL}, Interval: 20 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.node.Run(ctx)
+
+	p.node.Set("PollCount", int64(1))
+	waitSeq(t, f.node, 1)
+
+	// failover
+	p.down.Store(true)
+	p.node.Demote()
+
+	if _, code, err := p.node.post(ctx, f.URL+"/replication/promote", controlRequest{Time: time.Now().UnixNano()}); err != nil || code != http.StatusOK {
+		t.Fatalf("Error: promote failed: %d %v", code, err)
+	}
+
+	st := f.node.Status()
+	if st.Role != RolePrimary || st.Seq != 1 || st.Primary == p.node.Status().Primary {
+		t.Errorf("Error: status is incorrect: %+v", st)
+	}
+
+	if err := f.node.Set("PollCount", int64(2)); err != nil {
+		t.Errorf("Error: promoted node must accept writes: %s", err)
+	}
+
+	if err := p.node.Set("PollCount", int64(3)); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Error: demoted node must be read-only")
+	}
+}
+
+func TestInvalidSignature(t *testing.T) {
+	f := newTestServer(t, Config{Role: RoleFollower, Key: "secret"})
+	p, _ := NewNode(memstorage.NewMemStorage(), Config{Role: RolePrimary, Key: "other"})
+
+	_, code, err := p.post(context.Background(), f.URL+"/replication/apply", applyRequest{})
+	if err != nil || code != http.StatusForbidden {
+		t.Errorf("Error: status %d, want %d", code, http.StatusForbidden)
+	}
+
+	// role changes are signed too
+	resp, err := http.Post(f.URL+"/replication/promote", "application/json", nil)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden || f.node.Status().Role != RoleFollower {
+		t.Errorf("Error: unsigned promote must be rejected: %d", resp.StatusCode)
+	}
+
+	p.SetKey("secret")
+
+	// a recorded command can not be replayed later
+	old := controlRequest{Time: time.Now().Add(-2 * maxMessageAge).UnixNano()}
+	if _, code, err := p.post(context.Background(), f.URL+"/replication/promote", old); err != nil || code != http.StatusForbidden {
+		t.Errorf("Error: stale promote must be rejected: %d", code)
+	}
+
+	now := controlRequest{Time: time.Now().UnixNano()}
+	if st, code, err := p.post(context.Background(), f.URL+"/replication/promote", now); err != nil || code != http.StatusOK || st.Role != RolePrimary {
+		t.Errorf("Error: signed promote must be accepted: %d %+v", code, st)
+	}
+
+	if _, err := NewNode(memstorage.NewMemStorage(), Config{Role: "leader"}); err == nil {
+		t.Errorf("Error: unknown role must be rejected")
+	}
+}
+
+func TestReplicationDelete(t *testing.T) {
+	f := newTestServer(t, Config{Role: RoleFollower})
+	f.down.Store(true)
+
+	// the follower has a metric the primary never had
+	f.node.backend.Set("Stale", float64(1))
+
+	p := newTestServer(t, Config{
+		Role:      RolePrimary,
+		Followers: []string{f.URL},
+		Interval:  20 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.node.Run(ctx)
+
+	p.node.MSet(map[string]interface{}{"Alloc": float64(1), "PollCount": int64(2)})
+
+	// the snapshot removes metrics missing on the primary
+	f.down.Store(false)
+	waitSeq(t, f.node, 1)
+
+	if _, err := f.node.Get("Stale"); err == nil {
+		t.Errorf("Error: snapshot must delete stale metrics")
+	}
+
+	if err := p.node.Delete("PollCount"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err := p.node.Rename("Alloc", "HeapAlloc"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	waitSeq(t, f.node, 3)
+
+	if list := f.node.List(); len(list) != 1 || list[0] != "HeapAlloc" {
+		t.Errorf("Error: deletions are not replicated: %v", list)
+	}
+	if v, _ := f.node.Get("HeapAlloc"); v != float64(1) {
+		t.Errorf("Error: renamed metric is incorrect: %v", v)
+	}
+
+	if err := f.node.Delete("HeapAlloc"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Error: follower must be read-only")
+	}
+}
+
+func TestSnapshotReplay(t *testing.T) {
+	f := newTestServer(t, Config{Role: RoleFollower})
+	p, _ := NewNode(memstorage.NewMemStorage(), Config{Role: RolePrimary})
+
+	send := func(seq uint64, sent time.Time, list ...metrics.Metrics) int {
+		_, code, err := p.post(context.Background(), f.URL+"/replication/snapshot", snapshotRequest{
+			Primary: "p1",
+			Seq:     seq,
+			Metrics: list,
+			Time:    sent.UnixNano(),
+		})
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		return code
+	}
+
+	one, two := int64(1), int64(2)
+	if code := send(2, time.Now(), metrics.Metrics{ID: "PollCount", MType: "counter", Delta: &two}); code != http.StatusOK {
+		t.Fatalf("Error: snapshot is rejected: %d", code)
+	}
+
+	// an older snapshot of the same primary must not roll the follower back
+	if code := send(1, time.Now(), metrics.Metrics{ID: "PollCount", MType: "counter", Delta: &one}); code != http.StatusConflict {
+		t.Errorf("Error: old snapshot status %d, want %d", code, http.StatusConflict)
+	}
+
+	if code := send(3, time.Now().Add(-2*maxMessageAge)); code != http.StatusForbidden {
+		t.Errorf("Error: stale snapshot status %d, want %d", code, http.StatusForbidden)
+	}
+
+	if v, _ := f.node.Get("PollCount"); v != int64(2) || f.node.Status().Seq != 2 {
+		t.Errorf("Error: follower is rolled back: %v %+v", v, f.node.Status())
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"gometric/internal/federation"
+	"gometric/internal/logger"
+	"gometric/pkg/client"
+)
+
+// startFederation запускает отправку метрик на вышестоящий сервер.
+// Если источники не заданы, отправляются метрики локального хранилища.
+func (s *HTTPServer) startFederation(ctx context.Context, cfg *Config) error {
+	upstream, err := client.New(client.Config{
+		Address:      cfg.FederationUpstream,
+		Key:          cfg.KeySign,
+		RSAPublicKey: cfg.FederationRSAPubKey,
+		Timeout:      10 * time.Second,
+	})
+	if err != nil {
+		return err
+	}
+
+	var sources []federation.Source
+	for _, spec := range strings.Split(cfg.FederationSources, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+
+		src, err := federation.NewRemoteSource(spec, client.Config{Key: cfg.KeySign, Timeout: 10 * time.Second})
+		if err != nil {
+			return err
+		}
+		sources = append(sources, src)
+	}
+
+	if len(sources) == 0 {
+		name := cfg.FederationName
+		if name == "" {
+			name, _ = os.Hostname()
+		}
+		sources = append(sources, federation.NewStorageSource(name, s.Storage))
+	}
+
+	f, err := federation.New(federation.Config{
+		Mode:             cfg.FederationMode,
+		Aggregate:        cfg.FederationAggregate,
+		GaugeAggregation: cfg.FederationGaugeAgg,
+		Interval:         cfg.FederationInterval,
+	}, upstream, sources...)
+	if err != nil {
+		return err
+	}
+
+	s.Federation = f
+	go f.Run(ctx)
+	logger.Info("federation to " + cfg.FederationUpstream + " started")
+
+	return nil
+}
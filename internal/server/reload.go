@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"gometric/internal/crypto"
+	"gometric/internal/logger"
+	"gometric/internal/memstorage"
+	"gometric/internal/storage"
+)
+
+// settings описывает настройки сервера, которые можно изменить без перезапуска.
+// Значение не изменяется после создания, при перезагрузке заменяется целиком,
+// поэтому запрос использует одни и те же настройки от начала до конца.
+type settings struct {
+	keySign       string
+	trustedSubnet *net.IPNet
+	rsaPrivateKey *rsa.PrivateKey
+	storeInterval int
+	logLevel      string
+}
+
+// newSettings проверяет и создает настройки из конфигурации cfg.
+func newSettings(cfg *Config) (*settings, error) {
+	st := &settings{
+		keySign:       cfg.KeySign,
+		storeInterval: cfg.StoreInterval,
+		logLevel:      cfg.LogLevel,
+	}
+
+	if cfg.TrustedSubnet != "" {
+		_, trustedSubnet, err := net.ParseCIDR(cfg.TrustedSubnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted subnet: %v", err)
+		}
+		st.trustedSubnet = trustedSubnet
+	}
+
+	if cfg.RSAPrivateKey != "" {
+		key, err := crypto.NewPrivateKey(cfg.RSAPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key %s: %v", cfg.RSAPrivateKey, err)
+		}
+		st.rsaPrivateKey = key
+	}
+
+	if cfg.LogLevel != "" {
+		if _, err := logger.ParseLevel(cfg.LogLevel); err != nil {
+			return nil, err
+		}
+	}
+
+	return st, nil
+}
+
+// current возвращает действующие настройки.
+func (s HTTPServer) current() *settings {
+	return s.settings.Load()
+}
+
+// Reload проверяет конфигурацию cfg и применяет настройки, которые можно изменить без перезапуска:
+// доверенную подсеть, ключ подписи, закрытый ключ RSA, уровень логирования, интервал сохранения
+// и настройки агентов. При ошибке действующие настройки не изменяются.
+// Новый ключ подписи также передается репликации, федерации, потоку, оповещениям, журналу аудита
+// и настройкам агентов.
+func (s *HTTPServer) Reload(cfg *Config) error {
+	st, err := newSettings(cfg)
+	if err != nil {
+		return err
+	}
+
+	if s.AgentConfig != nil {
+		if err := s.AgentConfig.Reload(); err != nil {
+			return err
+		}
+	}
+
+	old := s.settings.Swap(st)
+
+	if st.logLevel != "" && st.logLevel != old.logLevel {
+		logger.SetLevel(st.logLevel)
+	}
+
+	if st.keySign != old.keySign {
+		s.setKey(st.keySign)
+	}
+
+	// sync mode saves the dump on every write
+	if m, ok := storage.Unwrap(s.Storage).(*memstorage.MemStorage); ok && old.storeInterval >= 0 {
+		m.Mutex.Lock()
+		m.SyncMode = st.storeInterval == 0
+		m.Mutex.Unlock()
+	}
+
+	logger.Info("config reloaded")
+
+	return nil
+}
+
+// setKey передает ключ подписи компонентам, которые подписывают или проверяют сообщения.
+func (s *HTTPServer) setKey(key string) {
+	if s.Stream != nil {
+		s.Stream.SetKey(key)
+	}
+	if s.Replication != nil {
+		s.Replication.SetKey(key)
+	}
+	if s.Federation != nil {
+		s.Federation.SetKey(key)
+	}
+	if s.Notifier != nil {
+		s.Notifier.SetKey(key)
+	}
+	if s.Audit != nil {
+		s.Audit.SetKey(key)
+	}
+	if s.AgentConfig != nil {
+		s.AgentConfig.SetKey(key)
+	}
+}
+
+// WatchConfig вызывает reload, когда изменяется время модификации файла path.
+// Файл проверяется раз в interval до отмены контекста ctx.
+func WatchConfig(ctx context.Context, path string, interval time.Duration, reload func()) {
+	modTime := func() time.Time {
+		info, err := os.Stat(path)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				logger.Error("config watch failed", err)
+			}
+			return time.Time{}
+		}
+
+		return info.ModTime()
+	}
+
+	last := modTime()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if t := modTime(); !t.IsZero() && !t.Equal(last) {
+				last = t
+				logger.Info("config file " + path + " changed")
+				reload()
+			}
+		}
+	}
+}
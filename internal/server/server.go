@@ -3,16 +3,31 @@ package server
 
 import (
 	"context"
-	"crypto/rsa"
-	"net"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	"gometric/internal/crypto"
+	"gometric/internal/agentconfig"
+	"gometric/internal/alert"
+	"gometric/internal/audit"
+	"gometric/internal/cache"
+	"gometric/internal/dashboard"
+	"gometric/internal/federation"
 	"gometric/internal/logger"
 	"gometric/internal/memstorage"
+	"gometric/internal/notify"
+	"gometric/internal/observer"
 	"gometric/internal/postgres"
+	"gometric/internal/query"
+	"gometric/internal/recording"
+	"gometric/internal/registry"
+	"gometric/internal/replication"
 	"gometric/internal/storage"
+	"gometric/internal/stream"
+	"gometric/internal/ttl"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -21,134 +36,321 @@ import (
 
 // HTTPServer описывает структуру сервера.
 type HTTPServer struct {
-	Server        *http.Server
-	chiRouter     chi.Router
-	Storage       storage.Storage
-	KeySign       string
-	RSAPrivateKey *rsa.PrivateKey
-	TrustedSubnet *net.IPNet
+	Server      *http.Server
+	chiRouter   chi.Router
+	Storage     storage.Storage
+	Replication *replication.Node
+	Alerts      *alert.Engine
+	Query       *query.Engine
+	History     *query.History
+	Recorder    *recording.Recorder
+	Dashboard   *dashboard.Dashboard
+	Observer    *observer.Observer
+	Stream      *stream.Hub
+	Audit       *audit.Log
+	Notifier    *notify.Notifier
+	Federation  *federation.Federator
+	Sweeper     *ttl.Sweeper
+	Registry    *registry.Registry
+	AgentConfig *agentconfig.Store
+	// StaleThreshold время без обновлений, после которого метрика считается устаревшей.
+	StaleThreshold time.Duration
+
+	// settings заменяются при перезагрузке конфигурации, см. Reload.
+	settings *atomic.Pointer[settings]
 }
 
 // NewServer создает новый http сервер.
 func NewServer(ctx context.Context, cfg *Config) *HTTPServer {
 	httpserver := HTTPServer{
 		chiRouter: chi.NewRouter(),
-		KeySign:   cfg.KeySign,
+		Stream:    stream.NewHub(cfg.StreamBuffer, cfg.StreamSubscriberBuffer),
+
+		StaleThreshold: cfg.StaleThreshold,
+		settings:       &atomic.Pointer[settings]{},
 	}
 
-	if cfg.TrustedSubnet != "" {
-		_, trustedSubnet, err := net.ParseCIDR(cfg.TrustedSubnet)
-		if err != nil {
-			logger.Fatal("error parse subnet", err)
+	st, err := newSettings(cfg)
+	if err != nil {
+		logger.Fatal("server config", err)
+	}
+	httpserver.settings.Store(st)
+
+	httpserver.Storage, err = newStorage(cfg)
+	if err != nil {
+		logger.Fatal("storage", err)
+	}
+
+	if _, ok := httpserver.Storage.(*memstorage.MemStorage); ok {
+		httpserver.StoreHandler(ctx, cfg.StoreInterval)
+
+		if cfg.Restore {
+			if err := httpserver.Restore(); err != nil {
+				logger.Error("restore MemStorage", err)
+			}
 		}
-		httpserver.TrustedSubnet = trustedSubnet
 	}
 
-	if cfg.RSAPrivateKey != "" {
-		var err error
-		httpserver.RSAPrivateKey, err = crypto.NewPrivateKey(cfg.RSAPrivateKey)
+	if err := httpserver.startAudit(cfg); err != nil {
+		logger.Fatal("audit", err)
+	}
+
+	if cfg.CacheSize > 0 {
+		c := cache.New(httpserver.Storage, cfg.CacheSize, cfg.CacheFlushInterval)
+		go c.Run(ctx)
+
+		httpserver.Storage = c
+		logger.Debug("storage cache enabled")
+	}
+
+	// writes are observed before replication, so followers publish applied updates
+	httpserver.Observer = observer.New(httpserver.Storage)
+	httpserver.Storage = httpserver.Observer
+
+	httpserver.Stream.SetKey(cfg.KeySign)
+	go httpserver.Stream.Run(ctx, httpserver.Observer.Subscribe("stream", cfg.ObserverBuffer))
+
+	// replication wraps the cache, so followers apply updates through it
+	if cfg.ReplicationRole != "" {
+		var followers []string
+		for _, f := range strings.Split(cfg.ReplicationFollowers, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				followers = append(followers, f)
+			}
+		}
+
+		node, err := replication.NewNode(httpserver.Storage, replication.Config{
+			Role:      cfg.ReplicationRole,
+			Followers: followers,
+			Key:       cfg.KeySign,
+		})
 		if err != nil {
-			logger.Fatal("new private key failed", err)
+			logger.Fatal("replication", err)
 		}
-		logger.Debug("new private key initialized")
+		go node.Run(ctx)
+
+		httpserver.Storage = node
+		httpserver.Replication = node
+		logger.Info("replication role: " + cfg.ReplicationRole)
 	}
 
-	if cfg.DatabaseDSN != "" {
-		var db *pgxpool.Pool
+	if cfg.MetricTTL > 0 || cfg.MetricTTLRules != "" {
+		rules, err := ttl.ParseRules(cfg.MetricTTLRules)
+		if err != nil {
+			logger.Fatal("metric ttl rules", err)
+		}
 
-		poolConfig, err := pgxpool.ParseConfig(cfg.DatabaseDSN)
+		httpserver.Sweeper, err = ttl.NewSweeper(httpserver.Storage, cfg.MetricTTL, rules)
 		if err != nil {
-			logger.Fatal("unable to parse database dsn", err)
+			logger.Fatal("metric ttl", err)
 		}
+		if cfg.TTLInterval > 0 {
+			httpserver.Sweeper.Interval = cfg.TTLInterval
+		}
+		go httpserver.Sweeper.Run(ctx)
+	}
+
+	httpserver.Registry = registry.New()
+	if cfg.AgentMissedReports > 0 {
+		httpserver.Registry.MissedReports = cfg.AgentMissedReports
+	}
+	if cfg.AgentTimeout > 0 {
+		httpserver.Registry.Timeout = cfg.AgentTimeout
+	}
+	if cfg.AgentMetricsInterval > 0 {
+		httpserver.Registry.Interval = cfg.AgentMetricsInterval
+		go httpserver.Registry.Run(ctx, httpserver.Storage)
+	}
+
+	agentConfig, err := agentconfig.NewStore(cfg.AgentConfig)
+	if err != nil {
+		logger.Fatal("agent config", err)
+	}
+	agentConfig.SetKey(cfg.KeySign)
+	httpserver.AgentConfig = agentConfig
+
+	if cfg.HistoryInterval > 0 {
+		httpserver.History = query.NewHistory(cfg.HistoryRetention)
+		go httpserver.History.Run(ctx, httpserver.Storage, cfg.HistoryInterval)
+	}
+	httpserver.Query = query.NewEngine(httpserver.Storage, httpserver.History)
+	httpserver.Dashboard = dashboard.New(httpserver.Storage, httpserver.History)
+	httpserver.Dashboard.Stream = httpserver.Stream
 
-		db, err = pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if cfg.RecordingRules != "" {
+		rules, err := recording.LoadRules(cfg.RecordingRules)
 		if err != nil {
-			logger.Fatal("unable to create connection pool", err)
+			logger.Fatal("load recording rules", err)
 		}
 
-		httpserver.Storage = storage.NewPostgresDB(db)
-		err = httpserver.Storage.(*postgres.Postgres).InitDB()
+		httpserver.Recorder, err = recording.NewRecorder(httpserver.Storage, httpserver.Query, rules)
 		if err != nil {
-			logger.Fatal("", err)
+			logger.Fatal("recording rules", err)
 		}
-	} else {
-		syncMode := false
+		if cfg.RecordingInterval > 0 {
+			httpserver.Recorder.Interval = cfg.RecordingInterval
+		}
+		go httpserver.Recorder.Run(ctx)
+	}
 
-		if cfg.StoreInterval == 0 {
-			syncMode = true
+	if cfg.AlertRules != "" {
+		rules, err := alert.LoadRules(cfg.AlertRules)
+		if err != nil {
+			logger.Fatal("load alert rules", err)
 		}
 
-		var err error
-		httpserver.Storage, err = storage.NewMemStorage(cfg.StoreFile, syncMode)
+		httpserver.Alerts, err = alert.NewEngine(httpserver.Storage, rules)
 		if err != nil {
-			logger.Fatal("new MemStorage", err)
+			logger.Fatal("alert rules", err)
+		}
+		if cfg.AlertInterval > 0 {
+			httpserver.Alerts.Interval = cfg.AlertInterval
 		}
 
-		httpserver.StoreHandler(ctx, cfg.StoreInterval)
+		if cfg.NotifyConfig != "" {
+			ncfg, err := notify.LoadConfig(cfg.NotifyConfig)
+			if err != nil {
+				logger.Fatal("load notify config", err)
+			}
+			ncfg.Key = cfg.KeySign
 
-		if cfg.Restore {
-			if err := httpserver.Restore(); err != nil {
-				logger.Error("restore MemStorage", err)
+			notifier, err := notify.New(ncfg)
+			if err != nil {
+				logger.Fatal("notify", err)
 			}
+			httpserver.Alerts.AddNotifier(notifier)
+			httpserver.Notifier = notifier
+			go notifier.Run(ctx, time.Second)
+		}
+
+		go httpserver.Alerts.Run(ctx)
+	}
+
+	if cfg.FederationUpstream != "" {
+		if err := httpserver.startFederation(ctx, cfg); err != nil {
+			logger.Fatal("federation", err)
 		}
 	}
 
 	return &httpserver
 }
 
+// startAudit открывает журнал аудита в таблице БД или в файле.
+func (s *HTTPServer) startAudit(cfg *Config) error {
+	var store audit.Store
+
+	switch {
+	case cfg.AuditDB:
+		pg, ok := storage.Unwrap(s.Storage).(*postgres.Postgres)
+		if !ok {
+			return errors.New("audit_db requires database storage")
+		}
+		store = audit.NewPostgresStore(pg.DB)
+
+	case cfg.AuditFile != "":
+		var err error
+		if store, err = audit.NewFileStore(cfg.AuditFile, cfg.AuditMaxSize, cfg.AuditMaxBackups); err != nil {
+			return err
+		}
+
+	default:
+		return nil
+	}
+
+	s.Audit = audit.New(store)
+	s.Audit.SetKey(cfg.KeySign)
+	logger.Info("audit log enabled")
+
+	return nil
+}
+
+// newStorage создает бэкенд хранилища: Postgres, если задан DSN, иначе MemStorage.
+func newStorage(cfg *Config) (storage.Storage, error) {
+	if cfg.DatabaseDSN == "" {
+		// the dump is written on every update only with a zero interval
+		return storage.NewMemStorage(cfg.StoreFile, cfg.StoreInterval == 0)
+	}
+
+	poolConfig, err := pgxpool.ParseConfig(cfg.DatabaseDSN)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse database dsn: %w", err)
+	}
+
+	db, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create connection pool: %w", err)
+	}
+
+	pg := storage.NewPostgresDB(db)
+	pg.Timeout = cfg.StorageTimeout
+
+	if err := pg.InitDB(); err != nil {
+		pg.Close()
+		return nil, err
+	}
+
+	return pg, nil
+}
+
 // Restore загрузка данных из файла в in-memory БД.
 // Используется только для бэкенда MemStorageDB.
 func (s HTTPServer) Restore() error {
-	data, err := s.Storage.(*memstorage.MemStorage).LoadDump()
+	mem := storage.Unwrap(s.Storage).(*memstorage.MemStorage)
+
+	data, err := mem.LoadMetrics()
 	if err != nil {
 		logger.Error("restore from json db", err)
 		return err
 	}
 
 	for k, v := range data {
-		switch k {
-		case "PollCount":
-			if err := s.Storage.Set(k, int64(v.(float64))); err != nil {
-				return err
-			}
-		default:
-			if err := s.Storage.Set(k, v.(float64)); err != nil {
-				return err
-			}
+		if err := s.Storage.Set(k, v); err != nil {
+			return err
 		}
 	}
 
+	// restored metrics keep their update time, otherwise every restart resets the ttl
+	meta, err := mem.LoadMeta()
+	if err != nil {
+		return err
+	}
+	mem.SetMeta(meta)
+
 	return nil
 }
 
 // StoreHandler сохранение данных из in-memory БД в файл.
 // Используется только для бэкенда MemStorageDB.
 func (s HTTPServer) StoreHandler(ctx context.Context, storeInterval int) {
-	if storeInterval <= 0 {
+	if storeInterval < 0 {
 		return
 	}
 
-	go func(ctx context.Context, storeInterval int) {
-		var interval = time.Duration(storeInterval) * time.Second
-
+	go func(ctx context.Context) {
 		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				if err := s.Storage.(*memstorage.MemStorage).SaveDump(); err != nil {
+			// the interval may be changed by Reload
+			var interval = time.Duration(s.current().storeInterval) * time.Second
+
+			if interval > 0 {
+				if err := storage.Unwrap(s.Storage).(*memstorage.MemStorage).SaveDump(); err != nil {
 					logger.Error("save dump to json db", err)
 				}
+			} else {
+				// sync mode saves the dump on every write
+				interval = time.Second
+			}
 
-				<-time.After(interval)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
 			}
 		}
-
-	}(ctx, storeInterval)
+	}(ctx)
 }
 
-// ListenAndServe старт сервера
-func (s *HTTPServer) ListenAndServe(addr string) {
+// routes регистрирует middleware и обработчики сервера.
+func (s *HTTPServer) routes() {
 
 	// middleware gzip response
 	// s.chiRouter.Use(middleware.Compress(5, "text/html", "application/json"))
@@ -156,22 +358,65 @@ func (s *HTTPServer) ListenAndServe(addr string) {
 	// middleware that sets a http.Request's RemoteAddr to the results
 	// of parsing either the True-Client-IP, X-Real-IP or the X-Forwarded-For headers
 	s.chiRouter.Use(middleware.RealIP)
+	// middleware that sets X-Request-Id of the request or a generated id to the context
+	s.chiRouter.Use(middleware.RequestID)
 	// middleware decrypt body
 	s.chiRouter.Use(s.decryptRSABodyHandler)
 	// middleware unzip body
 	s.chiRouter.Use(unzipBodyHandler)
 
-	s.chiRouter.Get("/", s.listHandler)
+	s.chiRouter.Get("/", s.Dashboard.Index)
+	s.chiRouter.Mount("/dashboard", s.Dashboard.Handler())
+	s.chiRouter.Get("/list", s.listHandler)
 	s.chiRouter.Post("/", s.defaultHandler)
 	s.chiRouter.Route("/", func(r chi.Router) {
+		// rejected requests are audited too
+		if s.Audit != nil {
+			r.Use(s.Audit.Handler)
+		}
 		r.Use(s.trustedSubnetHandler)
+		r.Use(s.Registry.Handler)
 		r.Use(middleware.AllowContentType("application/json"))
+		r.Use(sourceHandler)
 		r.Post("/value/", s.GetValueHandler)
+		r.Get("/values/", s.ListValuesHandler)
 		r.Post("/update/", s.UpdateHandler)
 		r.Post("/updates/", s.UpdatesHandler)
+		r.With(s.verifyBodyHandler).Post("/delete/", s.DeleteHandler)
+		r.With(s.verifyBodyHandler).Post("/rename/", s.RenameHandler)
+		r.Get("/agent/config", s.AgentConfig.Handler)
+		r.Get("/agent/configs", s.AgentConfig.FileHandler)
+		r.With(s.verifyBodyHandler).Put("/agent/configs", s.AgentConfig.UpdateHandler)
+	})
+	s.chiRouter.Group(func(r chi.Router) {
+		if s.Audit != nil {
+			r.Use(s.Audit.Handler)
+		}
+		r.Use(s.trustedSubnetHandler)
+		r.Get("/export", s.ExportHandler)
+		r.With(s.verifyBodyHandler).Post("/import", s.ImportHandler)
+		r.Get("/query", s.Query.Handler)
+		r.Mount("/stream", s.Stream.Handler())
+		r.Get("/observer", s.observerHandler)
+		r.Get("/stale", s.staleHandler)
+		r.Get("/agents", s.Registry.ListHandler)
+		if s.Audit != nil {
+			r.Get("/audit", s.Audit.QueryHandler)
+		}
+		if s.Alerts != nil {
+			r.Get("/alerts", s.Alerts.Handler)
+		}
+		if s.Replication != nil {
+			r.Mount("/replication", s.Replication.Handler())
+		}
 	})
 	s.chiRouter.Get("/ping", s.pingHandler)
 	s.chiRouter.Mount("/debug", middleware.Profiler())
+}
+
+// ListenAndServe старт сервера
+func (s *HTTPServer) ListenAndServe(addr string) {
+	s.routes()
 
 	s.Server = &http.Server{
 		Addr:    addr,
@@ -195,4 +440,10 @@ func (s *HTTPServer) Shutdown() {
 	if err := s.Storage.Close(); err != nil {
 		logger.Fatal("Server storage close is failed", err)
 	}
+
+	if s.Audit != nil {
+		if err := s.Audit.Close(); err != nil {
+			logger.Error("audit log close is failed", err)
+		}
+	}
 }
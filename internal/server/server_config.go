@@ -1,120 +1,199 @@
 package server
 
 import (
-	"bufio"
-	"encoding/json"
-	"io"
-	"os"
+	"net"
+	"net/url"
+	"strings"
 	"time"
+
+	"gometric/internal/config"
+	"gometric/internal/logger"
+	"gometric/internal/replication"
+	"gometric/internal/ttl"
 )
 
 // Config описывает структуру с настройками сервера.
 type Config struct {
-	ConfigFile    string `long:"config" short:"c" env:"CONFIG" default:"" description:"set config file"`
+	ConfigFile    string `long:"config" short:"c" env:"CONFIG" default:"" config:"file" description:"set config file (.json, .yaml, .yml or .toml)"`
 	ListenAddr    string `long:"address" short:"a" env:"ADDRESS" default:"127.0.0.1:8080" description:"set listen address"`
 	TrustedSubnet string `long:"trusted_subnet" short:"t" env:"TRUSTED_SUBNET" description:"set trusted subnet (example: 10.0.0.0/8)"`
-	StoreInterval int    `long:"store_interval" short:"i" env:"STORE_INTERVAL" default:"300" description:"set interval store to file"`
+	StoreInterval int    `long:"store_interval" short:"i" env:"STORE_INTERVAL" default:"300" unit:"s" description:"set interval store to file in seconds (0 stores on every update)"`
 	StoreFile     string `long:"store_file" short:"f" env:"STORE_FILE" default:"/tmp/devops-metrics-db.json" description:"set store file"`
 	Restore       bool   `long:"restore" short:"r" env:"RESTORE" description:"autorestore from file"`
-	KeySign       string `long:"key" short:"k" env:"KEY" description:"set key for signing"`
-	RSAPrivateKey string `long:"crypto-key" env:"CRYPTO_KEY" description:"set rsa-private-key file"`
-	DatabaseDSN   string `long:"database" short:"d" env:"DATABASE_DSN" description:"set database dsn"`
+	KeySign       string `long:"key" short:"k" env:"KEY" secret:"yes" description:"set key for signing"`
+	RSAPrivateKey string `long:"crypto-key" env:"CRYPTO_KEY" json:"crypto_key" description:"set rsa-private-key file"`
+	DatabaseDSN   string `long:"database" short:"d" env:"DATABASE_DSN" json:"database_dsn" secret:"yes" description:"set database dsn"`
 	LogLevel      string `long:"log_level" env:"LOG_LEVEL" default:"info" description:"set log level"`
 	LogFile       string `long:"log_file" env:"LOG_FILE" default:"" description:"set log file"`
-	Version       bool   `long:"version" short:"v" description:"print current version"`
+	Version       bool   `long:"version" short:"v" config:"-" description:"print current version"`
+	PrintConfig   string `long:"print-config" optional:"yes" optional-value:"json" choice:"json" choice:"yaml" choice:"toml" config:"-" description:"print resulting config in format json, yaml or toml and exit"`
+	CheckConfig   bool   `long:"check-config" config:"-" description:"check config and exit"`
+
+	ConfigWatchInterval time.Duration `long:"config_watch_interval" env:"CONFIG_WATCH_INTERVAL" default:"0s" description:"set interval of config file change checks, changes are applied without restart (0 disables, SIGHUP always reloads)"`
+
+	StorageTimeout     time.Duration `long:"storage_timeout" env:"STORAGE_TIMEOUT" default:"5s" description:"set timeout of database operations"`
+	CacheSize          int           `long:"cache_size" env:"CACHE_SIZE" default:"0" description:"set max number of cached metrics (0 disables cache)"`
+	CacheFlushInterval time.Duration `long:"cache_flush_interval" env:"CACHE_FLUSH_INTERVAL" default:"0s" description:"set interval of batched cache writes (0 writes through)"`
+
+	ReplicationRole      string `long:"replication_role" env:"REPLICATION_ROLE" description:"set replication role (primary, follower)"`
+	ReplicationFollowers string `long:"replication_followers" env:"REPLICATION_FOLLOWERS" description:"set comma-separated follower addresses (example: http://10.0.0.2:8080)"`
+
+	FederationUpstream  string        `long:"federation_upstream" env:"FEDERATION_UPSTREAM" description:"set upstream server address for federation"`
+	FederationSources   string        `long:"federation_sources" env:"FEDERATION_SOURCES" description:"set comma-separated downstream servers ([name=]address), local storage if empty"`
+	FederationName      string        `long:"federation_name" env:"FEDERATION_NAME" description:"set source name of local storage (default hostname)"`
+	FederationMode      string        `long:"federation_mode" env:"FEDERATION_MODE" default:"label" choice:"label" choice:"prefix" choice:"none" description:"set how federated metrics are marked with source"`
+	FederationAggregate bool          `long:"federation_aggregate" env:"FEDERATION_AGGREGATE" description:"send aggregates across all sources"`
+	FederationGaugeAgg  string        `long:"federation_gauge_aggregation" env:"FEDERATION_GAUGE_AGGREGATION" default:"avg" choice:"avg" choice:"max" choice:"min" choice:"sum" description:"set aggregation of gauges across sources"`
+	FederationInterval  time.Duration `long:"federation_interval" env:"FEDERATION_INTERVAL" default:"10s" description:"set interval of federation"`
+	FederationRSAPubKey string        `long:"federation_crypto_key" env:"FEDERATION_CRYPTO_KEY" description:"set rsa-public-key file of upstream server"`
+
+	AlertRules    string        `long:"alert_rules" env:"ALERT_RULES" description:"set alert rules file"`
+	AlertInterval time.Duration `long:"alert_interval" env:"ALERT_INTERVAL" default:"15s" description:"set interval of alert rules evaluation"`
+	NotifyConfig  string        `long:"notify_config" env:"NOTIFY_CONFIG" description:"set webhook notifications config file"`
+
+	HistoryInterval  time.Duration `long:"history_interval" env:"HISTORY_INTERVAL" default:"10s" description:"set interval of recording metric history for queries (0 disables rate)"`
+	HistoryRetention time.Duration `long:"history_retention" env:"HISTORY_RETENTION" default:"1h" description:"set retention of metric history"`
+
+	RecordingRules    string        `long:"recording_rules" env:"RECORDING_RULES" description:"set recording rules file"`
+	RecordingInterval time.Duration `long:"recording_interval" env:"RECORDING_INTERVAL" default:"15s" description:"set interval of recording rules evaluation"`
+
+	ObserverBuffer int `long:"observer_buffer" env:"OBSERVER_BUFFER" default:"1024" description:"set queue size of a storage write subscriber before changes are dropped"`
+
+	StreamBuffer           int `long:"stream_buffer" env:"STREAM_BUFFER" default:"1024" description:"set number of recent updates kept for stream resume"`
+	StreamSubscriberBuffer int `long:"stream_subscriber_buffer" env:"STREAM_SUBSCRIBER_BUFFER" default:"256" description:"set queue size of a stream subscriber before it is dropped"`
+
+	MetricTTL      time.Duration `long:"metric_ttl" env:"METRIC_TTL" default:"0s" description:"set time after which metrics that are not updated are deleted (0 disables)"`
+	MetricTTLRules string        `long:"metric_ttl_rules" env:"METRIC_TTL_RULES" description:"set comma-separated per-metric ttl (example: CPUutilization*=10m,Alloc=0)"`
+	TTLInterval    time.Duration `long:"ttl_interval" env:"TTL_INTERVAL" default:"1m" description:"set interval of expired metrics sweep"`
+	StaleThreshold time.Duration `long:"stale_threshold" env:"STALE_THRESHOLD" default:"5m" description:"set time after which metrics that are not updated are reported as stale"`
+
+	AgentMissedReports   int           `long:"agent_missed_reports" env:"AGENT_MISSED_REPORTS" default:"3" description:"set number of missed reports after which an agent is offline"`
+	AgentTimeout         time.Duration `long:"agent_timeout" env:"AGENT_TIMEOUT" default:"1m" description:"set time without requests after which an agent with unknown report interval is offline"`
+	AgentMetricsInterval time.Duration `long:"agent_metrics_interval" env:"AGENT_METRICS_INTERVAL" default:"10s" description:"set interval of agent metrics recording (0 disables)"`
+	AgentConfig          string        `long:"agent_config" env:"AGENT_CONFIG" description:"set file of remote agent config served to agents and updated via /agent/configs"`
+
+	AuditFile       string `long:"audit_file" env:"AUDIT_FILE" description:"set audit log file (JSON lines)"`
+	AuditMaxSize    int64  `long:"audit_max_size" env:"AUDIT_MAX_SIZE" default:"10485760" description:"set audit log file size in bytes before rotation"`
+	AuditMaxBackups int    `long:"audit_max_backups" env:"AUDIT_MAX_BACKUPS" default:"5" description:"set number of rotated audit log files to keep"`
+	AuditDB         bool   `long:"audit_db" env:"AUDIT_DB" description:"store audit log in the database table audit_log"`
+
+	ExportFile     string `long:"export" config:"-" description:"export all metrics to file and exit (- for stdout)"`
+	ImportFile     string `long:"import" config:"-" description:"import metrics from file and exit (- for stdin)"`
+	TransferFormat string `long:"transfer_format" config:"-" default:"jsonl" choice:"jsonl" choice:"csv" choice:"prometheus" description:"set export/import format"`
+	ImportStrategy string `long:"import_strategy" config:"-" default:"overwrite" choice:"overwrite" choice:"keep-existing" choice:"add-counters" description:"set import merge strategy"`
 }
 
 // DefaultConfig возвращает стандартные настройки сервера.
 func DefaultConfig() *Config {
 	return &Config{
-		ListenAddr: "127.0.0.1:8080",
-		KeySign:    "",
-		StoreFile:  "/tmp/devops-metrics-db.json",
+		ListenAddr:     "127.0.0.1:8080",
+		KeySign:        "",
+		StoreFile:      "/tmp/devops-metrics-db.json",
+		StorageTimeout: 5 * time.Second,
+		StaleThreshold: 5 * time.Minute,
 	}
 }
 
-func ParseConfigFile(cfg *Config) error {
-	if cfg.ConfigFile == "" {
-		return nil
+// Validate проверяет настройки сервера и возвращает все найденные ошибки.
+func (c *Config) Validate() error {
+	var errs config.Errors
+
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		errs.Addf("address: invalid listen address %q: %v", c.ListenAddr, err)
 	}
 
-	cfgTmp := struct {
-		ListenAddr    string `json:"address,omitempty"`
-		TrustedSubnet string `json:"trusted_subnet,omitempty"`
-		Restore       bool   `json:"restore,omitempty"`
-		StoreInterval string `json:"store_interval,omitempty"`
-		StoreFile     string `json:"store_file,omitempty"`
-		DatabaseDSN   string `json:"database_dsn,omitempty"`
-		RSAPrivateKey string `json:"crypto_key,omitempty"`
-	}{}
-
-	data, err := readFile(cfg.ConfigFile)
-	if err != nil {
-		return err
+	if c.TrustedSubnet != "" {
+		if _, _, err := net.ParseCIDR(c.TrustedSubnet); err != nil {
+			errs.Addf("trusted_subnet: invalid subnet %q, want CIDR such as 10.0.0.0/8", c.TrustedSubnet)
+		}
 	}
 
-	err = json.Unmarshal(data, &cfgTmp)
-	if err != nil {
-		return err
+	if _, err := logger.ParseLevel(c.LogLevel); err != nil {
+		errs.Addf("log_level: %v", err)
 	}
 
-	if cfg.ListenAddr == "127.0.0.1:8080" {
-		cfg.ListenAddr = cfgTmp.ListenAddr
+	if c.StoreInterval < 0 {
+		errs.Addf("store_interval: must not be negative")
 	}
 
-	if cfg.TrustedSubnet == "" {
-		cfg.TrustedSubnet = cfgTmp.TrustedSubnet
+	if c.StorageTimeout <= 0 {
+		errs.Addf("storage_timeout: must be positive")
 	}
 
-	if !cfg.Restore {
-		cfg.Restore = cfgTmp.Restore
+	switch c.ReplicationRole {
+	case "", replication.RoleFollower:
+	case replication.RolePrimary:
+		if strings.TrimSpace(c.ReplicationFollowers) == "" {
+			errs.Addf("replication_followers: required for role %s", replication.RolePrimary)
+		}
+	default:
+		errs.Addf("replication_role: invalid role %q, want %s or %s", c.ReplicationRole, replication.RolePrimary, replication.RoleFollower)
 	}
 
-	if cfg.StoreInterval == 300 {
-		d, err := time.ParseDuration(cfgTmp.StoreInterval)
-		if err != nil {
-			return err
+	for _, f := range strings.Split(c.ReplicationFollowers, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if u, err := url.Parse(f); err != nil || u.Host == "" {
+			errs.Addf("replication_followers: invalid address %q, want URL such as http://10.0.0.2:8080", f)
 		}
-		cfg.StoreInterval = int(d / time.Second)
 	}
 
-	if cfg.StoreFile == "/tmp/devops-metrics-db.json" {
-		cfg.StoreFile = cfgTmp.StoreFile
+	if c.MetricTTLRules != "" {
+		if _, err := ttl.ParseRules(c.MetricTTLRules); err != nil {
+			errs.Addf("metric_ttl_rules: %v", err)
+		}
 	}
 
-	if cfg.DatabaseDSN == "" {
-		cfg.DatabaseDSN = cfgTmp.DatabaseDSN
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"config_watch_interval", c.ConfigWatchInterval},
+		{"cache_flush_interval", c.CacheFlushInterval},
+		{"federation_interval", c.FederationInterval},
+		{"alert_interval", c.AlertInterval},
+		{"history_interval", c.HistoryInterval},
+		{"history_retention", c.HistoryRetention},
+		{"recording_interval", c.RecordingInterval},
+		{"metric_ttl", c.MetricTTL},
+		{"ttl_interval", c.TTLInterval},
+		{"stale_threshold", c.StaleThreshold},
+		{"agent_timeout", c.AgentTimeout},
+		{"agent_metrics_interval", c.AgentMetricsInterval},
+	} {
+		if d.value < 0 {
+			errs.Addf("%s: must not be negative", d.name)
+		}
 	}
 
-	if cfg.RSAPrivateKey == "" {
-		cfg.RSAPrivateKey = cfgTmp.RSAPrivateKey
+	for _, n := range []struct {
+		name  string
+		value int64
+	}{
+		{"cache_size", int64(c.CacheSize)},
+		{"observer_buffer", int64(c.ObserverBuffer)},
+		{"stream_buffer", int64(c.StreamBuffer)},
+		{"stream_subscriber_buffer", int64(c.StreamSubscriberBuffer)},
+		{"audit_max_size", c.AuditMaxSize},
+		{"audit_max_backups", int64(c.AuditMaxBackups)},
+	} {
+		if n.value < 0 {
+			errs.Addf("%s: must not be negative", n.name)
+		}
 	}
 
-	return nil
-}
+	if c.AgentMissedReports < 1 {
+		errs.Addf("agent_missed_reports: must be at least 1")
+	}
 
-func readFile(file string) ([]byte, error) {
-	f, err := os.OpenFile(file, os.O_RDONLY, 0777)
-	if err != nil {
-		return []byte{}, err
+	if c.FederationUpstream != "" && c.FederationInterval == 0 {
+		errs.Addf("federation_interval: must be positive when federation_upstream is set")
 	}
-	defer f.Close()
-
-	data := make([]byte, 0)
-
-	reader := bufio.NewReader(f)
-	for {
-		line, err := reader.ReadBytes('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				return []byte{}, err
-			}
-		}
 
-		data = append(data, line...)
+	if c.AuditDB && c.DatabaseDSN == "" {
+		errs.Addf("audit_db: requires database_dsn")
 	}
 
-	return data, nil
+	return errs.Err()
 }
@@ -3,16 +3,26 @@ package server
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"sort"
+	"time"
 
 	"gometric/internal/crypto"
 	"gometric/internal/logger"
 	"gometric/internal/metrics"
+	"gometric/internal/observer"
 	"gometric/internal/postgres"
+	"gometric/internal/replication"
+	"gometric/internal/storage"
+	"gometric/internal/transfer"
 )
 
 // defaultHandler стандарный handler, возвращает статус http.StatusForbidden.
@@ -21,16 +31,25 @@ func (s HTTPServer) defaultHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // listHandler выводит все существующие метрики в виде html.
+// Доступен по адресу /list для клиентов без JavaScript, основная страница — dashboard.
 func (s HTTPServer) listHandler(w http.ResponseWriter, r *http.Request) {
 	var varList string
 
-	for _, metricName := range s.Storage.List() {
-		v, err := s.Storage.Get(metricName)
+	names, err := s.Storage.ListCtx(r.Context())
+	if storageInterrupted(w, err) {
+		return
+	}
+
+	meta := s.meta(r.Context())
+	now := time.Now()
+
+	for _, metricName := range names {
+		v, err := s.Storage.GetCtx(r.Context(), metricName)
 		if err == nil {
 			if gaugeType(v) {
-				varList += fmt.Sprintf("%s (type: gauge): %f<br>\n", metricName, v.(float64))
+				varList += fmt.Sprintf("%s (type: gauge): %f%s<br>\n", metricName, v.(float64), s.staleness(meta, metricName, now))
 			} else if counterType(v) {
-				varList += fmt.Sprintf("%s (type: counter): %d<br>\n", metricName, v.(int64))
+				varList += fmt.Sprintf("%s (type: counter): %d%s<br>\n", metricName, v.(int64), s.staleness(meta, metricName, now))
 			}
 		}
 	}
@@ -43,8 +62,62 @@ func (s HTTPServer) listHandler(w http.ResponseWriter, r *http.Request) {
 		"</body>\n</html>", varList)
 }
 
+// meta возвращает сведения об обновлениях метрик keys или nil, если бэкенд их не хранит.
+func (s HTTPServer) meta(ctx context.Context, keys ...string) map[string]metrics.Meta {
+	reader, ok := storage.Meta(s.Storage)
+	if !ok {
+		return nil
+	}
+
+	meta, err := reader.MetaCtx(ctx, keys...)
+	if err != nil {
+		logger.Error("could not read metrics meta", err)
+		return nil
+	}
+
+	return meta
+}
+
+// staleness возвращает отметку для html устаревшей на момент now метрики name.
+func (s HTTPServer) staleness(meta map[string]metrics.Meta, name string, now time.Time) string {
+	m, ok := meta[name]
+	if !ok || s.StaleThreshold <= 0 {
+		return ""
+	}
+
+	age := now.Sub(m.Updated)
+	if age <= s.StaleThreshold {
+		return ""
+	}
+
+	return fmt.Sprintf(" <i>(stale: updated %s ago)</i>", age.Truncate(time.Second))
+}
+
+// valueMeta описывает ответ /value/ со сведениями об обновлениях метрики.
+type valueMeta struct {
+	metrics.Metrics
+	Updated *time.Time `json:"updated,omitempty"`
+	Updates int64      `json:"updates,omitempty"`
+}
+
+// valueResponse добавляет к метрике сведения об обновлениях, если они запрошены параметром meta.
+func (s HTTPServer) valueResponse(r *http.Request, metric metrics.Metrics) interface{} {
+	if r.URL.Query().Get("meta") == "" {
+		return metric
+	}
+
+	resp := valueMeta{Metrics: metric}
+	if m, ok := s.meta(r.Context(), metric.ID)[metric.ID]; ok {
+		resp.Updated = &m.Updated
+		resp.Updates = m.Updates
+	}
+
+	return resp
+}
+
 // GetValueHandler извлекает метрики из key-value бэкенда и отсылает в формате json.
 // Функция также подписывает сообщение перед отправкой с помощью функции Sign().
+// С параметром meta=1 в ответ добавляются время последнего обновления и число обновлений.
 func (s HTTPServer) GetValueHandler(w http.ResponseWriter, r *http.Request) {
 	reqBody, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -59,8 +132,10 @@ func (s HTTPServer) GetValueHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	logger.Debug(fmt.Sprintf("unmarshall succefull: %v", metric))
 
-	v, err := s.Storage.Get(metric.ID)
-	if err != nil {
+	v, err := s.Storage.GetCtx(r.Context(), metric.ID)
+	if storageInterrupted(w, err) {
+		return
+	} else if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
@@ -72,11 +147,11 @@ func (s HTTPServer) GetValueHandler(w http.ResponseWriter, r *http.Request) {
 			metric.Value = (*float64)(&v1)
 
 			// sign if key is not empty
-			if s.KeySign != "" {
-				metric.Sign(s.KeySign)
+			if key := s.current().keySign; key != "" {
+				metric.Sign(key)
 			}
 
-			ret, err := json.Marshal(metric)
+			ret, err := json.Marshal(s.valueResponse(r, metric))
 			if err != nil {
 				logger.Error("", err)
 				return
@@ -93,11 +168,11 @@ func (s HTTPServer) GetValueHandler(w http.ResponseWriter, r *http.Request) {
 			metric.Delta = (*int64)(&v1)
 
 			// sign if key is not empty
-			if s.KeySign != "" {
-				metric.Sign(s.KeySign)
+			if key := s.current().keySign; key != "" {
+				metric.Sign(key)
 			}
 
-			ret, err := json.Marshal(metric)
+			ret, err := json.Marshal(s.valueResponse(r, metric))
 			if err != nil {
 				logger.Error("", err)
 				return
@@ -113,6 +188,59 @@ func (s HTTPServer) GetValueHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 }
 
+// ListValuesHandler возвращает все метрики в формате json.
+// Метрики подписываются с помощью функции Sign(), если задан ключ.
+func (s HTTPServer) ListValuesHandler(w http.ResponseWriter, r *http.Request) {
+	result := make([]metrics.Metrics, 0)
+
+	names, err := s.Storage.ListCtx(r.Context())
+	if storageInterrupted(w, err) {
+		return
+	}
+
+	key := s.current().keySign
+
+	for _, metricName := range names {
+		v, err := s.Storage.GetCtx(r.Context(), metricName)
+		if storageInterrupted(w, err) {
+			return
+		} else if err != nil {
+			continue
+		}
+
+		metric := metrics.Metrics{ID: metricName}
+
+		if gaugeType(v) {
+			v1 := v.(float64)
+			metric.MType = "gauge"
+			metric.Value = &v1
+		} else if counterType(v) {
+			v1 := v.(int64)
+			metric.MType = "counter"
+			metric.Delta = &v1
+		} else {
+			continue
+		}
+
+		// sign if key is not empty
+		if key != "" {
+			metric.Sign(key)
+		}
+
+		result = append(result, metric)
+	}
+
+	ret, err := json.Marshal(result)
+	if err != nil {
+		logger.Error("", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(ret)
+}
+
 // UpdateHandler принимает метрики в формате json и сохраняет в key-value бэкенд.
 // Функция также проверяет подпись с помощью ValidMAC().
 func (s HTTPServer) UpdateHandler(w http.ResponseWriter, r *http.Request) {
@@ -128,8 +256,8 @@ func (s HTTPServer) UpdateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// ValidMAC if key is not epmty
-	if s.KeySign != "" {
-		if !metric.ValidMAC(s.KeySign) {
+	if key := s.current().keySign; key != "" {
+		if !metric.ValidMAC(key) {
 			logger.Debug("invalid HMAC of the data")
 			w.WriteHeader(http.StatusBadRequest)
 			return
@@ -139,24 +267,30 @@ func (s HTTPServer) UpdateHandler(w http.ResponseWriter, r *http.Request) {
 	switch metric.MType {
 	case "gauge":
 		if metric.ID != "" && metric.Value != nil {
-			err := s.Storage.Set(metric.ID, float64(*metric.Value))
+			err := s.Storage.SetCtx(r.Context(), metric.ID, float64(*metric.Value))
 			if err == nil {
 				w.WriteHeader(http.StatusOK)
 				return
+			} else if storageInterrupted(w, err) {
+				return
 			}
 		}
 	case "counter":
 		// get previous counter value
-		prevCounter, err := s.Storage.Get(metric.ID)
-		if err != nil {
+		prevCounter, err := s.Storage.GetCtx(r.Context(), metric.ID)
+		if storageInterrupted(w, err) {
+			return
+		} else if err != nil {
 			prevCounter = int64(0)
 		}
 
 		if metric.ID != "" && metric.Delta != nil {
-			err = s.Storage.Set(metric.ID, (*metric.Delta + prevCounter.(int64)))
+			err = s.Storage.SetCtx(r.Context(), metric.ID, (*metric.Delta + prevCounter.(int64)))
 			if err == nil {
 				w.WriteHeader(http.StatusOK)
 				return
+			} else if storageInterrupted(w, err) {
+				return
 			}
 		}
 	}
@@ -180,11 +314,12 @@ func (s HTTPServer) UpdatesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data := make(map[string]interface{})
+	key := s.current().keySign
 
 	for _, metric := range metrics {
 		// ValidMAC if key is not epmty
-		if s.KeySign != "" {
-			if !metric.ValidMAC(s.KeySign) {
+		if key != "" {
+			if !metric.ValidMAC(key) {
 				logger.Debug("invalid HMAC of the data")
 				w.WriteHeader(http.StatusForbidden)
 				return
@@ -200,8 +335,10 @@ func (s HTTPServer) UpdatesHandler(w http.ResponseWriter, r *http.Request) {
 		case "counter":
 			// get previous counter value
 			var prevCounter interface{}
-			prevCounter, err = s.Storage.Get(metric.ID)
-			if err != nil {
+			prevCounter, err = s.Storage.GetCtx(r.Context(), metric.ID)
+			if storageInterrupted(w, err) {
+				return
+			} else if err != nil {
 				prevCounter = int64(0)
 			}
 
@@ -211,26 +348,235 @@ func (s HTTPServer) UpdatesHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	err = s.Storage.MSet(data)
+	err = s.Storage.MSetCtx(r.Context(), data)
 	if err == nil {
 		w.WriteHeader(http.StatusOK)
 		return
+	} else if storageInterrupted(w, err) {
+		return
 	}
 
 	logger.Debug("response status is Forbidden")
 	w.WriteHeader(http.StatusForbidden)
 }
 
+// renameRequest описывает тело запроса /rename/.
+type renameRequest struct {
+	ID    string `json:"id"`
+	NewID string `json:"new_id"`
+}
+
+// DeleteHandler удаляет метрику, переданную в формате json: {"id":"Alloc"}.
+func (s HTTPServer) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	var metric metrics.Metrics
+	if err := json.NewDecoder(r.Body).Decode(&metric); err != nil || metric.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	writeStorageStatus(w, s.Storage.DeleteCtx(r.Context(), metric.ID))
+}
+
+// RenameHandler переименовывает метрику, переданную в формате json: {"id":"Alloc","new_id":"HeapAlloc"}.
+func (s HTTPServer) RenameHandler(w http.ResponseWriter, r *http.Request) {
+	var req renameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" || req.NewID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	writeStorageStatus(w, s.Storage.RenameCtx(r.Context(), req.ID, req.NewID))
+}
+
+// writeStorageStatus отвечает статусом по результату операции с хранилищем:
+// 404 для отсутствующей метрики, 409 для существующей, 403 для реплики.
+func writeStorageStatus(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusOK)
+	case storageInterrupted(w, err):
+	case errors.Is(err, metrics.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, metrics.ErrExists):
+		w.WriteHeader(http.StatusConflict)
+	case errors.Is(err, replication.ErrReadOnly):
+		w.WriteHeader(http.StatusForbidden)
+	default:
+		logger.Error("storage operation failed", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// observerHandler возвращает число изменений, доставленных и отброшенных подписчикам записей.
+func (s HTTPServer) observerHandler(w http.ResponseWriter, r *http.Request) {
+	ret, err := json.Marshal(s.Observer.Stats())
+	if err != nil {
+		logger.Error("", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(ret)
+}
+
+// staleMetric описывает устаревшую метрику.
+type staleMetric struct {
+	ID      string    `json:"id"`
+	MType   string    `json:"type"`
+	Updated time.Time `json:"updated"`
+	// Age время без обновлений в секундах.
+	Age     float64 `json:"age"`
+	Updates int64   `json:"updates"`
+}
+
+// staleHandler возвращает в формате json метрики, которые не обновлялись дольше порога.
+// Порог задается параметром threshold, например 10m, по умолчанию StaleThreshold.
+// Метрики сортируются от давно не обновлявшихся к недавним.
+func (s HTTPServer) staleHandler(w http.ResponseWriter, r *http.Request) {
+	threshold := s.StaleThreshold
+	if v := r.URL.Query().Get("threshold"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, fmt.Sprintf("invalid threshold %q", v), http.StatusBadRequest)
+			return
+		}
+		threshold = d
+	}
+
+	reader, ok := storage.Meta(s.Storage)
+	if !ok {
+		http.Error(w, "storage does not track update time", http.StatusNotImplemented)
+		return
+	}
+
+	meta, err := reader.MetaCtx(r.Context())
+	if storageInterrupted(w, err) {
+		return
+	} else if err != nil {
+		logger.Error("could not read metrics meta", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	result := make([]staleMetric, 0)
+	for id, m := range meta {
+		age := now.Sub(m.Updated)
+		if age <= threshold {
+			continue
+		}
+
+		v, err := s.Storage.GetCtx(r.Context(), id)
+		if err != nil {
+			// the metric is deleted concurrently
+			continue
+		}
+
+		result = append(result, staleMetric{
+			ID:      id,
+			MType:   observer.TypeOf(v),
+			Updated: m.Updated,
+			Age:     age.Seconds(),
+			Updates: m.Updates,
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Age != result[j].Age {
+			return result[i].Age > result[j].Age
+		}
+		return result[i].ID < result[j].ID
+	})
+
+	ret, err := json.Marshal(result)
+	if err != nil {
+		logger.Error("", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(ret)
+}
+
+// ExportHandler выгружает все метрики в формате, заданном параметром format (jsonl, csv, prometheus).
+func (s HTTPServer) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = transfer.FormatJSONLines
+	}
+
+	if err := transfer.ValidFormat(format); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", transfer.ContentType(format))
+	if err := transfer.Export(r.Context(), w, s.Storage, format); err != nil {
+		logger.Error("export metrics failed", err)
+	}
+}
+
+// ImportHandler загружает метрики из тела запроса в формате, заданном параметром format,
+// объединяя их с существующими по стратегии strategy (overwrite, keep-existing, add-counters).
+func (s HTTPServer) ImportHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = transfer.FormatJSONLines
+	}
+
+	strategy := r.URL.Query().Get("strategy")
+	if strategy == "" {
+		strategy = transfer.StrategyOverwrite
+	}
+
+	if err := transfer.ValidFormat(format); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := transfer.ValidStrategy(strategy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	n, err := transfer.Import(r.Context(), r.Body, s.Storage, format, strategy)
+	if storageInterrupted(w, err) {
+		return
+	} else if err != nil {
+		logger.Error("import metrics failed", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger.Debug(fmt.Sprintf("%d metrics imported", n))
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"imported":%d}`, n)
+}
+
+// storageInterrupted проверяет, что операция с хранилищем прервана по таймауту
+// или отменой запроса, и в этом случае отвечает статусом 504 Gateway Timeout.
+func storageInterrupted(w http.ResponseWriter, err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		logger.Error("storage operation interrupted", err)
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return true
+	}
+
+	return false
+}
+
 // trustedSubnetHandler проверяет, что переданный в заголовке запроса X-Real-IP, X-Forwarded-For IP-адрес агента
 // входит в доверенную подсеть, в противном случае возвращается статус ответа 403 Forbidden.
 func (s HTTPServer) trustedSubnetHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		realIP := r.RemoteAddr
 
-		if s.TrustedSubnet != nil {
+		if trustedSubnet := s.current().trustedSubnet; trustedSubnet != nil {
 			IPAddr := net.ParseIP(realIP)
 
-			if IPAddr == nil || !s.TrustedSubnet.Contains(IPAddr) {
+			if IPAddr == nil || !trustedSubnet.Contains(IPAddr) {
 				logger.Debug(fmt.Sprintf("client IP %s is not allowed", IPAddr))
 				w.WriteHeader(http.StatusForbidden)
 				return
@@ -241,6 +587,52 @@ func (s HTTPServer) trustedSubnetHandler(next http.Handler) http.Handler {
 	})
 }
 
+// verifyBodyHandler проверяет подпись тела запроса в заголовке metrics.SignHeader, если задан ключ.
+func (s HTTPServer) verifyBodyHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keySign := s.current().keySign
+		if keySign == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "could not read request body", http.StatusBadRequest)
+			return
+		}
+
+		mac1, err := metrics.Sign(string(body), keySign)
+		if err != nil {
+			logger.Error("", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		mac2, err := hex.DecodeString(r.Header.Get(metrics.SignHeader))
+		if err != nil || !hmac.Equal(mac1, mac2) {
+			logger.Debug("invalid request body signature")
+			http.Error(w, "invalid signature", http.StatusForbidden)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewBuffer(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sourceHandler передает адрес агента в контексте запроса как источник записей в хранилище.
+func sourceHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		source := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(source); err == nil {
+			source = host
+		}
+
+		next.ServeHTTP(w, r.WithContext(observer.WithSource(r.Context(), source)))
+	})
+}
+
 // unzipBodyHandler используется для распаковки сжатого с помощью gzip тела сообщения.
 func unzipBodyHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -280,7 +672,7 @@ func (s HTTPServer) decryptRSABodyHandler(next http.Handler) http.Handler {
 				return
 			}
 
-			decryptBody, err := crypto.Decrypt(s.RSAPrivateKey, bytes.NewBuffer(encryptBody))
+			decryptBody, err := crypto.Decrypt(s.current().rsaPrivateKey, bytes.NewBuffer(encryptBody))
 			if err != nil {
 				logger.Error("request decrypted is failed", err)
 				w.WriteHeader(http.StatusForbidden)
@@ -298,8 +690,8 @@ func (s HTTPServer) decryptRSABodyHandler(next http.Handler) http.Handler {
 // pingHandler используется для проверки доступности БД.
 // Используется только с бэкендом Postgres.
 func (s HTTPServer) pingHandler(w http.ResponseWriter, r *http.Request) {
-	if _, ok := s.Storage.(*postgres.Postgres); ok {
-		if err := s.Storage.(*postgres.Postgres).Ping(); err == nil {
+	if pg, ok := storage.Unwrap(s.Storage).(*postgres.Postgres); ok {
+		if err := pg.PingCtx(r.Context()); err == nil {
 			logger.Debug("database is reachable")
 			w.WriteHeader(http.StatusOK)
 			return
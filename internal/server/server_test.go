@@ -1,20 +1,32 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"gometric/internal/audit"
+	"gometric/internal/config"
+	"gometric/internal/memstorage"
+	"gometric/internal/metrics"
 	"gometric/internal/postgres"
-
-	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
+	"gometric/internal/registry"
+	"gometric/internal/storage"
+	"gometric/internal/stream"
 )
 
 func httpRequestRealIP(ts *httptest.Server, method, path string, body []byte, realIP string) (int, string) {
@@ -45,6 +57,23 @@ func httpRequest(ts *httptest.Server, method, path string, body []byte) (int, st
 	return resp.StatusCode, string(respBody)
 }
 
+// httpRequestSigned отправляет запрос с подписью тела ключом key.
+func httpRequestSigned(ts *httptest.Server, method, path string, body []byte, key string) (int, string) {
+	req, _ := http.NewRequest(method, ts.URL+path, bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	if key != "" {
+		sign, _ := metrics.Sign(string(body), key)
+		req.Header.Set(metrics.SignHeader, hex.EncodeToString(sign))
+	}
+
+	resp, _ := http.DefaultClient.Do(req)
+	respBody, _ := io.ReadAll(resp.Body)
+	defer resp.Body.Close()
+
+	return resp.StatusCode, string(respBody)
+}
+
 func httpRequestGzip(ts *httptest.Server, method, path string, body []byte) (int, string) {
 	var b bytes.Buffer
 
@@ -108,32 +137,7 @@ func TestContentEncodingContains(t *testing.T) {
 
 func NewTestServer(ctx context.Context, cfg *Config) *HTTPServer {
 	s := NewServer(ctx, cfg)
-
-	s.chiRouter.Use(middleware.RealIP)
-	s.chiRouter.Use(s.decryptRSABodyHandler)
-	s.chiRouter.Use(unzipBodyHandler)
-	s.chiRouter.Get("/", s.listHandler)
-	s.chiRouter.Post("/", s.defaultHandler)
-	s.chiRouter.Route("/", func(r chi.Router) {
-		r.Use(s.trustedSubnetHandler)
-		r.Use(middleware.AllowContentType("application/json"))
-		r.Post("/value/", s.GetValueHandler)
-		r.Post("/update/", s.UpdateHandler)
-		r.Post("/updates/", s.UpdatesHandler)
-	})
-
-	/*
-		s.chiRouter.Use(middleware.Compress(5, "text/html", "application/json"))
-		s.chiRouter.Use(unzipBodyHandler)
-		s.chiRouter.Get("/", s.listHandler)
-		s.chiRouter.Post("/", s.defaultHandler)
-		s.chiRouter.Route("/", func(r chi.Router) {
-			r.Use(middleware.AllowContentType("application/json"))
-			r.Post("/value/", s.GetValueHandler)
-			r.Post("/update/", s.UpdateHandler)
-			r.Post("/updates/", s.UpdatesHandler)
-		})
-	*/
+	s.routes()
 
 	return s
 }
@@ -596,3 +600,760 @@ func TestHTTPServerRealIP(t *testing.T) {
 		})
 	}
 }
+
+// test list of all metrics in json
+func TestHTTPServerListValues(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := DefaultConfig()
+	cfg.KeySign = "secret"
+	s := NewTestServer(ctx, cfg)
+
+	ts := httptest.NewServer(s.chiRouter)
+	defer ts.Close()
+
+	statusCode, body := httpRequest(ts, "GET", "/values/", nil)
+	if statusCode != http.StatusOK || body != "[]" {
+		t.Errorf("Error: empty list expected, got %s", body)
+	}
+
+	s.Storage.Set("PollCount", int64(1))
+	s.Storage.Set("Alloc", float64(226640))
+	s.Storage.Set("Unknown", "string")
+
+	statusCode, body = httpRequest(ts, "GET", "/values/", nil)
+	want := `[{"id":"Alloc","type":"gauge","value":226640,"hash":"3544777d62d524efaacb5eae93073cb716251bff20490e6e5c266376dc002f3e"},` +
+		`{"id":"PollCount","type":"counter","delta":1,"hash":"ce97c6062da4477a5fad4cfdd24f0f24e474d309b1f054928dd138683d1cab12"}]`
+	if statusCode != http.StatusOK || body != want {
+		t.Errorf("Error: got %s", body)
+	}
+}
+
+// test export and import of all metrics
+func TestHTTPServerExportImport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewTestServer(ctx, DefaultConfig())
+
+	ts := httptest.NewServer(s.chiRouter)
+	defer ts.Close()
+
+	s.Storage.Set("PollCount", int64(5))
+
+	statusCode, body := httpRequest(ts, "POST", "/import?format=csv&strategy=add-counters",
+		[]byte("id,type,value\nAlloc,gauge,1.5\nPollCount,counter,2\n"))
+	if statusCode != http.StatusOK || body != `{"imported":2}` {
+		t.Errorf("Error: import failed: %d %s", statusCode, body)
+	}
+
+	statusCode, body = httpRequest(ts, "GET", "/export?format=csv", nil)
+	if statusCode != http.StatusOK || body != "id,type,value\nAlloc,gauge,1.5\nPollCount,counter,7\n" {
+		t.Errorf("Error: export failed: %d %s", statusCode, body)
+	}
+
+	statusCode, _ = httpRequest(ts, "GET", "/export?format=xml", nil)
+	if statusCode != http.StatusBadRequest {
+		t.Errorf("Error: unknown format must be rejected")
+	}
+
+	statusCode, _ = httpRequest(ts, "POST", "/import?strategy=merge", []byte(""))
+	if statusCode != http.StatusBadRequest {
+		t.Errorf("Error: unknown strategy must be rejected")
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	dir := t.TempDir()
+
+	cfg := DefaultConfig()
+	cfg.StoreFile = filepath.Join(dir, "db.json")
+	cfg.TransferFormat = "csv"
+	cfg.ImportStrategy = "overwrite"
+	cfg.ImportFile = filepath.Join(dir, "in.csv")
+
+	if err := os.WriteFile(cfg.ImportFile, []byte("id,type,value\nAlloc,gauge,1.5\nPollCount,counter,2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Transfer(context.Background(), cfg); err != nil {
+		t.Fatalf("Error: import failed: %s", err)
+	}
+
+	// the imported metrics are restored from the dump
+	cfg.ImportFile = ""
+	cfg.ExportFile = filepath.Join(dir, "out.csv")
+	if err := Transfer(context.Background(), cfg); err != nil {
+		t.Fatalf("Error: export failed: %s", err)
+	}
+
+	got, err := os.ReadFile(cfg.ExportFile)
+	if err != nil || string(got) != "id,type,value\nAlloc,gauge,1.5\nPollCount,counter,2\n" {
+		t.Errorf("Error: exported metrics are incorrect: %q %v", got, err)
+	}
+
+	cfg.ImportFile = filepath.Join(dir, "missing.csv")
+	if err := Transfer(context.Background(), cfg); err == nil {
+		t.Errorf("Error: missing import file must be reported")
+	}
+}
+
+// test that requests changing the storage without signed metrics require a body signature
+func TestHTTPServerSignedBody(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := DefaultConfig()
+	cfg.KeySign = "secret"
+	cfg.AgentConfig = filepath.Join(t.TempDir(), "agents.json")
+	s := NewTestServer(ctx, cfg)
+
+	ts := httptest.NewServer(s.chiRouter)
+	defer ts.Close()
+
+	s.Storage.Set("PollCount", int64(5))
+	s.Storage.Set("Alloc", float64(1))
+	s.Storage.Set("Frees", float64(2))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{name: "import", method: "POST", path: "/import?format=csv", body: "id,type,value\nPollCount,counter,1\n", status: http.StatusOK},
+		{name: "delete", method: "POST", path: "/delete/", body: `{"id":"Alloc"}`, status: http.StatusOK},
+		{name: "rename", method: "POST", path: "/rename/", body: `{"id":"Frees","new_id":"HeapFrees"}`, status: http.StatusOK},
+		{name: "agent configs", method: "PUT", path: "/agent/configs", body: `{"default":{"report_interval":"5s"}}`, status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		if status, _ := httpRequestSigned(ts, tt.method, tt.path, []byte(tt.body), ""); status != http.StatusForbidden {
+			t.Errorf("Error: unsigned %s must be rejected: %d", tt.name, status)
+		}
+		if status, _ := httpRequestSigned(ts, tt.method, tt.path, []byte(tt.body), "wrong"); status != http.StatusForbidden {
+			t.Errorf("Error: %s signed with another key must be rejected: %d", tt.name, status)
+		}
+		if status, body := httpRequestSigned(ts, tt.method, tt.path, []byte(tt.body), cfg.KeySign); status != tt.status {
+			t.Errorf("Error: signed %s failed: %d %s", tt.name, status, body)
+		}
+	}
+
+	if v, _ := s.Storage.Get("PollCount"); v != int64(1) {
+		t.Errorf("Error: only the signed import must be applied: %v", v)
+	}
+
+	if list := s.Storage.List(); !reflect.DeepEqual(list, []string{"HeapFrees", "PollCount"}) {
+		t.Errorf("Error: only signed changes must be applied: %v", list)
+	}
+
+	// agent config is signed with the current key
+	cfg.KeySign = "new"
+	if err := s.Reload(cfg); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	resp, err := http.Get(ts.URL + "/agent/config")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	sign, _ := metrics.Sign(string(body), "new")
+	if resp.Header.Get(metrics.SignHeader) != hex.EncodeToString(sign) {
+		t.Errorf("Error: agent config must be signed with the current key: %s", body)
+	}
+}
+
+// test that storage operations are interrupted with the request context
+func TestHTTPServerCanceledRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewTestServer(ctx, DefaultConfig())
+
+	reqCtx, reqCancel := context.WithCancel(context.Background())
+	reqCancel()
+
+	body := []byte(`{"id":"PollCount","type":"counter","delta":1}`)
+	req := httptest.NewRequest("POST", "/update/", bytes.NewBuffer(body)).WithContext(reqCtx)
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	s.chiRouter.ServeHTTP(w, req)
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Error: status %d, want %d", w.Code, http.StatusGatewayTimeout)
+	}
+
+	if _, err := s.Storage.Get("PollCount"); err == nil {
+		t.Errorf("Error: metric must not be saved")
+	}
+}
+
+// test replication between two servers
+func TestHTTPServerReplication(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := DefaultConfig()
+	cfg.ReplicationRole = "follower"
+	follower := NewTestServer(ctx, cfg)
+
+	fts := httptest.NewServer(follower.chiRouter)
+	defer fts.Close()
+
+	cfg = DefaultConfig()
+	cfg.ReplicationRole = "primary"
+	cfg.ReplicationFollowers = fts.URL
+	primary := NewTestServer(ctx, cfg)
+
+	pts := httptest.NewServer(primary.chiRouter)
+	defer pts.Close()
+
+	statusCode, _ := httpRequest(pts, "POST", "/update/", []byte(`{"id":"PollCount","type":"counter","delta":3}`))
+	if statusCode != http.StatusOK {
+		t.Fatalf("Error: update failed: %d", statusCode)
+	}
+
+	var body string
+	for i := 0; i < 100; i++ {
+		statusCode, body = httpRequest(fts, "POST", "/value/", []byte(`{"id":"PollCount","type":"counter"}`))
+		if statusCode == http.StatusOK {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if body != `{"id":"PollCount","type":"counter","delta":3}` {
+		t.Errorf("Error: metric is not replicated: %s", body)
+	}
+
+	statusCode, _ = httpRequest(fts, "POST", "/update/", []byte(`{"id":"PollCount","type":"counter","delta":1}`))
+	if statusCode == http.StatusOK {
+		t.Errorf("Error: follower must be read-only")
+	}
+
+	statusCode, body = httpRequest(fts, "GET", "/replication/status", nil)
+	if statusCode != http.StatusOK || !strings.Contains(body, `"role":"follower"`) {
+		t.Errorf("Error: status is incorrect: %s", body)
+	}
+}
+
+// test alerts endpoint
+func TestHTTPServerAlerts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	file := "/tmp/test_server_alert_rules.json"
+	rules := `{"rules":[{"name":"LowMemory","metric":"FreeMemory","type":"threshold","op":"<","value":100}]}`
+	if err := os.WriteFile(file, []byte(rules), 0644); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer os.Remove(file)
+
+	cfg := DefaultConfig()
+	cfg.AlertRules = file
+	s := NewTestServer(ctx, cfg)
+
+	ts := httptest.NewServer(s.chiRouter)
+	defer ts.Close()
+
+	s.Storage.Set("FreeMemory", float64(50))
+	if err := s.Alerts.Eval(ctx); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	statusCode, body := httpRequest(ts, "GET", "/alerts?state=firing", nil)
+	if statusCode != http.StatusOK || !strings.Contains(body, `"rule":"LowMemory","metric":"FreeMemory","state":"firing","value":50`) {
+		t.Errorf("Error: alerts are incorrect: %s", body)
+	}
+}
+
+func TestHTTPServerQuery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewTestServer(ctx, DefaultConfig())
+
+	ts := httptest.NewServer(s.chiRouter)
+	defer ts.Close()
+
+	s.Storage.Set("CPUutilization1", float64(15))
+	s.Storage.Set("CPUutilization2", float64(25.5))
+
+	statusCode, body := httpRequest(ts, "GET", "/query?q=sum(CPUutilization*)", nil)
+	if statusCode != http.StatusOK || body != `{"type":"vector","result":[{"id":"","value":40.5}]}` {
+		t.Errorf("Error: query result is incorrect: %d %s", statusCode, body)
+	}
+
+	statusCode, _ = httpRequest(ts, "GET", "/query?q=sum(", nil)
+	if statusCode != http.StatusBadRequest {
+		t.Errorf("Error: invalid query status %d, want %d", statusCode, http.StatusBadRequest)
+	}
+}
+
+func TestHTTPServerRecordingRules(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	file := "/tmp/test_server_recording_rules.json"
+	rules := `{"rules":[{"record":"MemoryUsedPct","expr":"100*(TotalMemory-FreeMemory)/TotalMemory"}]}`
+	if err := os.WriteFile(file, []byte(rules), 0644); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer os.Remove(file)
+
+	cfg := DefaultConfig()
+	cfg.RecordingRules = file
+	s := NewTestServer(ctx, cfg)
+
+	ts := httptest.NewServer(s.chiRouter)
+	defer ts.Close()
+
+	s.Storage.Set("TotalMemory", float64(2048))
+	s.Storage.Set("FreeMemory", float64(512))
+	if err := s.Recorder.Eval(ctx, time.Now()); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	statusCode, body := httpRequest(ts, "POST", "/value/", []byte(`{"id":"MemoryUsedPct","type":"gauge"}`))
+	if statusCode != http.StatusOK || body != `{"id":"MemoryUsedPct","type":"gauge","value":75}` {
+		t.Errorf("Error: recorded metric is incorrect: %d %s", statusCode, body)
+	}
+}
+
+func TestHTTPServerDashboard(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewTestServer(ctx, DefaultConfig())
+
+	ts := httptest.NewServer(s.chiRouter)
+	defer ts.Close()
+
+	s.Storage.Set("Alloc", float64(100))
+
+	statusCode, body := httpRequest(ts, "GET", "/", nil)
+	if statusCode != http.StatusOK || !strings.Contains(body, "/dashboard/static/app.js") {
+		t.Errorf("Error: dashboard page is incorrect: %d %s", statusCode, body)
+	}
+
+	statusCode, body = httpRequest(ts, "GET", "/dashboard/api/metrics", nil)
+	if statusCode != http.StatusOK || body != `[{"id":"Alloc","name":"Alloc","type":"gauge","value":100}]` {
+		t.Errorf("Error: dashboard metrics are incorrect: %d %s", statusCode, body)
+	}
+
+	statusCode, body = httpRequest(ts, "GET", "/list", nil)
+	if statusCode != http.StatusOK || !strings.Contains(body, "Alloc (type: gauge): 100.000000<br>") {
+		t.Errorf("Error: metric list is incorrect: %d %s", statusCode, body)
+	}
+}
+
+func TestHTTPServerStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewTestServer(ctx, DefaultConfig())
+
+	ts := httptest.NewServer(s.chiRouter)
+	defer ts.Close()
+
+	reqCtx, reqCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer reqCancel()
+
+	req, _ := http.NewRequestWithContext(reqCtx, "GET", ts.URL+"/stream/?type=counter", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	httpRequest(ts, "POST", "/update/", []byte(`{"id":"Alloc","type":"gauge","value":1}`))
+	httpRequest(ts, "POST", "/updates/", []byte(`[{"id":"PollCount","type":"counter","delta":2},{"id":"PollCount2","type":"counter","delta":3}]`))
+	httpRequest(ts, "POST", "/update/", []byte(`{"id":"PollCount","type":"counter","delta":5}`))
+
+	var data []string
+	scanner := bufio.NewScanner(resp.Body)
+	for len(data) < 3 && scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+			data = append(data, line)
+		}
+	}
+
+	if len(data) != 3 || !strings.Contains(data[0], `"metric":{"id":"PollCount","type":"counter","delta":2}`) ||
+		!strings.Contains(data[1], `"id":"PollCount2"`) || !strings.Contains(data[2], `"delta":7`) {
+		t.Errorf("Error: stream events are incorrect: %v", data)
+	}
+
+	code, body := httpRequest(ts, "GET", "/observer", nil)
+	if code != http.StatusOK || !strings.Contains(body, `"published":4`) || !strings.Contains(body, `"name":"stream"`) {
+		t.Errorf("Error: observer stats are incorrect: %d %s", code, body)
+	}
+}
+
+func TestHTTPServerAudit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := DefaultConfig()
+	cfg.AuditFile = filepath.Join(t.TempDir(), "audit.jsonl")
+	cfg.TrustedSubnet = "10.0.0.0/8"
+
+	s := NewTestServer(ctx, cfg)
+	defer s.Audit.Close()
+
+	ts := httptest.NewServer(s.chiRouter)
+	defer ts.Close()
+
+	httpRequestRealIP(ts, "POST", "/update/", []byte(`{"id":"Alloc","type":"gauge","value":1}`), "10.0.0.10")
+	httpRequestRealIP(ts, "POST", "/update/", []byte(`{"id":"Alloc","type":"gauge","value":2}`), "192.168.0.1")
+
+	code, body := httpRequestRealIP(ts, "GET", "/audit?name=Alloc", nil, "10.0.0.10")
+
+	var records []audit.Record
+	if err := json.Unmarshal([]byte(body), &records); err != nil {
+		t.Fatalf("Error: %d %s", code, err)
+	}
+
+	if len(records) != 2 || records[0].ClientIP != "10.0.0.10" || records[0].Outcome != audit.OutcomeSuccess || records[0].RequestID == "" ||
+		records[1].ClientIP != "192.168.0.1" || records[1].Status != http.StatusForbidden {
+		t.Errorf("Error: audit records are incorrect: %s", body)
+	}
+}
+
+func TestHTTPServerDeleteRename(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := DefaultConfig()
+	cfg.MetricTTL = time.Hour
+	cfg.TTLInterval = time.Hour
+
+	s := NewTestServer(ctx, cfg)
+	if s.Sweeper == nil || s.Sweeper.TTL("Alloc") != time.Hour {
+		t.Fatalf("Error: ttl sweeper is not started")
+	}
+
+	ts := httptest.NewServer(s.chiRouter)
+	defer ts.Close()
+
+	httpRequest(ts, "POST", "/updates/", []byte(`[{"id":"Alloc","type":"gauge","value":1},{"id":"PollCount","type":"counter","delta":2}]`))
+
+	tests := []struct {
+		path string
+		body string
+		code int
+	}{
+		{path: "/rename/", body: `{"id":"Alloc","new_id":"PollCount"}`, code: http.StatusConflict},
+		{path: "/rename/", body: `{"id":"Alloc","new_id":"HeapAlloc"}`, code: http.StatusOK},
+		{path: "/rename/", body: `{"id":"Alloc"}`, code: http.StatusBadRequest},
+		{path: "/delete/", body: `{"id":"PollCount"}`, code: http.StatusOK},
+		{path: "/delete/", body: `{"id":"PollCount"}`, code: http.StatusNotFound},
+		{path: "/delete/", body: `{}`, code: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		if code, _ := httpRequest(ts, "POST", tt.path, []byte(tt.body)); code != tt.code {
+			t.Errorf("Error: %s %s status %d, want %d", tt.path, tt.body, code, tt.code)
+		}
+	}
+
+	if list := s.Storage.List(); len(list) != 1 || list[0] != "HeapAlloc" {
+		t.Errorf("Error: metrics are incorrect: %v", list)
+	}
+
+	// the sweeper deletes through the server storage
+	expired, err := s.Sweeper.Sweep(ctx, time.Now().Add(2*time.Hour))
+	if err != nil || len(expired) != 1 || len(s.Storage.List()) != 0 {
+		t.Errorf("Error: expired metrics are incorrect: %v %v", expired, err)
+	}
+}
+
+func TestHTTPServerStale(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := NewTestServer(ctx, DefaultConfig())
+
+	ts := httptest.NewServer(s.chiRouter)
+	defer ts.Close()
+
+	httpRequest(ts, "POST", "/updates/", []byte(`[{"id":"Alloc","type":"gauge","value":1},{"id":"PollCount","type":"counter","delta":2}]`))
+	httpRequest(ts, "POST", "/update/", []byte(`{"id":"PollCount","type":"counter","delta":3}`))
+
+	statusCode, body := httpRequest(ts, "POST", "/value/?meta=1", []byte(`{"id":"PollCount","type":"counter"}`))
+	var value struct {
+		Delta   int64      `json:"delta"`
+		Updated *time.Time `json:"updated"`
+		Updates int64      `json:"updates"`
+	}
+	if err := json.Unmarshal([]byte(body), &value); err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Error: value is incorrect: %d %s", statusCode, body)
+	}
+	if value.Delta != 5 || value.Updated == nil || value.Updates != 2 {
+		t.Errorf("Error: value meta is incorrect: %s", body)
+	}
+
+	if _, body := httpRequest(ts, "POST", "/value/", []byte(`{"id":"PollCount","type":"counter"}`)); strings.Contains(body, "updates") {
+		t.Errorf("Error: meta must be requested: %s", body)
+	}
+
+	backend := storage.Unwrap(s.Storage).(*memstorage.MemStorage)
+	backend.Mutex.Lock()
+	backend.Meta["Alloc"] = metrics.Meta{Updated: time.Now().Add(-time.Hour), Updates: 1}
+	backend.Mutex.Unlock()
+
+	statusCode, body = httpRequest(ts, "GET", "/stale", nil)
+	if statusCode != http.StatusOK || !strings.Contains(body, `"id":"Alloc","type":"gauge"`) || strings.Contains(body, "PollCount") {
+		t.Errorf("Error: stale metrics are incorrect: %d %s", statusCode, body)
+	}
+
+	_, body = httpRequest(ts, "GET", "/stale?threshold=0s", nil)
+	var stale []staleMetric
+	if err := json.Unmarshal([]byte(body), &stale); err != nil || len(stale) != 2 || stale[0].ID != "Alloc" || stale[1].Updates != 2 {
+		t.Errorf("Error: stale metrics are incorrect: %s", body)
+	}
+
+	if statusCode, _ := httpRequest(ts, "GET", "/stale?threshold=soon", nil); statusCode != http.StatusBadRequest {
+		t.Errorf("Error: invalid threshold must be rejected: %d", statusCode)
+	}
+
+	_, body = httpRequest(ts, "GET", "/list", nil)
+	if !strings.Contains(body, "Alloc (type: gauge): 1.000000 <i>(stale: updated 1h0m0s ago)</i><br>") ||
+		!strings.Contains(body, "PollCount (type: counter): 5<br>") {
+		t.Errorf("Error: list staleness is incorrect: %s", body)
+	}
+}
+
+func TestHTTPServerAgents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := DefaultConfig()
+	cfg.AgentMetricsInterval = 10 * time.Millisecond
+
+	s := NewTestServer(ctx, cfg)
+
+	ts := httptest.NewServer(s.chiRouter)
+	defer ts.Close()
+
+	for _, body := range []string{`{"id":"Alloc","type":"gauge","value":1}`, `{"id":"Alloc","type":"gauge"}`} {
+		req, _ := http.NewRequest("POST", ts.URL+"/update/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(registry.HeaderID, "agent-1")
+		req.Header.Set(registry.HeaderVersion, "v1.0.0")
+		req.Header.Set(registry.HeaderInterval, "10")
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		resp.Body.Close()
+	}
+
+	statusCode, body := httpRequest(ts, "GET", "/agents", nil)
+	if statusCode != http.StatusOK || !strings.Contains(body, `"online":1`) ||
+		!strings.Contains(body, `"id":"agent-1"`) || !strings.Contains(body, `"requests":2,"errors":1`) {
+		t.Errorf("Error: agents are incorrect: %d %s", statusCode, body)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if v, err := s.Storage.Get("agent_requests{agent=agent-1}"); err == nil && v == int64(2) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Error: agent metrics are not recorded: %v", s.Storage.List())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHTTPServerAgentConfig(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := DefaultConfig()
+	cfg.AgentConfig = filepath.Join(t.TempDir(), "agents.json")
+
+	s := NewTestServer(ctx, cfg)
+
+	ts := httptest.NewServer(s.chiRouter)
+	defer ts.Close()
+
+	statusCode, _ := httpRequest(ts, "PUT", "/agent/configs", []byte(`{"default":{"report_interval":"5s"},"agents":{"vm-1":{"rate_limit":8}}}`))
+	if statusCode != http.StatusOK {
+		t.Fatalf("Error: config update status %d", statusCode)
+	}
+
+	if statusCode, _ := httpRequest(ts, "PUT", "/agent/configs", []byte(`{"default":{"report_interval":"soon"}}`)); statusCode != http.StatusBadRequest {
+		t.Errorf("Error: invalid config must be rejected: %d", statusCode)
+	}
+
+	req, _ := http.NewRequest("GET", ts.URL+"/agent/config", nil)
+	req.Header.Set(registry.HeaderID, "vm-1")
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != `{"report_interval":"5s","rate_limit":8}` {
+		t.Errorf("Error: agent config is incorrect: %d %s", resp.StatusCode, body)
+	}
+
+	req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+	resp, err = ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Error: unchanged config status %d", resp.StatusCode)
+	}
+
+	if _, err := os.Stat(cfg.AgentConfig); err != nil {
+		t.Errorf("Error: agent config is not saved: %s", err)
+	}
+}
+
+func TestHTTPServerReload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := DefaultConfig()
+	cfg.TrustedSubnet = "10.0.0.0/8"
+
+	s := NewTestServer(ctx, cfg)
+
+	ts := httptest.NewServer(s.chiRouter)
+	defer ts.Close()
+
+	update := []byte(`{"id":"Alloc","type":"gauge","value":1}`)
+	if statusCode, _ := httpRequestRealIP(ts, "POST", "/update/", update, "192.168.0.1"); statusCode != http.StatusForbidden {
+		t.Errorf("Error: untrusted client status %d", statusCode)
+	}
+
+	// invalid config keeps the current settings
+	bad := DefaultConfig()
+	bad.TrustedSubnet = "192.168.0.0/33"
+	if err := s.Reload(bad); err == nil {
+		t.Errorf("Error: invalid subnet must be rejected")
+	}
+
+	bad = DefaultConfig()
+	bad.LogLevel = "verbose"
+	if err := s.Reload(bad); err == nil {
+		t.Errorf("Error: invalid log level must be rejected")
+	}
+
+	if statusCode, _ := httpRequestRealIP(ts, "POST", "/update/", update, "10.0.0.1"); statusCode != http.StatusOK {
+		t.Errorf("Error: trusted client status %d", statusCode)
+	}
+
+	next := DefaultConfig()
+	next.TrustedSubnet = "192.168.0.0/16"
+	next.KeySign = "secret"
+	if err := s.Reload(next); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if statusCode, _ := httpRequestRealIP(ts, "POST", "/update/", update, "10.0.0.1"); statusCode != http.StatusForbidden {
+		t.Errorf("Error: client of the old subnet status %d", statusCode)
+	}
+
+	// the new key is required
+	if statusCode, _ := httpRequestRealIP(ts, "POST", "/update/", update, "192.168.0.1"); statusCode != http.StatusBadRequest {
+		t.Errorf("Error: unsigned update status %d", statusCode)
+	}
+
+	sub := s.Stream.Subscribe(stream.Filter{}, 0, false)
+	defer sub.Close()
+
+	m := metrics.Metrics{ID: "Alloc", MType: "gauge", Value: new(float64)}
+	m.Sign("secret")
+	signed, _ := json.Marshal(m)
+	if statusCode, _ := httpRequestRealIP(ts, "POST", "/update/", signed, "192.168.0.1"); statusCode != http.StatusOK {
+		t.Errorf("Error: signed update status %d", statusCode)
+	}
+
+	// the new key is passed to the stream
+	select {
+	case e := <-sub.C():
+		if !e.Metric.ValidMAC("secret") {
+			t.Errorf("Error: stream event is not signed with the new key: %+v", e.Metric)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Error: stream event is not published")
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "server.json")
+	os.WriteFile(path, []byte(`{}`), 0644)
+
+	reloaded := make(chan struct{}, 1)
+	go WatchConfig(ctx, path, 10*time.Millisecond, func() { reloaded <- struct{}{} })
+
+	// the first check only records the modification time
+	time.Sleep(30 * time.Millisecond)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+
+	select {
+	case <-reloaded:
+	case <-time.After(time.Second):
+		t.Errorf("Error: config change is not detected")
+	}
+}
+
+func TestConfigLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	os.WriteFile(path, []byte(`address: 0.0.0.0:9090
+store_interval: 1m
+restore: true
+database_dsn: postgres://localhost/metrics
+crypto_key: /etc/server.pem
+storage_timeout: 3s
+federation_mode: prefix
+audit_max_size: 1024
+metric_ttl_rules: "Alloc=10m"
+`), 0644)
+
+	cfg := DefaultConfig()
+	if err := config.Load(cfg, []string{"--config", path, "--store_interval", "300"}); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if cfg.ListenAddr != "0.0.0.0:9090" || cfg.StoreInterval != 300 || !cfg.Restore || cfg.DatabaseDSN != "postgres://localhost/metrics" ||
+		cfg.RSAPrivateKey != "/etc/server.pem" || cfg.StorageTimeout != 3*time.Second || cfg.FederationMode != "prefix" ||
+		cfg.AuditMaxSize != 1024 || cfg.MetricTTLRules != "Alloc=10m" || cfg.LogLevel != "info" {
+		t.Errorf("Error: config is incorrect: %+v", cfg)
+	}
+
+	os.WriteFile(path, []byte(`{"address": "localhost", "trusted_subnet": "10.0.0.1", "replication_role": "primary", "log_level": "verbose", "federation_mode": "suffix"}`), 0644)
+
+	err := config.Load(DefaultConfig(), []string{"--config", path})
+	if err == nil {
+		t.Fatalf("Error: invalid config must be rejected")
+	}
+	if !strings.Contains(err.Error(), "federation_mode") {
+		t.Errorf("Error: invalid choice is not reported: %s", err)
+	}
+
+	os.WriteFile(path, []byte(`{"address": "localhost", "trusted_subnet": "10.0.0.1", "replication_role": "primary", "log_level": "verbose"}`), 0644)
+
+	err = config.Load(DefaultConfig(), []string{"--config", path})
+	for _, s := range []string{"address", "trusted_subnet", "replication_followers", "log_level"} {
+		if err == nil || !strings.Contains(err.Error(), s+":") {
+			t.Errorf("Error: %s is not reported: %v", s, err)
+		}
+	}
+}
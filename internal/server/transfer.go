@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"gometric/internal/logger"
+	"gometric/internal/memstorage"
+	"gometric/internal/storage"
+	"gometric/internal/transfer"
+)
+
+// Transfer импортирует и экспортирует метрики из файлов, заданных в cfg, и завершается.
+// Создается только хранилище, фоновые задачи сервера не запускаются. Дамп MemStorage
+// загружается один раз и сохраняется только после импорта.
+func Transfer(ctx context.Context, cfg *Config) error {
+	// the dump is written once after the import, not on every update
+	c := *cfg
+	c.StoreInterval = -1
+
+	st, err := newStorage(&c)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	s := HTTPServer{Storage: st}
+
+	if _, ok := st.(*memstorage.MemStorage); ok {
+		if err := s.Restore(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.ImportFile != "" {
+		n, err := s.Import(ctx, cfg.ImportFile, cfg.TransferFormat, cfg.ImportStrategy)
+		if err != nil {
+			return fmt.Errorf("import metrics: %w", err)
+		}
+		logger.Infof("%d metrics imported", n)
+	}
+
+	if cfg.ExportFile != "" {
+		if err := s.Export(ctx, cfg.ExportFile, cfg.TransferFormat); err != nil {
+			return fmt.Errorf("export metrics: %w", err)
+		}
+
+		// stdout is used for the exported data
+		if cfg.ExportFile != "-" {
+			logger.Info("metrics exported")
+		}
+	}
+
+	return nil
+}
+
+// Export выгружает все метрики хранилища в файл file ("-" для stdout).
+func (s HTTPServer) Export(ctx context.Context, file, format string) error {
+	var w io.Writer = os.Stdout
+
+	if file != "-" {
+		f, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return transfer.Export(ctx, w, s.Storage, format)
+}
+
+// Import загружает метрики из файла file ("-" для stdin) и возвращает число записанных метрик.
+// Для бэкенда MemStorage после загрузки сохраняется дамп.
+func (s HTTPServer) Import(ctx context.Context, file, format, strategy string) (int, error) {
+	var r io.Reader = os.Stdin
+
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	n, err := transfer.Import(ctx, r, s.Storage, format, strategy)
+	if err != nil {
+		return n, err
+	}
+
+	if m, ok := storage.Unwrap(s.Storage).(*memstorage.MemStorage); ok {
+		if err := m.SaveDump(); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
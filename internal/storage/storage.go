@@ -1,7 +1,13 @@
 package storage
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
 	"gometric/internal/memstorage"
+	"gometric/internal/metrics"
 	"gometric/internal/postgres"
 
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -13,6 +19,89 @@ type Storage interface {
 	MSet(data map[string]interface{}) error
 	Get(k string) (interface{}, error)
 	List() []string
+	// Delete удаляет метрику, для отсутствующей возвращает ошибку metrics.ErrNotFound.
+	Delete(k string) error
+	// Rename переименовывает метрику, если метрики с именем newKey нет,
+	// иначе возвращает ошибку metrics.ErrExists.
+	Rename(k, newKey string) error
+
+	// Варианты операций с контекстом: отмена запроса клиента или истечение
+	// дедлайна прерывают обращение к бэкенду.
+	SetCtx(ctx context.Context, k string, v interface{}) error
+	MSetCtx(ctx context.Context, data map[string]interface{}) error
+	GetCtx(ctx context.Context, k string) (interface{}, error)
+	ListCtx(ctx context.Context) ([]string, error)
+	DeleteCtx(ctx context.Context, k string) error
+	RenameCtx(ctx context.Context, k, newKey string) error
+}
+
+// MetaReader реализуется бэкендами, которые хранят время и число обновлений метрик.
+type MetaReader interface {
+	// MetaCtx возвращает сведения об обновлениях метрик keys или всех метрик, если keys пуст.
+	MetaCtx(ctx context.Context, keys ...string) (map[string]metrics.Meta, error)
+}
+
+// StaleDeleter реализуется хранилищами, которые удаляют метрику, только если она
+// не обновлялась. Проверка времени обновления и удаление выполняются атомарно.
+type StaleDeleter interface {
+	// DeleteStaleCtx удаляет метрику k, если она не обновлялась после before,
+	// иначе возвращает ошибку metrics.ErrUpdated.
+	DeleteStaleCtx(ctx context.Context, k string, before time.Time) error
+}
+
+// ErrUnsupported возвращается декоратором, если хранилище под ним не поддерживает операцию.
+var ErrUnsupported = errors.New("operation is not supported by the storage")
+
+// DeleteStale удаляет метрику k хранилища st, если она не обновлялась после before.
+func DeleteStale(ctx context.Context, st Storage, k string, before time.Time) error {
+	d, ok := st.(StaleDeleter)
+	if !ok {
+		return ErrUnsupported
+	}
+
+	return d.DeleteStaleCtx(ctx, k, before)
+}
+
+// Wrapper реализуется декораторами, построенными над другим хранилищем.
+type Wrapper interface {
+	Unwrap() Storage
+}
+
+// Unwrap возвращает хранилище, над которым построены все декораторы st.
+func Unwrap(st Storage) Storage {
+	for {
+		w, ok := st.(Wrapper)
+		if !ok {
+			return st
+		}
+		st = w.Unwrap()
+	}
+}
+
+// Meta возвращает внешний декоратор st, который читает сведения об обновлениях,
+// например кэш, учитывающий ожидающие записи. Если бэкенд не ведет сведения, ok равен false.
+func Meta(st Storage) (reader MetaReader, ok bool) {
+	if _, ok := Unwrap(st).(MetaReader); !ok {
+		return nil, false
+	}
+
+	for {
+		if r, ok := st.(MetaReader); ok {
+			return r, true
+		}
+		st = st.(Wrapper).Unwrap()
+	}
+}
+
+// ValidData проверяет, что ключи и значения для MSet не пустые.
+func ValidData(data map[string]interface{}) error {
+	for k, v := range data {
+		if k == "" || v == nil {
+			return fmt.Errorf("key or value no must be empty")
+		}
+	}
+
+	return nil
 }
 
 func NewMemStorage(storeFile string, syncMode bool) (*memstorage.MemStorage, error) {
@@ -0,0 +1,240 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gometric/internal/logger"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+)
+
+// Типы событий потока.
+const (
+	EventUpdate = "update"
+	// EventDelete отправляется при удалении метрики.
+	EventDelete = "delete"
+	// EventReset означает, что часть изменений потеряна и значения нужно запросить заново.
+	EventReset = "reset"
+	// EventLagged отправляется перед отключением подписчика, который не успевал читать события.
+	EventLagged = "lagged"
+)
+
+// Таймауты соединения.
+const (
+	heartbeatInterval = 15 * time.Second
+	writeTimeout      = 10 * time.Second
+	// retryInterval задержка переподключения клиента SSE.
+	retryInterval = time.Second
+)
+
+// Message сообщение WebSocket.
+type Message struct {
+	Event  string `json:"event"`
+	ID     uint64 `json:"id"`
+	Update *Event `json:"update,omitempty"`
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// Handler возвращает обработчик потока:
+// GET / события SSE, GET /ws сообщения WebSocket, GET /stats состояние.
+// Параметры name и type задают фильтр, номер последнего полученного события
+// передается заголовком Last-Event-ID или параметром last_event_id.
+func (h *Hub) Handler() http.Handler {
+	r := chi.NewRouter()
+
+	r.Get("/", h.sseHandler)
+	r.Get("/ws", h.wsHandler)
+	r.Get("/stats", func(w http.ResponseWriter, r *http.Request) {
+		ret, _ := json.Marshal(h.Stats())
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(ret)
+	})
+
+	return r
+}
+
+// subscribe разбирает фильтр и номер последнего события запроса.
+func (h *Hub) subscribe(r *http.Request) (*Subscription, error) {
+	filter, err := ParseFilter(r.URL.Query()["name"], r.URL.Query()["type"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid name pattern: %w", err)
+	}
+
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = r.URL.Query().Get("last_event_id")
+	}
+
+	var lastID uint64
+	if last != "" {
+		if lastID, err = strconv.ParseUint(last, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid last event id %q", last)
+		}
+	}
+
+	return h.Subscribe(filter, lastID, last != ""), nil
+}
+
+func (h *Hub) sseHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	sub, err := h.subscribe(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", retryInterval.Milliseconds())
+	if sub.Reset {
+		fmt.Fprintf(w, "id: %d\nevent: %s\ndata: {}\n\n", sub.Head, EventReset)
+	}
+	for _, e := range sub.Replay {
+		writeSSE(w, e)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+
+		case e, ok := <-sub.C():
+			if !ok {
+				if sub.Lagged() {
+					fmt.Fprintf(w, "event: %s\ndata: {}\n\n", EventLagged)
+					flusher.Flush()
+				}
+				return
+			}
+			writeSSE(w, e)
+
+			// send the queued events in one flush
+			for n := len(sub.C()); n > 0; n-- {
+				if e, ok = <-sub.C(); ok {
+					writeSSE(w, e)
+				}
+			}
+		}
+
+		flusher.Flush()
+	}
+}
+
+func writeSSE(w http.ResponseWriter, e Event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		logger.Error("", err)
+		return
+	}
+
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, eventName(e), data)
+}
+
+func eventName(e Event) string {
+	if e.Deleted {
+		return EventDelete
+	}
+
+	return EventUpdate
+}
+
+func (h *Hub) wsHandler(w http.ResponseWriter, r *http.Request) {
+	sub, err := h.subscribe(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer sub.Close()
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// upgrader has already replied
+		logger.Debug("websocket upgrade failed: " + err.Error())
+		return
+	}
+	defer conn.Close()
+
+	// the reader handles control frames and detects closed connections
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(m Message) error {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		return conn.WriteJSON(m)
+	}
+
+	if sub.Reset {
+		if err := write(Message{Event: EventReset, ID: sub.Head}); err != nil {
+			return
+		}
+	}
+	for i := range sub.Replay {
+		if err := write(Message{Event: eventName(sub.Replay[i]), ID: sub.Replay[i].ID, Update: &sub.Replay[i]}); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-closed:
+			return
+
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				return
+			}
+
+		case e, ok := <-sub.C():
+			if !ok {
+				if sub.Lagged() {
+					write(Message{Event: EventLagged})
+					conn.WriteControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "slow consumer"), time.Now().Add(writeTimeout))
+				}
+				return
+			}
+
+			if err := write(Message{Event: eventName(e), ID: e.ID, Update: &e}); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package stream
+
+import (
+	"context"
+
+	"gometric/internal/logger"
+	"gometric/internal/metrics"
+	"gometric/internal/observer"
+)
+
+// Run рассылает изменения из подписки sub до отмены контекста ctx.
+// Если sub отбросила изменения, подписчики Hub сбрасываются через Reset.
+func (h *Hub) Run(ctx context.Context, sub *observer.Subscription) {
+	defer sub.Close()
+
+	var dropped uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case c, ok := <-sub.C():
+			if !ok {
+				return
+			}
+
+			batch := h.changeEvents(nil, c)
+
+			// publish the queued changes at once
+			for n := len(sub.C()); n > 0; n-- {
+				if c, ok = <-sub.C(); ok {
+					batch = h.changeEvents(batch, c)
+				}
+			}
+
+			if d := sub.Dropped(); d != dropped {
+				dropped = d
+				logger.Debug("stream changes are dropped: resetting subscribers")
+				h.Reset()
+			}
+
+			h.publish(batch)
+		}
+	}
+}
+
+// changeEvents добавляет к batch события изменения c: переименование рассылается
+// как удаление старой метрики и обновление новой.
+func (h *Hub) changeEvents(batch []Event, c observer.Change) []Event {
+	switch c.Op {
+	case observer.OpDelete:
+		return append(batch, Event{Metric: metrics.Metrics{ID: c.Name, MType: c.Type}, Deleted: true})
+
+	case observer.OpRename:
+		batch = append(batch, Event{Metric: metrics.Metrics{ID: c.Name, MType: c.Type}, Deleted: true})
+		c.Name = c.NewName
+	}
+
+	if m, ok := h.metric(c.Name, c.New); ok {
+		batch = append(batch, Event{Metric: m})
+	}
+
+	return batch
+}
+
+// metric возвращает метрику id со значением v, подписанную ключом Hub.
+func (h *Hub) metric(id string, v interface{}) (metrics.Metrics, bool) {
+	m := metrics.Metrics{ID: id, MType: observer.TypeOf(v)}
+
+	switch v := v.(type) {
+	case float64:
+		m.Value = &v
+	case int64:
+		m.Delta = &v
+	default:
+		return m, false
+	}
+
+	if key := h.key.Get(); key != "" {
+		m.Sign(key)
+	}
+
+	return m, true
+}
@@ -0,0 +1,314 @@
+// Пакет stream предназначен для рассылки изменений метрик подписчикам.
+//
+// Hub присваивает каждому изменению последовательный номер и хранит последние
+// изменения, по которым подписчик восстанавливает пропущенное
+// после переподключения с номером последнего полученного события.
+// У каждого подписчика ограниченная очередь: подписчик, который не успевает
+// читать события, отключается и может переподключиться с последнего номера.
+// Если пропущенных событий уже нет в буфере, подписчик получает событие reset
+// и должен заново запросить все значения.
+package stream
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"gometric/internal/logger"
+	"gometric/internal/metrics"
+)
+
+// Значения по умолчанию.
+const (
+	DefaultBufferSize       = 1024
+	DefaultSubscriberBuffer = 256
+)
+
+// Event изменение метрики.
+type Event struct {
+	ID     uint64          `json:"id"`
+	Time   time.Time       `json:"time"`
+	Metric metrics.Metrics `json:"metric"`
+	// Deleted true, если метрика удалена. Metric содержит только идентификатор и тип.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// Filter отбирает события по метрике.
+type Filter struct {
+	// Names шаблоны glob идентификатора или имени метрики, пустой список пропускает все.
+	Names []string
+	// Types типы метрик, пустой список пропускает все.
+	Types []string
+}
+
+// Validate проверяет шаблоны фильтра.
+func (f Filter) Validate() error {
+	for _, p := range f.Names {
+		if _, err := path.Match(p, ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Match проверяет метрику m.
+func (f Filter) Match(m metrics.Metrics) bool {
+	if len(f.Types) > 0 && !contains(f.Types, m.MType) {
+		return false
+	}
+
+	if len(f.Names) == 0 {
+		return true
+	}
+
+	name, _ := metrics.ParseID(m.ID)
+	for _, p := range f.Names {
+		if ok, _ := path.Match(p, m.ID); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseFilter разбирает значения параметров запроса вида name=CPU*,Alloc и type=gauge.
+func ParseFilter(names, types []string) (Filter, error) {
+	var f Filter
+
+	for _, v := range names {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				f.Names = append(f.Names, p)
+			}
+		}
+	}
+
+	for _, v := range types {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				f.Types = append(f.Types, t)
+			}
+		}
+	}
+
+	return f, f.Validate()
+}
+
+// Subscription подписка на изменения.
+type Subscription struct {
+	hub    *Hub
+	filter Filter
+	events chan Event
+
+	// Replay пропущенные события, которые нужно отправить до событий из C.
+	Replay []Event
+	// Reset true, если пропущенных событий уже нет в буфере.
+	Reset bool
+	// Head номер последнего события на момент подписки.
+	Head uint64
+
+	lagged bool
+}
+
+// C возвращает канал событий. Канал закрывается при отключении подписчика.
+func (s *Subscription) C() <-chan Event {
+	return s.events
+}
+
+// Lagged возвращает true, если подписчик отключен, так как не успевал читать события.
+func (s *Subscription) Lagged() bool {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+
+	return s.lagged
+}
+
+// Close отменяет подписку.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+
+	if _, ok := s.hub.subs[s]; ok {
+		delete(s.hub.subs, s)
+		close(s.events)
+	}
+}
+
+// Stats описывает состояние Hub.
+type Stats struct {
+	Subscribers int    `json:"subscribers"`
+	LastID      uint64 `json:"last_id"`
+	// Dropped число подписчиков, отключенных из-за переполнения очереди.
+	Dropped uint64 `json:"dropped"`
+}
+
+// Hub рассылает изменения метрик подписчикам.
+type Hub struct {
+	// key ключ подписи метрик в событиях, если не пустой.
+	key metrics.Key
+
+	subscriberBuffer int
+
+	mu      sync.Mutex
+	seq     uint64
+	buffer  []Event
+	next    int
+	subs    map[*Subscription]struct{}
+	dropped uint64
+}
+
+// NewHub создает Hub, который хранит bufferSize последних событий
+// и до subscriberBuffer событий в очереди каждого подписчика.
+func NewHub(bufferSize, subscriberBuffer int) *Hub {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+
+	if subscriberBuffer <= 0 {
+		subscriberBuffer = DefaultSubscriberBuffer
+	}
+
+	return &Hub{
+		subscriberBuffer: subscriberBuffer,
+		buffer:           make([]Event, 0, bufferSize),
+		subs:             make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish рассылает изменения метрик. Не блокируется на медленных подписчиках.
+func (h *Hub) Publish(ms []metrics.Metrics) {
+	events := make([]Event, 0, len(ms))
+	for _, m := range ms {
+		events = append(events, Event{Metric: m})
+	}
+
+	h.publish(events)
+}
+
+// publish присваивает событиям номера и время и рассылает их.
+func (h *Hub) publish(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for _, e := range events {
+		h.seq++
+		e.ID, e.Time = h.seq, now
+		m := e.Metric
+
+		if len(h.buffer) < cap(h.buffer) {
+			h.buffer = append(h.buffer, e)
+		} else {
+			h.buffer[h.next] = e
+			h.next = (h.next + 1) % len(h.buffer)
+		}
+
+		for s := range h.subs {
+			if !s.filter.Match(m) {
+				continue
+			}
+
+			select {
+			case s.events <- e:
+			default:
+				// slow subscriber resumes from the last received event
+				s.lagged = true
+				delete(h.subs, s)
+				close(s.events)
+				h.dropped++
+				logger.Debug("stream subscriber is dropped: queue is full")
+			}
+		}
+	}
+}
+
+// Reset сбрасывает буфер событий и отключает подписчиков. Вызывается, когда
+// часть изменений потеряна: переподключившиеся подписчики получат событие reset.
+func (h *Hub) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// the skipped id makes resumed subscribers reset
+	h.seq++
+	h.buffer = h.buffer[:0]
+	h.next = 0
+
+	for s := range h.subs {
+		s.lagged = true
+		delete(h.subs, s)
+		close(s.events)
+	}
+}
+
+// Subscribe создает подписку с фильтром filter. Если resume, в Replay
+// возвращаются события после lastID, которые еще есть в буфере.
+func (h *Hub) Subscribe(filter Filter, lastID uint64, resume bool) *Subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := &Subscription{
+		hub:    h,
+		filter: filter,
+		events: make(chan Event, h.subscriberBuffer),
+		Head:   h.seq,
+	}
+
+	if resume && lastID != h.seq {
+		events := h.events()
+
+		// ids restart from 1 after server restart
+		if lastID > h.seq || len(events) == 0 || events[0].ID > lastID+1 {
+			s.Reset = true
+		} else {
+			for _, e := range events {
+				if e.ID > lastID && filter.Match(e.Metric) {
+					s.Replay = append(s.Replay, e)
+				}
+			}
+		}
+	}
+
+	h.subs[s] = struct{}{}
+
+	return s
+}
+
+// events возвращает буфер по порядку. Вызывается под h.mu.
+func (h *Hub) events() []Event {
+	result := make([]Event, 0, len(h.buffer))
+	result = append(result, h.buffer[h.next:]...)
+
+	return append(result, h.buffer[:h.next]...)
+}
+
+// SetKey заменяет ключ подписи метрик в событиях, пустой ключ отключает подпись.
+func (h *Hub) SetKey(key string) {
+	h.key.Set(key)
+}
+
+// Stats возвращает состояние Hub.
+func (h *Hub) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return Stats{Subscribers: len(h.subs), LastID: h.seq, Dropped: h.dropped}
+}
@@ -0,0 +1,303 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gometric/internal/memstorage"
+	"gometric/internal/metrics"
+	"gometric/internal/observer"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+)
+
+func gauge(id string, v float64) metrics.Metrics {
+	return metrics.Metrics{ID: id, MType: "gauge", Value: &v}
+}
+
+func counter(id string, d int64) metrics.Metrics {
+	return metrics.Metrics{ID: id, MType: "counter", Delta: &d}
+}
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		names, types []string
+		metric       metrics.Metrics
+		want         bool
+	}{
+		{metric: gauge("Alloc", 1), want: true},
+		{names: []string{"CPU*,Alloc"}, metric: gauge("Alloc", 1), want: true},
+		{names: []string{"CPU*"}, metric: gauge("CPUutilization1", 1), want: true},
+		{names: []string{"Requests"}, metric: counter("Requests{host=a}", 1), want: true},
+		{names: []string{"CPU*"}, metric: gauge("Alloc", 1), want: false},
+		{types: []string{"counter"}, metric: gauge("Alloc", 1), want: false},
+		{names: []string{"Poll*"}, types: []string{"counter"}, metric: counter("PollCount", 1), want: true},
+	}
+
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.names, tt.types)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+
+		if got := f.Match(tt.metric); got != tt.want {
+			t.Errorf("Error: filter %+v on %s = %v, want %v", f, tt.metric.ID, got, tt.want)
+		}
+	}
+
+	if _, err := ParseFilter([]string{"[a"}, nil); err == nil {
+		t.Errorf("Error: invalid pattern must be rejected")
+	}
+}
+
+func TestHubResume(t *testing.T) {
+	h := NewHub(4, 16)
+
+	sub := h.Subscribe(Filter{Types: []string{"gauge"}}, 0, false)
+	h.Publish([]metrics.Metrics{gauge("Alloc", 1), counter("PollCount", 1), gauge("Alloc", 2)})
+
+	var got []uint64
+	for len(sub.C()) > 0 {
+		got = append(got, (<-sub.C()).ID)
+	}
+	sub.Close()
+
+	if len(got) != 2 || got[0] != 1 || got[1] != 3 {
+		t.Fatalf("Error: events are incorrect: %v", got)
+	}
+
+	// events after 1 are still buffered
+	sub = h.Subscribe(Filter{}, 1, true)
+	if sub.Reset || len(sub.Replay) != 2 || sub.Replay[0].ID != 2 || sub.Head != 3 {
+		t.Errorf("Error: replay is incorrect: %+v", sub)
+	}
+	sub.Close()
+
+	h.Publish([]metrics.Metrics{gauge("Alloc", 3), gauge("Alloc", 4), gauge("Alloc", 5)})
+
+	// buffer keeps events 3..6 only
+	sub = h.Subscribe(Filter{}, 1, true)
+	if !sub.Reset || len(sub.Replay) != 0 {
+		t.Errorf("Error: lost events must reset subscriber: %+v", sub)
+	}
+	sub.Close()
+
+	sub = h.Subscribe(Filter{}, 2, true)
+	if sub.Reset || len(sub.Replay) != 4 {
+		t.Errorf("Error: replay from the oldest buffered event is incorrect: %+v", sub)
+	}
+	sub.Close()
+
+	// server restart
+	sub = h.Subscribe(Filter{}, 100, true)
+	if !sub.Reset {
+		t.Errorf("Error: unknown id must reset subscriber")
+	}
+	sub.Close()
+
+	if s := h.Stats(); s.Subscribers != 0 || s.LastID != 6 {
+		t.Errorf("Error: stats are incorrect: %+v", s)
+	}
+}
+
+func TestHubSlowSubscriber(t *testing.T) {
+	h := NewHub(0, 2)
+
+	slow := h.Subscribe(Filter{}, 0, false)
+	fast := h.Subscribe(Filter{}, 0, false)
+	defer fast.Close()
+
+	for i := 0; i < 3; i++ {
+		h.Publish([]metrics.Metrics{gauge("Alloc", float64(i))})
+		<-fast.C()
+	}
+
+	n := 0
+	for range slow.C() {
+		n++
+	}
+
+	if n != 2 || !slow.Lagged() || h.Stats().Dropped != 1 || h.Stats().Subscribers != 1 {
+		t.Errorf("Error: slow subscriber must be dropped: %d events, %+v", n, h.Stats())
+	}
+
+	// closing a dropped subscription is safe
+	slow.Close()
+}
+
+func newTestServer(t *testing.T, h *Hub) *httptest.Server {
+	r := chi.NewRouter()
+	r.Mount("/stream", h.Handler())
+
+	ts := httptest.NewServer(r)
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+// readSSE читает n событий и возвращает строки id и event.
+func readSSE(t *testing.T, url, lastID string, n int) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(resp.Body)
+	for len(lines) < n && scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "id: ") || strings.HasPrefix(line, "event: ") {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+func TestSSE(t *testing.T) {
+	h := NewHub(0, 0)
+	ts := newTestServer(t, h)
+
+	h.Publish([]metrics.Metrics{gauge("Alloc", 1), counter("PollCount", 1), gauge("Alloc", 2)})
+
+	// resume after event 1 with type filter
+	lines := readSSE(t, ts.URL+"/stream/?type=gauge", "1", 2)
+	if strings.Join(lines, ";") != "id: 3;event: update" {
+		t.Errorf("Error: replayed events are incorrect: %v", lines)
+	}
+
+	lines = readSSE(t, ts.URL+"/stream/", "100", 2)
+	if strings.Join(lines, ";") != "id: 3;event: reset" {
+		t.Errorf("Error: reset event is incorrect: %v", lines)
+	}
+
+	resp, err := http.Get(ts.URL + "/stream/?name=[a")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Error: invalid filter status %d", resp.StatusCode)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	h := NewHub(0, 0)
+	ts := newTestServer(t, h)
+
+	h.Publish([]metrics.Metrics{gauge("Alloc", 1)})
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/stream/ws?name=Alloc&last_event_id=0"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer conn.Close()
+
+	// wait until the live subscription is registered
+	for h.Stats().Subscribers == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	h.Publish([]metrics.Metrics{counter("PollCount", 1), gauge("Alloc", 2)})
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var values []float64
+	for i := 0; i < 2; i++ {
+		var m Message
+		if err := conn.ReadJSON(&m); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		if m.Event != EventUpdate || m.Update == nil {
+			t.Fatalf("Error: message is incorrect: %+v", m)
+		}
+		values = append(values, *m.Update.Metric.Value)
+	}
+
+	if values[0] != 1 || values[1] != 2 {
+		t.Errorf("Error: values are incorrect: %v", values)
+	}
+
+	ret, _ := json.Marshal(Message{Event: EventReset, ID: 3})
+	if string(ret) != `{"event":"reset","id":3}` {
+		t.Errorf("Error: reset message is incorrect: %s", ret)
+	}
+}
+
+func TestHubRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o := observer.New(memstorage.NewMemStorage())
+	changes := o.Subscribe("stream", 1)
+
+	h := NewHub(0, 0)
+	h.SetKey("secret")
+
+	sub := h.Subscribe(Filter{}, 0, false)
+
+	// the second change does not fit the queue
+	o.Set("Alloc", float64(1))
+	o.Set("PollCount", int64(2))
+
+	go h.Run(ctx, changes)
+
+	// lost changes reset subscribers
+	if _, ok := <-sub.C(); ok || !sub.Lagged() {
+		t.Fatalf("Error: subscriber must be reset after lost changes")
+	}
+
+	for h.Stats().LastID < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	resumed := h.Subscribe(Filter{}, 0, true)
+	resumed.Close()
+	if !resumed.Reset {
+		t.Errorf("Error: resumed subscriber must be reset: %+v", resumed)
+	}
+
+	// the reset skips id 1
+	resumed = h.Subscribe(Filter{}, 1, true)
+	resumed.Close()
+	if resumed.Reset || len(resumed.Replay) != 1 {
+		t.Fatalf("Error: replay is incorrect: %+v", resumed)
+	}
+
+	m := resumed.Replay[0].Metric
+	if m.ID != "Alloc" || *m.Value != 1 || !m.ValidMAC("secret") {
+		t.Errorf("Error: event is incorrect: %+v", m)
+	}
+}
+
+func TestChangeEvents(t *testing.T) {
+	h := NewHub(0, 0)
+
+	events := h.changeEvents(nil, observer.Change{Op: observer.OpDelete, Name: "PollCount", Type: "counter", Old: int64(1)})
+	events = h.changeEvents(events, observer.Change{Op: observer.OpRename, Name: "Alloc", NewName: "HeapAlloc", Type: "gauge", Old: 1.5, New: 1.5})
+
+	if len(events) != 3 || !events[0].Deleted || events[0].Metric.MType != "counter" ||
+		!events[1].Deleted || events[1].Metric.ID != "Alloc" ||
+		events[2].Deleted || events[2].Metric.ID != "HeapAlloc" || *events[2].Metric.Value != 1.5 {
+		t.Errorf("Error: events are incorrect: %+v", events)
+	}
+
+	if eventName(events[0]) != EventDelete || eventName(events[2]) != EventUpdate {
+		t.Errorf("Error: event names are incorrect")
+	}
+}
@@ -0,0 +1,452 @@
+// Пакет transfer предназначен для выгрузки и загрузки всех метрик хранилища
+// в форматах JSON lines, CSV и Prometheus text.
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gometric/internal/metrics"
+	"gometric/internal/storage"
+)
+
+// Поддерживаемые форматы.
+const (
+	FormatJSONLines  = "jsonl"
+	FormatCSV        = "csv"
+	FormatPrometheus = "prometheus"
+)
+
+// Стратегии объединения загружаемых метрик с существующими.
+const (
+	// StrategyOverwrite заменяет существующие значения.
+	StrategyOverwrite = "overwrite"
+	// StrategyKeepExisting пропускает метрики, которые уже есть в хранилище.
+	StrategyKeepExisting = "keep-existing"
+	// StrategyAddCounters прибавляет значения счетчиков к существующим, gauge заменяются.
+	StrategyAddCounters = "add-counters"
+)
+
+// ContentType возвращает Content-Type для формата.
+func ContentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv"
+	case FormatPrometheus:
+		return "text/plain; version=0.0.4"
+	default:
+		return "application/x-ndjson"
+	}
+}
+
+// ValidFormat проверяет, что формат поддерживается.
+func ValidFormat(format string) error {
+	switch format {
+	case FormatJSONLines, FormatCSV, FormatPrometheus:
+		return nil
+	}
+
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// ValidStrategy проверяет, что стратегия поддерживается.
+func ValidStrategy(strategy string) error {
+	switch strategy {
+	case StrategyOverwrite, StrategyKeepExisting, StrategyAddCounters:
+		return nil
+	}
+
+	return fmt.Errorf("unknown import strategy %q", strategy)
+}
+
+// Collect возвращает все метрики хранилища, отсортированные по имени.
+// Значения, не являющиеся gauge или counter, пропускаются.
+func Collect(ctx context.Context, st storage.Storage) ([]metrics.Metrics, error) {
+	result := make([]metrics.Metrics, 0)
+
+	names, err := st.ListCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		v, err := st.GetCtx(ctx, name)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+
+		if m, ok := toMetric(name, v); ok {
+			result = append(result, m)
+		}
+	}
+
+	return result, nil
+}
+
+// Export выгружает все метрики хранилища в w в указанном формате.
+func Export(ctx context.Context, w io.Writer, st storage.Storage, format string) error {
+	if err := ValidFormat(format); err != nil {
+		return err
+	}
+
+	list, err := Collect(ctx, st)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case FormatCSV:
+		return writeCSV(w, list)
+	case FormatPrometheus:
+		return writePrometheus(w, list)
+	default:
+		return writeJSONLines(w, list)
+	}
+}
+
+// Import загружает метрики из r в хранилище и возвращает число записанных метрик.
+// Данные сначала полностью разбираются, поэтому при ошибке формата хранилище не изменяется.
+func Import(ctx context.Context, r io.Reader, st storage.Storage, format, strategy string) (int, error) {
+	if err := ValidFormat(format); err != nil {
+		return 0, err
+	}
+
+	if err := ValidStrategy(strategy); err != nil {
+		return 0, err
+	}
+
+	var list []metrics.Metrics
+	var err error
+
+	switch format {
+	case FormatCSV:
+		list, err = readCSV(r)
+	case FormatPrometheus:
+		list, err = readPrometheus(r)
+	default:
+		list, err = readJSONLines(r)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	data := make(map[string]interface{}, len(list))
+
+	for _, m := range list {
+		existing, getErr := st.GetCtx(ctx, m.ID)
+		if getErr != nil && ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		exists := getErr == nil
+
+		if strategy == StrategyKeepExisting && exists {
+			continue
+		}
+
+		switch m.MType {
+		case "gauge":
+			data[m.ID] = *m.Value
+		case "counter":
+			delta := *m.Delta
+			if prev, ok := data[m.ID].(int64); ok {
+				// duplicate counter in the input
+				delta += prev
+			} else if strategy == StrategyAddCounters && exists {
+				switch prev := existing.(type) {
+				case int64:
+					delta += prev
+				case int:
+					delta += int64(prev)
+				}
+			}
+			data[m.ID] = delta
+		}
+	}
+
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	if err := st.MSetCtx(ctx, data); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func toMetric(id string, v interface{}) (metrics.Metrics, bool) {
+	m := metrics.Metrics{ID: id}
+
+	switch value := v.(type) {
+	case float64:
+		m.MType = "gauge"
+		m.Value = &value
+	case int64:
+		m.MType = "counter"
+		m.Delta = &value
+	case int:
+		delta := int64(value)
+		m.MType = "counter"
+		m.Delta = &delta
+	default:
+		return m, false
+	}
+
+	return m, true
+}
+
+func validate(m metrics.Metrics) error {
+	if m.ID == "" {
+		return fmt.Errorf("metric id must not be empty")
+	}
+
+	switch m.MType {
+	case "gauge":
+		if m.Value == nil {
+			return fmt.Errorf("metric %s: value must not be empty", m.ID)
+		}
+	case "counter":
+		if m.Delta == nil {
+			return fmt.Errorf("metric %s: delta must not be empty", m.ID)
+		}
+	default:
+		return fmt.Errorf("metric %s: unknown type %q", m.ID, m.MType)
+	}
+
+	return nil
+}
+
+func writeJSONLines(w io.Writer, list []metrics.Metrics) error {
+	enc := json.NewEncoder(w)
+	for _, m := range list {
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readJSONLines(r io.Reader) ([]metrics.Metrics, error) {
+	var list []metrics.Metrics
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var m metrics.Metrics
+		if err := json.Unmarshal([]byte(text), &m); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if err := validate(m); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		list = append(list, m)
+	}
+
+	return list, scanner.Err()
+}
+
+func writeCSV(w io.Writer, list []metrics.Metrics) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"id", "type", "value"}); err != nil {
+		return err
+	}
+
+	for _, m := range list {
+		var value string
+		if m.MType == "gauge" {
+			value = strconv.FormatFloat(*m.Value, 'f', -1, 64)
+		} else {
+			value = strconv.FormatInt(*m.Delta, 10)
+		}
+
+		if err := cw.Write([]string{m.ID, m.MType, value}); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func readCSV(r io.Reader) ([]metrics.Metrics, error) {
+	var list []metrics.Metrics
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 3
+
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, record := range records {
+		if i == 0 && record[0] == "id" {
+			continue
+		}
+
+		m, err := parseValue(record[0], record[1], record[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		list = append(list, m)
+	}
+
+	return list, nil
+}
+
+var promNameInvalid = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// promName приводит имя метрики к допустимому в Prometheus виду.
+func promName(name string) string {
+	name = promNameInvalid.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+
+	return name
+}
+
+// promSeries формирует имя серии Prometheus из идентификатора с метками.
+func promSeries(id string) (string, string) {
+	name, labels := metrics.ParseID(id)
+	name = promName(name)
+
+	if len(labels) == 0 {
+		return name, name
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", promName(k), strconv.Quote(labels[k])))
+	}
+
+	return name, name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func writePrometheus(w io.Writer, list []metrics.Metrics) error {
+	bw := bufio.NewWriter(w)
+	typed := make(map[string]bool)
+
+	for _, m := range list {
+		name, series := promSeries(m.ID)
+
+		if !typed[name] {
+			typed[name] = true
+			fmt.Fprintf(bw, "# TYPE %s %s\n", name, m.MType)
+		}
+
+		if m.MType == "gauge" {
+			fmt.Fprintf(bw, "%s %s\n", series, strconv.FormatFloat(*m.Value, 'g', -1, 64))
+		} else {
+			fmt.Fprintf(bw, "%s %d\n", series, *m.Delta)
+		}
+	}
+
+	return bw.Flush()
+}
+
+var promLine = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(?:\{(.*)\})?\s+(\S+)(?:\s+\S+)?$`)
+var promLabel = regexp.MustCompile(`([a-zA-Z_][a-zA-Z0-9_]*)\s*=\s*"((?:[^"\\]|\\.)*)"`)
+
+func readPrometheus(r io.Reader) ([]metrics.Metrics, error) {
+	var list []metrics.Metrics
+	types := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		if strings.HasPrefix(text, "#") {
+			fields := strings.Fields(text)
+			if len(fields) == 4 && fields[1] == "TYPE" {
+				types[fields[2]] = fields[3]
+			}
+			continue
+		}
+
+		match := promLine.FindStringSubmatch(text)
+		if match == nil {
+			return nil, fmt.Errorf("line %d: invalid sample %q", line, text)
+		}
+
+		labels := make(map[string]string)
+		for _, l := range promLabel.FindAllStringSubmatch(match[2], -1) {
+			v, err := strconv.Unquote(`"` + l[2] + `"`)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid label value %q", line, l[2])
+			}
+			labels[l[1]] = v
+		}
+
+		mtype := types[match[1]]
+		if mtype != "counter" {
+			mtype = "gauge"
+		}
+
+		m, err := parseValue(metrics.FormatID(match[1], labels), mtype, match[3])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		list = append(list, m)
+	}
+
+	return list, scanner.Err()
+}
+
+func parseValue(id, mtype, value string) (metrics.Metrics, error) {
+	m := metrics.Metrics{ID: id, MType: mtype}
+
+	switch mtype {
+	case "gauge":
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return m, fmt.Errorf("metric %s: invalid gauge value %q", id, value)
+		}
+		m.Value = &v
+	case "counter":
+		d, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			// Prometheus counters may be written as integral floats
+			f, ferr := strconv.ParseFloat(value, 64)
+			if ferr != nil || f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+				return m, fmt.Errorf("metric %s: invalid counter value %q", id, value)
+			}
+			d = int64(f)
+		}
+		m.Delta = &d
+	}
+
+	return m, validate(m)
+}
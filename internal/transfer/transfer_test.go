@@ -0,0 +1,180 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"gometric/internal/memstorage"
+)
+
+func newStorage() *memstorage.MemStorage {
+	m := memstorage.NewMemStorage()
+	m.Set("Alloc", float64(1907608))
+	m.Set("PollCount", int64(5))
+	m.Set("requests{method=GET}", int64(2))
+	m.Set("Unknown", "string")
+
+	return m
+}
+
+func TestExport(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{
+			format: FormatJSONLines,
+			want: `{"id":"Alloc","type":"gauge","value":1907608}` + "\n" +
+				`{"id":"PollCount","type":"counter","delta":5}` + "\n" +
+				`{"id":"requests{method=GET}","type":"counter","delta":2}` + "\n",
+		},
+		{
+			format: FormatCSV,
+			want:   "id,type,value\nAlloc,gauge,1907608\nPollCount,counter,5\nrequests{method=GET},counter,2\n",
+		},
+		{
+			format: FormatPrometheus,
+			want: "# TYPE Alloc gauge\nAlloc 1.907608e+06\n" +
+				"# TYPE PollCount counter\nPollCount 5\n" +
+				"# TYPE requests counter\nrequests{method=\"GET\"} 2\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := Export(context.Background(), &b, newStorage(), tt.format); err != nil {
+				t.Fatalf("Error: %s", err)
+			}
+
+			if b.String() != tt.want {
+				t.Errorf("Error: got\n%s\nwant\n%s", b.String(), tt.want)
+			}
+		})
+	}
+
+	if err := Export(context.Background(), &bytes.Buffer{}, newStorage(), "xml"); err == nil {
+		t.Errorf("Error: unknown format must be rejected")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []string{FormatJSONLines, FormatCSV, FormatPrometheus} {
+		t.Run(format, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := Export(context.Background(), &b, newStorage(), format); err != nil {
+				t.Fatalf("Error: %s", err)
+			}
+
+			dst := memstorage.NewMemStorage()
+			n, err := Import(context.Background(), &b, dst, format, StrategyOverwrite)
+			if err != nil || n != 3 {
+				t.Fatalf("Error: imported %d metrics: %v", n, err)
+			}
+
+			if v, _ := dst.Get("Alloc"); v != float64(1907608) {
+				t.Errorf("Error: gauge is incorrect: %v", v)
+			}
+			if v, _ := dst.Get("PollCount"); v != int64(5) {
+				t.Errorf("Error: counter is incorrect: %v", v)
+			}
+			if v, _ := dst.Get("requests{method=GET}"); v != int64(2) {
+				t.Errorf("Error: labeled counter is incorrect: %v", v)
+			}
+		})
+	}
+}
+
+func TestImportStrategies(t *testing.T) {
+	data := `{"id":"Alloc","type":"gauge","value":1}
+{"id":"PollCount","type":"counter","delta":10}
+{"id":"New","type":"counter","delta":1}
+`
+
+	tests := []struct {
+		strategy string
+		alloc    float64
+		count    int64
+		imported int
+	}{
+		{strategy: StrategyOverwrite, alloc: 1, count: 10, imported: 3},
+		{strategy: StrategyKeepExisting, alloc: 1907608, count: 5, imported: 1},
+		{strategy: StrategyAddCounters, alloc: 1, count: 15, imported: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			st := newStorage()
+
+			n, err := Import(context.Background(), strings.NewReader(data), st, FormatJSONLines, tt.strategy)
+			if err != nil || n != tt.imported {
+				t.Fatalf("Error: imported %d metrics: %v", n, err)
+			}
+
+			if v, _ := st.Get("Alloc"); v != tt.alloc {
+				t.Errorf("Error: gauge is incorrect: %v", v)
+			}
+			if v, _ := st.Get("PollCount"); v != tt.count {
+				t.Errorf("Error: counter is incorrect: %v", v)
+			}
+			if v, _ := st.Get("New"); v != int64(1) {
+				t.Errorf("Error: new counter is incorrect: %v", v)
+			}
+		})
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   string
+	}{
+		{name: "broken json #1", format: FormatJSONLines, data: `{"id":"Alloc"`},
+		{name: "gauge without value #2", format: FormatJSONLines, data: `{"id":"Alloc","type":"gauge","delta":1}`},
+		{name: "invalid csv value #3", format: FormatCSV, data: "Alloc,gauge,abc\n"},
+		{name: "invalid csv fields #4", format: FormatCSV, data: "Alloc,gauge\n"},
+		{name: "invalid prometheus sample #5", format: FormatPrometheus, data: "Alloc{ 1\n"},
+		{name: "fractional csv counter #6", format: FormatCSV, data: "PollCount,counter,2.5\n"},
+		{name: "fractional prometheus counter #7", format: FormatPrometheus, data: "# TYPE PollCount counter\nPollCount 2.5\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := newStorage()
+
+			if _, err := Import(context.Background(), strings.NewReader(tt.data+"\n"+`{"id":"Other","type":"gauge","value":1}`), st, tt.format, StrategyOverwrite); err == nil {
+				t.Errorf("Error: data must be invalid")
+			}
+
+			if _, err := st.Get("Other"); err == nil {
+				t.Errorf("Error: storage must not be changed on error")
+			}
+		})
+	}
+
+	if _, err := Import(context.Background(), strings.NewReader(""), newStorage(), FormatJSONLines, "merge"); err == nil {
+		t.Errorf("Error: unknown strategy must be rejected")
+	}
+}
+
+func TestCanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := Export(ctx, &bytes.Buffer{}, newStorage(), FormatJSONLines); err == nil {
+		t.Errorf("Error: export must be canceled")
+	}
+
+	st := newStorage()
+	data := `{"id":"New","type":"counter","delta":1}`
+	if _, err := Import(ctx, strings.NewReader(data), st, FormatJSONLines, StrategyOverwrite); err == nil {
+		t.Errorf("Error: import must be canceled")
+	}
+
+	if _, err := st.Get("New"); err == nil {
+		t.Errorf("Error: storage must not be changed")
+	}
+}
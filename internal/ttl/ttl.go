@@ -0,0 +1,184 @@
+// Пакет ttl предназначен для удаления метрик, которые давно не обновлялись.
+//
+// Sweeper периодически читает время последнего обновления метрик (storage.Meta,
+// с учетом записей, ожидающих в кэше) и удаляет метрики, срок жизни которых истек, через хранилище
+// сервера, поэтому удаление проходит через кэш, наблюдателей и репликацию.
+// Срок жизни задается правилами по шаблону имени или общим значением по умолчанию.
+package ttl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"gometric/internal/logger"
+	"gometric/internal/metrics"
+	"gometric/internal/replication"
+	"gometric/internal/storage"
+)
+
+// DefaultInterval период проверки по умолчанию.
+const DefaultInterval = time.Minute
+
+// ErrUnsupported возвращается, если бэкенд не хранит время обновления метрик
+// или хранилище не удаляет метрики с проверкой времени обновления.
+var ErrUnsupported = errors.New("storage does not track update time")
+
+// Rule задает срок жизни метрик, подходящих под шаблон.
+type Rule struct {
+	// Pattern шаблон glob идентификатора или имени метрики.
+	Pattern string
+	// TTL срок жизни, 0 отключает удаление.
+	TTL time.Duration
+}
+
+// Match проверяет идентификатор метрики id.
+func (r Rule) Match(id string) bool {
+	if ok, _ := path.Match(r.Pattern, id); ok {
+		return true
+	}
+
+	name, _ := metrics.ParseID(id)
+	ok, _ := path.Match(r.Pattern, name)
+
+	return ok
+}
+
+// ParseRules разбирает правила вида "CPUutilization*=10m,Alloc=0".
+func ParseRules(s string) ([]Rule, error) {
+	var rules []Rule
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		i := strings.LastIndex(item, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid ttl rule %q: want pattern=duration", item)
+		}
+
+		pattern := strings.TrimSpace(item[:i])
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid ttl rule %q: %v", item, err)
+		}
+
+		d, err := time.ParseDuration(strings.TrimSpace(item[i+1:]))
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid ttl rule %q: invalid duration", item)
+		}
+
+		rules = append(rules, Rule{Pattern: pattern, TTL: d})
+	}
+
+	return rules, nil
+}
+
+// Sweeper удаляет метрики с истекшим сроком жизни.
+type Sweeper struct {
+	st   storage.StaleDeleter
+	meta storage.MetaReader
+
+	// Default срок жизни метрик, не подходящих ни под одно правило, 0 - без ограничения.
+	Default time.Duration
+	// Rules правила, проверяются по порядку.
+	Rules []Rule
+	// Interval период проверки.
+	Interval time.Duration
+}
+
+// NewSweeper создает Sweeper над хранилищем st.
+func NewSweeper(st storage.Storage, def time.Duration, rules []Rule) (*Sweeper, error) {
+	meta, ok := storage.Meta(st)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+
+	deleter, ok := st.(storage.StaleDeleter)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+
+	return &Sweeper{
+		st:       deleter,
+		meta:     meta,
+		Default:  def,
+		Rules:    rules,
+		Interval: DefaultInterval,
+	}, nil
+}
+
+// TTL возвращает срок жизни метрики id.
+func (s *Sweeper) TTL(id string) time.Duration {
+	for _, r := range s.Rules {
+		if r.Match(id) {
+			return r.TTL
+		}
+	}
+
+	return s.Default
+}
+
+// Sweep удаляет метрики, которые не обновлялись дольше срока жизни на момент now,
+// и возвращает их идентификаторы.
+func (s *Sweeper) Sweep(ctx context.Context, now time.Time) ([]string, error) {
+	updated, err := s.meta.MetaCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(updated))
+	for id := range updated {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var expired []string
+	for _, id := range ids {
+		ttl := s.TTL(id)
+		if ttl <= 0 || now.Sub(updated[id].Updated) <= ttl {
+			continue
+		}
+
+		// the metric may be updated after the meta is read
+		if err := s.st.DeleteStaleCtx(ctx, id, now.Add(-ttl)); err != nil {
+			if errors.Is(err, metrics.ErrUpdated) || errors.Is(err, metrics.ErrNotFound) {
+				continue
+			}
+			return expired, err
+		}
+		expired = append(expired, id)
+	}
+
+	return expired, nil
+}
+
+// Run удаляет метрики раз в Interval до отмены контекста ctx.
+func (s *Sweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			expired, err := s.Sweep(ctx, now)
+			switch {
+			case errors.Is(err, replication.ErrReadOnly):
+				// followers receive deletions from the primary
+				logger.Debug("ttl: sweep skipped on read-only replica")
+			case err != nil && ctx.Err() == nil:
+				logger.Error("ttl sweep failed", err)
+			}
+			if len(expired) > 0 {
+				logger.Info(fmt.Sprintf("ttl: %d expired metrics deleted", len(expired)))
+			}
+		}
+	}
+}
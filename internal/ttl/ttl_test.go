@@ -0,0 +1,156 @@
+package ttl
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"gometric/internal/cache"
+	"gometric/internal/memstorage"
+	"gometric/internal/metrics"
+	"gometric/internal/storage"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(" CPUutilization*=10m, Alloc=0 ,,")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	want := []Rule{{Pattern: "CPUutilization*", TTL: 10 * time.Minute}, {Pattern: "Alloc", TTL: 0}}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("Error: rules are incorrect: %+v", rules)
+	}
+
+	for _, s := range []string{"Alloc", "=1m", "Alloc=1x", "Alloc=-1m", "[a=1m"} {
+		if _, err := ParseRules(s); err == nil {
+			t.Errorf("Error: invalid rule %q must be rejected", s)
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	now := time.Now()
+
+	st := memstorage.NewMemStorage()
+	st.MSet(map[string]interface{}{
+		"Alloc":                      float64(1),
+		"CPUutilization1":            float64(2),
+		"Requests{host=a}":           int64(3),
+		"Requests{host=b}":           int64(4),
+		"CPUutilization2{host=vm-1}": float64(5),
+	})
+
+	st.Meta["Requests{host=b}"] = metrics.Meta{Updated: now.Add(-time.Minute), Updates: 1}
+
+	rules, _ := ParseRules("CPUutilization*=10m,Alloc=0")
+	s, err := NewSweeper(st, time.Hour, rules)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if s.TTL("CPUutilization2{host=vm-1}") != 10*time.Minute || s.TTL("Alloc") != 0 || s.TTL("PollCount") != time.Hour {
+		t.Errorf("Error: ttl is incorrect")
+	}
+
+	expired, err := s.Sweep(context.Background(), now.Add(30*time.Minute))
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if !reflect.DeepEqual(expired, []string{"CPUutilization1", "CPUutilization2{host=vm-1}"}) {
+		t.Errorf("Error: expired metrics are incorrect: %v", expired)
+	}
+
+	expired, _ = s.Sweep(context.Background(), now.Add(time.Hour))
+	if !reflect.DeepEqual(expired, []string{"Requests{host=b}"}) {
+		t.Errorf("Error: expired metrics are incorrect: %v", expired)
+	}
+
+	// Alloc never expires
+	expired, _ = s.Sweep(context.Background(), now.Add(24*time.Hour))
+	if !reflect.DeepEqual(expired, []string{"Requests{host=a}"}) || !reflect.DeepEqual(st.List(), []string{"Alloc"}) {
+		t.Errorf("Error: expired metrics are incorrect: %v, left %v", expired, st.List())
+	}
+}
+
+// racyMeta обновляет метрику сразу после чтения сведений обо всех метриках.
+type racyMeta struct {
+	*memstorage.MemStorage
+	stale time.Time
+}
+
+func (r racyMeta) MetaCtx(ctx context.Context, keys ...string) (map[string]metrics.Meta, error) {
+	meta, err := r.MemStorage.MetaCtx(ctx, keys...)
+	if len(keys) > 0 || err != nil {
+		return meta, err
+	}
+
+	for k, m := range meta {
+		m.Updated = r.stale
+		meta[k] = m
+		r.MemStorage.Set(k, float64(2))
+	}
+
+	return meta, nil
+}
+
+func TestSweepConcurrentUpdate(t *testing.T) {
+	st := racyMeta{MemStorage: memstorage.NewMemStorage(), stale: time.Now().Add(-2 * time.Hour)}
+	st.Set("Alloc", float64(1))
+
+	s, err := NewSweeper(st, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if expired, err := s.Sweep(context.Background(), time.Now()); err != nil || len(expired) != 0 {
+		t.Errorf("Error: updated metric must not expire: %v %v", expired, err)
+	}
+
+	if v, _ := st.Get("Alloc"); v != float64(2) {
+		t.Errorf("Error: updated metric is deleted: %v", v)
+	}
+}
+
+func TestSweepPendingWrite(t *testing.T) {
+	backend := memstorage.NewMemStorage()
+	backend.Set("Alloc", float64(1))
+	backend.Meta["Alloc"] = metrics.Meta{Updated: time.Now().Add(-2 * time.Hour), Updates: 1}
+
+	c := cache.New(backend, 10, time.Hour)
+
+	s, err := NewSweeper(c, time.Hour, nil)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	// a fresh value is waiting in the cache
+	c.Set("Alloc", float64(2))
+	if expired, err := s.Sweep(context.Background(), time.Now()); err != nil || len(expired) != 0 {
+		t.Errorf("Error: metric with a pending write must not expire: %v %v", expired, err)
+	}
+
+	// the backend meta is stale until the flush, the delete must not win
+	if err := s.st.DeleteStaleCtx(context.Background(), "Alloc", time.Now().Add(-time.Hour)); !errors.Is(err, metrics.ErrUpdated) {
+		t.Errorf("Error: pending write must block the delete: %v", err)
+	}
+
+	if err := c.Flush(context.Background()); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if v, _ := backend.Get("Alloc"); v != float64(2) {
+		t.Errorf("Error: pending write is lost: %v", v)
+	}
+}
+
+type noUpdater struct {
+	storage.Storage
+}
+
+func TestSweeperUnsupported(t *testing.T) {
+	if _, err := NewSweeper(noUpdater{}, time.Hour, nil); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Error: backend without update time must be rejected: %v", err)
+	}
+}
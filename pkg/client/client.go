@@ -0,0 +1,494 @@
+// Пакет client предназначен для отправки метрик приложений на сервер gometric
+// или в локальный агент.
+//
+// Метрики создаются через Registry, после чего Reporter периодически отправляет
+// накопленные значения пачками на /updates/. Тело запроса сжимается gzip,
+// метрики подписываются ключом так же, как это делает агент, а при указании
+// публичного ключа тело запроса шифруется RSA.
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rsa"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gometric/internal/crypto"
+	"gometric/internal/metrics"
+)
+
+// DefaultBatchSize максимальное число метрик в одном запросе по умолчанию.
+const DefaultBatchSize = 100
+
+// Ошибки запросов к метрикам.
+var (
+	// ErrNotFound возвращается, если метрика отсутствует на сервере.
+	ErrNotFound = errors.New("metric not found")
+	// ErrExists возвращается, если метрика с новым именем уже есть на сервере.
+	ErrExists = errors.New("metric already exists")
+)
+
+// SendError описывает ошибку отправки, после которой часть метрик не доставлена.
+type SendError struct {
+	// Failed метрики, которые не были доставлены.
+	Failed []Metric
+	Err    error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("%d metrics not sent: %v", len(e.Failed), e.Err)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// Metric описывает метрику в формате json API сервера.
+type Metric struct {
+	ID    string   `json:"id"`
+	MType string   `json:"type"`
+	Delta *int64   `json:"delta,omitempty"`
+	Value *float64 `json:"value,omitempty"`
+	Hash  string   `json:"hash,omitempty"`
+}
+
+// Config описывает настройки клиента.
+type Config struct {
+	// Address адрес сервера или агента, например 127.0.0.1:8080 или http://127.0.0.1:8080.
+	Address string
+	// Key ключ для подписи метрик. Пустой ключ отключает подпись.
+	Key string
+	// RSAPublicKey путь к файлу с публичным ключом. Пустой путь отключает шифрование.
+	RSAPublicKey string
+	// BatchSize максимальное число метрик в одном запросе.
+	BatchSize int
+	// Timeout таймаут одного запроса.
+	Timeout time.Duration
+	// RealIP значение заголовка X-Real-IP, если сервер проверяет доверенную подсеть.
+	RealIP string
+}
+
+// Client отправляет метрики и запрашивает их значения с сервера.
+type Client struct {
+	baseURL   string
+	key       metrics.Key
+	pubKey    *rsa.PublicKey
+	batchSize int
+	realIP    string
+	http      *http.Client
+}
+
+// New создает новый Client.
+func New(cfg Config) (*Client, error) {
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("address must not be empty")
+	}
+
+	c := &Client{
+		baseURL:   strings.TrimSuffix(cfg.Address, "/"),
+		batchSize: cfg.BatchSize,
+		realIP:    cfg.RealIP,
+		http:      &http.Client{Timeout: cfg.Timeout},
+	}
+	c.key.Set(cfg.Key)
+
+	if !strings.HasPrefix(c.baseURL, "http://") && !strings.HasPrefix(c.baseURL, "https://") {
+		c.baseURL = "http://" + c.baseURL
+	}
+
+	if c.batchSize <= 0 {
+		c.batchSize = DefaultBatchSize
+	}
+
+	if cfg.RSAPublicKey != "" {
+		var err error
+		c.pubKey, err = crypto.NewPublicKey(cfg.RSAPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("new public key: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+// SetKey заменяет ключ подписи, пустой ключ отключает подпись и проверку метрик.
+func (c *Client) SetKey(key string) {
+	c.key.Set(key)
+}
+
+// Send отправляет метрики на /updates/ пачками не больше BatchSize.
+// Если включено шифрование и пачка не помещается в один блок RSA, она делится на части.
+// Пачки отправляются по порядку до первой ошибки. Если часть метрик уже доставлена,
+// возвращается *SendError с недоставленными метриками, чтобы повторно отправить только их.
+func (c *Client) Send(ctx context.Context, batch []Metric) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	signed := make([]Metric, len(batch))
+	for i, m := range batch {
+		if err := c.sign(&m); err != nil {
+			return fmt.Errorf("sign metric %s: %w", m.ID, err)
+		}
+		signed[i] = m
+	}
+
+	for start := 0; start < len(signed); start += c.batchSize {
+		end := start + c.batchSize
+		if end > len(signed) {
+			end = len(signed)
+		}
+
+		sent, err := c.sendBatch(ctx, signed[start:end])
+		if err != nil {
+			return &SendError{Failed: batch[start+sent:], Err: err}
+		}
+	}
+
+	return nil
+}
+
+// Import загружает метрики на сервер через /import и возвращает число записанных метрик.
+// Стратегия strategy определяет объединение с существующими метриками: overwrite заменяет значения,
+// keep-existing пропускает существующие метрики, add-counters прибавляет значения счетчиков.
+// В отличие от Send, значения счетчиков по умолчанию не прибавляются к текущим.
+func (c *Client) Import(ctx context.Context, list []Metric, strategy string) (int, error) {
+	var body bytes.Buffer
+
+	enc := json.NewEncoder(&body)
+	for _, m := range list {
+		if err := enc.Encode(m); err != nil {
+			return 0, err
+		}
+	}
+
+	resp, err := c.post(ctx, "/import?format=jsonl&strategy="+url.QueryEscape(strategy), body.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return 0, err
+	}
+
+	var result struct {
+		Imported int `json:"imported"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("decode response: %w", err)
+	}
+
+	return result.Imported, nil
+}
+
+// Update отправляет одну метрику на /update/.
+func (c *Client) Update(ctx context.Context, m Metric) error {
+	if err := c.sign(&m); err != nil {
+		return fmt.Errorf("sign metric %s: %w", m.ID, err)
+	}
+
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.post(ctx, "/update/", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkStatus(resp)
+}
+
+// Get запрашивает значение метрики с сервера через /value/.
+// Если у клиента задан ключ, подпись ответа проверяется.
+func (c *Client) Get(ctx context.Context, id, mtype string) (Metric, error) {
+	var m Metric
+
+	body, err := json.Marshal(Metric{ID: id, MType: mtype})
+	if err != nil {
+		return m, err
+	}
+
+	resp, err := c.post(ctx, "/value/", body)
+	if err != nil {
+		return m, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return m, ErrNotFound
+	}
+
+	if err := checkStatus(resp); err != nil {
+		return m, err
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return m, fmt.Errorf("decode response: %w", err)
+	}
+
+	if key := c.key.Get(); key != "" {
+		internal := toInternal(m)
+		if !internal.ValidMAC(key) {
+			return m, fmt.Errorf("invalid HMAC of metric %s", m.ID)
+		}
+	}
+
+	return m, nil
+}
+
+// List запрашивает все метрики с сервера через /values/.
+// Если у клиента задан ключ, подпись каждой метрики проверяется.
+func (c *Client) List(ctx context.Context) ([]Metric, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/values/", nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.realIP != "" {
+		req.Header.Set("X-Real-IP", c.realIP)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+
+	var result []Metric
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+
+	if key := c.key.Get(); key != "" {
+		for _, m := range result {
+			internal := toInternal(m)
+			if !internal.ValidMAC(key) {
+				return nil, fmt.Errorf("invalid HMAC of metric %s", m.ID)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// Delete удаляет метрику на сервере через /delete/.
+func (c *Client) Delete(ctx context.Context, id string) error {
+	body, err := json.Marshal(Metric{ID: id})
+	if err != nil {
+		return err
+	}
+
+	return c.modify(ctx, "/delete/", body)
+}
+
+// Rename переименовывает метрику на сервере через /rename/.
+func (c *Client) Rename(ctx context.Context, id, newID string) error {
+	body, err := json.Marshal(map[string]string{"id": id, "new_id": newID})
+	if err != nil {
+		return err
+	}
+
+	return c.modify(ctx, "/rename/", body)
+}
+
+// modify отправляет запрос изменения метрики и преобразует статус ответа в ошибку.
+func (c *Client) modify(ctx context.Context, path string, body []byte) error {
+	resp, err := c.post(ctx, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusConflict:
+		return ErrExists
+	}
+
+	return checkStatus(resp)
+}
+
+// Ping проверяет доступность хранилища сервера через /ping.
+func (c *Client) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/ping", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkStatus(resp)
+}
+
+// sendBatch отправляет пачку метрик и возвращает число доставленных метрик с начала пачки.
+func (c *Client) sendBatch(ctx context.Context, batch []Metric) (int, error) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return 0, err
+	}
+
+	// RSA-OAEP шифрует только один блок, поэтому слишком большую пачку делим пополам
+	if c.pubKey != nil && len(batch) > 1 {
+		compressed, err := compress(body)
+		if err != nil {
+			return 0, err
+		}
+
+		if len(compressed) > maxEncryptSize(c.pubKey) {
+			half := len(batch) / 2
+			sent, err := c.sendBatch(ctx, batch[:half])
+			if err != nil {
+				return sent, err
+			}
+			sent, err = c.sendBatch(ctx, batch[half:])
+			return half + sent, err
+		}
+	}
+
+	resp, err := c.post(ctx, "/updates/", body)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return 0, err
+	}
+
+	return len(batch), nil
+}
+
+// post сжимает и при необходимости шифрует тело запроса, как это делает агент.
+// Если задан ключ, тело подписывается в заголовке metrics.SignHeader.
+func (c *Client) post(ctx context.Context, path string, body []byte) (*http.Response, error) {
+	var sign []byte
+	if key := c.key.Get(); key != "" {
+		var err error
+		if sign, err = metrics.Sign(string(body), key); err != nil {
+			return nil, err
+		}
+	}
+
+	payload, err := compress(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.pubKey != nil {
+		payload, err = crypto.Encrypt(c.pubKey, bytes.NewBuffer(payload))
+		if err != nil {
+			return nil, fmt.Errorf("encrypt failed: %w", err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept-Encoding", "gzip")
+	if c.pubKey != nil {
+		req.Header.Set("Content-Encrypt", "rsa")
+	}
+	if c.realIP != "" {
+		req.Header.Set("X-Real-IP", c.realIP)
+	}
+	if sign != nil {
+		req.Header.Set(metrics.SignHeader, hex.EncodeToString(sign))
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed init compress reader: %w", err)
+		}
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{reader, resp.Body}
+	}
+
+	return resp, nil
+}
+
+func (c *Client) sign(m *Metric) error {
+	key := c.key.Get()
+	if key == "" {
+		return nil
+	}
+
+	internal := toInternal(*m)
+	if err := internal.Sign(key); err != nil {
+		return err
+	}
+	m.Hash = internal.Hash
+
+	return nil
+}
+
+func toInternal(m Metric) metrics.Metrics {
+	return metrics.Metrics{
+		ID:    m.ID,
+		MType: m.MType,
+		Delta: m.Delta,
+		Value: m.Value,
+		Hash:  m.Hash,
+	}
+}
+
+func compress(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+
+	g := gzip.NewWriter(&b)
+	if _, err := g.Write(data); err != nil {
+		return nil, fmt.Errorf("failed init compress writer: %w", err)
+	}
+	if err := g.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// maxEncryptSize максимальный размер данных, который можно зашифровать RSA-OAEP с SHA-512.
+func maxEncryptSize(pubKey *rsa.PublicKey) int {
+	return pubKey.Size() - 2*sha512.Size - 2
+}
+
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the request was not executed successfully: %s", resp.Status)
+	}
+
+	return nil
+}
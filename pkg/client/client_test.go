@@ -0,0 +1,478 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gometric/internal/crypto"
+	"gometric/internal/metrics"
+)
+
+// fakeServer принимает /updates/ так же, как сервер gometric: расшифровывает, распаковывает и проверяет подпись.
+type fakeServer struct {
+	mu       sync.Mutex
+	key      string
+	privKey  *rsa.PrivateKey
+	fail     bool
+	failFrom int
+	requests int
+	received []metrics.Metrics
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests++
+	if f.fail || (f.failFrom > 0 && f.requests >= f.failFrom) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+
+	if r.Header.Get("Content-Encrypt") == "rsa" {
+		var err error
+		body, err = crypto.Decrypt(f.privKey, bytes.NewBuffer(body))
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(bytes.NewBuffer(body))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ = io.ReadAll(reader)
+	}
+
+	var batch []metrics.Metrics
+	if err := json.Unmarshal(body, &batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	for _, m := range batch {
+		if f.key != "" && !m.ValidMAC(f.key) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	f.received = append(f.received, batch...)
+	w.WriteHeader(http.StatusOK)
+}
+
+func writePublicKey(t *testing.T, privKey *rsa.PrivateKey) string {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "public.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	return file
+}
+
+func TestRegistryCollect(t *testing.T) {
+	r := NewRegistry()
+
+	r.Gauge("temperature").Set(20)
+	r.Gauge("temperature").Add(1.5)
+	r.Counter("orders").Inc()
+	r.Counter("orders").Add(2)
+	r.Counter("orders").Add(-10)
+	r.Counter(ID("requests", map[string]string{"method": "GET"})).Inc()
+
+	h := r.Histogram("latency", []float64{1, 0.1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	got := make(map[string]Metric)
+	for _, m := range r.Collect() {
+		got[m.ID] = m
+	}
+
+	checkCounter := func(id string, want int64) {
+		t.Helper()
+		if m, ok := got[id]; !ok || m.MType != "counter" || *m.Delta != want {
+			t.Errorf("Error: counter %s is incorrect", id)
+		}
+	}
+
+	if m, ok := got["temperature"]; !ok || *m.Value != 21.5 {
+		t.Errorf("Error: gauge is incorrect")
+	}
+	checkCounter("orders", 3)
+	checkCounter("requests{method=GET}", 1)
+	checkCounter("latency.count", 3)
+	checkCounter("latency.bucket{le=0.1}", 1)
+	checkCounter("latency.bucket{le=1}", 2)
+	checkCounter("latency.bucket{le=+Inf}", 3)
+	if m, ok := got["latency.sum"]; !ok || *m.Value != 5.55 {
+		t.Errorf("Error: histogram sum is incorrect")
+	}
+
+	// deltas are reset after collect
+	got = make(map[string]Metric)
+	for _, m := range r.Collect() {
+		got[m.ID] = m
+	}
+
+	if _, ok := got["orders"]; ok {
+		t.Errorf("Error: counter must be reset after collect")
+	}
+	if _, ok := got["latency.count"]; ok {
+		t.Errorf("Error: histogram must be reset after collect")
+	}
+	if _, ok := got["temperature"]; !ok {
+		t.Errorf("Error: gauge must be reported on every collect")
+	}
+}
+
+func TestClientSend(t *testing.T) {
+	privKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	srv := &fakeServer{key: "secret", privKey: privKey}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	c, err := New(Config{
+		Address:      ts.URL,
+		Key:          "secret",
+		RSAPublicKey: writePublicKey(t, privKey),
+		BatchSize:    50,
+	})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	r := NewRegistry()
+	for i := 0; i < 120; i++ {
+		r.Counter(ID("orders", map[string]string{"shop": string(rune('a'+i%26)) + string(rune('a'+i/26))})).Inc()
+	}
+
+	if err := c.Send(context.Background(), r.Collect()); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if len(srv.received) != 120 {
+		t.Errorf("Error: received %d metrics, want 120", len(srv.received))
+	}
+
+	// batches are split to fit into a single RSA block
+	if srv.requests <= 3 {
+		t.Errorf("Error: encrypted batches must be split, got %d requests", srv.requests)
+	}
+}
+
+func TestReporterRetry(t *testing.T) {
+	srv := &fakeServer{fail: true}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	c, err := New(Config{Address: ts.URL})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	r := NewRegistry()
+	reporter := NewReporter(c, r, time.Second)
+
+	r.Counter("orders").Add(2)
+	if err := reporter.Flush(context.Background()); err == nil {
+		t.Errorf("Error: flush must fail")
+	}
+
+	srv.mu.Lock()
+	srv.fail = false
+	srv.mu.Unlock()
+
+	r.Counter("orders").Add(3)
+	if err := reporter.Flush(context.Background()); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if len(srv.received) != 1 || *srv.received[0].Delta != 5 {
+		t.Errorf("Error: failed deltas must be merged with the next report")
+	}
+}
+
+func TestReporterPartialRetry(t *testing.T) {
+	// the second batch fails
+	srv := &fakeServer{failFrom: 2}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	c, err := New(Config{Address: ts.URL, BatchSize: 2})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	r := NewRegistry()
+	reporter := NewReporter(c, r, time.Second)
+
+	r.Counter("a").Add(1)
+	r.Counter("b").Add(2)
+	r.Counter("c").Add(3)
+
+	err = reporter.Flush(context.Background())
+
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || len(sendErr.Failed) != 1 {
+		t.Fatalf("Error: undelivered metrics must be reported: %v", err)
+	}
+
+	srv.mu.Lock()
+	srv.failFrom = 0
+	srv.mu.Unlock()
+
+	if err := reporter.Flush(context.Background()); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	got := make(map[string]int64)
+	for _, m := range srv.received {
+		got[m.ID] += *m.Delta
+	}
+
+	if got["a"] != 1 || got["b"] != 2 || got["c"] != 3 {
+		t.Errorf("Error: delivered deltas must not be sent again: %v", got)
+	}
+}
+
+func TestClientGet(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, _ := gzip.NewReader(r.Body)
+		var m metrics.Metrics
+		json.NewDecoder(reader).Decode(&m)
+
+		if m.ID != "Alloc" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		v := 1.5
+		m.Value = &v
+		m.Sign("secret")
+		json.NewEncoder(w).Encode(m)
+	}))
+	defer ts.Close()
+
+	c, _ := New(Config{Address: ts.URL, Key: "secret"})
+
+	m, err := c.Get(context.Background(), "Alloc", "gauge")
+	if err != nil || *m.Value != 1.5 {
+		t.Errorf("Error: %v", err)
+	}
+
+	if _, err := c.Get(context.Background(), "Unknown", "gauge"); err != ErrNotFound {
+		t.Errorf("Error: ErrNotFound expected, got %v", err)
+	}
+
+	c, _ = New(Config{Address: ts.URL, Key: "other"})
+	if _, err := c.Get(context.Background(), "Alloc", "gauge"); err == nil {
+		t.Errorf("Error: invalid HMAC must be detected")
+	}
+}
+
+func TestClientList(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/values/" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		v, d := 1.5, int64(2)
+		list := []metrics.Metrics{
+			{ID: "Alloc", MType: "gauge", Value: &v},
+			{ID: "PollCount", MType: "counter", Delta: &d},
+		}
+		for i := range list {
+			list[i].Sign("secret")
+		}
+		json.NewEncoder(w).Encode(list)
+	}))
+	defer ts.Close()
+
+	c, _ := New(Config{Address: ts.URL, Key: "secret"})
+
+	list, err := c.List(context.Background())
+	if err != nil || len(list) != 2 || list[1].ID != "PollCount" || *list[1].Delta != 2 {
+		t.Errorf("Error: list is incorrect: %v", err)
+	}
+}
+
+func TestClientWatch(t *testing.T) {
+	event := func(w http.ResponseWriter, id int, name string, m metrics.Metrics) {
+		m.Sign("secret")
+		data, _ := json.Marshal(map[string]interface{}{"id": id, "metric": m})
+		fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, name, data)
+		w.(http.Flusher).Flush()
+	}
+
+	v1, v3, d := 1.0, 3.0, int64(2)
+
+	var mu sync.Mutex
+	var lastIDs []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/values/" {
+			m := metrics.Metrics{ID: "PollCount", MType: "counter", Delta: &d}
+			m.Sign("secret")
+			json.NewEncoder(w).Encode([]metrics.Metrics{m})
+			return
+		}
+
+		if r.URL.Path != "/stream/" || r.URL.Query().Get("name") != "*" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		lastIDs = append(lastIDs, r.Header.Get("Last-Event-ID"))
+		resumed := len(lastIDs) > 1
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		if !resumed {
+			// the connection breaks after the first event
+			event(w, 1, "update", metrics.Metrics{ID: "Alloc", MType: "gauge", Value: &v1})
+			return
+		}
+
+		fmt.Fprint(w, "id: 2\nevent: reset\ndata: {}\n\n")
+		event(w, 3, "update", metrics.Metrics{ID: "Alloc", MType: "gauge", Value: &v3})
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	c, _ := New(Config{Address: ts.URL, Key: "secret", Timeout: time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var got []string
+	err := c.Watch(ctx, WatchFilter{Match: "*"}, func(m Metric) {
+		got = append(got, m.ID)
+		if len(got) == 3 {
+			cancel()
+		}
+	})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if len(got) != 3 || got[0] != "Alloc" || got[1] != "PollCount" || got[2] != "Alloc" {
+		t.Errorf("Error: watched metrics are incorrect: %v", got)
+	}
+
+	if len(lastIDs) != 2 || lastIDs[0] != "" || lastIDs[1] != "1" {
+		t.Errorf("Error: stream must be resumed from the last event: %v", lastIDs)
+	}
+
+	c, _ = New(Config{Address: ts.URL})
+	if err := c.Watch(context.Background(), WatchFilter{Match: "Alloc"}, func(Metric) {}); err == nil {
+		t.Errorf("Error: rejected request must stop watching")
+	}
+}
+
+func TestClientDeleteRename(t *testing.T) {
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, _ := gzip.NewReader(r.Body)
+		var req map[string]string
+		json.NewDecoder(reader).Decode(&req)
+		paths = append(paths, r.URL.Path+" "+req["id"]+" "+req["new_id"])
+
+		switch req["id"] {
+		case "Unknown":
+			w.WriteHeader(http.StatusNotFound)
+		case "Taken":
+			w.WriteHeader(http.StatusConflict)
+		}
+	}))
+	defer ts.Close()
+
+	c, _ := New(Config{Address: ts.URL})
+
+	if err := c.Delete(context.Background(), "Alloc"); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if err := c.Rename(context.Background(), "Alloc", "HeapAlloc"); err != nil {
+		t.Errorf("Error: %s", err)
+	}
+	if err := c.Delete(context.Background(), "Unknown"); err != ErrNotFound {
+		t.Errorf("Error: ErrNotFound expected, got %v", err)
+	}
+	if err := c.Rename(context.Background(), "Taken", "Alloc"); err != ErrExists {
+		t.Errorf("Error: ErrExists expected, got %v", err)
+	}
+
+	want := []string{"/delete/ Alloc ", "/rename/ Alloc HeapAlloc", "/delete/ Unknown ", "/rename/ Taken Alloc"}
+	if strings.Join(paths, ";") != strings.Join(want, ";") {
+		t.Errorf("Error: requests are incorrect: %v", paths)
+	}
+}
+
+func TestClientImport(t *testing.T) {
+	var query string
+	var received []metrics.Metrics
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Path + "?" + r.URL.RawQuery
+
+		reader, _ := gzip.NewReader(r.Body)
+		dec := json.NewDecoder(reader)
+		for dec.More() {
+			var m metrics.Metrics
+			dec.Decode(&m)
+			received = append(received, m)
+		}
+
+		fmt.Fprintf(w, `{"imported":%d}`, len(received))
+	}))
+	defer ts.Close()
+
+	c, _ := New(Config{Address: ts.URL})
+
+	n, err := c.Import(context.Background(), []Metric{gaugeMetric("Alloc", 1.5), counterMetric("PollCount", 7)}, "keep-existing")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+
+	if n != 2 || len(received) != 2 || *received[1].Delta != 7 {
+		t.Errorf("Error: imported metrics are incorrect: %d %v", n, received)
+	}
+
+	if query != "/import?format=jsonl&strategy=keep-existing" {
+		t.Errorf("Error: import request is incorrect: %s", query)
+	}
+}
@@ -0,0 +1,269 @@
+package client
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"gometric/internal/metrics"
+)
+
+// DefaultBuckets границы бакетов гистограммы по умолчанию.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// ID формирует идентификатор метрики с метками, например requests{method=GET}.
+func ID(name string, labels map[string]string) string {
+	return metrics.FormatID(name, labels)
+}
+
+// Gauge хранит текущее значение метрики типа gauge.
+type Gauge struct {
+	id   string
+	bits atomic.Uint64
+}
+
+// Set задает значение.
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+// Add прибавляет значение к текущему.
+func (g *Gauge) Add(v float64) {
+	for {
+		old := g.bits.Load()
+		if g.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// Value возвращает текущее значение.
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+// Counter накапливает приращение счетчика между отчетами.
+// Сервер суммирует полученные приращения, поэтому после отправки счетчик обнуляется.
+type Counter struct {
+	id    string
+	delta atomic.Int64
+}
+
+// Inc увеличивает счетчик на единицу.
+func (c *Counter) Inc() {
+	c.delta.Add(1)
+}
+
+// Add увеличивает счетчик на n. Отрицательные значения игнорируются.
+func (c *Counter) Add(n int64) {
+	if n > 0 {
+		c.delta.Add(n)
+	}
+}
+
+// Histogram распределяет наблюдения по бакетам.
+// Отправляется как счетчики name.bucket{le=...} и name.count и gauge name.sum.
+type Histogram struct {
+	id      string
+	mu      sync.Mutex
+	buckets []float64
+	counts  []int64
+	count   int64
+	sum     float64
+}
+
+// Observe добавляет наблюдение.
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Registry хранит метрики приложения.
+type Registry struct {
+	mu         sync.Mutex
+	gauges     map[string]*Gauge
+	counters   map[string]*Counter
+	histograms map[string]*Histogram
+}
+
+// NewRegistry создает новый Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		gauges:     make(map[string]*Gauge),
+		counters:   make(map[string]*Counter),
+		histograms: make(map[string]*Histogram),
+	}
+}
+
+// Gauge возвращает gauge с идентификатором id, создавая его при первом обращении.
+func (r *Registry) Gauge(id string) *Gauge {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if g, ok := r.gauges[id]; ok {
+		return g
+	}
+
+	g := &Gauge{id: id}
+	r.gauges[id] = g
+
+	return g
+}
+
+// Counter возвращает счетчик с идентификатором id, создавая его при первом обращении.
+func (r *Registry) Counter(id string) *Counter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if c, ok := r.counters[id]; ok {
+		return c
+	}
+
+	c := &Counter{id: id}
+	r.counters[id] = c
+
+	return c
+}
+
+// Histogram возвращает гистограмму с идентификатором id, создавая ее при первом обращении.
+// Если buckets пустой, используются DefaultBuckets.
+func (r *Registry) Histogram(id string, buckets []float64) *Histogram {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if h, ok := r.histograms[id]; ok {
+		return h
+	}
+
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+
+	sorted := make([]float64, len(buckets))
+	copy(sorted, buckets)
+	sort.Float64s(sorted)
+
+	h := &Histogram{
+		id:      id,
+		buckets: append(sorted, math.Inf(1)),
+		counts:  make([]int64, len(sorted)+1),
+	}
+	r.histograms[id] = h
+
+	return h
+}
+
+// Collect возвращает текущие значения метрик в формате API сервера.
+// Приращения счетчиков и гистограмм после вызова обнуляются.
+func (r *Registry) Collect() []Metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var result []Metric
+
+	for id, g := range r.gauges {
+		result = append(result, gaugeMetric(id, g.Value()))
+	}
+
+	for id, c := range r.counters {
+		if delta := c.delta.Swap(0); delta != 0 {
+			result = append(result, counterMetric(id, delta))
+		}
+	}
+
+	for id, h := range r.histograms {
+		result = append(result, h.collect(id)...)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+
+	return result
+}
+
+func (h *Histogram) collect(id string) []Metric {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	name, labels := metrics.ParseID(id)
+
+	result := []Metric{gaugeMetric(metrics.FormatID(name+".sum", labels), h.sum)}
+	if h.count == 0 {
+		return result
+	}
+
+	result = append(result, counterMetric(metrics.FormatID(name+".count", labels), h.count))
+
+	for i, le := range h.buckets {
+		if h.counts[i] == 0 {
+			continue
+		}
+
+		bucketLabels := make(map[string]string, len(labels)+1)
+		for k, v := range labels {
+			bucketLabels[k] = v
+		}
+		bucketLabels["le"] = formatBound(le)
+
+		result = append(result, counterMetric(metrics.FormatID(name+".bucket", bucketLabels), h.counts[i]))
+		h.counts[i] = 0
+	}
+	h.count = 0
+
+	return result
+}
+
+func formatBound(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func gaugeMetric(id string, v float64) Metric {
+	return Metric{ID: id, MType: "gauge", Value: &v}
+}
+
+func counterMetric(id string, delta int64) Metric {
+	return Metric{ID: id, MType: "counter", Delta: &delta}
+}
+
+// merge объединяет неотправленные метрики с новыми: приращения счетчиков суммируются,
+// для gauge берется последнее значение.
+func merge(pending, fresh []Metric) []Metric {
+	index := make(map[string]int, len(pending)+len(fresh))
+	result := make([]Metric, 0, len(pending)+len(fresh))
+
+	for _, m := range append(append([]Metric{}, pending...), fresh...) {
+		key := fmt.Sprintf("%s/%s", m.MType, m.ID)
+
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(result)
+			result = append(result, m)
+			continue
+		}
+
+		if m.MType == "counter" && m.Delta != nil && result[i].Delta != nil {
+			delta := *result[i].Delta + *m.Delta
+			result[i].Delta = &delta
+		} else {
+			result[i] = m
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// maxPending максимальное число неотправленных метрик, которые хранятся до следующей попытки.
+const maxPending = 10000
+
+// Reporter периодически отправляет метрики из Registry с помощью Client.
+// Если отправка не удалась, недоставленные метрики объединяются со следующим отчетом.
+type Reporter struct {
+	client   *Client
+	registry *Registry
+	interval time.Duration
+
+	// ErrorHandler вызывается при ошибке отправки. По умолчанию ошибки игнорируются.
+	ErrorHandler func(error)
+
+	mu      sync.Mutex
+	pending []Metric
+}
+
+// NewReporter создает новый Reporter.
+func NewReporter(c *Client, r *Registry, interval time.Duration) *Reporter {
+	return &Reporter{
+		client:   c,
+		registry: r,
+		interval: interval,
+	}
+}
+
+// Run отправляет метрики каждые interval до завершения контекста,
+// после чего выполняет последнюю отправку.
+func (r *Reporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), r.interval)
+			r.report(flushCtx)
+			cancel()
+			return
+		case <-ticker.C:
+			r.report(ctx)
+		}
+	}
+}
+
+// Flush немедленно отправляет накопленные метрики.
+func (r *Reporter) Flush(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	batch := merge(r.pending, r.registry.Collect())
+	if err := r.client.Send(ctx, batch); err != nil {
+		// delivered counter deltas must not be sent again
+		var sendErr *SendError
+		if errors.As(err, &sendErr) {
+			batch = sendErr.Failed
+		}
+
+		if len(batch) > maxPending {
+			batch = batch[len(batch)-maxPending:]
+		}
+		r.pending = batch
+		return err
+	}
+	r.pending = nil
+
+	return nil
+}
+
+func (r *Reporter) report(ctx context.Context) {
+	if err := r.Flush(ctx); err != nil && r.ErrorHandler != nil {
+		r.ErrorHandler(err)
+	}
+}
@@ -0,0 +1,182 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"gometric/internal/metrics"
+)
+
+// watchRetry задержка переподключения к потоку.
+const watchRetry = time.Second
+
+// WatchFilter отбирает метрики потока.
+type WatchFilter struct {
+	// Match шаблон glob идентификатора или имени метрики.
+	Match string
+	// Type тип метрики.
+	Type string
+}
+
+func (f WatchFilter) match(m Metric) bool {
+	if f.Type != "" && m.MType != f.Type {
+		return false
+	}
+
+	if f.Match == "" {
+		return true
+	}
+
+	name, _ := metrics.ParseID(m.ID)
+	okID, _ := path.Match(f.Match, m.ID)
+	okName, _ := path.Match(f.Match, name)
+
+	return okID || okName
+}
+
+// Watch получает изменения метрик из потока /stream и вызывает fn для каждого изменения,
+// пока не будет отменен контекст ctx. При обрыве соединения Watch переподключается
+// и получает пропущенные изменения. Если их уже нет на сервере, fn вызывается
+// для текущих значений всех метрик из List.
+func (c *Client) Watch(ctx context.Context, filter WatchFilter, fn func(Metric)) error {
+	if filter.Match != "" {
+		if _, err := path.Match(filter.Match, ""); err != nil {
+			return fmt.Errorf("invalid match pattern: %w", err)
+		}
+	}
+
+	// the stream is long-lived, so the request timeout is not applied
+	httpClient := &http.Client{Transport: c.http.Transport}
+
+	lastID := ""
+	for {
+		err := c.watch(ctx, httpClient, filter, &lastID, fn)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		var fatal *fatalError
+		if errors.As(err, &fatal) {
+			return fatal.err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(watchRetry):
+		}
+	}
+}
+
+// fatalError ошибка, после которой переподключение не поможет.
+type fatalError struct {
+	err error
+}
+
+func (e *fatalError) Error() string {
+	return e.err.Error()
+}
+
+func (c *Client) watch(ctx context.Context, httpClient *http.Client, filter WatchFilter, lastID *string, fn func(Metric)) error {
+	params := url.Values{}
+	if filter.Match != "" {
+		params.Set("name", filter.Match)
+	}
+	if filter.Type != "" {
+		params.Set("type", filter.Type)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/stream/?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if *lastID != "" {
+		req.Header.Set("Last-Event-ID", *lastID)
+	}
+	if c.realIP != "" {
+		req.Header.Set("X-Real-IP", c.realIP)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		if resp.StatusCode < http.StatusInternalServerError {
+			return &fatalError{err}
+		}
+		return err
+	}
+
+	var id, event, data string
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "":
+			if err := c.dispatch(ctx, filter, event, data, fn); err != nil {
+				return err
+			}
+			if id != "" {
+				*lastID = id
+			}
+			id, event, data = "", "", ""
+		}
+	}
+
+	return scanner.Err()
+}
+
+// dispatch обрабатывает одно событие потока.
+func (c *Client) dispatch(ctx context.Context, filter WatchFilter, event, data string, fn func(Metric)) error {
+	switch event {
+	case "update":
+		var e struct {
+			Metric Metric `json:"metric"`
+		}
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return &fatalError{fmt.Errorf("decode event: %w", err)}
+		}
+
+		internal := toInternal(e.Metric)
+		if key := c.key.Get(); key != "" && !internal.ValidMAC(key) {
+			return &fatalError{fmt.Errorf("invalid HMAC of metric %s", e.Metric.ID)}
+		}
+
+		fn(e.Metric)
+
+	case "reset":
+		list, err := c.List(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range list {
+			if filter.match(m) {
+				fn(m)
+			}
+		}
+	}
+
+	return nil
+}